@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- CACHE KEYS ---------------- */
+
+// volatileFields match the parts of a message that change between repeats
+// of the same event: timestamps, sequence numbers, process IDs, counters
+// and uptimes. Interface names, addresses, MAC addresses, router and
+// neighbor IDs and values such as a CPU percentage are kept, since the
+// analysis depends on them.
+var volatileFields = []*regexp.Regexp{
+	// 2024-03-13T09:13:33.123Z, 2024-03-13 09:13:33
+	regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`),
+	// Syslog "Mar 13 09:13:33.123", "*Mar 13 2024 09:13:33 UTC:"
+	regexp.MustCompile(`(?i)\*?\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)\s+\d{1,2}(\s+\d{4})?\s+\d{2}:\d{2}:\d{2}(\.\d+)?(\s+[a-z]{2,4})?:?`),
+	// Bare times standing on their own, "09:13:33.123:", but not the
+	// groups of a MAC address such as 00:1a:2b:11:22:33
+	regexp.MustCompile(`(^|\s)([01]\d|2[0-3]):[0-5]\d:[0-5]\d(\.\d+)?:?(\s|$)`),
+	// Leading syslog sequence numbers ("000123: ")
+	regexp.MustCompile(`^\s*\d+:\s`),
+	// Process IDs ("sshd[4123]")
+	regexp.MustCompile(`\[\d+\]`),
+	// Sequence numbers, counters and uptimes given as key=value or
+	// key: value. A bare "id" is left alone: "router id: 10.0.0.1" names
+	// the device the event is about.
+	regexp.MustCompile(`(?i)\b(seq|sequence|seqno|count|counter|uptime|sysuptime|timeticks|msgid|pid)\s*[=:]\s*\d\S*`),
+	// Timeticks "(123456789)"
+	regexp.MustCompile(`\(\d{6,}\)`),
+}
+
+// cacheKey identifies events that get the same analysis from a provider's
+// model and prompt template: the same type, severity and message once
+// volatile fields are removed, from the same device with the same labels.
+// The device and labels are part of the key because templates render them
+// and the device's history is retrieved by host.
+func cacheKey(p Provider, prompt string, event Event) string {
+	return hashKey(p.Name(), p.Model(), prompt, strings.ToLower(event.Type), strings.ToLower(event.Severity), stableMessage(event.Message),
+		strings.ToLower(event.Host), event.SourceIP, strings.ToLower(event.Category), stableLabels(event.Labels))
+}
+
+// stableLabels is the labels as sorted key=value lines
+func stableLabels(labels map[string]string) string {
+	lines := make([]string, 0, len(labels))
+	for k, v := range labels {
+		lines = append(lines, k+"="+v)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// stableMessage is a message without its volatile fields, lowercased
+func stableMessage(msg string) string {
+	for _, re := range volatileFields {
+		msg = re.ReplaceAllString(msg, " ")
+	}
+	return strings.Join(strings.Fields(strings.ToLower(msg)), " ")
+}
+
+func hashKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+/* ---------------- ANALYSIS CACHE ---------------- */
+
+// analysisCache is an LRU cache of analyses with a TTL. Concurrent misses
+// for the same key are coalesced into one upstream call.
+type analysisCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	flights map[string]*flight
+
+	hits, misses, coalesced, evictions, expirations uint64
+}
+
+type cacheEntry struct {
+	key     string
+	res     models.Analysis
+	expires time.Time
+}
+
+// flight is an upstream call in progress that other requests wait for
+type flight struct {
+	done chan struct{}
+	res  models.Analysis
+	err  error
+}
+
+// cache holds analyses for AGENTS_CACHE_TTL_SECONDS, at most
+// AGENTS_CACHE_SIZE of them (0 disables caching but not coalescing)
+var cache = newAnalysisCache(1000, 5*time.Minute)
+
+func newAnalysisCache(size int, ttl time.Duration) *analysisCache {
+	return &analysisCache{
+		size: size, ttl: ttl, lru: list.New(),
+		entries: make(map[string]*list.Element), flights: make(map[string]*flight),
+	}
+}
+
+// do returns the cached analysis for key or calls fn for it, sharing the
+// call with concurrent requests for the same key. The call runs detached
+// from the caller's cancellation, since others may be waiting on it; a
+// caller that gives up gets its context's error. Results are cached only
+// when fn reports them cacheable.
+func (c *analysisCache) do(ctx context.Context, key string, fn func(context.Context) (models.Analysis, bool, error)) (models.Analysis, bool, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			c.mu.Unlock()
+			return e.res, true, nil
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.expirations++
+	}
+	if f, ok := c.flights[key]; ok {
+		c.coalesced++
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.res, false, f.err
+		case <-ctx.Done():
+			return models.Analysis{}, false, ctx.Err()
+		}
+	}
+	c.misses++
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	res, cacheable, err := fn(context.WithoutCancel(ctx))
+	f.res, f.err = res, err
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	if err == nil && cacheable && c.size > 0 {
+		c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, res: res, expires: time.Now().Add(c.ttl)})
+		for c.lru.Len() > c.size {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).key)
+			c.evictions++
+		}
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return res, false, err
+}
+
+// writeMetrics renders the cache counters in the Prometheus text format
+func (c *analysisCache) writeMetrics(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("agents_api_cache_hits_total", "Analyses served from the cache.", c.hits)
+	counter("agents_api_cache_misses_total", "Analyses that needed an upstream call.", c.misses)
+	counter("agents_api_cache_coalesced_total", "Requests that waited for an identical upstream call in progress.", c.coalesced)
+	counter("agents_api_cache_evictions_total", "Analyses evicted to keep the cache within its size.", c.evictions)
+	counter("agents_api_cache_expirations_total", "Analyses dropped after their TTL.", c.expirations)
+	fmt.Fprintf(b, "# HELP agents_api_cache_entries Analyses in the cache.\n# TYPE agents_api_cache_entries gauge\nagents_api_cache_entries %d\n", c.lru.Len())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// repeats are the same event as different devices and collectors word it
+var repeats = []string{
+	"Interface Gi0/1 down",
+	"2024-03-13T09:13:33Z Interface Gi0/1 down",
+	"000123: *Mar 13 09:13:33.123 UTC: interface  Gi0/1 DOWN seq=88",
+}
+
+func TestCacheKey(t *testing.T) {
+	p := rulesProvider{}
+	key := func(msg string) string { return cacheKey(p, "default.v1", Event{Type: "syslog", Message: msg}) }
+	for _, msg := range repeats[1:] {
+		if key(msg) != key(repeats[0]) {
+			t.Errorf("%q keyed apart from %q", msg, repeats[0])
+		}
+	}
+	if key("Interface Gi0/2 down") == key(repeats[0]) {
+		t.Error("other interface keyed like Gi0/1")
+	}
+}
+
+// Addresses and identifiers that look like times or counters are kept
+func TestCacheKeyKeepsIdentifiers(t *testing.T) {
+	p := rulesProvider{}
+	key := func(msg string) string { return cacheKey(p, "default.v1", Event{Type: "syslog", Message: msg}) }
+	for _, tc := range []struct{ a, b string }{
+		{"MAC 00:11:22:33:44:55 moved to Gi0/1", "MAC 00:11:22:aa:bb:cc moved to Gi0/1"},
+		{"OSPF neighbor id 10.0.0.1 down", "OSPF neighbor id 10.0.0.2 down"},
+		{"BGP router id: 192.0.2.1 changed", "BGP router id: 192.0.2.9 changed"},
+	} {
+		if key(tc.a) == key(tc.b) {
+			t.Errorf("%q keyed like %q", tc.a, tc.b)
+		}
+	}
+	if key("09:13:33: link down seq=4") != key("10:01:02: link down seq=5") {
+		t.Error("time and sequence number not removed")
+	}
+}
+
+// Everything a template can render about the event is part of the key
+func TestCacheKeySeparatesDevicesAndLabels(t *testing.T) {
+	p := rulesProvider{}
+	base := Event{Type: "syslog", Message: repeats[0], Host: "sw-1", SourceIP: "10.0.0.1", Category: "network",
+		Labels: map[string]string{"site": "fra", "team": "netops"}}
+	same := base
+	same.Labels = map[string]string{"team": "netops", "site": "fra"}
+	if cacheKey(p, "default.v1", same) != cacheKey(p, "default.v1", base) {
+		t.Error("label order changed the key")
+	}
+	for name, change := range map[string]func(*Event){
+		"host":     func(e *Event) { e.Host = "sw-2" },
+		"address":  func(e *Event) { e.SourceIP = "10.0.0.2" },
+		"category": func(e *Event) { e.Category = "security" },
+		"labels":   func(e *Event) { e.Labels = map[string]string{"site": "ams", "team": "netops"} },
+	} {
+		other := base
+		change(&other)
+		if cacheKey(p, "default.v1", other) == cacheKey(p, "default.v1", base) {
+			t.Errorf("events with a different %s share a key", name)
+		}
+	}
+}
+
+// Repeats of an event are answered from the cache, and identical requests
+// in flight share one upstream call
+func TestCacheCoalescesRepeats(t *testing.T) {
+	agentsFixture(t)
+	cache = newAnalysisCache(2, time.Hour)
+	slow := &blockingProvider{release: make(chan struct{})}
+	provider = slow
+
+	var wg sync.WaitGroup
+	results := make([]models.Analysis, 6)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = DispatchEvent(context.Background(), Event{Type: "syslog", Message: repeats[i%len(repeats)]})
+		}(i)
+	}
+	// Release the upstream call once every repeat is waiting on it
+	if !waitFor(func() bool { cache.mu.Lock(); defer cache.mu.Unlock(); return cache.coalesced == 5 }) {
+		t.Error("repeats not coalesced while the upstream call was in progress")
+	}
+	close(slow.release)
+	wg.Wait()
+	incidentIDs := map[string]bool{}
+	for _, r := range results {
+		if r.Summary != "The link is down." {
+			t.Errorf("coalesced call answered %+v", r)
+		}
+		incidentIDs[r.IncidentID] = true
+	}
+	if slow.count() != 1 || cache.coalesced != 5 || len(incidentIDs) != 1 {
+		t.Errorf("%d calls, %d coalesced, %d incident IDs; want 1 call and the repeats kept as 1 incident", slow.count(), cache.coalesced, len(incidentIDs))
+	}
+
+	res := DispatchEvent(context.Background(), Event{Type: "syslog", Message: repeats[2]})
+	if !res.Cached || slow.count() != 1 || cache.hits != 1 {
+		t.Errorf("repeat not served from the cache: %d calls, %+v", slow.count(), res)
+	}
+	DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/2 down"})
+	DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/3 down"})
+	res = DispatchEvent(context.Background(), Event{Type: "syslog", Message: repeats[0]})
+	if res.Cached || slow.count() != 4 || cache.evictions != 2 {
+		t.Errorf("least recently used analysis not evicted: %d calls, %d evictions", slow.count(), cache.evictions)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	agentsFixture(t)
+	cache = newAnalysisCache(10, time.Millisecond)
+	slow := &blockingProvider{release: make(chan struct{})}
+	close(slow.release)
+	provider = slow
+
+	DispatchEvent(context.Background(), Event{Type: "syslog", Message: repeats[0]})
+	time.Sleep(5 * time.Millisecond)
+	res := DispatchEvent(context.Background(), Event{Type: "syslog", Message: repeats[0]})
+	if res.Cached || cache.expirations != 1 {
+		t.Errorf("expired analysis served: %d expirations", cache.expirations)
+	}
+}
+
+func TestFallbackNotCached(t *testing.T) {
+	fake := agentsFixture(t)
+	t.Setenv("OPENAI_BASE_URL", fake.server.URL+"/broken")
+	useProvider(t, "openai")
+	cache = newAnalysisCache(10, time.Hour)
+
+	DispatchEvent(context.Background(), linkDown)
+	res := DispatchEvent(context.Background(), linkDown)
+	if res.Cached || res.Source != "rules" || cache.misses != 2 {
+		t.Errorf("fallback answer cached: %+v", res)
+	}
+	var b strings.Builder
+	cache.writeMetrics(&b)
+	if !strings.Contains(b.String(), "agents_api_cache_misses_total 2\n") {
+		t.Errorf("cache metrics not reported:\n%s", b.String())
+	}
+}
@@ -1,14 +1,161 @@
 package main
 
-func DispatchEvent(event Event) UnifiedResponse {
-	response, err := CallWatsonAI(event)
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+var (
+	// rulesFallback answers from the rule knowledge base when the provider
+	// fails or returns something unusable (AGENTS_RULES_FALLBACK, default on)
+	rulesFallback = true
+
+	// repairAttempts is how many times an invalid answer is sent back to
+	// the model with the validation error (AGENTS_REPAIR_ATTEMPTS)
+	repairAttempts = 2
+)
+
+// DispatchEvent analyzes an event with the configured provider, given the
+// runbook sections and similar past incidents retrieved for it, and keeps
+// it as a past incident for later events. Repeats of an event share one
+// analysis through the cache.
+func DispatchEvent(ctx context.Context, event Event) models.Analysis {
+	res, err := analyzeEvent(ctx, event)
+	if err != nil {
+		return failedAnalysis(err)
+	}
+	return res
+}
+
+// analyzeEvent is DispatchEvent without the placeholder analysis: it fails
+// when the provider does and the rules fallback is off (a call shed by the
+// provider's limits always falls back), when the rules fail, or when ctx ends
+// while waiting for an identical request's analysis
+func analyzeEvent(ctx context.Context, event Event) (models.Analysis, error) {
+	if event.ID == "" {
+		event.ID = fileutil.NewID("evt")
+	}
+	similar, total := incidents.similar(event, similarResults)
+
+	tmpl := prompts.pick(event)
+
+	res, cached, err := cache.do(ctx, cacheKey(provider, tmpl.ID(), event), func(ctx context.Context) (models.Analysis, bool, error) {
+		req := GenerateRequest{Event: event, Runbooks: searchEvent(event), Similar: similar, History: incidents.history(event, historyResults)}
+		if _, offline := provider.(rulesProvider); offline {
+			res, err := analyze(ctx, provider, req)
+			return res, err == nil, err
+		}
+		var res models.Analysis
+		prompt, err := tmpl.render(req)
+		if err == nil {
+			req.Prompt = prompt
+			res, err = analyze(ctx, provider, req)
+		}
+		if err == nil {
+			res.PromptVersion = tmpl.ID()
+			metrics.recordPrompt(tmpl.ID(), &res)
+			return res, true, nil
+		}
+		metrics.recordPrompt(tmpl.ID(), nil)
+		log.Printf("⚠️  %s analysis failed: %v", provider.Name(), err)
+		if !rulesFallback && !shedCall(err) {
+			return models.Analysis{}, false, err
+		}
+		// Not cached, so the provider is tried again next time
+		res, rulesErr := analyze(ctx, rulesProvider{}, req)
+		if rulesErr != nil {
+			return models.Analysis{}, false, fmt.Errorf("%v; rules: %w", err, rulesErr)
+		}
+		res.FallbackReason = provider.Name() + ": " + err.Error()
+		return res, false, nil
+	})
 	if err != nil {
-		// Safe fallback for demo / outages
-		return UnifiedResponse{
-			Severity:            "unknown",
-			Explanation:         "AI processing failed: " + err.Error(),
-			RecommendedAction:   "Check AI service or logs",
+		return models.Analysis{}, err
+	}
+	res.Cached = cached
+	res.SimilarIncidents, res.SimilarCount = similar, total
+	res.IncidentID = incidents.record(event, res)
+	return res, nil
+}
+
+// failedAnalysis is returned when the provider fails and the rules
+// fallback is off
+func failedAnalysis(err error) models.Analysis {
+	// Safe fallback for demo / outages
+	return models.Analysis{
+		SchemaVersion:      models.AnalysisSchemaVersion,
+		Severity:           "unknown",
+		Summary:            "AI processing failed: " + err.Error(),
+		RootCauses:         []string{},
+		BusinessImpact:     "Unknown",
+		RecommendedActions: []string{"Check AI service or logs"},
+		Source:             provider.Name(),
+		Model:              provider.Model(),
+	}
+}
+
+// analyze asks the provider for an analysis and validates it against the
+// schema. An invalid answer is sent back with the problem for up to
+// repairAttempts more tries; a failed call is not retried here.
+func analyze(ctx context.Context, p Provider, req GenerateRequest) (models.Analysis, error) {
+	prompt := req.Prompt
+	for attempt := 0; ; attempt++ {
+		metrics.record(p, func(s *modelStats) { s.calls++ })
+		text, err := p.Generate(ctx, req)
+		if err != nil {
+			metrics.record(p, func(s *modelStats) { s.errors++ })
+			return models.Analysis{}, err
+		}
+
+		var answer modelAnswer
+		err = decodeAnalysis(text, analysisSchema, &answer)
+		if err == nil {
+			if attempt > 0 {
+				metrics.record(p, func(s *modelStats) { s.repaired++ })
+			}
+			res := answer.Analysis
+			res.Citations = citeRunbooks(req.Runbooks, answer.Citations)
+			res.SchemaVersion, res.FallbackReason = models.AnalysisSchemaVersion, ""
+			if _, offline := p.(rulesProvider); !offline {
+				res.Source, res.Model, res.Rule = p.Name(), p.Model(), ""
+				res.Confidence = calibrateConfidence(res, req.Event, attempt)
+			}
+			return res, nil
+		}
+
+		metrics.record(p, func(s *modelStats) { s.invalid++ })
+		if attempt >= repairAttempts || ctx.Err() != nil {
+			metrics.record(p, func(s *modelStats) { s.exhausted++ })
+			return models.Analysis{}, err
+		}
+		log.Printf("🔧 %s/%s answer invalid (%v), asking for a repair", p.Name(), p.Model(), err)
+		metrics.record(p, func(s *modelStats) { s.repairs++ })
+		req.Prompt = repairPrompt(prompt, text, err, analysisSchema)
+	}
+}
+
+/* ---------------- CONFIDENCE ---------------- */
+
+// calibrateConfidence turns the model's self-reported confidence into the
+// one returned. Models state high confidence far more often than they are
+// right, so it is pulled towards 0.5, lowered for every repair the answer
+// needed, and moved up or down by whether the knowledge base, where a rule
+// matches, agrees on the severity.
+func calibrateConfidence(a models.Analysis, event Event, repairs int) float64 {
+	c := 0.5 + (a.Confidence-0.5)*0.6
+	c *= math.Pow(0.8, float64(repairs))
+	if r, ok := matchRule(event); ok {
+		if r.Severity == a.Severity {
+			c += 0.1
+		} else {
+			c -= 0.15
 		}
 	}
-	return response
+	c = math.Min(0.95, math.Max(0.05, c))
+	return math.Round(c*100) / 100
 }
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- ANALYSIS JOBS ---------------- */
+
+// Job states. A job is queued until a worker takes it, then running, then
+// in one of the final states until it expires.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+	JobExpired   = "expired" // still queued when it expired
+)
+
+// Job is an event analyzed in the background, for callers that cannot hold
+// a connection open while the model answers
+type Job struct {
+	ID          string           `json:"id"`
+	Status      string           `json:"status"`
+	Event       Event            `json:"event"`
+	CallbackURL string           `json:"callback_url,omitempty"`
+	Result      *models.Analysis `json:"result,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+	StartedAt   *time.Time       `json:"started_at,omitempty"`
+	FinishedAt  *time.Time       `json:"finished_at,omitempty"`
+	ExpiresAt   time.Time        `json:"expires_at"`
+	Callback    *CallbackStatus  `json:"callback,omitempty"`
+}
+
+// CallbackStatus is how delivery of a finished job to its callback URL went
+type CallbackStatus struct {
+	Delivered   bool       `json:"delivered"`
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	GaveUp      bool       `json:"gave_up,omitempty"` // no more attempts will be made
+}
+
+func (j *Job) finished() bool {
+	return j.Status != JobQueued && j.Status != JobRunning
+}
+
+var (
+	errJobNotFound  = errors.New("job not found")
+	errJobFinished  = errors.New("job already finished")
+	errJobQueueFull = errors.New("job queue full")
+)
+
+// Callback delivery is retried with a doubling backoff. The client only
+// connects to addresses callbackAllow permits, and does not follow
+// redirects, which could lead anywhere.
+var (
+	callbackRetries = 3
+	callbackBackoff = time.Second
+	callbackAllow   = &callbackPolicy{}
+	callbackClient  = &http.Client{
+		Timeout:       10 * time.Second,
+		Transport:     &http.Transport{DialContext: dialCallback},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+)
+
+// jobStore queues jobs for a pool of workers and keeps them, with their
+// results, until they expire, journaling each change to its file. Jobs
+// queued or running when the service stopped are queued again when it
+// starts.
+type jobStore struct {
+	mu       sync.Mutex
+	ready    *sync.Cond
+	journal  *fileutil.Journal
+	ttl      time.Duration // from creation while unfinished, then from finishing
+	maxQueue int
+	jobs     map[string]*Job
+	pending  []string                      // queued job IDs, oldest first
+	cancels  map[string]context.CancelFunc // of running jobs
+
+	callbacksDelivered, callbacksFailed uint64
+}
+
+// jobs is the store of AGENTS_JOBS_PATH
+var jobs = newJobs(time.Hour, 1000)
+
+func newJobs(ttl time.Duration, maxQueue int) *jobStore {
+	s := &jobStore{
+		ttl: ttl, maxQueue: maxQueue,
+		jobs: map[string]*Job{}, cancels: map[string]context.CancelFunc{},
+	}
+	s.ready = sync.NewCond(&s.mu)
+	return s
+}
+
+// newJobStore loads the jobs kept in path. Unfinished jobs are queued
+// again and undelivered callbacks are retried once workers are started.
+func newJobStore(path string, ttl time.Duration, maxQueue int) (*jobStore, error) {
+	s := newJobs(ttl, maxQueue)
+
+	var err error
+	s.journal, err = fileutil.OpenJournal(path,
+		func(raw json.RawMessage) error {
+			var job Job
+			if err := json.Unmarshal(raw, &job); err != nil {
+				return err
+			}
+			s.jobs[job.ID] = &job
+			return nil
+		},
+		func(id string) { delete(s.jobs, id) },
+		func() interface{} { return s.sorted() })
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range s.sorted() {
+		if !job.finished() {
+			job.Status, job.StartedAt = JobQueued, nil
+			s.pending = append(s.pending, job.ID)
+		}
+	}
+	if len(s.jobs) > 0 {
+		log.Printf("🗂️  Loaded %d jobs from %s, %d to run", len(s.jobs), path, len(s.pending))
+	}
+	return s, nil
+}
+
+// start runs the workers, the expiry sweep and the callbacks left
+// undelivered by a restart
+func (s *jobStore) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.expire()
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.finished() && job.CallbackURL != "" && (job.Callback == nil || !job.Callback.Delivered && !job.Callback.GaveUp) {
+			go s.deliver(job.ID)
+		}
+	}
+}
+
+// sorted returns all jobs, oldest first; callers must hold s.mu
+func (s *jobStore) sorted() []*Job {
+	out := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		out = append(out, job)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// save journals a new or changed job; callers must hold s.mu
+func (s *jobStore) save(job *Job) {
+	if s.journal == nil {
+		return
+	}
+	if err := s.journal.Put(job); err != nil {
+		log.Printf("⚠️  Failed to persist job %s: %v", job.ID, err)
+	}
+}
+
+// submit queues an event for analysis
+func (s *jobStore) submit(event Event, callbackURL string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= s.maxQueue {
+		return Job{}, errJobQueueFull
+	}
+	if event.ID == "" {
+		event.ID = fileutil.NewID("evt")
+	}
+	now := time.Now().UTC()
+	job := &Job{
+		ID: fileutil.NewID("job"), Status: JobQueued, Event: event, CallbackURL: callbackURL,
+		CreatedAt: now, ExpiresAt: now.Add(s.ttl),
+	}
+	s.jobs[job.ID] = job
+	s.pending = append(s.pending, job.ID)
+	s.save(job)
+	s.ready.Signal()
+	return *job, nil
+}
+
+// get returns a copy of a job
+func (s *jobStore) get(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return *job, nil
+}
+
+// cancel stops a queued or running job. A running job's model call may
+// still finish, for identical requests waiting on it, but the job keeps
+// no result.
+func (s *jobStore) cancel(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if job.finished() {
+		return *job, errJobFinished
+	}
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+		delete(s.cancels, id)
+	}
+	s.unqueue(id)
+	s.finish(job, JobCanceled)
+	return *job, nil
+}
+
+// finish moves a job to a final state and delivers it to its callback;
+// callers must hold s.mu
+func (s *jobStore) finish(job *Job, status string) {
+	now := time.Now().UTC()
+	job.Status, job.FinishedAt, job.ExpiresAt = status, &now, now.Add(s.ttl)
+	s.save(job)
+	if job.CallbackURL != "" {
+		go s.deliver(job.ID)
+	}
+}
+
+// unqueue takes a job out of the queue; callers must hold s.mu
+func (s *jobStore) unqueue(id string) {
+	for i, pending := range s.pending {
+		if pending == id {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// next waits for a queued job and marks it running
+func (s *jobStore) next() (Job, context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.pending) == 0 {
+			s.ready.Wait()
+		}
+		id := s.pending[0]
+		s.pending = s.pending[1:]
+		job, ok := s.jobs[id]
+		if !ok || job.Status != JobQueued {
+			continue
+		}
+		if time.Now().After(job.ExpiresAt) {
+			s.finish(job, JobExpired)
+			continue
+		}
+		now := time.Now().UTC()
+		job.Status, job.StartedAt = JobRunning, &now
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancels[id] = cancel
+		s.save(job)
+		return *job, ctx
+	}
+}
+
+// work analyzes queued jobs one at a time
+func (s *jobStore) work() {
+	for {
+		job, ctx := s.next()
+		res, err := analyzeEvent(ctx, job.Event)
+
+		s.mu.Lock()
+		cur, ok := s.jobs[job.ID]
+		if ok && cur.Status == JobRunning {
+			delete(s.cancels, job.ID)
+			if err != nil {
+				cur.Error = err.Error()
+				s.finish(cur, JobFailed)
+			} else {
+				cur.Result = &res
+				s.finish(cur, JobSucceeded)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// expire expires queued jobs past their time and drops finished ones
+func (s *jobStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, job := range s.jobs {
+		if now.Before(job.ExpiresAt) {
+			continue
+		}
+		switch {
+		case job.Status == JobQueued:
+			s.unqueue(id)
+			s.finish(job, JobExpired)
+		case job.finished():
+			delete(s.jobs, id)
+			if s.journal != nil {
+				if err := s.journal.Delete(id); err != nil {
+					log.Printf("⚠️  Failed to persist job %s: %v", id, err)
+				}
+			}
+		}
+	}
+}
+
+// deliver posts a finished job to its callback URL, retrying failures
+// other than client errors
+func (s *jobStore) deliver(id string) {
+	job, err := s.get(id)
+	if err != nil {
+		return
+	}
+	body, _ := json.Marshal(job)
+
+	backoff := callbackBackoff
+	for attempt := 0; ; attempt++ {
+		err := postCallback(job.CallbackURL, body)
+		var cbErr *callbackError
+		gaveUp := err != nil && (attempt >= callbackRetries || errors.Is(err, errCallbackBlocked) ||
+			errors.As(err, &cbErr) && cbErr.StatusCode < 500 && cbErr.StatusCode != http.StatusTooManyRequests)
+
+		// The status is replaced, not updated, since copies of the job
+		// handed out by get share it
+		s.mu.Lock()
+		cur, ok := s.jobs[id]
+		if ok {
+			status := CallbackStatus{}
+			if cur.Callback != nil {
+				status = *cur.Callback
+			}
+			status.Attempts++
+			status.Error, status.GaveUp = "", gaveUp
+			if err == nil {
+				now := time.Now().UTC()
+				status.Delivered, status.DeliveredAt = true, &now
+				s.callbacksDelivered++
+			} else {
+				status.Error = err.Error()
+			}
+			if gaveUp {
+				s.callbacksFailed++
+			}
+			cur.Callback = &status
+			s.save(cur)
+		}
+		s.mu.Unlock()
+
+		if err == nil || !ok {
+			return
+		}
+		if gaveUp {
+			log.Printf("⚠️  Callback for job %s failed: %v", id, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// callbackError is a reply other than 2xx from a callback URL
+type callbackError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *callbackError) Error() string {
+	return fmt.Sprintf("callback returned %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+func postCallback(url string, body []byte) error {
+	resp, err := callbackClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &callbackError{StatusCode: resp.StatusCode, Body: string(b)}
+	}
+	return nil
+}
+
+/* ---------------- CALLBACK ADDRESSES ---------------- */
+
+var errCallbackBlocked = errors.New("callback address not allowed")
+
+// callbackPolicy decides where job callbacks may be posted, so that
+// callback_url cannot be used to reach the service's own network. Without
+// an allowlist any host is allowed as long as it resolves to a public
+// address. With one (AGENTS_JOBS_CALLBACK_ALLOW), only the listed hosts
+// ("hooks.example.com", "*.example.com") and addresses ("10.1.0.0/16",
+// "192.0.2.7") are, private or not.
+type callbackPolicy struct {
+	hosts []string
+	nets  []*net.IPNet
+}
+
+func parseCallbackAllow(list string) (*callbackPolicy, error) {
+	p := &callbackPolicy{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("callback allowlist: %w", err)
+			}
+			p.nets = append(p.nets, n)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			p.hosts = append(p.hosts, entry)
+		}
+	}
+	return p, nil
+}
+
+func (p *callbackPolicy) listed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range p.hosts {
+		if h == host || strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow reports whether a host may be reached at one of its addresses
+func (p *callbackPolicy) allow(host string, ip net.IP) error {
+	if p.listed(host) {
+		return nil
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	if len(p.hosts) > 0 || len(p.nets) > 0 {
+		return fmt.Errorf("%w: %s is not in AGENTS_JOBS_CALLBACK_ALLOW", errCallbackBlocked, host)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w: %s resolves to %s", errCallbackBlocked, host, ip)
+	}
+	return nil
+}
+
+// resolve returns the addresses of host that callbacks may connect to
+func (p *callbackPolicy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	var allowed []net.IP
+	var err error
+	for _, ip := range ips {
+		if e := p.allow(host, ip); e != nil {
+			err = e
+			continue
+		}
+		allowed = append(allowed, ip)
+	}
+	if len(allowed) == 0 {
+		return nil, err
+	}
+	return allowed, nil
+}
+
+// dialCallback connects to an allowed address of the callback host, so
+// that the check holds for the address actually dialed
+func dialCallback(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := callbackAllow.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// writeMetrics renders the jobs by state and the callback counters in the
+// Prometheus text format
+func (s *jobStore) writeMetrics(b *strings.Builder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := map[string]int{}
+	for _, job := range s.jobs {
+		counts[job.Status]++
+	}
+	fmt.Fprintf(b, "# HELP agents_api_jobs Analysis jobs kept, by status.\n# TYPE agents_api_jobs gauge\n")
+	for _, status := range []string{JobQueued, JobRunning, JobSucceeded, JobFailed, JobCanceled, JobExpired} {
+		fmt.Fprintf(b, "agents_api_jobs{status=%q} %d\n", status, counts[status])
+	}
+	fmt.Fprintf(b, "# HELP agents_api_job_callbacks_total Job callbacks delivered, or given up on.\n# TYPE agents_api_job_callbacks_total counter\n")
+	fmt.Fprintf(b, "agents_api_job_callbacks_total{result=\"delivered\"} %d\n", s.callbacksDelivered)
+	fmt.Fprintf(b, "agents_api_job_callbacks_total{result=\"failed\"} %d\n", s.callbacksFailed)
+}
+
+/* ---------------- HANDLERS ---------------- */
+
+// postJob queues an event for analysis and returns the job at once; the
+// body is that of /v2/events, plus an optional callback_url
+func postJob(c *gin.Context) {
+	var req struct {
+		Event
+		CallbackURL string `json:"callback_url"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.CallbackURL != "" {
+		u, err := url.Parse(req.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "callback_url must be an http or https URL"})
+			return
+		}
+		if _, err := callbackAllow.resolve(c.Request.Context(), u.Hostname()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "callback_url: " + err.Error()})
+			return
+		}
+	}
+	job, err := jobs.submit(req.Event, req.CallbackURL)
+	if errors.Is(err, errJobQueueFull) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// getJob returns a job, with its result once it has succeeded
+func getJob(c *gin.Context) {
+	job, err := jobs.get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// postJobCancel cancels a queued or running job
+func postJobCancel(c *gin.Context) {
+	job, err := jobs.cancel(c.Param("id"))
+	switch {
+	case errors.Is(err, errJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errJobFinished):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": job.Status})
+	default:
+		c.JSON(http.StatusOK, job)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// callbackReceiver records the jobs posted to it and answers them with the
+// scripted status codes, then 200
+type callbackReceiver struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	jobs    []Job
+	replies []int
+}
+
+func newCallbackReceiver(t *testing.T) *callbackReceiver {
+	c := &callbackReceiver{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job Job
+		json.NewDecoder(r.Body).Decode(&job)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.jobs = append(c.jobs, job)
+		if len(c.replies) > 0 {
+			w.WriteHeader(c.replies[0])
+			c.replies = c.replies[1:]
+		}
+	}))
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+func (c *callbackReceiver) reply(codes ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replies = codes
+}
+
+func (c *callbackReceiver) received() []Job {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Job(nil), c.jobs...)
+}
+
+// waitFor polls cond for up to two seconds
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func jobStatus(id string) string {
+	job, _ := jobs.get(id)
+	return job.Status
+}
+
+func jobCallback(id string, cond func(*CallbackStatus) bool) func() bool {
+	return func() bool {
+		job, _ := jobs.get(id)
+		return job.Callback != nil && cond(job.Callback)
+	}
+}
+
+// Jobs are analyzed in the background, polled or delivered to a callback,
+// and kept across restarts
+func TestJobs(t *testing.T) {
+	fake := agentsFixture(t)
+	receiver := newCallbackReceiver(t)
+	callbackBackoff = 10 * time.Millisecond
+	callbackAllow, _ = parseCallbackAllow("127.0.0.1")
+
+	slow := &blockingProvider{release: make(chan struct{})}
+	provider = slow
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	var err error
+	if jobs, err = newJobStore(path, time.Hour, 2); err != nil {
+		t.Fatal(err)
+	}
+	jobs.start(1)
+
+	running, _ := jobs.submit(Event{Type: "syslog", Message: "Interface Gi0/1 down"}, receiver.server.URL)
+	if !waitFor(func() bool { return jobStatus(running.ID) == JobRunning }) {
+		t.Fatalf("job not running: %s", jobStatus(running.ID))
+	}
+	queuedA, _ := jobs.submit(Event{Type: "syslog", Message: "BGP neighbor 10.0.0.1 down"}, "")
+	queuedB, _ := jobs.submit(Event{Type: "syslog", Message: "BGP neighbor 10.0.0.2 down"}, "")
+	if _, err := jobs.submit(Event{Type: "syslog", Message: "BGP neighbor 10.0.0.3 down"}, ""); !errors.Is(err, errJobQueueFull) {
+		t.Errorf("job beyond the queue: got %v", err)
+	}
+
+	if _, err := os.Stat(path + ".log"); err != nil {
+		t.Errorf("jobs not journaled: %v", err)
+	}
+	reloaded, err := newJobStore(path, time.Hour, 2)
+	if err != nil {
+		t.Fatal("jobs not reloaded: ", err)
+	}
+	if job, _ := reloaded.get(running.ID); job.Status != JobQueued || len(reloaded.pending) != 3 || reloaded.pending[0] != running.ID {
+		t.Errorf("unfinished jobs not queued again after a restart: %s, %v", job.Status, reloaded.pending)
+	}
+
+	canceled, err := jobs.cancel(queuedB.ID)
+	if err != nil || canceled.Status != JobCanceled || canceled.FinishedAt == nil {
+		t.Errorf("queued job not canceled: %+v %v", canceled, err)
+	}
+	if _, err := jobs.cancel(queuedB.ID); !errors.Is(err, errJobFinished) {
+		t.Errorf("finished job canceled again: %v", err)
+	}
+	if _, err := jobs.cancel("job-none"); !errors.Is(err, errJobNotFound) {
+		t.Errorf("unknown job: got %v", err)
+	}
+
+	close(slow.release)
+	if !waitFor(func() bool { return jobStatus(running.ID) == JobSucceeded && jobStatus(queuedA.ID) == JobSucceeded }) {
+		t.Fatalf("jobs did not succeed: %s %s", jobStatus(running.ID), jobStatus(queuedA.ID))
+	}
+	if job, _ := jobs.get(running.ID); job.Result == nil || job.Result.Source != "blocking" || job.Result.IncidentID != job.Event.ID || job.StartedAt == nil {
+		t.Errorf("job does not keep the result: %+v", job)
+	}
+	if !waitFor(func() bool { return len(receiver.received()) == 1 }) {
+		t.Errorf("result not delivered to the callback: %+v", receiver.received())
+	} else if got := receiver.received()[0]; got.ID != running.ID || got.Result == nil || got.Result.Summary == "" {
+		t.Errorf("callback got %+v", got)
+	}
+	if !waitFor(jobCallback(running.ID, func(c *CallbackStatus) bool { return c.Delivered && c.Attempts == 1 })) {
+		t.Error("callback delivery not recorded")
+	}
+	if slow.count() != 2 {
+		t.Errorf("%d calls, want the canceled job skipped", slow.count())
+	}
+
+	// A running job canceled keeps no result
+	slow = &blockingProvider{release: make(chan struct{})}
+	provider = slow
+	job, _ := jobs.submit(Event{Type: "syslog", Message: "Fan 2 failed"}, "")
+	waitFor(func() bool { return jobStatus(job.ID) == JobRunning })
+	_, err = jobs.cancel(job.ID)
+	close(slow.release)
+	time.Sleep(50 * time.Millisecond)
+	if job, _ = jobs.get(job.ID); err != nil || job.Status != JobCanceled || job.Result != nil {
+		t.Errorf("running job not canceled without a result: %+v %v", job, err)
+	}
+
+	// Callbacks are retried, unless the receiver refuses them
+	receiver.reply(http.StatusBadGateway, http.StatusOK)
+	job, _ = jobs.submit(Event{Type: "syslog", Message: "Power supply 1 failed"}, receiver.server.URL)
+	if !waitFor(jobCallback(job.ID, func(c *CallbackStatus) bool { return c.Delivered && c.Attempts == 2 })) {
+		t.Errorf("failed callback not retried: %+v", receiver.received())
+	}
+	receiver.reply(http.StatusBadRequest)
+	job, _ = jobs.submit(Event{Type: "syslog", Message: "Temperature sensor over threshold"}, receiver.server.URL)
+	if !waitFor(jobCallback(job.ID, func(c *CallbackStatus) bool { return c.GaveUp && c.Attempts == 1 && strings.Contains(c.Error, "400") })) {
+		t.Error("callback refused by the receiver retried")
+	}
+
+	// Without the rules to fall back on, the provider's error fails the job
+	rulesFallback = false
+	t.Setenv("OPENAI_BASE_URL", fake.server.URL+"/broken")
+	useProvider(t, "openai")
+	job, _ = jobs.submit(Event{Type: "syslog", Message: "Link flapping on Gi0/4"}, "")
+	if !waitFor(func() bool { return jobStatus(job.ID) == JobFailed }) {
+		t.Errorf("job did not fail with the provider's error: %s", jobStatus(job.ID))
+	}
+	if job, _ = jobs.get(job.ID); job.Result != nil || !strings.Contains(job.Error, "503") {
+		t.Errorf("failed job does not keep the error: %+v", job)
+	}
+
+	var b strings.Builder
+	jobs.writeMetrics(&b)
+	if !strings.Contains(b.String(), `agents_api_jobs{status="succeeded"} 4`) || !strings.Contains(b.String(), `agents_api_job_callbacks_total{result="failed"} 1`) {
+		t.Errorf("job metrics not reported:\n%s", b.String())
+	}
+}
+
+func TestJobExpiry(t *testing.T) {
+	expiring := newJobs(0, 10)
+	stale, _ := expiring.submit(Event{Type: "syslog", Message: "Interface Gi0/9 down"}, "")
+	expiring.expire()
+	if job, _ := expiring.get(stale.ID); job.Status != JobExpired {
+		t.Errorf("job still queued past its expiry is %s", job.Status)
+	}
+	expiring.expire()
+	if _, err := expiring.get(stale.ID); !errors.Is(err, errJobNotFound) {
+		t.Errorf("finished job kept past its expiry: %v", err)
+	}
+}
+
+// Callbacks reach only public addresses, or those allowed by
+// AGENTS_JOBS_CALLBACK_ALLOW, checked again for the address dialed
+func TestCallbackAddresses(t *testing.T) {
+	agentsFixture(t)
+	for _, tc := range []struct {
+		allow, host string
+		ok          bool
+	}{
+		{"", "127.0.0.1", false},
+		{"", "::1", false},
+		{"", "10.0.0.5", false},
+		{"", "192.168.1.10", false},
+		{"", "169.254.169.254", false},
+		{"", "0.0.0.0", false},
+		{"", "::ffff:127.0.0.1", false},
+		{"", "localhost", false},
+		{"", "93.184.216.34", true},
+		{"10.1.0.0/16, hooks.example.com", "10.1.2.3", true},
+		{"10.1.0.0/16, hooks.example.com", "10.2.0.1", false},
+		{"10.1.0.0/16, hooks.example.com", "93.184.216.34", false},
+		{"127.0.0.1", "127.0.0.1", true},
+		{"*.example.com", "localhost", false},
+	} {
+		p, err := parseCallbackAllow(tc.allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.resolve(context.Background(), tc.host)
+		if (err == nil) != tc.ok {
+			t.Errorf("allow %q, host %s: got %v, want allowed=%v", tc.allow, tc.host, err, tc.ok)
+		}
+		if !tc.ok && err != nil && !errors.Is(err, errCallbackBlocked) && tc.host != "localhost" {
+			t.Errorf("allow %q, host %s: %v is not errCallbackBlocked", tc.allow, tc.host, err)
+		}
+	}
+	p, _ := parseCallbackAllow("*.example.com")
+	if !p.listed("hooks.example.com") || p.listed("example.com.evil.test") {
+		t.Error("wildcard host matched wrongly")
+	}
+	if _, err := parseCallbackAllow("10.0.0.0/33"); err == nil {
+		t.Error("bad CIDR accepted")
+	}
+
+	// The handler refuses a private callback, and delivery does not reach
+	// one that got in anyway
+	receiver := newCallbackReceiver(t)
+	router := gin.New()
+	router.POST("/jobs", postJob)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"type": "syslog", "message": "Interface Gi0/1 down", "callback_url": "`+receiver.server.URL+`"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not allowed") {
+		t.Errorf("private callback_url accepted: %d %s", w.Code, w.Body.String())
+	}
+
+	provider = rulesProvider{}
+	jobs = newJobs(time.Hour, 10)
+	jobs.start(1)
+	job, _ := jobs.submit(Event{Type: "syslog", Message: "Interface Gi0/1 down"}, receiver.server.URL)
+	if !waitFor(jobCallback(job.ID, func(c *CallbackStatus) bool {
+		return c.GaveUp && c.Attempts == 1 && strings.Contains(c.Error, "not allowed")
+	})) {
+		job, _ = jobs.get(job.ID)
+		t.Errorf("callback to a private address attempted: %+v", job.Callback)
+	}
+	if n := len(receiver.received()); n != 0 {
+		t.Errorf("receiver got %d callbacks", n)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+)
+
+/* ---------------- PROVIDER LIMITS ---------------- */
+
+// LimitSettings bound how a provider is called. They are read from
+// environment variables prefixed with the provider's name, e.g.
+// WATSONX_MAX_CONCURRENT.
+type LimitSettings struct {
+	MaxConcurrent     int           // calls in flight at once
+	MaxQueue          int           // calls waiting for a slot; more are shed
+	QueueTimeout      time.Duration // longest a call waits for a slot and its quota
+	RequestsPerMinute float64       // quota, 0 for none
+	MaxRetries        int           // retries of a 429 or 503 reply
+}
+
+// limitsFromEnv reads <PREFIX>_MAX_CONCURRENT, _MAX_QUEUE,
+// _QUEUE_TIMEOUT_SECONDS, _REQUESTS_PER_MINUTE and _MAX_RETRIES over the
+// given defaults
+func limitsFromEnv(prefix string, d LimitSettings) LimitSettings {
+	return LimitSettings{
+		MaxConcurrent:     config.GetEnvInt(prefix+"_MAX_CONCURRENT", d.MaxConcurrent),
+		MaxQueue:          config.GetEnvInt(prefix+"_MAX_QUEUE", d.MaxQueue),
+		QueueTimeout:      time.Duration(config.GetEnvInt(prefix+"_QUEUE_TIMEOUT_SECONDS", int(d.QueueTimeout/time.Second))) * time.Second,
+		RequestsPerMinute: config.GetEnvFloat(prefix+"_REQUESTS_PER_MINUTE", d.RequestsPerMinute),
+		MaxRetries:        config.GetEnvInt(prefix+"_MAX_RETRIES", d.MaxRetries),
+	}
+}
+
+// Errors of calls that never reached the provider. Either way DispatchEvent
+// answers from the rules instead, even with the fallback off: the provider
+// did not fail, and failing the event would only add to the burst.
+var (
+	errOverloaded   = errors.New("overloaded: queue full")
+	errQueueTimeout = errors.New("overloaded: timed out waiting for a slot")
+)
+
+// shedCall reports whether err is from a call the limits kept from the
+// provider
+func shedCall(err error) bool {
+	return errors.Is(err, errOverloaded) || errors.Is(err, errQueueTimeout)
+}
+
+// Backoff between retries when the provider gives no Retry-After
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// limiter is a semaphore with a bounded wait queue and an optional request
+// quota. A Retry-After from the provider pauses every call, not just the
+// one that got it.
+type limiter struct {
+	settings LimitSettings
+	slots    chan struct{}
+
+	mu          sync.Mutex
+	waiting     int
+	nextAllowed time.Time // when the quota allows the next call
+	pausedUntil time.Time // from the last Retry-After
+
+	shed, timeouts, throttled, retries uint64
+}
+
+func newLimiter(s LimitSettings) *limiter {
+	if s.MaxConcurrent < 1 {
+		s.MaxConcurrent = 1
+	}
+	return &limiter{settings: s, slots: make(chan struct{}, s.MaxConcurrent)}
+}
+
+// acquire waits for a free slot and the quota, up to QueueTimeout. It sheds
+// the call at once when MaxQueue calls are already waiting.
+func (l *limiter) acquire(ctx context.Context) (release func(), err error) {
+	release = func() { <-l.slots }
+	deadline := time.Now().Add(l.settings.QueueTimeout)
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		l.mu.Lock()
+		if l.waiting >= l.settings.MaxQueue {
+			l.shed++
+			l.mu.Unlock()
+			return nil, errOverloaded
+		}
+		l.waiting++
+		l.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			err = nil
+		case <-timer.C:
+			err = errQueueTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		l.mu.Lock()
+		l.waiting--
+		if err == errQueueTimeout {
+			l.timeouts++
+		}
+		l.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Holding a slot, wait for the quota and any Retry-After pause
+	l.mu.Lock()
+	now := time.Now()
+	start := now
+	if l.nextAllowed.After(start) {
+		start = l.nextAllowed
+	}
+	if l.pausedUntil.After(start) {
+		start = l.pausedUntil
+	}
+	if start.After(deadline) {
+		l.timeouts++
+		l.mu.Unlock()
+		release()
+		return nil, errQueueTimeout
+	}
+	if l.settings.RequestsPerMinute > 0 {
+		l.nextAllowed = start.Add(time.Duration(float64(time.Minute) / l.settings.RequestsPerMinute))
+	}
+	l.mu.Unlock()
+
+	if wait := start.Sub(now); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// pause holds back every call until the Retry-After has passed
+func (l *limiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// retryDelay is the provider's Retry-After if it gave one, else an
+// exponential backoff with jitter
+func retryDelay(retryAfter time.Duration, attempt int) time.Duration {
+	d := retryAfter
+	if d <= 0 {
+		d = retryBaseDelay << attempt
+		d += time.Duration(rand.Int63n(int64(d) / 5))
+	}
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d
+}
+
+// limitedProvider calls a provider within its limits, retrying replies that
+// say it is rate limited or briefly unavailable
+type limitedProvider struct {
+	Provider
+	limits *limiter
+}
+
+func (p *limitedProvider) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	for attempt := 0; ; attempt++ {
+		release, err := p.limits.acquire(ctx)
+		if err != nil {
+			return "", err
+		}
+		text, err := p.Provider.Generate(ctx, req)
+		release()
+
+		var upstream *upstreamError
+		if err == nil || !errors.As(err, &upstream) || !upstream.retryable() {
+			return text, err
+		}
+		p.limits.mu.Lock()
+		p.limits.throttled++
+		p.limits.mu.Unlock()
+		if attempt >= p.limits.settings.MaxRetries {
+			return "", err
+		}
+
+		wait := retryDelay(upstream.RetryAfter, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return "", err
+		}
+		if upstream.RetryAfter > 0 {
+			p.limits.pause(upstream.RetryAfter)
+		}
+		log.Printf("⏳ %s replied %d, retrying in %s", p.Name(), upstream.StatusCode, wait.Round(time.Millisecond))
+		p.limits.mu.Lock()
+		p.limits.retries++
+		p.limits.mu.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", err
+		}
+	}
+}
+
+// limiters are those of the providers built so far, by name, for /metrics
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*limiter{}
+)
+
+// withLimits wraps a provider built by newProvider in the limits read from
+// the environment with its prefix
+func withLimits(prefix string, p Provider, err error, d LimitSettings) (Provider, error) {
+	if err != nil {
+		return nil, err
+	}
+	l := newLimiter(limitsFromEnv(prefix, d))
+	limitersMu.Lock()
+	limiters[p.Name()] = l
+	limitersMu.Unlock()
+	return &limitedProvider{Provider: p, limits: l}, nil
+}
+
+// writeLimiterMetrics renders the limiter gauges and counters in the
+// Prometheus text format
+func writeLimiterMetrics(b *strings.Builder) {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	names := make([]string, 0, len(limiters))
+	for name := range limiters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	series := func(name, kind, help string, value func(*limiter) uint64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, n := range names {
+			l := limiters[n]
+			l.mu.Lock()
+			v := value(l)
+			l.mu.Unlock()
+			fmt.Fprintf(b, "%s{provider=%q} %d\n", name, n, v)
+		}
+	}
+	series("agents_api_provider_in_flight", "gauge", "Calls to the provider in flight.", func(l *limiter) uint64 { return uint64(len(l.slots)) })
+	series("agents_api_provider_queued", "gauge", "Calls waiting for a slot.", func(l *limiter) uint64 { return uint64(l.waiting) })
+	series("agents_api_provider_shed_total", "counter", "Calls shed because the queue was full.", func(l *limiter) uint64 { return l.shed })
+	series("agents_api_provider_queue_timeouts_total", "counter", "Calls that timed out waiting for a slot or the quota.", func(l *limiter) uint64 { return l.timeouts })
+	series("agents_api_provider_throttled_total", "counter", "429 and 503 replies from the provider.", func(l *limiter) uint64 { return l.throttled })
+	series("agents_api_provider_retries_total", "counter", "Calls retried after a 429 or 503 reply.", func(l *limiter) uint64 { return l.retries })
+}
+
+/* ---------------- UPSTREAM ERRORS ---------------- */
+
+// upstreamError is a reply other than 200 from a provider's API
+type upstreamError struct {
+	URL        string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("%s failed %d: %s", e.URL, e.StatusCode, e.Body)
+}
+
+// retryable reports whether the provider asked to be called again later
+func (e *upstreamError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as a date
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(strings.TrimSpace(h)); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
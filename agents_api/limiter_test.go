@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// Calls wait for a slot in a bounded queue; beyond it they are shed to the
+// rules, even with the fallback for failed calls off
+func TestLimiterShedsBeyondQueue(t *testing.T) {
+	agentsFixture(t)
+	rulesFallback = false
+	slow := &blockingProvider{release: make(chan struct{})}
+	lim := newLimiter(LimitSettings{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: time.Second})
+	provider = &limitedProvider{Provider: slow, limits: lim}
+
+	first, queued := make(chan models.Analysis), make(chan models.Analysis)
+	go func() {
+		first <- DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/1 down"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		queued <- DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/2 down"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	res := DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/3 down"})
+	if res.Source != "rules" || !strings.Contains(res.FallbackReason, "queue full") || lim.shed != 1 {
+		t.Errorf("call beyond the queue not shed to the rules: %+v", res)
+	}
+	close(slow.release)
+	r1, r2 := <-first, <-queued
+	if r1.Source != "blocking" || r2.Source != "blocking" || slow.count() != 2 {
+		t.Errorf("queued call not served after the one in flight: %+v / %+v", r1, r2)
+	}
+}
+
+func TestLimiterQueueTimeout(t *testing.T) {
+	agentsFixture(t)
+	rulesFallback = false
+	slow := &blockingProvider{release: make(chan struct{})}
+	lim := newLimiter(LimitSettings{MaxConcurrent: 1, MaxQueue: 5, QueueTimeout: 100 * time.Millisecond})
+	provider = &limitedProvider{Provider: slow, limits: lim}
+
+	done := make(chan struct{})
+	go func() {
+		DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/1 down"})
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	res := DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/2 down"})
+	if res.Source != "rules" || !strings.Contains(res.FallbackReason, "timed out") || lim.timeouts != 1 {
+		t.Errorf("call waiting past its deadline did not fall back: %+v", res)
+	}
+	close(slow.release)
+	<-done
+}
+
+func TestLimiterQuota(t *testing.T) {
+	agentsFixture(t)
+	slow := &blockingProvider{release: make(chan struct{})}
+	close(slow.release)
+	lim := newLimiter(LimitSettings{MaxConcurrent: 4, MaxQueue: 4, QueueTimeout: time.Second, RequestsPerMinute: 600})
+	provider = &limitedProvider{Provider: slow, limits: lim}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		DispatchEvent(context.Background(), Event{Type: "syslog", Message: fmt.Sprintf("BGP neighbor 10.0.0.%d down", i)})
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || slow.count() != 3 {
+		t.Errorf("quota does not space calls: %d calls in %s", slow.count(), elapsed)
+	}
+}
+
+// 429 and 503 replies are retried, after Retry-After when given
+func TestThrottledCallsRetried(t *testing.T) {
+	fake := agentsFixture(t)
+	t.Setenv("OPENAI_MODEL", "gpt-throttled")
+	t.Setenv("OPENAI_MAX_RETRIES", "2")
+	fake.throttle(1, "1")
+	useProvider(t, "openai")
+	lim := provider.(*limitedProvider).limits
+
+	start := time.Now()
+	res := DispatchEvent(context.Background(), linkDown)
+	if elapsed := time.Since(start); res.Source != "openai" || elapsed < time.Second || lim.throttled != 1 || lim.retries != 1 {
+		t.Errorf("429 not retried after Retry-After: %s, %d throttled, %d retries: %+v", elapsed, lim.throttled, lim.retries, res)
+	}
+
+	fake.throttle(5, "")
+	res = DispatchEvent(context.Background(), linkDown)
+	if res.Source != "rules" || !strings.Contains(res.FallbackReason, "429") || lim.retries != 3 {
+		t.Errorf("exhausted retries did not fall back with the reason: %d retries: %+v", lim.retries, res)
+	}
+
+	var b strings.Builder
+	writeLimiterMetrics(&b)
+	if !strings.Contains(b.String(), `agents_api_provider_throttled_total{provider="openai"} 4`) {
+		t.Errorf("limiter metrics not reported:\n%s", b.String())
+	}
+}
@@ -3,21 +3,79 @@ package main
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
 	"github.com/joho/godotenv"
 )
 
 func main() {
-	// Load environment variables from .env
+	// Load environment variables from .env (optional: the environment may
+	// already be set, e.g. in a container)
 	if err := godotenv.Load(); err != nil {
-		log.Fatal("❌ Failed to load .env file")
+		log.Println("ℹ️  No .env file loaded, using the environment")
+	} else {
+		log.Println("✅ .env loaded successfully")
 	}
-	log.Println("✅ .env loaded successfully")
+
+	// Rule knowledge base, used by the rules provider and as the fallback
+	if err := loadKnowledgeBase(); err != nil {
+		log.Fatal("❌ Failed to load rule knowledge base: ", err)
+	}
+	rulesFallback = config.GetEnvBool("AGENTS_RULES_FALLBACK", true)
+
+	// Runbooks retrieved into prompts, re-indexed when the files change
+	if err := runbooks.open(config.GetEnv("AGENTS_RUNBOOKS_DIR", "runbooks")); err != nil {
+		log.Fatal("❌ Failed to index runbooks: ", err)
+	}
+	runbookResults = config.GetEnvInt("AGENTS_RUNBOOKS_RESULTS", 3)
+	go runbooks.watch(time.Duration(config.GetEnvInt("AGENTS_RUNBOOKS_REFRESH_SECONDS", 30)) * time.Second)
+
+	// Prompt templates, per event type and category, reloaded when edited
+	if err := prompts.open(config.GetEnv("AGENTS_PROMPTS_DIR", "prompts")); err != nil {
+		log.Fatal("❌ Failed to load prompt templates: ", err)
+	}
+	go prompts.watch(time.Duration(config.GetEnvInt("AGENTS_PROMPTS_REFRESH_SECONDS", 30)) * time.Second)
+
+	// Past incidents, searched for ones similar to each new event
+	var err error
+	if incidents, err = newIncidentStore(config.GetEnv("AGENTS_INCIDENTS_PATH", "incidents.json"), config.GetEnvInt("AGENTS_INCIDENTS_MAX", 5000)); err != nil {
+		log.Fatal("❌ Failed to load past incidents: ", err)
+	}
+	similarThreshold = config.GetEnvFloat("AGENTS_SIMILAR_THRESHOLD", 0.3)
+	similarResults = config.GetEnvInt("AGENTS_SIMILAR_RESULTS", 5)
+	historyResults = config.GetEnvInt("AGENTS_HISTORY_RESULTS", 5)
+
+	// Analyses of repeated events are reused for a while
+	cache = newAnalysisCache(config.GetEnvInt("AGENTS_CACHE_SIZE", 1000), time.Duration(config.GetEnvInt("AGENTS_CACHE_TTL_SECONDS", 300))*time.Second)
+	repairAttempts = config.GetEnvInt("AGENTS_REPAIR_ATTEMPTS", 2)
+
+	// Select the analysis provider
+	if provider, err = providerFromEnv(); err != nil {
+		log.Fatal("❌ Failed to set up AI provider: ", err)
+	}
+	log.Printf("🤖 Using %s provider", provider.Name())
+
+	// Background analysis jobs, kept across restarts
+	if jobs, err = newJobStore(config.GetEnv("AGENTS_JOBS_PATH", "jobs.json"), time.Duration(config.GetEnvInt("AGENTS_JOBS_TTL_SECONDS", 3600))*time.Second, config.GetEnvInt("AGENTS_JOBS_MAX_QUEUE", 1000)); err != nil {
+		log.Fatal("❌ Failed to load jobs: ", err)
+	}
+	callbackRetries = config.GetEnvInt("AGENTS_JOBS_CALLBACK_RETRIES", 3)
+	if callbackAllow, err = parseCallbackAllow(config.GetEnv("AGENTS_JOBS_CALLBACK_ALLOW", "")); err != nil {
+		log.Fatal("❌ Failed to read AGENTS_JOBS_CALLBACK_ALLOW: ", err)
+	}
+	jobs.start(config.GetEnvInt("AGENTS_JOBS_WORKERS", 4))
 
 	// Initialize Gin router
 	router := gin.Default()
 
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "healthy", "service": "agents-api", "provider": provider.Name()})
+	})
+
+	router.GET("/metrics", getMetrics)
+
 	// Core Agents API endpoint
 	router.POST("/events", func(c *gin.Context) {
 		var evt Event
@@ -31,11 +89,41 @@ func main() {
 		}
 
 		// Dispatch event to AI processing pipeline
-		result := DispatchEvent(evt)
+		result := DispatchEvent(c.Request.Context(), evt)
 
 		// Return unified response
-		c.JSON(http.StatusOK, result)
+		c.JSON(http.StatusOK, toUnified(result))
+	})
+
+	// Versioned analysis: the full models.Analysis, as the gateway shows it
+	router.POST("/v2/events", func(c *gin.Context) {
+		var evt Event
+		if err := c.ShouldBindJSON(&evt); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, DispatchEvent(c.Request.Context(), evt))
 	})
+	router.GET("/v2/schema", func(c *gin.Context) {
+		c.JSON(http.StatusOK, analysisSchema)
+	})
+
+	// Asynchronous analysis: poll the job or give a callback URL
+	router.POST("/jobs", postJob)
+	router.GET("/jobs/:id", getJob)
+	router.POST("/jobs/:id/cancel", postJobCancel)
+
+	// Prompt templates in use, and the prompt an event would get
+	router.GET("/prompts", getPrompts)
+	router.POST("/prompts/preview", postPromptPreview)
+
+	// Runbook sections a query retrieves, for tuning the runbooks
+	router.GET("/runbooks/search", getRunbookSearch)
+
+	// Past incidents: similarity search, bulk load and resolutions
+	router.GET("/incidents/similar", getSimilarIncidents)
+	router.POST("/incidents", postIncidents)
+	router.POST("/incidents/:id/resolution", postIncidentResolution)
 
 	log.Println("🚀 Agents API running on :9000")
 	if err := router.Run(":9000"); err != nil {
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- ANALYSIS METRICS ---------------- */
+
+// modelStats counts how well one provider's model keeps to the schema
+type modelStats struct {
+	provider, model string
+
+	calls     uint64 // generate calls, including repairs
+	errors    uint64 // calls that failed before returning text
+	invalid   uint64 // answers that failed parsing or validation
+	repairs   uint64 // repair prompts sent
+	repaired  uint64 // analyses that were valid only after a repair
+	exhausted uint64 // analyses still invalid after every repair
+}
+
+// promptStats counts the analyses of one prompt template version, to
+// compare versions by how often they fail and how confident they are
+type promptStats struct {
+	analyses   uint64  // valid analyses
+	failures   uint64  // calls or answers that failed, leaving it to the rules
+	confidence float64 // sum of the analyses' calibrated confidence
+}
+
+type analysisMetrics struct {
+	mu      sync.Mutex
+	stats   map[string]*modelStats
+	prompts map[string]*promptStats
+}
+
+var metrics = &analysisMetrics{stats: make(map[string]*modelStats), prompts: make(map[string]*promptStats)}
+
+// record updates the counters of a provider's model
+func (m *analysisMetrics) record(p Provider, update func(*modelStats)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := p.Name() + "/" + p.Model()
+	s, ok := m.stats[key]
+	if !ok {
+		s = &modelStats{provider: p.Name(), model: p.Model()}
+		m.stats[key] = s
+	}
+	update(s)
+}
+
+// recordPrompt counts an analysis made with a prompt template, or a failure
+// when a is nil
+func (m *analysisMetrics) recordPrompt(id string, a *models.Analysis) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.prompts[id]
+	if !ok {
+		s = &promptStats{}
+		m.prompts[id] = s
+	}
+	if a == nil {
+		s.failures++
+		return
+	}
+	s.analyses++
+	s.confidence += a.Confidence
+}
+
+// writeMetrics renders the counters in the Prometheus text format
+func (m *analysisMetrics) writeMetrics(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.stats))
+	for k := range m.stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	series := func(name, help string, value func(*modelStats) uint64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, k := range keys {
+			s := m.stats[k]
+			fmt.Fprintf(b, "%s{provider=%q,model=%q} %d\n", name, s.provider, s.model, value(s))
+		}
+	}
+	series("agents_api_model_calls_total", "Generate calls to the model, including repair prompts.", func(s *modelStats) uint64 { return s.calls })
+	series("agents_api_model_errors_total", "Generate calls that failed without an answer.", func(s *modelStats) uint64 { return s.errors })
+	series("agents_api_model_invalid_output_total", "Answers that could not be parsed or failed schema validation.", func(s *modelStats) uint64 { return s.invalid })
+	series("agents_api_model_repairs_total", "Repair prompts sent after an invalid answer.", func(s *modelStats) uint64 { return s.repairs })
+	series("agents_api_model_repaired_total", "Analyses that became valid after a repair.", func(s *modelStats) uint64 { return s.repaired })
+	series("agents_api_model_repair_exhausted_total", "Analyses still invalid after every repair.", func(s *modelStats) uint64 { return s.exhausted })
+
+	ids := make([]string, 0, len(m.prompts))
+	for id := range m.prompts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	promptSeries := func(name, help string, value func(*promptStats) string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, id := range ids {
+			fmt.Fprintf(b, "%s{template=%q} %s\n", name, id, value(m.prompts[id]))
+		}
+	}
+	promptSeries("agents_api_prompt_analyses_total", "Valid analyses made with the prompt template.", func(s *promptStats) string { return fmt.Sprint(s.analyses) })
+	promptSeries("agents_api_prompt_failures_total", "Analyses with the prompt template that failed and fell back.", func(s *promptStats) string { return fmt.Sprint(s.failures) })
+	promptSeries("agents_api_prompt_confidence_sum", "Sum of the calibrated confidence of the template's analyses.", func(s *promptStats) string { return fmt.Sprint(s.confidence) })
+}
+
+// getMetrics serves the analysis metrics
+func getMetrics(c *gin.Context) {
+	var b strings.Builder
+	metrics.writeMetrics(&b)
+	cache.writeMetrics(&b)
+	writeLimiterMetrics(&b)
+	jobs.writeMetrics(&b)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
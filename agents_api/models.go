@@ -1,13 +1,51 @@
 package main
 
+import (
+	"strings"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
 type Event struct {
-    Type     string `json:"type" binding:"required"`
-    Message  string `json:"message" binding:"required"`
-    Severity string `json:"severity,omitempty"`
+	Type     string `json:"type" binding:"required"`
+	Message  string `json:"message" binding:"required"`
+	Severity string `json:"severity,omitempty"`
+
+	// ID and Host identify the event among past incidents; an event without
+	// an ID is given one
+	ID   string `json:"id,omitempty"`
+	Host string `json:"source_host,omitempty"`
+
+	// Where the event came from and the labels the Event Router's lookup
+	// tables enriched it with (site, owner team, business service, ...),
+	// for prompt templates
+	SourceIP string            `json:"source_ip,omitempty"`
+	Category string            `json:"category,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
 }
 
+// UnifiedResponse is the original /events contract, kept for existing
+// callers; /v2/events returns the full models.Analysis
 type UnifiedResponse struct {
-    Severity          string `json:"severity"`
-    Explanation       string `json:"explanation"`
-    RecommendedAction string `json:"recommended_action"`
+	Severity          string `json:"severity"`
+	Explanation       string `json:"explanation"`
+	RecommendedAction string `json:"recommended_action"`
+
+	// Source is the provider that produced the analysis (watsonx, openai,
+	// ollama or rules); Rule is the knowledge base rule used, if any
+	Source         string `json:"source"`
+	Rule           string `json:"rule,omitempty"`
+	FallbackReason string `json:"fallback_reason,omitempty"`
+}
+
+// toUnified flattens an analysis into the original contract
+func toUnified(a models.Analysis) UnifiedResponse {
+	return UnifiedResponse{
+		Severity:          a.Severity,
+		Explanation:       a.Summary,
+		RecommendedAction: strings.Join(a.RecommendedActions, "; "),
+		Source:            a.Source,
+		Rule:              a.Rule,
+		FallbackReason:    a.FallbackReason,
+	}
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+/* ---------------- OLLAMA-COMPATIBLE PROVIDER ---------------- */
+
+// ollamaProvider calls a local model through Ollama's /api/generate
+type ollamaProvider struct {
+	settings ProviderSettings
+	client   *http.Client
+}
+
+func newOllamaProvider(s ProviderSettings) (*ollamaProvider, error) {
+	if s.BaseURL == "" || s.Model == "" {
+		return nil, errors.New("Ollama provider needs OLLAMA_BASE_URL and OLLAMA_MODEL")
+	}
+	return &ollamaProvider{settings: s, client: &http.Client{Timeout: s.Timeout}}, nil
+}
+
+func (p *ollamaProvider) Name() string  { return "ollama" }
+func (p *ollamaProvider) Model() string { return p.settings.Model }
+
+func (p *ollamaProvider) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	payload := map[string]interface{}{
+		"model":  p.settings.Model,
+		"prompt": req.Prompt,
+		"stream": false,
+		"format": "json",
+		"options": map[string]interface{}{
+			"temperature": p.settings.Temperature,
+			"num_predict": p.settings.MaxTokens,
+		},
+	}
+
+	var res struct {
+		Response string `json:"response"`
+	}
+	if err := postJSON(ctx, p.client, p.settings.BaseURL+"/api/generate", nil, payload, &res); err != nil {
+		return "", fmt.Errorf("Ollama: %w", err)
+	}
+	if res.Response == "" {
+		return "", errors.New("empty response from Ollama")
+	}
+	return res.Response, nil
+}
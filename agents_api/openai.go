@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+/* ---------------- OPENAI-COMPATIBLE PROVIDER ---------------- */
+
+// openAIProvider calls a /chat/completions endpoint. Besides OpenAI itself
+// this covers most hosted and self-hosted gateways (vLLM, LiteLLM, Azure
+// behind a proxy), so OPENAI_BASE_URL must include the version path, e.g.
+// https://api.openai.com/v1.
+type openAIProvider struct {
+	settings ProviderSettings
+	client   *http.Client
+}
+
+func newOpenAIProvider(s ProviderSettings) (*openAIProvider, error) {
+	if s.BaseURL == "" || s.Model == "" {
+		return nil, errors.New("OpenAI provider needs OPENAI_BASE_URL and OPENAI_MODEL")
+	}
+	return &openAIProvider{settings: s, client: &http.Client{Timeout: s.Timeout}}, nil
+}
+
+func (p *openAIProvider) Name() string  { return "openai" }
+func (p *openAIProvider) Model() string { return p.settings.Model }
+
+func (p *openAIProvider) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	payload := map[string]interface{}{
+		"model": p.settings.Model,
+		"messages": []map[string]string{
+			{"role": "user", "content": req.Prompt},
+		},
+		"temperature": p.settings.Temperature,
+		"max_tokens":  p.settings.MaxTokens,
+	}
+	headers := map[string]string{}
+	if p.settings.APIKey != "" {
+		headers["Authorization"] = "Bearer " + p.settings.APIKey
+	}
+
+	var res struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := postJSON(ctx, p.client, p.settings.BaseURL+"/chat/completions", headers, payload, &res); err != nil {
+		return "", fmt.Errorf("OpenAI: %w", err)
+	}
+	if len(res.Choices) == 0 {
+		return "", errors.New("empty response from OpenAI")
+	}
+	return res.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- PROMPT TEMPLATES ---------------- */
+
+// promptTemplate is one version of a prompt variant, read from a file named
+// <variant>.v<version>.tmpl. The variant is "default", an event type, a
+// category, or <type>-<category>.
+type promptTemplate struct {
+	Variant string `json:"variant"`
+	Version int    `json:"version"`
+	File    string `json:"file,omitempty"` // empty for the built-in prompt
+
+	tmpl *template.Template
+}
+
+// ID is what an analysis records as its promptVersion, e.g. "snmp.v2"
+func (t *promptTemplate) ID() string {
+	return fmt.Sprintf("%s.v%d", t.Variant, t.Version)
+}
+
+// promptData is what a template renders: the full event, with the labels
+// it was enriched with, and everything retrieved for it
+type promptData struct {
+	Event      Event
+	Similar    []models.SimilarIncident // similar past incidents, most similar first
+	History    []models.SimilarIncident // the device's latest past incidents, newest first
+	Runbooks   []runbookHit
+	Severities string // the severities the answer may use
+}
+
+// render fills in the template for a request
+func (t *promptTemplate) render(req GenerateRequest) (string, error) {
+	var b strings.Builder
+	err := t.tmpl.Execute(&b, promptData{
+		Event: req.Event, Similar: req.Similar, History: req.History, Runbooks: req.Runbooks,
+		Severities: strings.Join(constants.AllSeverities, ", "),
+	})
+	if err != nil {
+		return "", fmt.Errorf("prompt %s: %w", t.ID(), err)
+	}
+	return b.String(), nil
+}
+
+var promptFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	"join":  strings.Join,
+
+	// The blocks of the built-in prompt, for templates to reuse
+	"similarContext":      similarContext,
+	"historyContext":      historyContext,
+	"runbookContext":      runbookContext,
+	"citationInstruction": citationInstruction,
+}
+
+// builtinPrompt is used when no template file applies to an event: the
+// prompt from before templates were files, with the device history
+var builtinPrompt = &promptTemplate{
+	Variant: "builtin", Version: 2,
+	tmpl: template.Must(template.New("builtin").Funcs(promptFuncs).Parse(`<System data>
+Event type: {{.Event.Type}}
+Event message: {{.Event.Message}}
+</System data>
+{{historyContext .History}}{{similarContext .Similar}}{{runbookContext .Runbooks}}
+<Instructions>
+Use the system data to answer the question.
+If the device history shows the same fault recurring, say so and prefer a
+lasting fix over repeating the last resolution.
+Do NOT mention system data or how you derived the answer.
+Respond ONLY in valid JSON with fields:
+severity (one of {{.Severities}}),
+summary (one or two sentences on what happened),
+rootCauses (list of likely causes, most likely first),
+businessImpact (what users or services are affected),
+recommendedActions (list of concrete steps, in order),
+confidence (0 to 1, how sure you are of the root cause){{citationInstruction .Runbooks}}
+</Instructions>
+
+<Question>
+What is the severity of the event, why did it happen and what action should be taken?
+</Question>`)),
+}
+
+// promptLibrary holds the newest version of every prompt variant in a
+// directory, reloaded whenever a file is added, removed or modified
+type promptLibrary struct {
+	mu        sync.RWMutex
+	dir       string
+	variants  map[string]*promptTemplate
+	signature string
+}
+
+// prompts is the library of AGENTS_PROMPTS_DIR
+var prompts = &promptLibrary{}
+
+// promptFileName matches template files, e.g. "snmp.v2.tmpl"
+var promptFileName = regexp.MustCompile(`^([a-z0-9_-]+)\.v([0-9]+)\.tmpl$`)
+
+// open points the library at a directory and loads it. A relative
+// directory is taken from the working directory now, so the templates do
+// not depend on where later code runs. A missing directory leaves only the
+// built-in prompt until it appears.
+func (l *promptLibrary) open(dir string) error {
+	if dir != "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		dir = abs
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			log.Printf("⚠️  No prompt templates in %s (AGENTS_PROMPTS_DIR), using the built-in prompt", dir)
+		}
+	}
+	l.mu.Lock()
+	l.dir, l.signature = dir, ""
+	l.mu.Unlock()
+	_, err := l.refresh()
+	return err
+}
+
+// watch reloads the directory when its files change
+func (l *promptLibrary) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := l.refresh(); err != nil {
+			log.Printf("⚠️  Prompt template reload failed, keeping the previous templates: %v", err)
+		}
+	}
+}
+
+// refresh reloads the templates if the files changed since the last load,
+// reporting whether it did. A template that does not parse fails the
+// whole reload, so a typo never half-applies.
+func (l *promptLibrary) refresh() (bool, error) {
+	l.mu.RLock()
+	dir, prev := l.dir, l.signature
+	l.mu.RUnlock()
+	if dir == "" {
+		return false, nil
+	}
+
+	files, signature, err := listPrompts(dir)
+	if err != nil || signature == prev {
+		return false, err
+	}
+
+	variants := make(map[string]*promptTemplate)
+	for _, file := range files {
+		m := promptFileName.FindStringSubmatch(file)
+		version, _ := strconv.Atoi(m[2])
+		if cur, ok := variants[m[1]]; ok && cur.Version >= version {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return false, err
+		}
+		tmpl, err := template.New(file).Funcs(promptFuncs).Option("missingkey=zero").Parse(string(data))
+		if err != nil {
+			return false, err
+		}
+		variants[m[1]] = &promptTemplate{Variant: m[1], Version: version, File: file, tmpl: tmpl}
+	}
+
+	l.mu.Lock()
+	l.variants, l.signature = variants, signature
+	l.mu.Unlock()
+	ids := make([]string, 0, len(variants))
+	for _, t := range variants {
+		ids = append(ids, t.ID())
+	}
+	sort.Strings(ids)
+	log.Printf("📝 Loaded prompt templates from %s: %s", dir, strings.Join(ids, ", "))
+	return true, nil
+}
+
+// listPrompts returns the template files directly in dir and a signature
+// of their names, sizes and modification times. Other files are ignored.
+func listPrompts(dir string) ([]string, string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var files, sig []string
+	for _, e := range entries {
+		if e.IsDir() || !promptFileName.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			continue // removed since the directory was read
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		files = append(files, e.Name())
+		sig = append(sig, fmt.Sprintf("%s:%d:%d", e.Name(), info.Size(), info.ModTime().UnixNano()))
+	}
+	return files, strings.Join(sig, "|"), nil
+}
+
+// pick returns the template for an event, most specific variant first:
+// <type>-<category>, <category>, <type>, then default
+func (l *promptLibrary) pick(event Event) *promptTemplate {
+	typ, category := variantName(event.Type), variantName(event.Category)
+	var candidates []string
+	if typ != "" && category != "" {
+		candidates = append(candidates, typ+"-"+category)
+	}
+	if category != "" {
+		candidates = append(candidates, category)
+	}
+	if typ != "" {
+		candidates = append(candidates, typ)
+	}
+	candidates = append(candidates, "default")
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, name := range candidates {
+		if t, ok := l.variants[name]; ok {
+			return t
+		}
+	}
+	return builtinPrompt
+}
+
+// variantName is how a type or category appears in template file names
+func variantName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, strings.TrimSpace(s))
+}
+
+// active lists the directory and the templates in use from it, by variant
+func (l *promptLibrary) active() (string, []*promptTemplate) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]*promptTemplate, 0, len(l.variants))
+	for _, t := range l.variants {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Variant < out[j].Variant })
+	return l.dir, out
+}
+
+/* ---------------- HANDLERS ---------------- */
+
+// getPrompts lists the templates in use, and the built-in prompt used
+// when none applies
+func getPrompts(c *gin.Context) {
+	dir, active := prompts.active()
+	out := []gin.H{}
+	for _, t := range append(active, builtinPrompt) {
+		out = append(out, gin.H{"id": t.ID(), "variant": t.Variant, "version": t.Version, "file": t.File})
+	}
+	c.JSON(http.StatusOK, gin.H{"dir": dir, "templates": out})
+}
+
+// postPromptPreview renders the prompt an event would get, without asking
+// the model, for writing templates
+func postPromptPreview(c *gin.Context) {
+	var event Event
+	if err := c.ShouldBindJSON(&event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tmpl := prompts.pick(event)
+	similar, _ := incidents.similar(event, similarResults)
+	req := GenerateRequest{Event: event, Runbooks: searchEvent(event), Similar: similar, History: incidents.history(event, historyResults)}
+	prompt, err := tmpl.render(req)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"promptVersion": tmpl.ID(), "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"promptVersion": tmpl.ID(), "prompt": prompt})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+func TestShippedPrompts(t *testing.T) {
+	agentsFixture(t)
+	if got := prompts.pick(Event{Type: "snmp"}); got != builtinPrompt {
+		t.Errorf("without templates %s picked, want the built-in prompt", got.ID())
+	}
+	if err := prompts.open("prompts"); err != nil {
+		t.Fatal("shipped templates do not load: ", err)
+	}
+	if !filepath.IsAbs(prompts.dir) {
+		t.Errorf("templates directory %s kept relative to the working directory", prompts.dir)
+	}
+	for _, e := range []Event{
+		{Type: "syslog", Message: "Interface Gi0/1 down"},
+		{Type: "snmp", Message: "linkDown ifIndex=3"},
+		{Type: "syslog", Category: "security", Message: "Login failed for admin"},
+	} {
+		e.Host, e.SourceIP, e.Labels = "core-1", "10.1.0.1", map[string]string{"site": "dc1"}
+		tmpl := prompts.pick(e)
+		prompt, err := tmpl.render(GenerateRequest{Event: e})
+		if err != nil || tmpl.File == "" || !strings.Contains(prompt, e.Message) || !strings.Contains(prompt, "site: dc1") ||
+			!strings.Contains(prompt, "10.1.0.1") || strings.Contains(prompt, "<no value>") {
+			t.Errorf("shipped template %s does not render: %v\n%s", tmpl.ID(), err, prompt)
+		}
+	}
+}
+
+// Prompts come from versioned template files, picked by event type and
+// category, and every analysis records the one it was given
+func TestPromptTemplates(t *testing.T) {
+	fake := agentsFixture(t)
+	dir := t.TempDir()
+	writePrompt := func(name, text string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// The size alone may not change, and mtimes can be coarse
+		later := time.Now().Add(time.Duration(len(name)) * time.Second)
+		os.Chtimes(filepath.Join(dir, name), later, later)
+	}
+	writePrompt("default.v1.tmpl", "v1 {{.Event.Message}}")
+	writePrompt("default.v2.tmpl", `v2 {{.Event.Message}} on {{.Event.Host}} ({{.Event.SourceIP}}) site={{.Event.Labels.site}} owner={{.Event.Labels.owner}}
+{{historyContext .History}}{{range .Similar}}similar: {{.Message}}
+{{end}}Answer in JSON with severity (one of {{.Severities}}).`)
+	writePrompt("snmp.v1.tmpl", "snmp {{.Event.Message}}")
+	writePrompt("syslog-security.v3.tmpl", "syslog security {{.Event.Message}}")
+	writePrompt("notes.txt", "not a template")
+	if err := prompts.open(dir); err != nil {
+		t.Fatal("templates do not load: ", err)
+	}
+	for _, c := range []struct {
+		event Event
+		want  string
+	}{
+		{Event{Type: "syslog", Message: "x"}, "default.v2"},
+		{Event{Type: "SNMP", Message: "x"}, "snmp.v1"},
+		{Event{Type: "snmp", Category: "security", Message: "x"}, "snmp.v1"},
+		{Event{Type: "syslog", Category: "Security", Message: "x"}, "syslog-security.v3"},
+	} {
+		if got := prompts.pick(c.event).ID(); got != c.want {
+			t.Errorf("%s/%s picks %s, want %s", c.event.Type, c.event.Category, got, c.want)
+		}
+	}
+
+	t.Setenv("OPENAI_MODEL", "gpt-prompts")
+	useProvider(t, "openai")
+	cache = newAnalysisCache(10, time.Minute)
+	incidents.record(Event{ID: "evt-core-1-old", Type: "syslog", Message: "Fan 1 failed", Host: "core-1"}, models.Analysis{Severity: "medium"})
+	incidents.resolve("evt-core-1-old", "Replaced fan tray")
+	enriched := Event{Type: "syslog", Message: "Interface Gi0/5 down", Host: "core-1", SourceIP: "10.1.0.1", Labels: map[string]string{"site": "dc1"}}
+	res := DispatchEvent(context.Background(), enriched)
+	prompt := fake.lastPrompt()
+	if res.PromptVersion != "default.v2" || res.Source != "openai" {
+		t.Errorf("analysis does not record its prompt version: %+v", res)
+	}
+	if !strings.HasPrefix(prompt, "v2 Interface Gi0/5 down on core-1 (10.1.0.1) site=dc1 owner=\n") {
+		t.Errorf("template does not get the full event and enrichment:\n%s", prompt)
+	}
+	if !strings.Contains(prompt, "Fan 1 failed (medium). Resolution: Replaced fan tray") {
+		t.Errorf("template does not get the device history:\n%s", prompt)
+	}
+	if !strings.Contains(prompt, "critical, high") {
+		t.Errorf("template does not get the severities:\n%s", prompt)
+	}
+	if res = DispatchEvent(context.Background(), enriched); !res.Cached || res.PromptVersion != "default.v2" {
+		t.Errorf("repeat not served from the cache: %+v", res)
+	}
+
+	calls := fake.count("/v1/chat/completions")
+	writePrompt("default.v3.tmpl", "v3 {{.Event.Message}}")
+	changed, err := prompts.refresh()
+	res = DispatchEvent(context.Background(), enriched)
+	if !changed || err != nil || res.PromptVersion != "default.v3" || res.Cached ||
+		fake.count("/v1/chat/completions") != calls+1 || fake.lastPrompt() != "v3 Interface Gi0/5 down" {
+		t.Errorf("new version not picked up, or served from the cache: %v %v %+v", changed, err, res)
+	}
+
+	writePrompt("default.v4.tmpl", "v4 {{.Event.Message")
+	if _, err := prompts.refresh(); err == nil || prompts.pick(enriched).ID() != "default.v3" {
+		t.Errorf("template that does not parse not rejected: %v", err)
+	}
+	os.Remove(filepath.Join(dir, "default.v4.tmpl"))
+	writePrompt("default.v5.tmpl", "v5 {{.Event.Message.Nope}}")
+	prompts.refresh()
+	res = DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/6 down"})
+	if res.Source != "rules" || res.PromptVersion != "" || !strings.Contains(res.FallbackReason, "prompt default.v5") {
+		t.Errorf("template that fails to render did not fall back to the rules: %+v", res)
+	}
+
+	var b strings.Builder
+	metrics.writeMetrics(&b)
+	for _, line := range []string{
+		`agents_api_prompt_analyses_total{template="default.v2"} 1`,
+		`agents_api_prompt_analyses_total{template="default.v3"} 1`,
+		`agents_api_prompt_failures_total{template="default.v5"} 1`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("missing metric %s", line)
+		}
+	}
+
+	provider = rulesProvider{}
+	if res = DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/7 down"}); res.Source != "rules" || res.PromptVersion != "" {
+		t.Errorf("rule answer records a prompt: %+v", res)
+	}
+}
+
+func TestBuiltinPromptHistory(t *testing.T) {
+	history := []models.SimilarIncident{{ID: "evt-1", Message: "Fan 1 failed", Severity: "medium", Resolution: "Replaced fan tray", Timestamp: time.Now()}}
+	prompt, err := builtinPrompt.render(GenerateRequest{Event: Event{Type: "syslog", Message: "Fan 2 failed", Host: "core-1"}, History: history})
+	if err != nil || !strings.Contains(prompt, "Fan 1 failed (medium). Resolution: Replaced fan tray") {
+		t.Errorf("built-in prompt leaves out the device history: %v\n%s", err, prompt)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- PROVIDER INTERFACE ---------------- */
+
+// Provider generates the analysis text for an event. LLM providers send the
+// prompt to a model; the rule-based provider works from the event alone.
+// Either way the text is expected to hold a JSON models.Analysis.
+type Provider interface {
+	Name() string
+	Model() string
+	Generate(ctx context.Context, req GenerateRequest) (string, error)
+}
+
+// GenerateRequest is what a provider is asked to analyze. Runbooks, Similar
+// and History are the runbook sections and past incidents retrieved for the
+// event, for the prompt template to include.
+type GenerateRequest struct {
+	Event    Event
+	Prompt   string
+	Runbooks []runbookHit
+	Similar  []models.SimilarIncident
+	History  []models.SimilarIncident // the device's latest past incidents
+}
+
+// ProviderSettings configures one provider. They are read from environment
+// variables prefixed with the provider's name, e.g. OPENAI_MODEL.
+type ProviderSettings struct {
+	BaseURL     string
+	APIKey      string
+	Model       string
+	Temperature float64
+	MaxTokens   int
+	Timeout     time.Duration
+}
+
+// defaultMaxTokens is the default answer length. A v2 analysis with root
+// causes, impact, actions and citations runs to several hundred tokens, and
+// an answer cut off mid-object is invalid JSON.
+const defaultMaxTokens = 1024
+
+// providerNames lists the values accepted for AGENTS_PROVIDER
+var providerNames = []string{"watsonx", "openai", "ollama", "rules"}
+
+// provider is the one DispatchEvent uses, chosen by AGENTS_PROVIDER
+var provider Provider
+
+// settingsFromEnv reads <PREFIX>_BASE_URL, _API_KEY, _MODEL, _TEMPERATURE,
+// _MAX_TOKENS and _TIMEOUT_SECONDS over the given defaults
+func settingsFromEnv(prefix string, d ProviderSettings) ProviderSettings {
+	return ProviderSettings{
+		BaseURL:     strings.TrimRight(config.GetEnv(prefix+"_BASE_URL", d.BaseURL), "/"),
+		APIKey:      config.GetEnv(prefix+"_API_KEY", d.APIKey),
+		Model:       config.GetEnv(prefix+"_MODEL", d.Model),
+		Temperature: config.GetEnvFloat(prefix+"_TEMPERATURE", d.Temperature),
+		MaxTokens:   config.GetEnvInt(prefix+"_MAX_TOKENS", d.MaxTokens),
+		Timeout:     time.Duration(config.GetEnvInt(prefix+"_TIMEOUT_SECONDS", int(d.Timeout/time.Second))) * time.Second,
+	}
+}
+
+// newProvider builds a provider from its environment settings
+func newProvider(name string) (Provider, error) {
+	switch strings.ToLower(name) {
+	case "watsonx":
+		p, err := newWatsonxProvider()
+		return withLimits("WATSONX", p, err, LimitSettings{MaxConcurrent: 4, MaxQueue: 32, QueueTimeout: 10 * time.Second, MaxRetries: 2})
+	case "openai":
+		p, err := newOpenAIProvider(settingsFromEnv("OPENAI", ProviderSettings{
+			BaseURL: "https://api.openai.com/v1", Model: "gpt-4o-mini",
+			Temperature: 0.2, MaxTokens: defaultMaxTokens, Timeout: 20 * time.Second,
+		}))
+		return withLimits("OPENAI", p, err, LimitSettings{MaxConcurrent: 8, MaxQueue: 64, QueueTimeout: 10 * time.Second, MaxRetries: 2})
+	case "ollama":
+		// A local model serves one or two requests at a time
+		p, err := newOllamaProvider(settingsFromEnv("OLLAMA", ProviderSettings{
+			BaseURL: "http://localhost:11434", Model: "llama3.1",
+			Temperature: 0.2, MaxTokens: defaultMaxTokens, Timeout: 60 * time.Second,
+		}))
+		return withLimits("OLLAMA", p, err, LimitSettings{MaxConcurrent: 2, MaxQueue: 16, QueueTimeout: 30 * time.Second, MaxRetries: 1})
+	case "rules":
+		return rulesProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q, want one of %s", name, strings.Join(providerNames, ", "))
+}
+
+// providerFromEnv builds the provider named by AGENTS_PROVIDER. Without
+// one, watsonx is tried and the service starts on the rules when watsonx is
+// not configured, so it runs out of the box; a provider asked for by name
+// must work.
+func providerFromEnv() (Provider, error) {
+	name := config.GetEnv("AGENTS_PROVIDER", "")
+	if name != "" {
+		return newProvider(name)
+	}
+	p, err := newProvider("watsonx")
+	if err != nil {
+		log.Printf("⚠️  Default watsonx provider unavailable, answering from the rules: %v", err)
+		return rulesProvider{}, nil
+	}
+	return p, nil
+}
+
+/* ---------------- PROMPT ---------------- */
+
+// similarContext lists similar past incidents and how they were resolved
+func similarContext(similar []models.SimilarIncident) string {
+	if len(similar) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n<Similar past incidents>\n")
+	for _, s := range similar {
+		resolution := s.Resolution
+		if resolution == "" {
+			resolution = "not recorded"
+		}
+		fmt.Fprintf(&b, "- %s (%s, %s, %.0f%% similar). Resolution: %s\n",
+			s.Message, s.Severity, s.Timestamp.Format("2006-01-02"), s.Similarity*100, resolution)
+	}
+	b.WriteString("</Similar past incidents>\n")
+	return b.String()
+}
+
+// runbookContext lists the runbook sections retrieved for the event, each
+// under the ID the model cites it by
+func runbookContext(sections []runbookHit) string {
+	if len(sections) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n<Runbooks>\n")
+	for _, s := range sections {
+		fmt.Fprintf(&b, "[%s] %s\n%s\n\n", s.ID, s.Heading, s.Text)
+	}
+	b.WriteString("</Runbooks>\n")
+	return b.String()
+}
+
+// historyContext lists the device's latest past incidents
+func historyContext(history []models.SimilarIncident) string {
+	if len(history) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n<Device history>\n")
+	for _, h := range history {
+		resolution := h.Resolution
+		if resolution == "" {
+			resolution = "not recorded"
+		}
+		fmt.Fprintf(&b, "- %s %s (%s). Resolution: %s\n", h.Timestamp.Format("2006-01-02 15:04"), h.Message, h.Severity, resolution)
+	}
+	b.WriteString("</Device history>\n")
+	return b.String()
+}
+
+func citationInstruction(sections []runbookHit) string {
+	if len(sections) == 0 {
+		return "."
+	}
+	return `,
+citations (list of the IDs of the runbook sections your answer follows, empty if none apply).
+Prefer the steps in the runbooks over generic advice when they apply.`
+}
+
+// repairPrompt asks the model to correct an answer that failed validation
+func repairPrompt(prompt, answer string, problem error, schema *jsonSchema) string {
+	return fmt.Sprintf(`%s
+
+<Previous answer>
+%s
+</Previous answer>
+
+<Problem>
+The previous answer was rejected: %s
+</Problem>
+
+<Instructions>
+Answer the question again. Respond ONLY with one JSON object, with no other
+text, that matches this JSON Schema:
+%s
+</Instructions>`, prompt, answer, problem, schema)
+}
+
+/* ---------------- HTTP ---------------- */
+
+// postJSON sends payload as JSON and decodes a 200 reply into out
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return &upstreamError{URL: url, StatusCode: resp.StatusCode, Body: string(body), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
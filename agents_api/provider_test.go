@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// agentsFixture points every provider at a fresh fakeLLM through the same
+// environment variables used in production, and gives the test its own
+// cache, incidents, runbooks, prompts and metrics. Analyses are not cached
+// unless the test sets up a cache.
+func agentsFixture(t *testing.T) *fakeLLM {
+	t.Helper()
+	if err := loadKnowledgeBase(); err != nil {
+		t.Fatal("knowledge base: ", err)
+	}
+	fake := newFakeLLM()
+	t.Cleanup(fake.server.Close)
+	for k, v := range map[string]string{
+		"WATSONX_API_KEY": "wx-key", "WATSONX_PROJECT_ID": "proj-1",
+		"WATSONX_BASE_URL": fake.server.URL, "WATSONX_IAM_URL": fake.server.URL,
+		"WATSONX_MODEL": "ibm/granite-test", "WATSONX_MAX_TOKENS": "321",
+		"OPENAI_BASE_URL": fake.server.URL + "/v1", "OPENAI_API_KEY": "sk-test",
+		"OPENAI_MODEL": "gpt-test", "OPENAI_TEMPERATURE": "0.7", "OPENAI_MAX_RETRIES": "0",
+		"OLLAMA_BASE_URL": fake.server.URL, "OLLAMA_MODEL": "llama-test", "OLLAMA_MAX_TOKENS": "99",
+	} {
+		t.Setenv(k, v)
+	}
+
+	savedProvider, savedCache, savedIncidents, savedRunbooks, savedPrompts, savedMetrics, savedJobs :=
+		provider, cache, incidents, runbooks, prompts, metrics, jobs
+	savedFallback, savedBackoff, savedAllow := rulesFallback, callbackBackoff, callbackAllow
+	t.Cleanup(func() {
+		provider, cache, incidents, runbooks, prompts, metrics, jobs =
+			savedProvider, savedCache, savedIncidents, savedRunbooks, savedPrompts, savedMetrics, savedJobs
+		rulesFallback, callbackBackoff, callbackAllow = savedFallback, savedBackoff, savedAllow
+		limitersMu.Lock()
+		limiters = map[string]*limiter{}
+		limitersMu.Unlock()
+	})
+
+	var err error
+	if incidents, err = newIncidentStore(filepath.Join(t.TempDir(), "incidents.json"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	cache = newAnalysisCache(0, 0)
+	runbooks, prompts = &runbookIndex{}, &promptLibrary{}
+	metrics = &analysisMetrics{stats: make(map[string]*modelStats), prompts: make(map[string]*promptStats)}
+	rulesFallback = true
+	limitersMu.Lock()
+	limiters = map[string]*limiter{}
+	limitersMu.Unlock()
+	return fake
+}
+
+// useProvider makes the named provider, built from the environment, the one
+// DispatchEvent calls
+func useProvider(t *testing.T, name string) {
+	t.Helper()
+	p, err := newProvider(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	provider = p
+}
+
+var linkDown = Event{Type: "critical", Message: "Interface Gi0/1 down"}
+
+func TestProviders(t *testing.T) {
+	fake := agentsFixture(t)
+
+	cases := []struct {
+		name, path string
+		want       map[string]interface{}
+	}{
+		{"watsonx", "/ml/v1/text/generation", map[string]interface{}{"model_id": "ibm/granite-test", "project_id": "proj-1", "max_new_tokens": 321.0, "auth": "Bearer iam-token"}},
+		{"openai", "/v1/chat/completions", map[string]interface{}{"model": "gpt-test", "temperature": 0.7, "max_tokens": 1024.0, "auth": "Bearer sk-test"}},
+		{"ollama", "/api/generate", map[string]interface{}{"model": "llama-test", "num_predict": 99.0}},
+	}
+	for _, tc := range cases {
+		useProvider(t, tc.name)
+		for i := 0; i < 2; i++ {
+			res := DispatchEvent(context.Background(), linkDown)
+			if res.Severity != "critical" || len(res.RootCauses) != 2 || res.RecommendedActions[0] != "Check the link" ||
+				res.Source != tc.name || res.Model == "" || res.SchemaVersion != models.AnalysisSchemaVersion {
+				t.Errorf("%s analysis %d not parsed: %+v", tc.name, i+1, res)
+			}
+		}
+		got := fake.last(tc.path)
+		if got == nil {
+			t.Errorf("%s not called at its configured base URL %s", tc.name, tc.path)
+			continue
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Errorf("%s sends %s = %v, want %v", tc.name, k, got[k], v)
+			}
+		}
+	}
+
+	res := DispatchEvent(context.Background(), linkDown)
+	if res.Confidence != 0.62 {
+		t.Errorf("model confidence not calibrated: 0.95 reported, link-down rule disagrees on severity, got %v", res.Confidence)
+	}
+	if v1 := toUnified(res); v1.Explanation != "The link is down." || v1.RecommendedAction != "Check the link; Check the far end" {
+		t.Errorf("v1 response does not flatten the analysis: %+v", v1)
+	}
+	if n := fake.count("/identity/token"); n != 1 {
+		t.Errorf("watsonx IAM token not cached: %d token requests", n)
+	}
+
+	var b strings.Builder
+	metrics.writeMetrics(&b)
+	if line := `agents_api_model_calls_total{provider="watsonx",model="ibm/granite-test"} 2`; !strings.Contains(b.String(), line) {
+		t.Errorf("missing metric %s", line)
+	}
+}
+
+func TestUpstreamFailureFallsBackToRules(t *testing.T) {
+	fake := agentsFixture(t)
+	t.Setenv("OPENAI_BASE_URL", fake.server.URL+"/broken")
+	useProvider(t, "openai")
+
+	res := DispatchEvent(context.Background(), linkDown)
+	if res.Source != "rules" || res.Rule != "link-down" || !strings.Contains(res.FallbackReason, "503") {
+		t.Errorf("upstream failure did not fall back to rules: %+v", res)
+	}
+
+	rulesFallback = false
+	res = DispatchEvent(context.Background(), linkDown)
+	if res.Severity != "unknown" || res.Source != "openai" {
+		t.Errorf("without fallback the failure is not reported: %+v", res)
+	}
+}
+
+func TestAnswersRepaired(t *testing.T) {
+	fake := agentsFixture(t)
+
+	// Answers are validated against the schema and normalized
+	for _, tc := range []struct{ answer, severity string }{
+		{"```json\n{\"severity\": \"Major\", \"summary\": \"x\", \"rootCauses\": \"y\", \"businessImpact\": \"z\", \"recommendedActions\": [\"a\"], \"confidence\": 90}\n```", "high"},
+		{`Note {not json}. {"severity": "WARNING", "summary": "x", "rootCauses": ["y"], "businessImpact": "z", "recommendedActions": ["a"], "confidence": "40%"}`, "medium"},
+	} {
+		fake.answer(tc.answer)
+		useProvider(t, "openai")
+		res := DispatchEvent(context.Background(), linkDown)
+		if res.Source != "openai" || res.Severity != tc.severity || len(res.RootCauses) != 1 || res.Confidence <= 0 || res.Confidence >= 1 {
+			t.Errorf("answer %q not normalized to %s: %+v", tc.answer, tc.severity, res)
+		}
+	}
+
+	t.Setenv("OPENAI_MODEL", "gpt-flaky")
+	fake.answer(`{"severity": "catastrophic", "summary": "x", "confidence": 0.95}`, fakeAnalysis)
+	useProvider(t, "openai")
+	res := DispatchEvent(context.Background(), linkDown)
+	if res.Source != "openai" || res.Severity != "critical" {
+		t.Errorf("invalid answer not repaired: %+v", res)
+	}
+	if res.Confidence != 0.47 {
+		t.Errorf("repaired answer trusted as much: confidence %v", res.Confidence)
+	}
+	if repair := fake.lastPrompt(); !strings.Contains(repair, `severity: must be one of critical, high, medium, low, info, got "catastrophic"`) ||
+		!strings.Contains(repair, `missing required field "recommendedActions"`) {
+		t.Errorf("repair prompt does not name the problems:\n%s", repair)
+	}
+
+	// An answer cut off at the token limit is sent back like any other
+	// invalid answer
+	t.Setenv("OPENAI_MODEL", "gpt-truncated")
+	fake.answer(fakeAnalysis[:len(fakeAnalysis)/2], fakeAnalysis)
+	useProvider(t, "openai")
+	res = DispatchEvent(context.Background(), linkDown)
+	if res.Source != "openai" || res.Summary != "The link is down." {
+		t.Errorf("truncated answer not repaired: %+v", res)
+	}
+	if repair := fake.lastPrompt(); !strings.Contains(repair, fakeAnalysis[:len(fakeAnalysis)/2]) {
+		t.Errorf("repair prompt does not include the truncated answer:\n%s", repair)
+	}
+
+	t.Setenv("OPENAI_MODEL", "gpt-garbage")
+	fake.answer("I cannot help with that.")
+	useProvider(t, "openai")
+	calls := fake.count("/v1/chat/completions")
+	res = DispatchEvent(context.Background(), linkDown)
+	if res.Source != "rules" || !strings.Contains(res.FallbackReason, "no JSON") {
+		t.Errorf("unparseable output did not fall back to rules: %+v", res)
+	}
+	if n := fake.count("/v1/chat/completions") - calls; n != 3 {
+		t.Errorf("%d calls, want the answer and two repairs", n)
+	}
+
+	var b strings.Builder
+	metrics.writeMetrics(&b)
+	for _, line := range []string{
+		`agents_api_model_repaired_total{provider="openai",model="gpt-flaky"} 1`,
+		`agents_api_model_invalid_output_total{provider="openai",model="gpt-garbage"} 3`,
+		`agents_api_model_repair_exhausted_total{provider="openai",model="gpt-garbage"} 1`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("missing metric %s", line)
+		}
+	}
+}
+
+func TestUnknownProviderRejected(t *testing.T) {
+	if _, err := newProvider("bard"); err == nil {
+		t.Error("unknown provider accepted")
+	}
+	t.Setenv("AGENTS_PROVIDER", "bard")
+	if _, err := providerFromEnv(); err == nil {
+		t.Error("unknown AGENTS_PROVIDER accepted")
+	}
+}
+
+// Without AGENTS_PROVIDER an unconfigured watsonx falls back to the rules
+func TestDefaultProviderFallsBackToRules(t *testing.T) {
+	agentsFixture(t)
+	t.Setenv("AGENTS_PROVIDER", "")
+	if p, err := providerFromEnv(); err != nil || p.Name() != "watsonx" {
+		t.Errorf("configured watsonx not used by default: %v, %v", p, err)
+	}
+
+	t.Setenv("WATSONX_API_KEY", "")
+	if p, err := providerFromEnv(); err != nil || p.Name() != "rules" {
+		t.Errorf("unconfigured watsonx not replaced by the rules: %v, %v", p, err)
+	}
+	t.Setenv("AGENTS_PROVIDER", "watsonx")
+	if _, err := providerFromEnv(); err == nil {
+		t.Error("unconfigured watsonx accepted when asked for by name")
+	}
+}
+
+/* ---------------- FAKE LLM SERVERS ---------------- */
+
+// blockingProvider answers fakeAnalysis once release is closed, counting
+// the calls it gets
+type blockingProvider struct {
+	release chan struct{}
+	mu      sync.Mutex
+	calls   int
+}
+
+func (p *blockingProvider) Name() string  { return "blocking" }
+func (p *blockingProvider) Model() string { return "test" }
+
+func (p *blockingProvider) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	p.mu.Lock()
+	p.calls++
+	p.mu.Unlock()
+	<-p.release
+	return fakeAnalysis, nil
+}
+
+func (p *blockingProvider) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// fakeLLM answers the IAM token endpoint and the watsonx, OpenAI and Ollama
+// generation endpoints, recording the interesting fields of each request
+type fakeLLM struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	calls   map[string][]map[string]interface{}
+	answers []string
+
+	// throttled OpenAI calls left to answer 429, with this Retry-After
+	throttled  int
+	retryAfter string
+}
+
+const fakeAnalysis = `Sure! {"severity": "critical", "summary": "The link is down.", "rootCauses": ["Cable fault", "Remote port down"],
+"businessImpact": "Loss of redundancy.", "recommendedActions": ["Check the link", "Check the far end"], "confidence": 0.95}`
+
+func newFakeLLM() *fakeLLM {
+	f := &fakeLLM{calls: make(map[string][]map[string]interface{})}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := map[string]interface{}{"auth": r.Header.Get("Authorization")}
+		if r.URL.Path == "/identity/token" {
+			r.ParseForm()
+			rec["apikey"] = r.Form.Get("apikey")
+		} else {
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			for k, v := range body {
+				rec[k] = v
+			}
+			for _, nested := range []string{"parameters", "options"} {
+				if m, ok := body[nested].(map[string]interface{}); ok {
+					for k, v := range m {
+						rec[k] = v
+					}
+				}
+			}
+		}
+
+		f.mu.Lock()
+		f.calls[r.URL.Path] = append(f.calls[r.URL.Path], rec)
+		throttled := r.URL.Path == "/v1/chat/completions" && f.throttled > 0
+		if throttled {
+			f.throttled--
+		}
+		retryAfter := f.retryAfter
+		f.mu.Unlock()
+		if throttled {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+
+		var reply interface{}
+		switch r.URL.Path {
+		case "/identity/token":
+			reply = map[string]interface{}{"access_token": "iam-token", "expires_in": 3600}
+		case "/ml/v1/text/generation":
+			reply = map[string]interface{}{"results": []map[string]string{{"generated_text": fakeAnalysis}}}
+		case "/v1/chat/completions":
+			reply = map[string]interface{}{"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": f.nextAnswer()}}}}
+		case "/api/generate":
+			reply = map[string]interface{}{"response": fakeAnalysis, "done": true}
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(reply)
+	}))
+	return f
+}
+
+// throttle makes the next n OpenAI calls answer 429
+func (f *fakeLLM) throttle(n int, retryAfter string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.throttled, f.retryAfter = n, retryAfter
+}
+
+// answer scripts the next OpenAI answers; the last one repeats
+func (f *fakeLLM) answer(answers ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answers = answers
+}
+
+func (f *fakeLLM) nextAnswer() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.answers) == 0 {
+		return fakeAnalysis
+	}
+	a := f.answers[0]
+	if len(f.answers) > 1 {
+		f.answers = f.answers[1:]
+	}
+	return a
+}
+
+// lastPrompt returns the prompt of the last OpenAI request
+func (f *fakeLLM) lastPrompt() string {
+	rec := f.last("/v1/chat/completions")
+	msgs, _ := rec["messages"].([]interface{})
+	if len(msgs) == 0 {
+		return ""
+	}
+	msg, _ := msgs[len(msgs)-1].(map[string]interface{})
+	content, _ := msg["content"].(string)
+	return content
+}
+
+func (f *fakeLLM) last(path string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.calls[path]; len(c) > 0 {
+		return c[len(c)-1]
+	}
+	return nil
+}
+
+func (f *fakeLLM) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls[path])
+}
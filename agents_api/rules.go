@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- KNOWLEDGE BASE ---------------- */
+
+// KnowledgeRule maps an event message pattern to a canned analysis. The
+// text fields may refer to named groups of the pattern, e.g. ${iface}.
+type KnowledgeRule struct {
+	ID                 string   `json:"id"`
+	Pattern            string   `json:"pattern"`
+	Severity           string   `json:"severity"`
+	Summary            string   `json:"summary"`
+	RootCauses         []string `json:"root_causes"`
+	BusinessImpact     string   `json:"business_impact"`
+	RecommendedActions []string `json:"recommended_actions"`
+
+	re *regexp.Regexp
+}
+
+// builtinRules cover the common network failures. They are tried in order,
+// so specific rules come before general ones, and a failure before a
+// recovery: a message that reports both, such as a bundle down with a
+// member still up, is about the failure.
+var builtinRules = []KnowledgeRule{
+	{ID: "bgp-neighbor-down", Pattern: `(?i)bgp.*(neighbou?r|peer)\s*(?P<peer>\d+\.\d+\.\d+\.\d+)?.*(down|idle|reset|closed)`,
+		Severity:       "critical",
+		Summary:        "A BGP session ${peer} went down, so routes learned from that neighbor were withdrawn.",
+		RootCauses:     []string{"Peer unreachable (link or path failure)", "Hold timer expired under CPU or control-plane load", "Authentication, max-prefix or policy error on either side"},
+		BusinessImpact: "Traffic may be blackholed or shifted to a backup path with less capacity.",
+		RecommendedActions: []string{"Check reachability of the peer and the interface towards it", "Review 'show bgp summary' and the neighbor's notification reason",
+			"Contact the peer's operator if the session stays down"}},
+	{ID: "ospf-neighbor-down", Pattern: `(?i)ospf.*(neighbou?r|nbr|adjacency).*(down|lost|init)`,
+		Severity:           "high",
+		Summary:            "An OSPF adjacency was lost and the area is reconverging.",
+		RootCauses:         []string{"Link failure between the neighbors", "Mismatched hello/dead timers, area, MTU or authentication"},
+		BusinessImpact:     "Paths through this neighbor are unavailable; traffic reroutes if redundancy exists.",
+		RecommendedActions: []string{"Check the link between the neighbors", "Compare OSPF settings on both ends ('show ip ospf neighbor')"}},
+	{ID: "power-supply-failure", Pattern: `(?i)(power supply|psu|pwr)\s*(?P<unit>\S+)?.*(fail|fault|down|removed|not (ok|present))`,
+		Severity:           "high",
+		Summary:            "A power supply ${unit} failed and the device has lost power redundancy.",
+		RootCauses:         []string{"Failed power supply unit", "Loss of the power feed or PDU", "Loose or removed power cable"},
+		BusinessImpact:     "No immediate outage, but a second failure would take the device down.",
+		RecommendedActions: []string{"Check the power feed and cabling to the supply", "Replace the failed unit", "Confirm the remaining supply can carry the load"}},
+	{ID: "fan-failure", Pattern: `(?i)fan.*(fail|fault|stopped|not (ok|present))`,
+		Severity:           "high",
+		Summary:            "A cooling fan failed.",
+		RootCauses:         []string{"Failed fan or fan tray", "Fan tray not seated"},
+		BusinessImpact:     "The device may overheat and shut down components.",
+		RecommendedActions: []string{"Check the environment status ('show environment')", "Replace the fan tray", "Watch temperatures until it is replaced"}},
+	{ID: "temperature-high", Pattern: `(?i)(temperature|thermal|overheat).*(high|exceed|critical|alarm|warning)|overheat`,
+		Severity:           "high",
+		Summary:            "The device is running hot.",
+		RootCauses:         []string{"Fan failure", "Blocked airflow", "Room cooling failure"},
+		BusinessImpact:     "The device may throttle or shut down to protect itself.",
+		RecommendedActions: []string{"Check fans and airflow", "Check room cooling", "Reduce load or relocate the device if the temperature keeps rising"}},
+	{ID: "high-cpu", Pattern: `(?i)cpu.*(high|utili[sz]ation|threshold|exceed|\d{2,3}\s*%)`,
+		Severity:           "medium",
+		Summary:            "CPU utilization is high.",
+		RootCauses:         []string{"Broadcast storm or traffic punted to the CPU", "Routing protocol churn", "A runaway process"},
+		BusinessImpact:     "A slow control plane can make routing and management protocols time out.",
+		RecommendedActions: []string{"Find the busiest processes ('show processes cpu sorted')", "Look for broadcast storms and route churn", "Apply control-plane policing if needed"}},
+	{ID: "high-memory", Pattern: `(?i)(memory|mem).*(high|low|exhaust|threshold|alloc.*fail)`,
+		Severity:           "medium",
+		Summary:            "Memory is running short.",
+		RootCauses:         []string{"Memory leak in a process", "Routing table or feature growth beyond the platform's capacity"},
+		BusinessImpact:     "Processes may fail to allocate memory and the device can become unstable.",
+		RecommendedActions: []string{"Check memory use per process ('show processes memory')", "Plan a controlled reload if free memory keeps falling"}},
+	{ID: "interface-flapping", Pattern: `(?i)(flap|changed state to (up|down).*changed state to (up|down))`,
+		Severity:           "medium",
+		Summary:            "An interface is repeatedly going up and down.",
+		RootCauses:         []string{"Faulty cable or optic", "Errors on the far-end port", "Duplex or speed mismatch"},
+		BusinessImpact:     "Intermittent traffic loss and repeated protocol reconvergence.",
+		RecommendedActions: []string{"Check the cable, optics and far-end port for errors ('show interface')", "Consider dampening until the physical fault is fixed"}},
+	{ID: "link-down", Pattern: `(?i)(interface|link|port|line protocol)\s*(on )?(interface )?(?P<iface>[A-Za-z][\w\-/.:]*\d)?.*(down|lost|fail)`,
+		Severity:           "high",
+		Summary:            "Interface ${iface} went down.",
+		RootCauses:         []string{"Physical layer failure (cable or optic)", "Remote device or port down", "Interface shut administratively"},
+		BusinessImpact:     "Traffic over the interface is interrupted unless a redundant path takes over.",
+		RecommendedActions: []string{"Check whether it was shut administratively", "Check the cable, optics and far-end port", "Review 'show interface' for errors"}},
+	{ID: "link-up", Pattern: `(?i)(interface|link|port|line protocol)\s*(on )?(interface )?(?P<iface>[A-Za-z][\w\-/.:]*\d)?.*(changed state to up|is (now |back )?up\b|came (back )?up\b|restored|recovered)`,
+		Severity:           "info",
+		Summary:            "Interface ${iface} is up again.",
+		RootCauses:         []string{"Recovery from an earlier outage"},
+		BusinessImpact:     "Service over the interface is restored.",
+		RecommendedActions: []string{"No action needed; if it went down unexpectedly, review what caused the outage"}},
+	{ID: "packet-loss", Pattern: `(?i)(packet loss|latency|jitter).*(high|exceed|threshold|\d+\s*%)`,
+		Severity:           "medium",
+		Summary:            "The path is losing or delaying packets.",
+		RootCauses:         []string{"Congestion", "Interface errors along the path", "QoS drops"},
+		BusinessImpact:     "Applications over the path are degraded, voice and video first.",
+		RecommendedActions: []string{"Look for congestion or errors on the interfaces along the path", "Compare with the baseline", "Check QoS drop counters"}},
+	{ID: "auth-failure", Pattern: `(?i)(auth(entication)?|login).*(fail|denied|invalid)`,
+		Severity:           "medium",
+		Summary:            "Logins to the device are failing.",
+		RootCauses:         []string{"Mistyped password", "AAA server unreachable or misconfigured", "Attempted intrusion"},
+		BusinessImpact:     "Operators may be locked out; repeated failures may indicate an attack.",
+		RecommendedActions: []string{"Check the source addresses and usernames", "Block repeated failures from unknown sources", "Review the AAA configuration"}},
+	{ID: "config-change", Pattern: `(?i)(config(uration)?\s*(changed|saved|modified)|%SYS-\d-CONFIG)`,
+		Severity:           "low",
+		Summary:            "The device configuration was changed.",
+		RootCauses:         []string{"Planned or unplanned configuration change"},
+		BusinessImpact:     "None expected if the change was planned.",
+		RecommendedActions: []string{"Confirm the change was planned", "Compare the configuration with the last backup"}},
+}
+
+var knowledgeBase []KnowledgeRule
+
+// loadKnowledgeBase compiles the built-in rules, preceded by the rules in
+// AGENTS_RULES_PATH (a JSON array of KnowledgeRule) if set, so local rules
+// take precedence
+func loadKnowledgeBase() error {
+	rules := []KnowledgeRule{}
+	if path := config.GetEnv("AGENTS_RULES_PATH", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	rules = append(rules, builtinRules...)
+	for i := range rules {
+		r := &rules[i]
+		if !constants.IsValidSeverity(r.Severity) {
+			return fmt.Errorf("rule %s: unknown severity %q", r.ID, r.Severity)
+		}
+		if r.Summary == "" || len(r.RecommendedActions) == 0 {
+			return fmt.Errorf("rule %s: summary and recommended_actions are required", r.ID)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+		r.re = re
+	}
+	knowledgeBase = rules
+	return nil
+}
+
+/* ---------------- RULE-BASED ANALYSIS ---------------- */
+
+var severityActions = map[string]string{
+	"critical": "Page the on-call engineer and start incident response",
+	"high":     "Investigate the affected device promptly",
+	"medium":   "Review the event during working hours",
+	"low":      "Monitor for recurrence",
+	"info":     "No action required",
+}
+
+// Fixed confidences of rule-based answers: a matched rule is a known
+// failure, a guess from the event's own severity is little more than that
+const (
+	ruleMatchConfidence   = 0.7
+	ruleNoMatchConfidence = 0.3
+)
+
+// matchRule returns the first knowledge base rule matching the event
+// message, with its text fields expanded
+func matchRule(event Event) (KnowledgeRule, bool) {
+	for _, r := range knowledgeBase {
+		m := r.re.FindStringSubmatchIndex(event.Message)
+		if m == nil {
+			continue
+		}
+		expand := func(tmpl string) string {
+			out := string(r.re.ExpandString(nil, tmpl, event.Message, m))
+			return strings.Join(strings.Fields(out), " ")
+		}
+		expandAll := func(tmpls []string) []string {
+			out := make([]string, len(tmpls))
+			for i, t := range tmpls {
+				out[i] = expand(t)
+			}
+			return out
+		}
+		r.Summary, r.BusinessImpact = expand(r.Summary), expand(r.BusinessImpact)
+		r.RootCauses, r.RecommendedActions = expandAll(r.RootCauses), expandAll(r.RecommendedActions)
+		return r, true
+	}
+	return KnowledgeRule{}, false
+}
+
+// analyzeWithRules answers from the knowledge base. Without a matching rule
+// the severity comes from the event and the action from the severity.
+func analyzeWithRules(event Event) models.Analysis {
+	if r, ok := matchRule(event); ok {
+		return models.Analysis{
+			SchemaVersion:      models.AnalysisSchemaVersion,
+			Severity:           r.Severity,
+			Summary:            r.Summary,
+			RootCauses:         r.RootCauses,
+			BusinessImpact:     r.BusinessImpact,
+			RecommendedActions: r.RecommendedActions,
+			Confidence:         ruleMatchConfidence,
+			Source:             "rules",
+			Rule:               r.ID,
+		}
+	}
+
+	severity := strings.ToLower(event.Severity)
+	if !constants.IsValidSeverity(severity) {
+		severity = strings.ToLower(event.Type)
+	}
+	if !constants.IsValidSeverity(severity) {
+		severity = constants.SeverityMedium
+	}
+	return models.Analysis{
+		SchemaVersion:      models.AnalysisSchemaVersion,
+		Severity:           severity,
+		Summary:            "No known pattern matched this " + event.Type + " event: " + event.Message,
+		RootCauses:         []string{"Unknown"},
+		BusinessImpact:     "Unknown",
+		RecommendedActions: []string{severityActions[severity]},
+		Confidence:         ruleNoMatchConfidence,
+		Source:             "rules",
+	}
+}
+
+// rulesProvider answers offline, without a model, from the knowledge base
+type rulesProvider struct{}
+
+func (rulesProvider) Name() string  { return "rules" }
+func (rulesProvider) Model() string { return "knowledge-base" }
+
+// Generate answers from the knowledge base, adding how the most similar
+// past incident was resolved and the best matching runbook section, if any
+func (rulesProvider) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	answer := modelAnswer{Analysis: analyzeWithRules(req.Event)}
+	for _, s := range req.Similar {
+		if s.Resolution != "" {
+			answer.RecommendedActions = append(answer.RecommendedActions, "A similar incident was resolved by: "+s.Resolution)
+			break
+		}
+	}
+	if len(req.Runbooks) > 0 {
+		top := req.Runbooks[0]
+		answer.RecommendedActions = append(answer.RecommendedActions, "Follow the runbook: "+top.File+", "+top.Heading)
+		answer.Citations = []string{top.ID}
+	}
+	out, err := json.Marshal(answer)
+	return string(out), err
+}
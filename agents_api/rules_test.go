@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// The knowledge base recognizes common failures offline
+func TestKnowledgeBase(t *testing.T) {
+	agentsFixture(t)
+	useProvider(t, "rules")
+
+	for _, tc := range []struct{ message, rule, severity, mentions string }{
+		{"Interface GigabitEthernet0/1 changed state to down", "link-down", "high", "GigabitEthernet0/1"},
+		{"Line protocol on Interface Te1/0/4, changed state to up", "link-up", "info", "Te1/0/4"},
+		{"%BGP-5-ADJCHANGE: neighbor 10.0.0.2 Down BGP Notification sent", "bgp-neighbor-down", "critical", "10.0.0.2"},
+		{"OSPF neighbor 10.1.1.1 on Vlan10 from FULL to DOWN", "ospf-neighbor-down", "high", ""},
+		{"CPU utilization 97% exceeds threshold", "high-cpu", "medium", ""},
+		{"Power supply 2 failed", "power-supply-failure", "high", "2"},
+		{"Fan tray 1 failure detected", "fan-failure", "high", ""},
+		{"Something odd happened", "", "critical", ""},
+	} {
+		res := DispatchEvent(context.Background(), Event{Type: "critical", Message: tc.message})
+		if res.Source != "rules" || res.Rule != tc.rule || res.Severity != tc.severity || !strings.Contains(res.Summary, tc.mentions) {
+			t.Errorf("%q: want rule %q with severity %s, got %+v", tc.message, tc.rule, tc.severity, res)
+		}
+	}
+}
+
+// A message reporting a failure and a recovery is about the failure, and
+// "up" counts only as a state change
+func TestKnowledgeBaseMixedMessages(t *testing.T) {
+	agentsFixture(t)
+
+	for _, tc := range []struct{ message, rule string }{
+		{"Port-channel1 is down, member Gi0/1 is up", "link-down"},
+		{"Interface Gi0/1 is up, line protocol is down", "link-down"},
+		{"Interface Gi0/2 down, backup link Gi0/3 is up", "link-down"},
+		{"Link Gi0/4 restored", "link-up"},
+		{"Uplink port Gi0/5 is up", "link-up"},
+		{"Interface Gi0/6 came back up", "link-up"},
+		{"Interface Gi0/7 set up for VLAN 10", ""},
+		{"Port Gi0/8 is upgraded to 10G", ""},
+	} {
+		r, _ := matchRule(Event{Type: "syslog", Message: tc.message})
+		if r.ID != tc.rule {
+			t.Errorf("%q: matched rule %q, want %q", tc.message, r.ID, tc.rule)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- RUNBOOK INDEX ---------------- */
+
+// runbookSection is one chunk of a markdown runbook: the text under a
+// heading, split further when it is long
+type runbookSection struct {
+	ID      string // <file>#<heading slug>, what the model cites
+	File    string // path relative to the runbooks directory
+	Heading string // heading path, e.g. "Interface down > Physical checks"
+	Text    string
+
+	tf     map[string]int
+	length int
+}
+
+// runbookHit is a section retrieved for an event, with its BM25 score
+type runbookHit struct {
+	*runbookSection
+	Score float64
+}
+
+// runbookIndex is a BM25 index over the markdown files of a directory. It
+// is rebuilt whenever a file is added, removed or modified.
+type runbookIndex struct {
+	mu        sync.RWMutex
+	dir       string
+	sections  []*runbookSection
+	df        map[string]int
+	avgLen    float64
+	signature string
+}
+
+// BM25 parameters, and the score below which a section is not relevant
+const (
+	bm25K1          = 1.2
+	bm25B           = 0.75
+	minRunbookScore = 1.0
+
+	// maxSectionChars is roughly where a section is split into chunks, at
+	// paragraph boundaries
+	maxSectionChars = 1200
+)
+
+// runbooks is the index of AGENTS_RUNBOOKS_DIR; runbookResults is how many
+// sections go into a prompt (AGENTS_RUNBOOKS_RESULTS)
+var (
+	runbooks       = &runbookIndex{}
+	runbookResults = 3
+)
+
+// open points the index at a directory and indexes it. A missing directory
+// leaves the index empty until it appears.
+func (ix *runbookIndex) open(dir string) error {
+	ix.mu.Lock()
+	ix.dir, ix.signature = dir, ""
+	ix.mu.Unlock()
+	_, err := ix.refresh()
+	return err
+}
+
+// watch re-indexes the directory when its files change
+func (ix *runbookIndex) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := ix.refresh(); err != nil {
+			log.Printf("⚠️  Runbook re-index failed: %v", err)
+		}
+	}
+}
+
+// refresh rebuilds the index if the markdown files changed since the last
+// build, reporting whether it did
+func (ix *runbookIndex) refresh() (bool, error) {
+	ix.mu.RLock()
+	dir, prev := ix.dir, ix.signature
+	ix.mu.RUnlock()
+	if dir == "" {
+		return false, nil
+	}
+
+	files, signature, err := listRunbooks(dir)
+	if err != nil || signature == prev {
+		return false, err
+	}
+
+	var sections []*runbookSection
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return false, err
+		}
+		sections = append(sections, chunkMarkdown(filepath.ToSlash(file), string(data))...)
+	}
+
+	df := make(map[string]int)
+	total := 0
+	for _, s := range sections {
+		for term := range s.tf {
+			df[term]++
+		}
+		total += s.length
+	}
+	avgLen := 0.0
+	if len(sections) > 0 {
+		avgLen = float64(total) / float64(len(sections))
+	}
+
+	ix.mu.Lock()
+	ix.sections, ix.df, ix.avgLen, ix.signature = sections, df, avgLen, signature
+	ix.mu.Unlock()
+	log.Printf("📚 Indexed %d runbook sections from %d files in %s", len(sections), len(files), dir)
+	return true, nil
+}
+
+// listRunbooks returns the markdown files under dir and a signature of
+// their names, sizes and modification times
+func listRunbooks(dir string) ([]string, string, error) {
+	var files, sig []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".md") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files = append(files, rel)
+		sig = append(sig, fmt.Sprintf("%s:%d:%d", rel, info.Size(), info.ModTime().UnixNano()))
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, "missing", nil
+	}
+	return files, strings.Join(sig, "\n"), err
+}
+
+// search returns up to k sections ranked by BM25 against the query
+func (ix *runbookIndex) search(query string, k int) []runbookHit {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	terms := map[string]bool{}
+	for _, t := range tokenize(query) {
+		terms[t] = true
+	}
+	n := float64(len(ix.sections))
+	var hits []runbookHit
+	for _, s := range ix.sections {
+		score := 0.0
+		for t := range terms {
+			tf := float64(s.tf[t])
+			if tf == 0 {
+				continue
+			}
+			df := float64(ix.df[t])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(s.length)/ix.avgLen))
+		}
+		if score >= minRunbookScore {
+			hits = append(hits, runbookHit{s, score})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+// searchEvent retrieves the runbook sections relevant to an event
+func searchEvent(event Event) []runbookHit {
+	return runbooks.search(event.Type+" "+event.Message, runbookResults)
+}
+
+/* ---------------- MARKDOWN CHUNKING ---------------- */
+
+// chunkMarkdown splits a runbook at its headings. Each section keeps the
+// path of headings above it, and long sections are split at blank lines.
+func chunkMarkdown(file, text string) []*runbookSection {
+	var (
+		sections []*runbookSection
+		headings []string
+		body     []string
+		inFence  bool
+		seen     = map[string]int{}
+	)
+	flush := func() {
+		var path []string
+		for _, h := range headings {
+			if h != "" {
+				path = append(path, h)
+			}
+		}
+		heading := strings.Join(path, " > ")
+		if heading == "" {
+			heading = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		for _, chunk := range splitParagraphs(strings.TrimSpace(strings.Join(body, "\n")), maxSectionChars) {
+			id := file + "#" + slugify(heading)
+			if seen[id]++; seen[id] > 1 {
+				id = fmt.Sprintf("%s-%d", id, seen[id])
+			}
+			s := &runbookSection{ID: id, File: file, Heading: heading, Text: chunk, tf: map[string]int{}}
+			// Heading words count twice: they say what the section is about
+			for _, t := range append(tokenize(heading+" "+heading), tokenize(chunk)...) {
+				s.tf[t]++
+				s.length++
+			}
+			sections = append(sections, s)
+		}
+		body = body[:0]
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+		if !inFence && level > 0 && level <= 6 && strings.HasPrefix(trimmed[level:], " ") {
+			flush()
+			if level <= len(headings) {
+				headings = headings[:level-1]
+			}
+			for len(headings) < level-1 {
+				headings = append(headings, "")
+			}
+			headings = append(headings, strings.TrimSpace(trimmed[level:]))
+			continue
+		}
+		body = append(body, line)
+	}
+	flush()
+	return sections
+}
+
+// splitParagraphs cuts text into chunks of about max characters at blank
+// lines; a single longer paragraph stays whole
+func splitParagraphs(text string, max int) []string {
+	if text == "" {
+		return nil
+	}
+	var chunks []string
+	var cur strings.Builder
+	for _, para := range strings.Split(text, "\n\n") {
+		if cur.Len() > 0 && cur.Len()+len(para) > max {
+			chunks = append(chunks, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		}
+		cur.WriteString(para + "\n\n")
+	}
+	if s := strings.TrimSpace(cur.String()); s != "" {
+		chunks = append(chunks, s)
+	}
+	return chunks
+}
+
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// stopwords are too common in runbooks and events to rank by
+var stopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "was": true, "with": true, "that": true,
+	"this": true, "from": true, "has": true, "have": true, "not": true, "but": true, "you": true,
+	"its": true, "into": true, "then": true, "than": true, "any": true, "all": true, "can": true,
+	"will": true, "should": true, "on": true, "of": true, "to": true, "in": true, "is": true,
+	"if": true, "it": true, "or": true, "be": true, "by": true, "an": true, "as": true, "at": true,
+}
+
+// tokenize lowercases text and splits it into words, dropping stopwords
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	out := words[:0]
+	for _, w := range words {
+		if len(w) > 1 && !stopwords[w] {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+/* ---------------- CITATIONS ---------------- */
+
+// citeRunbooks turns the section IDs a model cited into citations, keeping
+// only sections it was actually given
+func citeRunbooks(hits []runbookHit, cited []string) []models.Citation {
+	var out []models.Citation
+	used := map[string]bool{}
+	for _, c := range cited {
+		id := strings.Trim(strings.TrimSpace(c), "[]`\"")
+		for _, h := range hits {
+			if strings.EqualFold(h.ID, id) && !used[h.ID] {
+				used[h.ID] = true
+				out = append(out, models.Citation{ID: h.ID, Runbook: h.File, Section: h.Heading})
+			}
+		}
+	}
+	return out
+}
+
+// getRunbookSearch shows the sections retrieved for ?q=
+func getRunbookSearch(c *gin.Context) {
+	hits := runbooks.search(c.Query("q"), runbookResults)
+	out := make([]gin.H, 0, len(hits))
+	for _, h := range hits {
+		out = append(out, gin.H{"id": h.ID, "runbook": h.File, "section": h.Heading, "score": math.Round(h.Score*100) / 100, "text": h.Text})
+	}
+	c.JSON(http.StatusOK, out)
+}
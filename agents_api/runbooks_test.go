@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// testRunbook has a section long enough to be split into two chunks
+var testRunbook = "# Link down\n\nFor interfaces that go down.\n\n## Physical checks\n\nReseat the SFP and the cable of the interface.\n\n" +
+	"## Escalation\n\n" + strings.Repeat("Call the on-call engineer.\n\n", 50) + "```\n# not a heading\n```\n"
+
+// Runbooks are chunked, retrieved into the prompt and cited
+func TestRunbooks(t *testing.T) {
+	fake := agentsFixture(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "link.md"), []byte(testRunbook), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runbooks.open(dir); err != nil {
+		t.Fatal("runbooks not indexed: ", err)
+	}
+
+	hits := searchEvent(linkDown)
+	if len(hits) == 0 || hits[0].ID != "link.md#link-down-physical-checks" || hits[0].Heading != "Link down > Physical checks" {
+		t.Errorf("runbook section not retrieved: %+v", hits)
+	}
+
+	var ids []string
+	for _, h := range runbooks.search("on-call engineer", 5) {
+		ids = append(ids, h.ID)
+	}
+	sort.Strings(ids)
+	if got := strings.Join(ids, " "); got != "link.md#link-down-escalation link.md#link-down-escalation-2" {
+		t.Errorf("long section not split into chunks: %s", got)
+	}
+
+	fake.answer(strings.Replace(fakeAnalysis, `"confidence"`, `"citations": ["[link.md#link-down-physical-checks]", "made-up.md#x"], "confidence"`, 1))
+	useProvider(t, "openai")
+	res := DispatchEvent(context.Background(), linkDown)
+	if prompt := fake.lastPrompt(); !strings.Contains(prompt, "[link.md#link-down-physical-checks] Link down > Physical checks\nReseat the SFP") {
+		t.Errorf("runbook sections not in the prompt:\n%s", prompt)
+	}
+	if len(res.Citations) != 1 || res.Citations[0] != (models.Citation{ID: "link.md#link-down-physical-checks", Runbook: "link.md", Section: "Link down > Physical checks"}) {
+		t.Errorf("want the cited section resolved and the unknown one dropped, got %+v", res.Citations)
+	}
+
+	useProvider(t, "rules")
+	res = DispatchEvent(context.Background(), linkDown)
+	if len(res.Citations) != 1 || !strings.Contains(res.RecommendedActions[len(res.RecommendedActions)-1], "link.md") {
+		t.Errorf("rules answer does not point at the runbook: %+v", res)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cpu.md"), []byte("# High CPU\n\nFind the busiest process with show processes cpu sorted.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changed, _ := runbooks.refresh()
+	hits = runbooks.search("CPU utilization high", 3)
+	if !changed || len(hits) == 0 || hits[0].File != "cpu.md" {
+		t.Errorf("new runbook not re-indexed: %+v", hits)
+	}
+	if changed, _ = runbooks.refresh(); changed {
+		t.Error("unchanged runbooks re-indexed")
+	}
+}
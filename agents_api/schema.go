@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- JSON SCHEMA ---------------- */
+
+// jsonSchema is the subset of JSON Schema used to check model output
+type jsonSchema struct {
+	ID         string                 `json:"$id,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	Type       string                 `json:"type"`
+	Required   []string               `json:"required,omitempty"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	Items      *jsonSchema            `json:"items,omitempty"`
+	Enum       []string               `json:"enum,omitempty"`
+	MinLength  int                    `json:"minLength,omitempty"`
+	MinItems   int                    `json:"minItems,omitempty"`
+	Minimum    *float64               `json:"minimum,omitempty"`
+	Maximum    *float64               `json:"maximum,omitempty"`
+}
+
+var zero, one = 0.0, 1.0
+
+// analysisSchema is what the model must answer with: the fields of
+// models.Analysis it produces. It is shown to the model when asking it to
+// repair an answer and served at /v2/schema.
+var analysisSchema = &jsonSchema{
+	ID:       models.AnalysisSchemaVersion,
+	Title:    "Event analysis",
+	Type:     "object",
+	Required: []string{"severity", "summary", "rootCauses", "businessImpact", "recommendedActions", "confidence"},
+	Properties: map[string]*jsonSchema{
+		"severity":           {Type: "string", Enum: constants.AllSeverities},
+		"summary":            {Type: "string", MinLength: 1},
+		"rootCauses":         {Type: "array", MinItems: 1, Items: &jsonSchema{Type: "string", MinLength: 1}},
+		"businessImpact":     {Type: "string", MinLength: 1},
+		"recommendedActions": {Type: "array", MinItems: 1, Items: &jsonSchema{Type: "string", MinLength: 1}},
+		"confidence":         {Type: "number", Minimum: &zero, Maximum: &one},
+		"citations":          {Type: "array", Items: &jsonSchema{Type: "string", MinLength: 1}},
+	},
+}
+
+// modelAnswer is an analysis as the model writes it: citations are the IDs
+// of runbook sections, resolved against the retrieved ones afterwards
+type modelAnswer struct {
+	models.Analysis
+	Citations []string `json:"citations,omitempty"`
+}
+
+func (s *jsonSchema) String() string {
+	out, _ := json.Marshal(s)
+	return string(out)
+}
+
+// validate checks a decoded JSON value and returns every violation found
+func (s *jsonSchema) validate(path string, v interface{}) []string {
+	at := func(msg string, args ...interface{}) []string {
+		p := path
+		if p == "" {
+			p = "answer"
+		}
+		return []string{p + ": " + fmt.Sprintf(msg, args...)}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return at("must be an object")
+		}
+		var errs []string
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, at("missing required field %q", name)...)
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if fv, ok := obj[name]; ok {
+				errs = append(errs, s.Properties[name].validate(strings.TrimPrefix(path+"."+name, "."), fv)...)
+			}
+		}
+		return errs
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return at("must be an array")
+		}
+		if len(arr) < s.MinItems {
+			return at("must have at least %d items", s.MinItems)
+		}
+		var errs []string
+		if s.Items != nil {
+			for i, item := range arr {
+				errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+		return errs
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return at("must be a string")
+		}
+		if len(strings.TrimSpace(str)) < s.MinLength {
+			return at("must not be empty")
+		}
+		if len(s.Enum) > 0 {
+			for _, e := range s.Enum {
+				if str == e {
+					return nil
+				}
+			}
+			return at("must be one of %s, got %q", strings.Join(s.Enum, ", "), str)
+		}
+	case "number":
+		n, ok := v.(float64)
+		if !ok {
+			return at("must be a number")
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return at("must be at least %g", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return at("must be at most %g", *s.Maximum)
+		}
+	}
+	return nil
+}
+
+/* ---------------- MODEL OUTPUT ---------------- */
+
+// severityAliases maps words models use for severity to the shared levels
+var severityAliases = map[string]string{
+	"emergency": constants.SeverityCritical, "fatal": constants.SeverityCritical,
+	"crit": constants.SeverityCritical, "severe": constants.SeverityCritical, "alert": constants.SeverityCritical,
+	"major": constants.SeverityHigh, "error": constants.SeverityHigh, "urgent": constants.SeverityHigh,
+	"moderate": constants.SeverityMedium, "warning": constants.SeverityMedium, "warn": constants.SeverityMedium,
+	"minor": constants.SeverityLow, "notice": constants.SeverityLow,
+	"informational": constants.SeverityInfo, "information": constants.SeverityInfo, "debug": constants.SeverityInfo,
+}
+
+// normalizeSeverity maps a model's severity onto constants.AllSeverities,
+// returning it unchanged when it cannot
+func normalizeSeverity(s string) string {
+	norm := strings.ToLower(strings.Trim(strings.TrimSpace(s), ".!\"'"))
+	if constants.IsValidSeverity(norm) {
+		return norm
+	}
+	if alias, ok := severityAliases[norm]; ok {
+		return alias
+	}
+	return s
+}
+
+// findJSONObject returns the first complete JSON object in text, skipping
+// prose and code fences around it and braces that do not start valid JSON
+func findJSONObject(text string) (map[string]interface{}, error) {
+	for i := strings.IndexByte(text, '{'); i >= 0; {
+		var obj map[string]interface{}
+		if err := json.NewDecoder(strings.NewReader(text[i:])).Decode(&obj); err == nil {
+			return obj, nil
+		}
+		next := strings.IndexByte(text[i+1:], '{')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	if strings.Contains(text, "{") {
+		return nil, errors.New("answer contains no valid JSON object")
+	}
+	return nil, errors.New("answer contains no JSON object")
+}
+
+// normalizeAnswer fixes the harmless ways models stray from the schema:
+// severity synonyms, a confidence given as a percentage and a single string
+// where a list is expected
+func normalizeAnswer(obj map[string]interface{}) {
+	if sev, ok := obj["severity"].(string); ok {
+		obj["severity"] = normalizeSeverity(sev)
+	}
+	switch c := obj["confidence"].(type) {
+	case float64:
+		if c > 1 && c <= 100 {
+			obj["confidence"] = c / 100
+		}
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(c), "%"), 64); err == nil {
+			if f > 1 && f <= 100 {
+				f /= 100
+			}
+			obj["confidence"] = f
+		}
+	}
+	for _, list := range []string{"rootCauses", "recommendedActions"} {
+		if str, ok := obj[list].(string); ok {
+			obj[list] = []interface{}{str}
+		}
+	}
+}
+
+// decodeAnalysis validates generated text against the schema, normalizing
+// it first, and decodes it into out
+func decodeAnalysis(text string, schema *jsonSchema, out interface{}) error {
+	obj, err := findJSONObject(text)
+	if err != nil {
+		return err
+	}
+	normalizeAnswer(obj)
+	if errs := schema.validate("", obj); len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+/* ---------------- PAST INCIDENTS ---------------- */
+
+// PastIncident is an analyzed event kept to find similar ones later, with
+// how it was resolved once that is known. Repeats of an unresolved incident
+// (same host, type and message once volatile fields are removed) are
+// folded into it instead of being kept apart.
+type PastIncident struct {
+	ID         string     `json:"id"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Type       string     `json:"type"`
+	Message    string     `json:"message"`
+	Host       string     `json:"source_host,omitempty"`
+	Severity   string     `json:"severity"`
+	Summary    string     `json:"summary,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Repeats    int        `json:"repeats,omitempty"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+	// Aliases are the IDs of the latest repeats, which resolve the
+	// incident too
+	Aliases []string `json:"aliases,omitempty"`
+
+	key string
+	sig minHash
+}
+
+// maxAliases bounds the repeat IDs an incident remembers
+const maxAliases = 20
+
+// MinHash signature size and LSH banding: 32 bands of 2 rows make events
+// with a Jaccard similarity of 0.3 candidates 95% of the time
+const (
+	minHashSize = 64
+	lshBands    = 32
+	lshRows     = minHashSize / lshBands
+)
+
+type minHash [minHashSize]uint64
+
+// incidentStore indexes past incidents by MinHash over word shingles of
+// their messages, with LSH buckets to find candidates without a full scan.
+// It keeps at most max incidents, the least recently seen dropped first,
+// and journals each change to its file.
+type incidentStore struct {
+	mu        sync.Mutex
+	max       int
+	incidents map[string]*PastIncident
+	order     []string // IDs, least recently seen first
+	buckets   map[uint64]map[string]bool
+	open      map[string]string // incident key to the unresolved incident
+	aliases   map[string]string // repeat ID to the incident it was folded into
+	journal   *fileutil.Journal
+}
+
+var errIncidentNotFound = errors.New("incident not found")
+
+// incidents is the store of AGENTS_INCIDENTS_PATH; similarThreshold and
+// similarResults bound what a similarity search returns
+// (AGENTS_SIMILAR_THRESHOLD, AGENTS_SIMILAR_RESULTS)
+var (
+	incidents        = newIncidents(5000)
+	similarThreshold = 0.3
+	similarResults   = 5
+
+	// historyResults is how many of the device's latest incidents a prompt
+	// gets (AGENTS_HISTORY_RESULTS)
+	historyResults = 5
+)
+
+func newIncidents(max int) *incidentStore {
+	return &incidentStore{
+		max: max, incidents: map[string]*PastIncident{}, buckets: map[uint64]map[string]bool{},
+		open: map[string]string{}, aliases: map[string]string{},
+	}
+}
+
+func newIncidentStore(path string, max int) (*incidentStore, error) {
+	s := newIncidents(max)
+
+	var err error
+	s.journal, err = fileutil.OpenJournal(path,
+		func(raw json.RawMessage) error {
+			var inc PastIncident
+			if err := json.Unmarshal(raw, &inc); err != nil {
+				return err
+			}
+			s.add(&inc)
+			return nil
+		},
+		func(id string) { s.remove(id) },
+		func() interface{} { return s.sorted() })
+	if err != nil {
+		return nil, err
+	}
+	if len(s.incidents) > 0 {
+		log.Printf("🗂️  Loaded %d past incidents from %s", len(s.incidents), path)
+	}
+	return s, nil
+}
+
+// incidentKey identifies repeats of an incident: the same host, type and
+// message once volatile fields are removed, as for the analysis cache
+func incidentKey(host, typ, message string) string {
+	return hashKey(strings.ToLower(host), strings.ToLower(typ), stableMessage(message))
+}
+
+// add indexes an incident as the most recently seen, replacing one with
+// the same ID, and returns the IDs of the oldest evicted beyond max;
+// callers must hold s.mu
+func (s *incidentStore) add(inc *PastIncident) []string {
+	if _, ok := s.incidents[inc.ID]; ok {
+		s.remove(inc.ID)
+	}
+	inc.key = incidentKey(inc.Host, inc.Type, inc.Message)
+	inc.sig = signature(inc.Message)
+	s.incidents[inc.ID] = inc
+	s.order = append(s.order, inc.ID)
+	for b := 0; b < lshBands; b++ {
+		key := bandKey(inc.sig, b)
+		if s.buckets[key] == nil {
+			s.buckets[key] = map[string]bool{}
+		}
+		s.buckets[key][inc.ID] = true
+	}
+	if inc.Resolution == "" {
+		s.open[inc.key] = inc.ID
+	}
+	for _, alias := range inc.Aliases {
+		s.aliases[alias] = inc.ID
+	}
+
+	var evicted []string
+	for s.max > 0 && len(s.order) > s.max {
+		evicted = append(evicted, s.order[0])
+		s.remove(s.order[0])
+	}
+	return evicted
+}
+
+// remove drops an incident from the store and its indexes; callers must
+// hold s.mu
+func (s *incidentStore) remove(id string) {
+	inc, ok := s.incidents[id]
+	if !ok {
+		return
+	}
+	for b := 0; b < lshBands; b++ {
+		key := bandKey(inc.sig, b)
+		delete(s.buckets[key], inc.ID)
+		if len(s.buckets[key]) == 0 {
+			delete(s.buckets, key)
+		}
+	}
+	if s.open[inc.key] == id {
+		delete(s.open, inc.key)
+	}
+	for _, alias := range inc.Aliases {
+		if s.aliases[alias] == id {
+			delete(s.aliases, alias)
+		}
+	}
+	delete(s.incidents, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// sorted returns all incidents, least recently seen first; callers must
+// hold s.mu
+func (s *incidentStore) sorted() []*PastIncident {
+	out := make([]*PastIncident, 0, len(s.order))
+	for _, id := range s.order {
+		out = append(out, s.incidents[id])
+	}
+	return out
+}
+
+// save indexes a new or changed incident and journals it along with the
+// incidents it evicted; callers must hold s.mu
+func (s *incidentStore) save(inc *PastIncident) error {
+	evicted := s.add(inc)
+	if s.journal == nil {
+		return nil
+	}
+	if err := s.journal.Put(inc); err != nil {
+		return err
+	}
+	for _, id := range evicted {
+		if err := s.journal.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repeated returns the unresolved incident an event repeats, if any;
+// callers must hold s.mu
+func (s *incidentStore) repeated(event Event) *PastIncident {
+	if id, ok := s.aliases[event.ID]; ok {
+		return s.incidents[id]
+	}
+	return s.incidents[s.open[incidentKey(event.Host, event.Type, event.Message)]]
+}
+
+// record keeps an analyzed event, which must have an ID, and returns the
+// ID of the incident it was kept as. Analyzing the same event again
+// updates it but keeps its resolution; a repeat of an unresolved incident
+// is counted in it.
+func (s *incidentStore) record(event Event, a models.Analysis) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inc := &PastIncident{
+		ID: event.ID, Timestamp: time.Now().UTC(), Type: event.Type, Message: event.Message,
+		Host: event.Host, Severity: a.Severity, Summary: a.Summary,
+	}
+	if old, ok := s.incidents[inc.ID]; ok {
+		inc.Timestamp, inc.Resolution, inc.ResolvedAt = old.Timestamp, old.Resolution, old.ResolvedAt
+		inc.Repeats, inc.LastSeen, inc.Aliases = old.Repeats, old.LastSeen, old.Aliases
+	} else if old := s.repeated(event); old != nil {
+		repeat := *old
+		repeat.Severity, repeat.Summary = a.Severity, a.Summary
+		repeat.Repeats++
+		now := time.Now().UTC()
+		repeat.LastSeen = &now
+		if s.aliases[event.ID] == "" {
+			repeat.Aliases = append(append([]string(nil), old.Aliases...), event.ID)
+			if len(repeat.Aliases) > maxAliases {
+				delete(s.aliases, repeat.Aliases[0])
+				repeat.Aliases = repeat.Aliases[1:]
+			}
+		}
+		inc = &repeat
+	}
+	if err := s.save(inc); err != nil {
+		log.Printf("⚠️  Failed to persist incident %s: %v", inc.ID, err)
+	}
+	return inc.ID
+}
+
+// resolve records how an incident, or one of its repeats, was resolved
+func (s *incidentStore) resolve(id, resolution string) (*PastIncident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if folded, ok := s.aliases[id]; ok {
+		id = folded
+	}
+	old, ok := s.incidents[id]
+	if !ok {
+		return nil, errIncidentNotFound
+	}
+	inc := *old
+	now := time.Now().UTC()
+	inc.Resolution, inc.ResolvedAt = resolution, &now
+	return &inc, s.save(&inc)
+}
+
+// load adds incidents from elsewhere, e.g. a ticketing system export
+func (s *incidentStore) load(list []*PastIncident) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, inc := range list {
+		if inc.ID == "" {
+			inc.ID = fileutil.NewID("evt")
+		}
+		if inc.Timestamp.IsZero() {
+			inc.Timestamp = time.Now().UTC()
+		}
+		if err := s.save(inc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// similar returns up to k past incidents whose messages are at least
+// similarThreshold similar to the event's, most similar first and resolved
+// ones before unresolved on ties, along with how many there were in all.
+// The event itself, or the unresolved incident it repeats, is left out.
+func (s *incidentStore) similar(event Event, k int) ([]models.SimilarIncident, int) {
+	sig := signature(event.Message)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := map[string]bool{event.ID: true}
+	if inc := s.repeated(event); inc != nil {
+		seen[inc.ID] = true
+	}
+	var out []models.SimilarIncident
+	for b := 0; b < lshBands; b++ {
+		for id := range s.buckets[bandKey(sig, b)] {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			inc := s.incidents[id]
+			sim := sig.similarity(inc.sig)
+			if sim < similarThreshold {
+				continue
+			}
+			out = append(out, models.SimilarIncident{
+				ID: inc.ID, Timestamp: inc.Timestamp, Message: inc.Message, Host: inc.Host,
+				Severity: inc.Severity, Resolution: inc.Resolution, Similarity: math.Round(sim*100) / 100,
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Similarity != b.Similarity {
+			return a.Similarity > b.Similarity
+		}
+		if (a.Resolution != "") != (b.Resolution != "") {
+			return a.Resolution != ""
+		}
+		return a.Timestamp.After(b.Timestamp)
+	})
+	total := len(out)
+	if len(out) > k {
+		out = out[:k]
+	}
+	return out, total
+}
+
+// history returns up to k of the latest past incidents on the event's
+// host, most recently seen first, leaving out the event itself and the
+// unresolved incident it repeats
+func (s *incidentStore) history(event Event, k int) []models.SimilarIncident {
+	if event.Host == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	skip := event.ID
+	if inc := s.repeated(event); inc != nil {
+		skip = inc.ID
+	}
+	var out []models.SimilarIncident
+	for i := len(s.order) - 1; i >= 0 && len(out) < k; i-- {
+		inc, ok := s.incidents[s.order[i]]
+		if !ok || inc.ID == event.ID || inc.ID == skip || !strings.EqualFold(inc.Host, event.Host) {
+			continue
+		}
+		out = append(out, models.SimilarIncident{
+			ID: inc.ID, Timestamp: inc.Timestamp, Message: inc.Message, Host: inc.Host,
+			Severity: inc.Severity, Resolution: inc.Resolution,
+		})
+	}
+	return out
+}
+
+/* ---------------- MINHASH ---------------- */
+
+// minHashSeeds are the multipliers and offsets of the hash functions,
+// fixed so signatures stay comparable across restarts
+var minHashSeeds = func() (seeds [minHashSize][2]uint64) {
+	x := uint64(0x9e3779b97f4a7c15)
+	next := func() uint64 { // splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		return z ^ (z >> 31)
+	}
+	for i := range seeds {
+		seeds[i] = [2]uint64{next() | 1, next()}
+	}
+	return seeds
+}()
+
+// signature is the MinHash of a message's shingles
+func signature(message string) minHash {
+	var sig minHash
+	for i := range sig {
+		sig[i] = math.MaxUint64
+	}
+	for _, sh := range shingles(message) {
+		h := fnv.New64a()
+		h.Write([]byte(sh))
+		x := h.Sum64()
+		for i, seed := range minHashSeeds {
+			if v := x*seed[0] + seed[1]; v < sig[i] {
+				sig[i] = v
+			}
+		}
+	}
+	return sig
+}
+
+// similarity estimates the Jaccard similarity of the two shingle sets
+func (m minHash) similarity(o minHash) float64 {
+	same := 0
+	for i := range m {
+		if m[i] == o[i] {
+			same++
+		}
+	}
+	return float64(same) / minHashSize
+}
+
+func bandKey(sig minHash, band int) uint64 {
+	h := fnv.New64a()
+	fmt.Fprint(h, band)
+	for _, v := range sig[band*lshRows : (band+1)*lshRows] {
+		fmt.Fprintf(h, ":%x", v)
+	}
+	return h.Sum64()
+}
+
+// shingles are the words and word pairs of a message. Digits are masked so
+// "Gi0/1 down" and "Gi0/2 down", or two addresses, look alike.
+func shingles(message string) []string {
+	words := strings.FieldsFunc(strings.ToLower(message), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var toks []string
+	for _, w := range words {
+		w = strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return '#'
+			}
+			return r
+		}, w)
+		for strings.Contains(w, "##") {
+			w = strings.ReplaceAll(w, "##", "#")
+		}
+		if !stopwords[w] {
+			toks = append(toks, w)
+		}
+	}
+	out := append([]string(nil), toks...)
+	for i := 1; i < len(toks); i++ {
+		out = append(out, toks[i-1]+" "+toks[i])
+	}
+	return out
+}
+
+/* ---------------- HANDLERS ---------------- */
+
+// getSimilarIncidents returns the past incidents similar to ?message=
+func getSimilarIncidents(c *gin.Context) {
+	event := Event{Type: c.Query("type"), Message: c.Query("message")}
+	if event.Message == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message is required"})
+		return
+	}
+	similar, total := incidents.similar(event, similarResults)
+	c.JSON(http.StatusOK, gin.H{"similarCount": total, "similarIncidents": similar})
+}
+
+// postIncidents loads past incidents, e.g. resolved tickets from before
+// the Agents API was deployed
+func postIncidents(c *gin.Context) {
+	var list []*PastIncident
+	if err := c.ShouldBindJSON(&list); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, inc := range list {
+		if strings.TrimSpace(inc.Message) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "every incident needs a message"})
+			return
+		}
+	}
+	if err := incidents.load(list); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"loaded": len(list)})
+}
+
+// postIncidentResolution records how an incident was resolved
+func postIncidentResolution(c *gin.Context) {
+	var req struct {
+		Resolution string `json:"resolution" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	inc, err := incidents.resolve(c.Param("id"), req.Resolution)
+	if errors.Is(err, errIncidentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, inc)
+}
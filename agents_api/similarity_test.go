@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// Similar past incidents are found, shown to the model and persisted
+func TestSimilarIncidents(t *testing.T) {
+	fake := agentsFixture(t)
+	path := filepath.Join(t.TempDir(), "incidents.json")
+	var err error
+	if incidents, err = newIncidentStore(path, 5); err != nil {
+		t.Fatal(err)
+	}
+	day := 24 * time.Hour
+	incidents.load([]*PastIncident{
+		{ID: "old-1", Timestamp: time.Now().Add(-3 * day), Message: "Interface Gi0/3 down", Severity: "high", Resolution: "Replaced the SFP"},
+		{ID: "old-2", Timestamp: time.Now().Add(-2 * day), Message: "Interface Gi0/12 down", Severity: "high"},
+		{ID: "old-3", Timestamp: time.Now().Add(-1 * day), Message: "CPU utilization 95% on core-sw1", Severity: "medium"},
+		{ID: "old-4", Timestamp: time.Now(), Message: "Interface Te1/0/1 line protocol down", Severity: "high"},
+	})
+	similar, total := incidents.similar(linkDown, 5)
+	if total != 2 || len(similar) != 2 || similar[0].ID != "old-1" || similar[0].Similarity != 1 {
+		t.Errorf("want 2 similar incidents, the resolved one first; got %d: %+v", total, similar)
+	}
+
+	useProvider(t, "openai")
+	res := DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/7 down", ID: "evt-new"})
+	if prompt := fake.lastPrompt(); !strings.Contains(prompt, "- Interface Gi0/3 down (high, ") || !strings.Contains(prompt, "Resolution: Replaced the SFP") {
+		t.Errorf("similar incidents not in the prompt:\n%s", prompt)
+	}
+	if res.SimilarCount != 2 || res.SimilarIncidents[0].Resolution != "Replaced the SFP" || res.IncidentID != "evt-new" {
+		t.Errorf("similar incidents not in the analysis: %+v", res)
+	}
+
+	useProvider(t, "rules")
+	res = DispatchEvent(context.Background(), Event{Type: "syslog", Message: "Interface Gi0/8 down"})
+	if actions := strings.Join(res.RecommendedActions, "|"); !strings.Contains(actions, "resolved by: Replaced the SFP") {
+		t.Errorf("rules answer does not pass on the past resolution: %s", actions)
+	}
+
+	if _, err := incidents.resolve("evt-new", "Reseated the cable"); err != nil {
+		t.Errorf("incident not resolved: %v", err)
+	}
+	if _, err := incidents.resolve("nope", "x"); !errors.Is(err, errIncidentNotFound) {
+		t.Errorf("unknown incident: got %v", err)
+	}
+
+	reloaded, err := newIncidentStore(path, 5)
+	if err != nil {
+		t.Fatal("incident store not reloaded: ", err)
+	}
+	inc := reloaded.incidents["evt-new"]
+	if _, kept := reloaded.incidents["old-1"]; len(reloaded.incidents) != 5 || kept || inc == nil || inc.Resolution != "Reseated the cable" {
+		t.Errorf("want 5 incidents persisted, the oldest evicted and the resolution kept; got %d", len(reloaded.incidents))
+	}
+}
+
+// Repeats of an unresolved incident, including cache hits, are counted in
+// it instead of filling the store and evicting resolved history
+func TestRepeatsFoldedIntoIncident(t *testing.T) {
+	agentsFixture(t)
+	path := filepath.Join(t.TempDir(), "incidents.json")
+	var err error
+	if incidents, err = newIncidentStore(path, 3); err != nil {
+		t.Fatal(err)
+	}
+	incidents.load([]*PastIncident{{ID: "old-1", Message: "Fan 1 failed", Host: "core-1", Severity: "high", Resolution: "Replaced the fan tray"}})
+	useProvider(t, "rules")
+	cache = newAnalysisCache(10, time.Hour)
+
+	first := DispatchEvent(context.Background(), Event{ID: "evt-1", Type: "syslog", Host: "core-1", Message: "Interface Gi0/1 down"})
+	var res models.Analysis
+	for i, msg := range repeats {
+		res = DispatchEvent(context.Background(), Event{ID: fmt.Sprintf("evt-%d", i+2), Type: "syslog", Host: "core-1", Message: msg})
+	}
+	if res.IncidentID != first.IncidentID || first.IncidentID != "evt-1" {
+		t.Errorf("repeat kept as %s, want evt-1", res.IncidentID)
+	}
+	for _, e := range []Event{
+		{ID: "evt-other-host", Type: "syslog", Host: "core-2", Message: "Interface Gi0/1 down"},
+		{ID: "evt-other-port", Type: "syslog", Host: "core-1", Message: "Interface Gi0/2 down"},
+	} {
+		if res := DispatchEvent(context.Background(), e); res.IncidentID != e.ID {
+			t.Errorf("%s folded into %s", e.ID, res.IncidentID)
+		}
+	}
+	if len(incidents.incidents) != 3 {
+		t.Errorf("%d incidents, want 3", len(incidents.incidents))
+	}
+
+	// A repeat resolves the incident it was folded into; the next
+	// occurrence is a new incident
+	if inc, err := incidents.resolve("evt-3", "Reseated the cable"); err != nil || inc.ID != "evt-1" {
+		t.Errorf("repeat did not resolve its incident: %+v %v", inc, err)
+	}
+	if res := DispatchEvent(context.Background(), Event{ID: "evt-again", Type: "syslog", Host: "core-1", Message: "Interface Gi0/1 down"}); res.IncidentID != "evt-again" {
+		t.Errorf("recurrence of a resolved incident folded into %s", res.IncidentID)
+	}
+
+	if _, err := os.Stat(path + ".log"); err != nil {
+		t.Errorf("changes not journaled: %v", err)
+	}
+	reloaded, err := newIncidentStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inc := reloaded.incidents["evt-1"]
+	if inc == nil || inc.Repeats != 3 || inc.LastSeen == nil || inc.Resolution != "Reseated the cable" || len(inc.Aliases) != 3 {
+		t.Fatalf("folded incident not persisted: %+v", inc)
+	}
+	if _, kept := reloaded.incidents["old-1"]; kept || len(reloaded.incidents) != 3 {
+		t.Errorf("want the least recently seen incident evicted, got %d incidents", len(reloaded.incidents))
+	}
+	if _, err := reloaded.resolve("evt-4", "Replaced the SFP"); err != nil {
+		t.Errorf("repeat ID not kept across a restart: %v", err)
+	}
+}
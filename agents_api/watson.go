@@ -2,43 +2,78 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"strings"
 	"sync"
 	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
 )
 
-/* ---------------- IAM TOKEN CACHE ---------------- */
+/* ---------------- WATSONX PROVIDER ---------------- */
+
+// watsonxProvider calls the watsonx.ai text generation API, authenticating
+// with an IBM Cloud API key exchanged for an IAM token
+type watsonxProvider struct {
+	settings  ProviderSettings
+	projectID string
+	iamURL    string
+	client    *http.Client
 
-var (
+	// IAM token cache
+	tokenMutex  sync.Mutex
 	iamToken    string
 	tokenExpiry time.Time
-	tokenMutex  sync.Mutex
-)
+}
+
+// newWatsonxProvider reads WATSONX_API_KEY and WATSONX_PROJECT_ID, plus
+// WATSONX_REGION for the default base URL and WATSONX_IAM_URL for the token
+// endpoint
+func newWatsonxProvider() (*watsonxProvider, error) {
+	region := config.GetEnv("WATSONX_REGION", "")
+	s := settingsFromEnv("WATSONX", ProviderSettings{
+		Model: "ibm/granite-3-8b-instruct", Temperature: 0.2, MaxTokens: defaultMaxTokens, Timeout: 20 * time.Second,
+	})
+	if s.BaseURL == "" && region != "" {
+		s.BaseURL = fmt.Sprintf("https://%s.ml.cloud.ibm.com", region)
+	}
+	p := &watsonxProvider{
+		settings:  s,
+		projectID: config.GetEnv("WATSONX_PROJECT_ID", ""),
+		iamURL:    config.GetEnv("WATSONX_IAM_URL", "https://iam.cloud.ibm.com"),
+		client:    &http.Client{Timeout: s.Timeout},
+	}
+	if s.APIKey == "" || s.BaseURL == "" || p.projectID == "" {
+		return nil, errors.New("Watsonx env vars missing: set WATSONX_API_KEY, WATSONX_PROJECT_ID and WATSONX_REGION (or WATSONX_BASE_URL)")
+	}
+	return p, nil
+}
+
+func (p *watsonxProvider) Name() string  { return "watsonx" }
+func (p *watsonxProvider) Model() string { return p.settings.Model }
 
 /* ---------------- GET IAM TOKEN ---------------- */
 
-func getIAMToken(apiKey string) (string, error) {
-	tokenMutex.Lock()
-	defer tokenMutex.Unlock()
+func (p *watsonxProvider) getIAMToken(ctx context.Context) (string, error) {
+	p.tokenMutex.Lock()
+	defer p.tokenMutex.Unlock()
 
-	if iamToken != "" && time.Now().Before(tokenExpiry) {
-		return iamToken, nil
+	if p.iamToken != "" && time.Now().Before(p.tokenExpiry) {
+		return p.iamToken, nil
 	}
 
 	data := url.Values{}
 	data.Set("grant_type", "urn:ibm:params:oauth:grant-type:apikey")
-	data.Set("apikey", apiKey)
+	data.Set("apikey", p.settings.APIKey)
 
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(ctx,
 		"POST",
-		"https://iam.cloud.ibm.com/identity/token",
+		p.iamURL+"/identity/token",
 		bytes.NewBufferString(data.Encode()),
 	)
 	if err != nil {
@@ -69,129 +104,43 @@ func getIAMToken(apiKey string) (string, error) {
 		return "", err
 	}
 
-	iamToken = tokenResp.AccessToken
-	tokenExpiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn-60) * time.Second)
-
-	return iamToken, nil
-}
-
-/* ---------------- JSON EXTRACTOR ---------------- */
+	p.iamToken = tokenResp.AccessToken
+	p.tokenExpiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn-60) * time.Second)
 
-func extractJSON(text string) string {
-	start := strings.Index(text, "{")
-	end := strings.LastIndex(text, "}")
-	if start == -1 || end == -1 || end <= start {
-		return ""
-	}
-	return text[start : end+1]
+	return p.iamToken, nil
 }
 
 /* ---------------- CALL WATSONX ---------------- */
 
-func CallWatsonAI(event Event) (UnifiedResponse, error) {
-	apiKey := os.Getenv("WATSONX_API_KEY")
-	region := os.Getenv("WATSONX_REGION")
-	projectID := os.Getenv("WATSONX_PROJECT_ID")
-
-	if apiKey == "" || region == "" || projectID == "" {
-		return UnifiedResponse{}, errors.New("Watsonx env vars missing")
-	}
-
-	token, err := getIAMToken(apiKey)
+func (p *watsonxProvider) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	token, err := p.getIAMToken(ctx)
 	if err != nil {
-		return UnifiedResponse{}, err
+		return "", err
 	}
 
-	endpoint := fmt.Sprintf(
-		"https://%s.ml.cloud.ibm.com/ml/v1/text/generation?version=2024-01-10",
-		region,
-	)
-
-	// ✅ REQUIRED PROMPT FORMAT (as per spec)
-	prompt := fmt.Sprintf(
-		`<System data>
-Event type: %s
-Event message: %s
-</System data>
-
-<Instructions>
-Use the system data to answer the question.
-Do NOT mention system data or how you derived the answer.
-Respond ONLY in valid JSON with fields:
-severity, explanation, recommended_action.
-</Instructions>
-
-<Question>
-What is the severity of the event and what action should be taken?
-</Question>`,
-		event.Type,
-		event.Message,
-	)
-
 	payload := map[string]interface{}{
-		"model_id":   "ibm/granite-3-8b-instruct",
-		"project_id": projectID,
-		"input":      prompt,
+		"model_id":   p.settings.Model,
+		"project_id": p.projectID,
+		"input":      req.Prompt,
 		"parameters": map[string]interface{}{
-			"temperature":    0.2,
-			"max_new_tokens": 200,
+			"temperature":    p.settings.Temperature,
+			"max_new_tokens": p.settings.MaxTokens,
 		},
 	}
 
-	body, _ := json.Marshal(payload)
-
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(body))
-	if err != nil {
-		return UnifiedResponse{}, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{Timeout: 20 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return UnifiedResponse{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return UnifiedResponse{}, fmt.Errorf("Watsonx failed %d: %s", resp.StatusCode, string(body))
-	}
-
 	var res struct {
 		Results []struct {
 			GeneratedText string `json:"generated_text"`
 		} `json:"results"`
 	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return UnifiedResponse{}, err
+	err = postJSON(ctx, p.client, p.settings.BaseURL+"/ml/v1/text/generation?version=2024-01-10",
+		map[string]string{"Authorization": "Bearer " + token}, payload, &res)
+	if err != nil {
+		return "", fmt.Errorf("Watsonx: %w", err)
 	}
 
 	if len(res.Results) == 0 {
-		return UnifiedResponse{}, errors.New("empty response from Watsonx")
+		return "", errors.New("empty response from Watsonx")
 	}
-
-	cleanJSON := extractJSON(res.Results[0].GeneratedText)
-	if cleanJSON == "" {
-		return UnifiedResponse{
-			Severity:          "unknown",
-			Explanation:       res.Results[0].GeneratedText,
-			RecommendedAction: "Manual review required",
-		}, nil
-	}
-
-	var ai UnifiedResponse
-	if err := json.Unmarshal([]byte(cleanJSON), &ai); err != nil {
-		return UnifiedResponse{
-			Severity:          "unknown",
-			Explanation:       cleanJSON,
-			RecommendedAction: "Manual review required",
-		}, nil
-	}
-
-	return ai, nil
+	return res.Results[0].GeneratedText, nil
 }
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -27,6 +34,10 @@ type Config struct {
 	JWTExpiryHours     int
 	RateLimitEnabled   bool
 	RateLimitRPM       int
+	AgentsAPIURL       string
+	// AgentsAnalysisWait is how long an analysis job is waited for in the
+	// background before the next request for the alert waits again
+	AgentsAnalysisWait time.Duration
 }
 
 func loadConfig() Config {
@@ -57,6 +68,16 @@ func loadConfig() Config {
 		jwtSecret = hex.EncodeToString(bytes)
 	}
 
+	agentsURL := os.Getenv("AGENTS_API_URL")
+	if agentsURL == "" {
+		agentsURL = "http://localhost:9000"
+	}
+
+	analysisWait, err := strconv.Atoi(os.Getenv("AGENTS_ANALYSIS_WAIT_SECONDS"))
+	if err != nil || analysisWait < 0 {
+		analysisWait = 30
+	}
+
 	return Config{
 		Port:               port,
 		GinMode:            ginMode,
@@ -65,6 +86,8 @@ func loadConfig() Config {
 		JWTExpiryHours:     24,
 		RateLimitEnabled:   os.Getenv("RATE_LIMIT_ENABLED") == "true",
 		RateLimitRPM:       100,
+		AgentsAPIURL:       strings.TrimRight(agentsURL, "/"),
+		AgentsAnalysisWait: time.Duration(analysisWait) * time.Second,
 	}
 }
 
@@ -96,6 +119,14 @@ type Alert struct {
 	AITitle    string        `json:"aiTitle"`
 	AISummary  string        `json:"aiSummary"`
 	Confidence int           `json:"confidence"`
+
+	// Correlation: incident alerts list their child events, and events
+	// correlated into an incident point at it
+	EventID       string   `json:"eventId,omitempty"`
+	Kind          string   `json:"kind,omitempty"`
+	IncidentID    string   `json:"incidentId,omitempty"`
+	RootEventID   string   `json:"rootEventId,omitempty"`
+	ChildEventIDs []string `json:"childEventIds,omitempty"`
 }
 
 type ExtendedDeviceInfo struct {
@@ -115,13 +146,24 @@ type AlertDetail struct {
 	RawData        string             `json:"rawData"`
 	History        []HistoryItem      `json:"history"`
 	ExtendedDevice ExtendedDeviceInfo `json:"extendedDevice"`
+	Parent         *Alert             `json:"parent,omitempty"`
+	Children       []Alert            `json:"children,omitempty"`
+	// AnalysisStatus is "pending" while the Agents API is still analyzing
+	// the alert; fetch the alert again for the analysis
+	AnalysisStatus string `json:"analysisStatus,omitempty"`
 }
 
+// AIAnalysis is decoded as is from the result of an Agents API job
 type AIAnalysis struct {
+	SchemaVersion      string   `json:"schemaVersion,omitempty"`
 	Summary            string   `json:"summary"`
 	RootCauses         []string `json:"rootCauses"`
 	BusinessImpact     string   `json:"businessImpact"`
 	RecommendedActions []string `json:"recommendedActions"`
+	Confidence         float64  `json:"confidence,omitempty"`
+	Source             string   `json:"source,omitempty"`
+	Model              string   `json:"model,omitempty"`
+	PromptVersion      string   `json:"promptVersion,omitempty"`
 }
 
 type HistoryItem struct {
@@ -291,6 +333,7 @@ type Ticket struct {
 	CreatedAt    string `json:"createdAt"`
 	UpdatedAt    string `json:"updatedAt"`
 	CreatedBy    string `json:"createdBy"`
+	Resolution   string `json:"resolution,omitempty"`
 }
 
 // Tickets store
@@ -327,6 +370,52 @@ var ticketsStore = []Ticket{
 
 var ticketCounter = 3
 
+// storeMu guards alertsStore, ticketsStore and ticketCounter. Handlers work
+// on copies and never hold it while calling another service.
+var storeMu sync.RWMutex
+
+// alertsSnapshot returns a copy of the alerts
+func alertsSnapshot() []Alert {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	alerts := make([]Alert, len(alertsStore))
+	copy(alerts, alertsStore)
+	return alerts
+}
+
+// findAlert returns a copy of the alert with the given ID
+func findAlert(id string) (Alert, bool) {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	for _, alert := range alertsStore {
+		if alert.ID == id {
+			return alert, true
+		}
+	}
+	return Alert{}, false
+}
+
+// findAlertByEventID returns a copy of the alert raised for an event
+func findAlertByEventID(eventID string) (Alert, bool) {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	if i := alertIndexByEventID(eventID); i >= 0 {
+		return alertsStore[i], true
+	}
+	return Alert{}, false
+}
+
+// alertIndexByEventID is the index in alertsStore of the alert raised for an
+// event, or -1; callers must hold storeMu
+func alertIndexByEventID(eventID string) int {
+	for i := range alertsStore {
+		if alertsStore[i].EventID == eventID {
+			return i
+		}
+	}
+	return -1
+}
+
 // ==========================================
 // JWT Helpers
 // ==========================================
@@ -509,52 +598,79 @@ func register(c *gin.Context) {
 // ==========================================
 
 func getAlerts(c *gin.Context) {
-	c.JSON(http.StatusOK, alertsStore)
+	c.JSON(http.StatusOK, alertsSnapshot())
 }
 
 func getAlertByID(c *gin.Context) {
-	id := c.Param("id")
-	for _, alert := range alertsStore {
-		if alert.ID == id {
-			detail := AlertDetail{
-				Alert:         alert,
-				SimilarEvents: 7,
-				AIAnalysis: AIAnalysis{
-					Summary:        "The network interface has transitioned to a down state while the administrative status remains up.",
-					RootCauses:     []string{"Physical layer failure detected", "Possible cable fault or SFP failure", "Remote device may be powered off"},
-					BusinessImpact: "High - Loss of redundancy to distribution layer.",
-					RecommendedActions: []string{
-						"Verify physical cable connection",
-						"Check remote device status",
-						"Review interface error counters",
-					},
-				},
-				RawData: `SNMP-v2-MIB::sysUpTime.0 = Timeticks: (123456789)
+	alert, ok := findAlert(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+		return
+	}
+	detail := AlertDetail{
+		Alert:         alert,
+		SimilarEvents: 7,
+		AIAnalysis: AIAnalysis{
+			Summary:        "The network interface has transitioned to a down state while the administrative status remains up.",
+			RootCauses:     []string{"Physical layer failure detected", "Possible cable fault or SFP failure", "Remote device may be powered off"},
+			BusinessImpact: "High - Loss of redundancy to distribution layer.",
+			RecommendedActions: []string{
+				"Verify physical cable connection",
+				"Check remote device status",
+				"Review interface error counters",
+			},
+		},
+		RawData: `SNMP-v2-MIB::sysUpTime.0 = Timeticks: (123456789)
 IF-MIB::ifOperStatus.24 = INTEGER: down(2)
 IF-MIB::ifAdminStatus.24 = INTEGER: up(1)`,
-				History: []HistoryItem{
-					{ID: "hist-001", Timestamp: "2024-03-13 09:13:33", Title: "Interface Down", Resolution: "Cable reseated", Severity: "critical"},
-				},
-				ExtendedDevice: ExtendedDeviceInfo{
-					Name:           alert.Device.Name,
-					IP:             alert.Device.IP,
-					Location:       "Data Center 1, Rack A12",
-					Vendor:         alert.Device.Vendor,
-					Model:          alert.Device.Model,
-					Interface:      "GigabitEthernet0/1",
-					InterfaceAlias: "Uplink to Distribution",
-				},
-			}
-			c.JSON(http.StatusOK, detail)
-			return
+		History: []HistoryItem{
+			{ID: "hist-001", Timestamp: "2024-03-13 09:13:33", Title: "Interface Down", Resolution: "Cable reseated", Severity: "critical"},
+		},
+		ExtendedDevice: ExtendedDeviceInfo{
+			Name:           alert.Device.Name,
+			IP:             alert.Device.IP,
+			Location:       "Data Center 1, Rack A12",
+			Vendor:         alert.Device.Vendor,
+			Model:          alert.Device.Model,
+			Interface:      "GigabitEthernet0/1",
+			InterfaceAlias: "Uplink to Distribution",
+		},
+	}
+	if analysis, err := analyzeAlert(alert); err == nil {
+		detail.AIAnalysis = analysis.AIAnalysis
+		detail.Confidence = int(math.Round(analysis.Confidence * 100))
+		detail.SimilarEvents = analysis.SimilarCount
+		detail.History = []HistoryItem{}
+		for _, s := range analysis.SimilarIncidents {
+			detail.History = append(detail.History, HistoryItem{
+				ID:         s.ID,
+				Timestamp:  s.Timestamp.Local().Format("2006-01-02 15:04:05"),
+				Title:      s.Message,
+				Resolution: s.Resolution,
+				Severity:   mapEventTypeToSeverity(s.Severity),
+			})
 		}
+	} else if errors.Is(err, errAnalysisPending) {
+		detail.AnalysisStatus = "pending"
+	} else {
+		log.Printf("⚠️  Agents API analysis for %s unavailable: %v", alert.ID, err)
 	}
-	c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+	if alert.IncidentID != "" {
+		if parent, ok := findAlertByEventID(alert.IncidentID); ok {
+			detail.Parent = &parent
+		}
+	}
+	for _, childID := range alert.ChildEventIDs {
+		if child, ok := findAlertByEventID(childID); ok {
+			detail.Children = append(detail.Children, child)
+		}
+	}
+	c.JSON(http.StatusOK, detail)
 }
 
 func getAlertsSummary(c *gin.Context) {
 	summary := AlertSummary{
-		ActiveCount:   len(alertsStore),
+		ActiveCount:   len(alertsSnapshot()),
 		CriticalCount: 1,
 		MajorCount:    1,
 		MinorCount:    0,
@@ -565,7 +681,7 @@ func getAlertsSummary(c *gin.Context) {
 
 func getSeverityDistribution(c *gin.Context) {
 	counts := make(map[string]int)
-	for _, alert := range alertsStore {
+	for _, alert := range alertsSnapshot() {
 		sev := strings.Title(alert.Severity)
 		counts[sev]++
 	}
@@ -591,7 +707,7 @@ func getNoisyDevices(c *gin.Context) {
 	deviceInfo := make(map[string]DeviceInfo)
 	deviceSeverity := make(map[string]string)
 
-	for _, alert := range alertsStore {
+	for _, alert := range alertsSnapshot() {
 		deviceCounts[alert.Device.Name]++
 		deviceInfo[alert.Device.Name] = alert.Device
 		if deviceSeverity[alert.Device.Name] == "" || alert.Severity == "critical" {
@@ -623,7 +739,7 @@ func getAIMetrics(c *gin.Context) {
 
 func getTrendsKPI(c *gin.Context) {
 	kpis := []TrendKPI{
-		{ID: "alert-volume", Label: "Alert Volume", Value: fmt.Sprintf("%d", len(alertsStore)), Trend: "stable"},
+		{ID: "alert-volume", Label: "Alert Volume", Value: fmt.Sprintf("%d", len(alertsSnapshot())), Trend: "stable"},
 		{ID: "mttr", Label: "MTTR", Value: "5m", Trend: "up"},
 		{ID: "recurring-alerts", Label: "Recurring Alerts", Value: "15%", Trend: "stable"},
 		{ID: "escalation-rate", Label: "Escalation Rate", Value: "0%", Trend: "stable", Tag: &Tag{Text: "Low", Type: "green"}},
@@ -635,14 +751,15 @@ func getRecurringAlerts(c *gin.Context) {
 	alertCounts := make(map[string]int)
 	alertSeverity := make(map[string]string)
 
-	for _, alert := range alertsStore {
+	snapshot := alertsSnapshot()
+	for _, alert := range snapshot {
 		alertCounts[alert.AITitle]++
 		if alertSeverity[alert.AITitle] == "" {
 			alertSeverity[alert.AITitle] = alert.Severity
 		}
 	}
 
-	total := len(alertsStore)
+	total := len(snapshot)
 	var alerts []RecurringAlert
 	i := 1
 	for title, count := range alertCounts {
@@ -705,6 +822,8 @@ func getHealth(c *gin.Context) {
 
 func acknowledgeAlert(c *gin.Context) {
 	id := c.Param("id")
+	storeMu.Lock()
+	defer storeMu.Unlock()
 	for i, alert := range alertsStore {
 		if alert.ID == id {
 			alertsStore[i].Status = "acknowledged"
@@ -718,6 +837,8 @@ func acknowledgeAlert(c *gin.Context) {
 
 func dismissAlert(c *gin.Context) {
 	id := c.Param("id")
+	storeMu.Lock()
+	defer storeMu.Unlock()
 	for i, alert := range alertsStore {
 		if alert.ID == id {
 			alertsStore[i].Status = "dismissed"
@@ -745,6 +866,7 @@ func createTicket(c *gin.Context) {
 
 	username := c.GetString("username")
 	now := time.Now()
+	storeMu.Lock()
 	ticketNumber := fmt.Sprintf("TKT-%s-%03d", now.Format("20060102"), ticketCounter)
 	ticketCounter++
 
@@ -764,16 +886,23 @@ func createTicket(c *gin.Context) {
 	}
 
 	ticketsStore = append(ticketsStore, newTicket)
+	storeMu.Unlock()
 	log.Printf("🎟️ Ticket %s created by %s", ticketNumber, username)
 	c.JSON(http.StatusCreated, newTicket)
 }
 
 func getTickets(c *gin.Context) {
-	c.JSON(http.StatusOK, ticketsStore)
+	storeMu.RLock()
+	tickets := make([]Ticket, len(ticketsStore))
+	copy(tickets, ticketsStore)
+	storeMu.RUnlock()
+	c.JSON(http.StatusOK, tickets)
 }
 
 func getTicketByID(c *gin.Context) {
 	id := c.Param("id")
+	storeMu.RLock()
+	defer storeMu.RUnlock()
 	for _, ticket := range ticketsStore {
 		if ticket.ID == id {
 			c.JSON(http.StatusOK, ticket)
@@ -791,37 +920,64 @@ func updateTicket(c *gin.Context) {
 		Priority    string `json:"priority"`
 		Status      string `json:"status"`
 		AssignedTo  string `json:"assignedTo"`
+		Resolution  string `json:"resolution"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	for i, ticket := range ticketsStore {
-		if ticket.ID == id {
-			if req.Title != "" {
-				ticketsStore[i].Title = req.Title
-			}
-			if req.Description != "" {
-				ticketsStore[i].Description = req.Description
-			}
-			if req.Priority != "" {
-				ticketsStore[i].Priority = req.Priority
-			}
-			if req.Status != "" {
-				ticketsStore[i].Status = req.Status
-			}
-			if req.AssignedTo != "" {
-				ticketsStore[i].AssignedTo = req.AssignedTo
-			}
-			ticketsStore[i].UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
-
-			log.Printf("🎟️ Ticket %s updated by %s", ticket.TicketNumber, c.GetString("username"))
-			c.JSON(http.StatusOK, ticketsStore[i])
-			return
+	storeMu.Lock()
+	i := -1
+	for j := range ticketsStore {
+		if ticketsStore[j].ID == id {
+			i = j
+			break
 		}
 	}
-	c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+	if i < 0 {
+		storeMu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+		return
+	}
+	before := ticketsStore[i]
+	if req.Title != "" {
+		ticketsStore[i].Title = req.Title
+	}
+	if req.Description != "" {
+		ticketsStore[i].Description = req.Description
+	}
+	if req.Priority != "" {
+		ticketsStore[i].Priority = req.Priority
+	}
+	if req.Status != "" {
+		ticketsStore[i].Status = req.Status
+	}
+	if req.AssignedTo != "" {
+		ticketsStore[i].AssignedTo = req.AssignedTo
+	}
+	if req.Resolution != "" {
+		ticketsStore[i].Resolution = req.Resolution
+	}
+	ticketsStore[i].UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+	ticket := ticketsStore[i]
+	var alert Alert
+	alertFound := false
+	for _, a := range alertsStore {
+		if a.ID == ticket.AlertID {
+			alert, alertFound = a, true
+			break
+		}
+	}
+	storeMu.Unlock()
+
+	// Closing a ticket teaches the Agents API how its alert was resolved
+	if alertFound && isClosedStatus(ticket.Status) && !isClosedStatus(before.Status) {
+		go reportResolution(analyzedIncidentID(alert), ticket)
+	}
+
+	log.Printf("🎟️ Ticket %s updated by %s", ticket.TicketNumber, c.GetString("username"))
+	c.JSON(http.StatusOK, ticket)
 }
 
 func exportReport(c *gin.Context) {
@@ -839,6 +995,17 @@ func ingestEvent(c *gin.Context) {
 		SourceIP   string `json:"source_ip"`
 		EventType  string `json:"event_type"`
 		Category   string `json:"category"`
+		EventID    string `json:"event_id"`
+		Kind       string `json:"kind"`
+		IncidentID string `json:"incident_id"`
+		// Labels are what the Event Router's lookup tables enriched the
+		// event with; the Agents API gives them to the model
+		Labels   map[string]string `json:"labels"`
+		Incident *struct {
+			Status      string   `json:"status"`
+			RootEventID string   `json:"root_event_id"`
+			EventIDs    []string `json:"event_ids"`
+		} `json:"incident"`
 	}
 
 	if err := c.ShouldBindJSON(&event); err != nil {
@@ -880,9 +1047,46 @@ func ingestEvent(c *gin.Context) {
 		AITitle:    event.Message,
 		AISummary:  "Event received: " + event.Message,
 		Confidence: 85,
+		EventID:    event.EventID,
+		Kind:       event.Kind,
+		IncidentID: event.IncidentID,
+	}
+	if event.EventID != "" {
+		newAlert.ID = "alert-" + event.EventID
+	}
+
+	storeMu.Lock()
+	if event.Kind == "incident" && event.Incident != nil {
+		newAlert.RootEventID = event.Incident.RootEventID
+		newAlert.ChildEventIDs = event.Incident.EventIDs
+		// Link children that arrived before the incident
+		for i := range alertsStore {
+			for _, id := range event.Incident.EventIDs {
+				if alertsStore[i].EventID == id {
+					alertsStore[i].IncidentID = event.EventID
+				}
+			}
+		}
+		// An incident update replaces the existing incident alert
+		if i := alertIndexByEventID(event.EventID); i >= 0 {
+			existing := alertsStore[i]
+			newAlert.ID = existing.ID
+			newAlert.Status = existing.Status
+			newAlert.Timestamp = existing.Timestamp
+			alertsStore[i] = newAlert
+			storeMu.Unlock()
+			rememberAlertEvent(newAlert.ID, agentsEvent{Type: event.EventType, Message: event.Message, Severity: event.Type,
+				SourceIP: event.SourceIP, Category: event.Category, Labels: event.Labels})
+			log.Printf("📨 Updated incident %s: %d events, root %s", event.EventID, len(newAlert.ChildEventIDs), newAlert.RootEventID)
+			c.JSON(http.StatusOK, gin.H{"status": "updated", "alert_id": newAlert.ID})
+			return
+		}
 	}
 
 	alertsStore = append([]Alert{newAlert}, alertsStore...)
+	storeMu.Unlock()
+	rememberAlertEvent(newAlert.ID, agentsEvent{Type: event.EventType, Message: event.Message, Severity: event.Type,
+		SourceIP: event.SourceIP, Category: event.Category, Labels: event.Labels})
 	log.Printf("📨 Ingested event: type=%s, device=%s, ip=%s", event.Type, deviceName, deviceIP)
 	c.JSON(http.StatusOK, gin.H{"status": "ingested", "alert_id": newAlert.ID})
 }
@@ -904,6 +1108,276 @@ func mapEventTypeToSeverity(eventType string) string {
 	}
 }
 
+// ==========================================
+// AI Analysis (Agents API)
+// ==========================================
+
+// agentsEvent is the request body of the Agents API's /jobs
+type agentsEvent struct {
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type"`
+	Message  string            `json:"message"`
+	Severity string            `json:"severity,omitempty"`
+	Host     string            `json:"source_host,omitempty"`
+	SourceIP string            `json:"source_ip,omitempty"`
+	Category string            `json:"category,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// agentsAnalysis is the result of an Agents API job: the analysis shown
+// with the alert, and the similar past incidents that become its history
+type agentsAnalysis struct {
+	AIAnalysis
+	// IncidentID is what the Agents API kept the event as: its own ID, or
+	// that of the unresolved incident it repeats
+	IncidentID       string `json:"incidentId"`
+	SimilarCount     int    `json:"similarCount"`
+	SimilarIncidents []struct {
+		ID         string    `json:"id"`
+		Timestamp  time.Time `json:"timestamp"`
+		Message    string    `json:"message"`
+		Severity   string    `json:"severity"`
+		Resolution string    `json:"resolution"`
+	} `json:"similarIncidents"`
+}
+
+var (
+	analysisMu sync.Mutex
+	// alertEvents keeps the event behind each ingested alert so it can be
+	// analyzed when the alert is first opened
+	alertEvents = map[string]agentsEvent{}
+	// analysisCache holds one analysis per alert; alerts do not change
+	// after ingestion, so neither does their analysis
+	analysisCache = map[string]agentsAnalysis{}
+	// analysisJobs is the Agents API job analyzing each alert, until it
+	// has finished
+	analysisJobs = map[string]string{}
+	// analysisPolls marks the alerts whose job is being waited for
+	analysisPolls = map[string]bool{}
+	// analysisErrors holds why an alert's last analysis failed, until the
+	// next request for the alert reports it
+	analysisErrors = map[string]error{}
+	// analysisGen counts the events recorded for each alert, so a job for an
+	// event that has since been replaced is not taken as the analysis
+	analysisGen = map[string]int{}
+
+	// analysisPollInterval is how often a running job is checked
+	analysisPollInterval = 250 * time.Millisecond
+
+	agentsClient = &http.Client{Timeout: 10 * time.Second}
+
+	errAnalysisPending = errors.New("analysis still running")
+)
+
+// agentsJob is an Agents API job, as /jobs and /jobs/{id} return it
+type agentsJob struct {
+	ID     string          `json:"id"`
+	Status string          `json:"status"`
+	Result *agentsAnalysis `json:"result"`
+	Error  string          `json:"error"`
+}
+
+func rememberAlertEvent(alertID string, event agentsEvent) {
+	analysisMu.Lock()
+	defer analysisMu.Unlock()
+	alertEvents[alertID] = event
+	analysisGen[alertID]++
+	delete(analysisCache, alertID)
+	delete(analysisJobs, alertID)
+	delete(analysisErrors, alertID)
+}
+
+// analyzeAlert returns the Agents API's analysis of an alert without
+// waiting for it. The model can take longer than a request should, so the
+// analysis runs as an Agents API job that is submitted and waited for in the
+// background: errAnalysisPending means it is still running and a later call
+// picks it up. A failure is returned to the next call, and the call after
+// that asks again.
+func analyzeAlert(alert Alert) (agentsAnalysis, error) {
+	analysisMu.Lock()
+	defer analysisMu.Unlock()
+	if cached, ok := analysisCache[alert.ID]; ok {
+		return cached, nil
+	}
+	if err, failed := analysisErrors[alert.ID]; failed {
+		delete(analysisErrors, alert.ID)
+		return agentsAnalysis{}, err
+	}
+	if !analysisPolls[alert.ID] {
+		analysisPolls[alert.ID] = true
+		go pollAnalysis(alert, alertEvents[alert.ID], analysisJobs[alert.ID], analysisGen[alert.ID])
+	}
+	return agentsAnalysis{}, errAnalysisPending
+}
+
+// pollAnalysis submits an alert's event for analysis unless jobID already
+// analyzes it, and waits for the job up to AgentsAnalysisWait. A job still
+// running then is kept for the next call to wait for. Alerts without a
+// recorded event (the seed data) are described from their title and
+// summary.
+func pollAnalysis(alert Alert, event agentsEvent, jobID string, gen int) {
+	analysis, jobID, err := runAnalysis(alert, event, jobID)
+
+	analysisMu.Lock()
+	defer analysisMu.Unlock()
+	delete(analysisPolls, alert.ID)
+	if analysisGen[alert.ID] != gen {
+		return
+	}
+	switch {
+	case errors.Is(err, errAnalysisPending):
+		analysisJobs[alert.ID] = jobID
+	case err != nil:
+		// Finished or lost: either way the next call starts afresh
+		delete(analysisJobs, alert.ID)
+		analysisErrors[alert.ID] = err
+	default:
+		delete(analysisJobs, alert.ID)
+		analysisCache[alert.ID] = analysis
+	}
+}
+
+// runAnalysis runs one round of pollAnalysis and returns the job it waited for
+func runAnalysis(alert Alert, event agentsEvent, jobID string) (agentsAnalysis, string, error) {
+	if jobID == "" {
+		if event.Message == "" {
+			event = agentsEvent{Message: alert.AITitle + ". " + alert.AISummary, Severity: mapSeverityToEventType(alert.Severity)}
+		}
+		if event.Type == "" {
+			event.Type = "alert"
+		}
+		event.ID, event.Host = alertIncidentID(alert), alert.Device.Name
+		job, err := submitAnalysis(event)
+		if err != nil {
+			return agentsAnalysis{}, "", err
+		}
+		jobID = job.ID
+	}
+
+	job, err := waitForAnalysis(jobID, config.AgentsAnalysisWait)
+	if err != nil {
+		return agentsAnalysis{}, jobID, err
+	}
+	if job.Status == "queued" || job.Status == "running" {
+		return agentsAnalysis{}, jobID, errAnalysisPending
+	}
+	if job.Status != "succeeded" || job.Result == nil {
+		return agentsAnalysis{}, jobID, fmt.Errorf("analysis job %s %s: %s", job.ID, job.Status, job.Error)
+	}
+	analysis := *job.Result
+	if !strings.HasPrefix(analysis.SchemaVersion, "analysis/v2") {
+		return agentsAnalysis{}, jobID, fmt.Errorf("unsupported analysis schema %q", analysis.SchemaVersion)
+	}
+	return analysis, jobID, nil
+}
+
+// submitAnalysis queues an event for analysis with POST /jobs
+func submitAnalysis(event agentsEvent) (agentsJob, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return agentsJob{}, err
+	}
+	resp, err := agentsClient.Post(config.AgentsAPIURL+"/jobs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return agentsJob{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return agentsJob{}, fmt.Errorf("agents api returned %s", resp.Status)
+	}
+	var job agentsJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return agentsJob{}, err
+	}
+	return job, nil
+}
+
+// waitForAnalysis polls GET /jobs/{id} until the job finishes or wait has
+// passed, and returns the job as last seen
+func waitForAnalysis(id string, wait time.Duration) (agentsJob, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		resp, err := agentsClient.Get(config.AgentsAPIURL + "/jobs/" + url.PathEscape(id))
+		if err != nil {
+			return agentsJob{}, err
+		}
+		var job agentsJob
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&job)
+		} else {
+			err = fmt.Errorf("agents api returned %s for job %s", resp.Status, id)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return agentsJob{}, err
+		}
+		if (job.Status != "queued" && job.Status != "running") || time.Now().After(deadline) {
+			return job, nil
+		}
+		time.Sleep(analysisPollInterval)
+	}
+}
+
+// alertIncidentID is the ID an alert's event is kept under by the Agents
+// API: its event ID, or the alert ID for alerts without one
+func alertIncidentID(alert Alert) string {
+	if alert.EventID != "" {
+		return alert.EventID
+	}
+	return alert.ID
+}
+
+// analyzedIncidentID is the incident an alert was kept as once it has been
+// analyzed, which for a repeat is the incident it repeats
+func analyzedIncidentID(alert Alert) string {
+	analysisMu.Lock()
+	analysis, ok := analysisCache[alert.ID]
+	analysisMu.Unlock()
+	if ok && analysis.IncidentID != "" {
+		return analysis.IncidentID
+	}
+	return alertIncidentID(alert)
+}
+
+func isClosedStatus(status string) bool {
+	return status == "resolved" || status == "closed"
+}
+
+// reportResolution sends a closed ticket's resolution to the Agents API,
+// where it is shown with similar incidents in the future
+func reportResolution(incidentID string, ticket Ticket) {
+	resolution := ticket.Resolution
+	if resolution == "" {
+		resolution = ticket.Description
+	}
+	if resolution == "" {
+		resolution = ticket.Title
+	}
+
+	body, _ := json.Marshal(map[string]string{"resolution": resolution})
+	resp, err := agentsClient.Post(config.AgentsAPIURL+"/incidents/"+url.PathEscape(incidentID)+"/resolution", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("⚠️  Failed to report resolution of %s: %v", ticket.TicketNumber, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("⚠️  Agents API rejected resolution of %s: %s", ticket.TicketNumber, resp.Status)
+	}
+}
+
+// mapSeverityToEventType reverses mapEventTypeToSeverity
+func mapSeverityToEventType(severity string) string {
+	switch severity {
+	case "major":
+		return "high"
+	case "minor":
+		return "medium"
+	default:
+		return severity
+	}
+}
+
 // ==========================================
 // Main
 // ==========================================
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeAgents stands in for the Agents API. Jobs run until finish is
+// called; failSubmit makes POST /jobs fail.
+type fakeAgents struct {
+	mu          sync.Mutex
+	release     chan struct{}
+	once        sync.Once
+	failSubmit  bool
+	submitted   []agentsEvent
+	resolutions map[string]string
+}
+
+func (f *fakeAgents) finish() {
+	f.once.Do(func() { close(f.release) })
+}
+
+func (f *fakeAgents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/jobs":
+		if f.failSubmit {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		var evt agentsEvent
+		json.NewDecoder(r.Body).Decode(&evt)
+		f.submitted = append(f.submitted, evt)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(agentsJob{ID: fmt.Sprintf("job-%d", len(f.submitted)), Status: "queued"})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/jobs/"):
+		job := agentsJob{ID: strings.TrimPrefix(r.URL.Path, "/jobs/"), Status: "running"}
+		select {
+		case <-f.release:
+			job.Status = "succeeded"
+			job.Result = &agentsAnalysis{
+				AIAnalysis: AIAnalysis{SchemaVersion: "analysis/v2.1", Summary: "Uplink lost", Confidence: 0.9},
+				IncidentID: "inc-earlier",
+			}
+		default:
+		}
+		json.NewEncoder(w).Encode(job)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/incidents/"):
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		f.resolutions[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/incidents/"), "/resolution")] = body["resolution"]
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// gatewayFixture serves the alert and ticket handlers against a fake Agents
+// API and restores the stores afterwards
+func gatewayFixture(t *testing.T) (*gin.Engine, *fakeAgents) {
+	t.Helper()
+	agents := &fakeAgents{release: make(chan struct{}), resolutions: map[string]string{}}
+	srv := httptest.NewServer(agents)
+	t.Cleanup(srv.Close)
+
+	prevAlerts, prevTickets, prevCounter, prevConfig, prevInterval := alertsStore, ticketsStore, ticketCounter, config, analysisPollInterval
+	alertsStore, ticketsStore = alertsSnapshot(), append([]Ticket(nil), ticketsStore...)
+	config = Config{AgentsAPIURL: srv.URL, AgentsAnalysisWait: 2 * time.Second}
+	analysisPollInterval = 5 * time.Millisecond
+	t.Cleanup(func() {
+		// Let the analyses still being waited for finish before the config goes
+		agents.finish()
+		waitFor(func() bool {
+			analysisMu.Lock()
+			defer analysisMu.Unlock()
+			return len(analysisPolls) == 0
+		})
+		storeMu.Lock()
+		alertsStore, ticketsStore, ticketCounter = prevAlerts, prevTickets, prevCounter
+		storeMu.Unlock()
+		config, analysisPollInterval = prevConfig, prevInterval
+		analysisMu.Lock()
+		alertEvents, analysisCache, analysisJobs = map[string]agentsEvent{}, map[string]agentsAnalysis{}, map[string]string{}
+		analysisPolls, analysisErrors, analysisGen = map[string]bool{}, map[string]error{}, map[string]int{}
+		analysisMu.Unlock()
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/events", ingestEvent)
+	r.GET("/alerts", getAlerts)
+	r.GET("/alerts/:id", getAlertByID)
+	r.POST("/alerts/:id/acknowledge", acknowledgeAlert)
+	r.GET("/tickets", getTickets)
+	r.POST("/tickets", createTicket)
+	r.PUT("/tickets/:id", updateTicket)
+	return r, agents
+}
+
+func request(r *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func alertDetail(t *testing.T, r *gin.Engine, id string) AlertDetail {
+	t.Helper()
+	w := request(r, "GET", "/alerts/"+id, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("get %s = %d %s", id, w.Code, w.Body)
+	}
+	var detail AlertDetail
+	if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil {
+		t.Fatal(err)
+	}
+	return detail
+}
+
+// waitFor polls cond for up to two seconds
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// Opening an alert answers at once while its analysis runs, and shows the
+// analysis once the job has finished
+func TestAlertAnalysisDoesNotBlock(t *testing.T) {
+	r, agents := gatewayFixture(t)
+	request(r, "POST", "/events", `{"type": "critical", "message": "Interface Gi0/1 down", "source_host": "core-sw-01", "event_id": "evt-1"}`)
+
+	start := time.Now()
+	detail := alertDetail(t, r, "alert-evt-1")
+	if took := time.Since(start); took > config.AgentsAnalysisWait/2 {
+		t.Errorf("opening the alert took %s", took)
+	}
+	if detail.AnalysisStatus != "pending" {
+		t.Errorf("analysis status = %q, want pending", detail.AnalysisStatus)
+	}
+	// Further requests wait for the same job
+	alertDetail(t, r, "alert-evt-1")
+
+	agents.finish()
+	if !waitFor(func() bool { return alertDetail(t, r, "alert-evt-1").AnalysisStatus == "" }) {
+		t.Fatal("analysis never arrived")
+	}
+	detail = alertDetail(t, r, "alert-evt-1")
+	if detail.AIAnalysis.Summary != "Uplink lost" || detail.Confidence != 90 {
+		t.Errorf("analysis = %+v confidence %d, want the job's", detail.AIAnalysis, detail.Confidence)
+	}
+	agents.mu.Lock()
+	defer agents.mu.Unlock()
+	if len(agents.submitted) != 1 || agents.submitted[0].ID != "evt-1" || agents.submitted[0].Host != "core-sw-01" {
+		t.Errorf("submitted %+v, want one job for evt-1", agents.submitted)
+	}
+}
+
+// A failed analysis is reported once, with the built-in description, and
+// asked for again on the next request
+func TestAlertAnalysisFailureFallsBack(t *testing.T) {
+	r, agents := gatewayFixture(t)
+	agents.failSubmit = true
+
+	if detail := alertDetail(t, r, "alert-001"); detail.AnalysisStatus != "pending" {
+		t.Fatalf("analysis status = %q, want pending", detail.AnalysisStatus)
+	}
+	var detail AlertDetail
+	if !waitFor(func() bool { detail = alertDetail(t, r, "alert-001"); return detail.AnalysisStatus == "" }) {
+		t.Fatal("failure never reported")
+	}
+	if !strings.Contains(detail.AIAnalysis.Summary, "network interface") {
+		t.Errorf("summary = %q, want the built-in description", detail.AIAnalysis.Summary)
+	}
+
+	agents.mu.Lock()
+	agents.failSubmit = false
+	agents.mu.Unlock()
+	agents.finish()
+	if !waitFor(func() bool { return alertDetail(t, r, "alert-001").AIAnalysis.Summary == "Uplink lost" }) {
+		t.Error("analysis not asked for again after the failure")
+	}
+}
+
+// Alerts found by event ID are copies: changing one leaves the store alone
+func TestAlertLookupsReturnCopies(t *testing.T) {
+	r, _ := gatewayFixture(t)
+	request(r, "POST", "/events", `{"type": "high", "message": "BGP down", "source_host": "edge-1", "event_id": "evt-child"}`)
+	request(r, "POST", "/events", `{"type": "critical", "kind": "incident", "message": "Site down", "source_host": "edge-1", "event_id": "inc-1",
+	  "incident": {"status": "opened", "root_event_id": "evt-child", "event_ids": ["evt-child"]}}`)
+
+	child, ok := findAlertByEventID("evt-child")
+	if !ok || child.IncidentID != "inc-1" {
+		t.Fatalf("child = %+v, want it linked to inc-1", child)
+	}
+	child.Status = "tampered"
+	if again, _ := findAlertByEventID("evt-child"); again.Status != "new" {
+		t.Errorf("changing a found alert changed the store: %q", again.Status)
+	}
+
+	detail := alertDetail(t, r, "alert-inc-1")
+	if len(detail.Children) != 1 || detail.Children[0].EventID != "evt-child" {
+		t.Errorf("children = %+v, want evt-child", detail.Children)
+	}
+	if detail := alertDetail(t, r, "alert-evt-child"); detail.Parent == nil || detail.Parent.EventID != "inc-1" {
+		t.Errorf("parent = %+v, want inc-1", detail.Parent)
+	}
+
+	// An incident update replaces the alert in place
+	request(r, "POST", "/events", `{"type": "critical", "kind": "incident", "message": "Site down, 2 events", "source_host": "edge-1", "event_id": "inc-1",
+	  "incident": {"status": "updated", "root_event_id": "evt-child", "event_ids": ["evt-child", "evt-2"]}}`)
+	if incident, _ := findAlert("alert-inc-1"); incident.AITitle != "Site down, 2 events" || len(incident.ChildEventIDs) != 2 {
+		t.Errorf("updated incident = %+v", incident)
+	}
+	if n := len(alertsSnapshot()); n != 4 {
+		t.Errorf("%d alerts, want the 2 seeded and 2 ingested", n)
+	}
+}
+
+// Closing a ticket reports its resolution once, for the incident its alert
+// was analyzed as
+func TestClosingTicketReportsResolution(t *testing.T) {
+	r, agents := gatewayFixture(t)
+	agents.finish()
+	if !waitFor(func() bool { return alertDetail(t, r, "alert-001").AnalysisStatus == "" }) {
+		t.Fatal("analysis never arrived")
+	}
+
+	w := request(r, "PUT", "/tickets/ticket-001", `{"status": "resolved", "resolution": "Replaced the SFP"}`)
+	var ticket Ticket
+	json.Unmarshal(w.Body.Bytes(), &ticket)
+	if w.Code != http.StatusOK || ticket.Status != "resolved" || ticket.Resolution != "Replaced the SFP" {
+		t.Fatalf("update = %d %+v", w.Code, ticket)
+	}
+	reported := func() string {
+		agents.mu.Lock()
+		defer agents.mu.Unlock()
+		return agents.resolutions["inc-earlier"]
+	}
+	if !waitFor(func() bool { return reported() != "" }) || reported() != "Replaced the SFP" {
+		t.Errorf("resolutions = %v, want the SFP for inc-earlier", agents.resolutions)
+	}
+
+	request(r, "PUT", "/tickets/ticket-001", `{"status": "closed", "resolution": "Changed my mind"}`)
+	time.Sleep(20 * time.Millisecond)
+	if got := reported(); got != "Replaced the SFP" {
+		t.Errorf("closing a resolved ticket reported %q again", got)
+	}
+	if w := request(r, "PUT", "/tickets/ticket-404", `{"status": "closed"}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown ticket = %d, want 404", w.Code)
+	}
+}
+
+// Handlers share the stores; run with -race to check them
+func TestConcurrentAlertsAndTickets(t *testing.T) {
+	r, agents := gatewayFixture(t)
+	agents.finish()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				id := fmt.Sprintf("evt-%d-%d", i, j)
+				request(r, "POST", "/events", `{"type": "high", "message": "link down", "source_host": "sw", "event_id": "`+id+`"}`)
+				request(r, "GET", "/alerts/alert-"+id, "")
+				request(r, "GET", "/alerts", "")
+				request(r, "POST", "/alerts/alert-001/acknowledge", "")
+				request(r, "POST", "/tickets", `{"title": "t", "alertId": "alert-`+id+`"}`)
+				request(r, "PUT", "/tickets/ticket-002", `{"status": "in-progress"}`)
+				request(r, "GET", "/tickets", "")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(alertsSnapshot()); n != 2+8*20 {
+		t.Errorf("%d alerts, want %d", n, 2+8*20)
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	numbers := map[string]bool{}
+	for _, tk := range ticketsStore {
+		numbers[tk.TicketNumber] = true
+	}
+	if len(numbers) != 2+8*20 {
+		t.Errorf("%d distinct ticket numbers, want %d", len(numbers), 2+8*20)
+	}
+}
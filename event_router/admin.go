@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+)
+
+/* ---------------- AUTH ---------------- */
+
+// adminToken is a bearer token and the actor recorded in the audit trail
+// for it
+type adminToken struct {
+	token, actor string
+}
+
+// adminTokens reads the admin tokens. EVENT_ROUTER_ADMIN_TOKENS holds
+// "name:token" pairs separated by commas; EVENT_ROUTER_ADMIN_TOKEN is a
+// single token for the actor "admin".
+func adminTokens() []adminToken {
+	var tokens []adminToken
+	if t := config.GetEnv("EVENT_ROUTER_ADMIN_TOKEN", ""); t != "" {
+		tokens = append(tokens, adminToken{t, "admin"})
+	}
+	for _, pair := range strings.Split(config.GetEnv("EVENT_ROUTER_ADMIN_TOKENS", ""), ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && name != "" && token != "" {
+			tokens = append(tokens, adminToken{token, name})
+		}
+	}
+	return tokens
+}
+
+// matchToken returns the actor of a presented token. Every configured token
+// is compared in constant time, so the time taken says nothing about how
+// much of a token was right or which one it resembled.
+func matchToken(tokens []adminToken, presented string) (string, bool) {
+	actor, found := "", false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.token), []byte(presented)) == 1 && !found {
+			actor, found = t.actor, true
+		}
+	}
+	return actor, found
+}
+
+// adminAuth protects the admin endpoints with static bearer tokens and
+// stores the caller's name as "actor". With no tokens configured the admin
+// API is disabled.
+func adminAuth() gin.HandlerFunc {
+	tokens := adminTokens()
+	return func(c *gin.Context) {
+		if len(tokens) == 0 {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "admin API disabled: EVENT_ROUTER_ADMIN_TOKEN(S) not set"})
+			return
+		}
+		actor, ok := matchToken(tokens, strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing admin token"})
+			return
+		}
+		c.Set("actor", actor)
+		c.Next()
+	}
+}
+
+// singleReplica rejects changes to state kept in the named file when the
+// router is clustered. The admin API only changes the replica it reaches,
+// which would leave replicas handling the same event differently; clustered
+// deployments change the file on every replica instead, which each reloads.
+func singleReplica(file string) gin.HandlerFunc {
+	msg := fmt.Sprintf("%s changes through the admin API are disabled while clustered; change the %s file on every replica instead", file, file)
+	return func(c *gin.Context) {
+		if peers != nil {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": msg})
+			return
+		}
+		c.Next()
+	}
+}
+
+/* ---------------- AUDIT TRAIL ---------------- */
+
+// auditEntry records one change to the router's runtime state
+type auditEntry struct {
+	At      time.Time   `json:"at"`
+	Actor   string      `json:"actor"`
+	Action  string      `json:"action"` // create, update, delete, reload
+	Kind    string      `json:"kind"`   // route, destination, config
+	Name    string      `json:"name"`
+	Version int         `json:"version,omitempty"`
+	Before  interface{} `json:"before,omitempty"`
+	After   interface{} `json:"after,omitempty"`
+}
+
+// auditTrail appends entries to a JSON-lines file
+type auditTrail struct {
+	mu   sync.Mutex
+	path string
+}
+
+var auditLog = &auditTrail{path: config.GetEnv("EVENT_ROUTER_AUDIT_PATH", "audit.jsonl")}
+
+func (a *auditTrail) record(e auditEntry) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Audit: failed to encode entry: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Audit: failed to open %s: %v", a.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Audit: failed to write %s: %v", a.path, err)
+	}
+}
+
+// recent returns up to limit entries, newest first, optionally for one kind
+func (a *auditTrail) recent(limit int, kind string) ([]auditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := []auditEntry{}
+	f, err := os.Open(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if kind == "" || e.Kind == kind {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func getAuditTrail(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	entries, err := auditLog.recent(limit, c.Query("kind"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"count": len(entries), "entries": entries})
+}
+
+/* ---------------- CONFIG API ---------------- */
+
+// expectedVersion reads the If-Match header that every change must carry
+func expectedVersion(c *gin.Context) (int, bool) {
+	raw := strings.Trim(c.GetHeader("If-Match"), `"`)
+	if raw == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{
+			"error":   "If-Match header with the current config version is required",
+			"version": configs.current().Version,
+		})
+		return 0, false
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "If-Match must be a config version number"})
+		return 0, false
+	}
+	return v, true
+}
+
+// applyChange runs a config mutation and writes the HTTP response and audit
+// entry. The action "put" is recorded as a create (201) or an update (200),
+// whichever it was against the config the change was applied to.
+func applyChange(c *gin.Context, action, kind, name string, status int, fn func(*RouterConfig) error, snapshot func(*RouterConfig) interface{}) {
+	version, ok := expectedVersion(c)
+	if !ok {
+		return
+	}
+
+	before, after, err := configs.update(version, fn)
+	if err != nil {
+		code := http.StatusBadRequest
+		var nf *notFoundError
+		switch {
+		case errors.Is(err, errVersionConflict):
+			code = http.StatusConflict
+		case errors.As(err, &nf):
+			code = http.StatusNotFound
+		case errors.Is(err, errPersist):
+			code = http.StatusInternalServerError
+		}
+		c.JSON(code, gin.H{"error": err.Error(), "version": configs.current().Version})
+		return
+	}
+	if action == "put" {
+		action, status = "update", http.StatusOK
+		if snapshot(before) == nil {
+			action, status = "create", http.StatusCreated
+		}
+	}
+
+	auditLog.record(auditEntry{
+		Actor:   c.GetString("actor"),
+		Action:  action,
+		Kind:    kind,
+		Name:    name,
+		Version: after.Version,
+		Before:  snapshot(before),
+		After:   snapshot(after),
+	})
+	log.Printf("Config %s %s %q by %s (version %d)", action, kind, name, c.GetString("actor"), after.Version)
+
+	c.Header("ETag", strconv.Itoa(after.Version))
+	body := snapshot(after)
+	if body == nil {
+		body = gin.H{"status": "deleted", "name": name}
+	}
+	c.JSON(status, gin.H{"version": after.Version, kind: body})
+}
+
+type notFoundError struct{ kind, name string }
+
+func (e *notFoundError) Error() string { return fmt.Sprintf("%s %q not found", e.kind, e.name) }
+
+func findRoute(cfg *RouterConfig, name string) int {
+	for i, r := range cfg.Routes {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func routeSnapshot(name string) func(*RouterConfig) interface{} {
+	return func(cfg *RouterConfig) interface{} {
+		if i := findRoute(cfg, name); i >= 0 {
+			return cfg.Routes[i].redacted(cfg.Destinations)
+		}
+		return nil
+	}
+}
+
+func destinationSnapshot(name string) func(*RouterConfig) interface{} {
+	return func(cfg *RouterConfig) interface{} {
+		if d, ok := cfg.Destinations[name]; ok {
+			return d.redacted()
+		}
+		return nil
+	}
+}
+
+func getConfig(c *gin.Context) {
+	cfg := configs.current()
+	c.Header("ETag", strconv.Itoa(cfg.Version))
+	c.JSON(http.StatusOK, cfg.redacted())
+}
+
+func listRoutes(c *gin.Context) {
+	cfg := configs.current()
+	c.Header("ETag", strconv.Itoa(cfg.Version))
+	c.JSON(http.StatusOK, gin.H{"version": cfg.Version, "routes": cfg.redacted().Routes})
+}
+
+func getRoute(c *gin.Context) {
+	cfg := configs.current()
+	i := findRoute(cfg, c.Param("name"))
+	if i < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": (&notFoundError{"route", c.Param("name")}).Error()})
+		return
+	}
+	c.Header("ETag", strconv.Itoa(cfg.Version))
+	c.JSON(http.StatusOK, gin.H{"version": cfg.Version, "route": cfg.Routes[i].redacted(cfg.Destinations)})
+}
+
+// createRoute adds a route; ?position=N inserts it at index N instead of appending
+func createRoute(c *gin.Context) {
+	var route Route
+	if err := c.ShouldBindJSON(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if route.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "route name is required"})
+		return
+	}
+	position := -1
+	if p := c.Query("position"); p != "" {
+		var err error
+		if position, err = strconv.Atoi(p); err != nil || position < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "position must be a non-negative integer"})
+			return
+		}
+	}
+
+	applyChange(c, "create", "route", route.Name, http.StatusCreated, func(cfg *RouterConfig) error {
+		if findRoute(cfg, route.Name) >= 0 {
+			return fmt.Errorf("route %q already exists", route.Name)
+		}
+		r := route
+		if position < 0 || position >= len(cfg.Routes) {
+			cfg.Routes = append(cfg.Routes, &r)
+		} else {
+			cfg.Routes = append(cfg.Routes[:position], append([]*Route{&r}, cfg.Routes[position:]...)...)
+		}
+		return nil
+	}, routeSnapshot(route.Name))
+}
+
+func updateRoute(c *gin.Context) {
+	name := c.Param("name")
+	var route Route
+	if err := c.ShouldBindJSON(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	route.Name = name
+
+	applyChange(c, "update", "route", name, http.StatusOK, func(cfg *RouterConfig) error {
+		i := findRoute(cfg, name)
+		if i < 0 {
+			return &notFoundError{"route", name}
+		}
+		r := route
+		cfg.Routes[i] = &r
+		return nil
+	}, routeSnapshot(name))
+}
+
+func deleteRoute(c *gin.Context) {
+	name := c.Param("name")
+	applyChange(c, "delete", "route", name, http.StatusOK, func(cfg *RouterConfig) error {
+		i := findRoute(cfg, name)
+		if i < 0 {
+			return &notFoundError{"route", name}
+		}
+		cfg.Routes = append(cfg.Routes[:i], cfg.Routes[i+1:]...)
+		return nil
+	}, routeSnapshot(name))
+}
+
+func listDestinations(c *gin.Context) {
+	cfg := configs.current()
+	c.Header("ETag", strconv.Itoa(cfg.Version))
+	c.JSON(http.StatusOK, gin.H{"version": cfg.Version, "destinations": redactedDestinations(cfg.Destinations)})
+}
+
+func getDestination(c *gin.Context) {
+	cfg := configs.current()
+	d, ok := cfg.Destinations[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": (&notFoundError{"destination", c.Param("name")}).Error()})
+		return
+	}
+	c.Header("ETag", strconv.Itoa(cfg.Version))
+	c.JSON(http.StatusOK, gin.H{"version": cfg.Version, "destination": d.redacted()})
+}
+
+// putDestination creates or replaces a destination. Secrets sent back as
+// returned by the API, i.e. redacted, keep their current values.
+func putDestination(c *gin.Context) {
+	name := c.Param("name")
+	var dest Destination
+	if err := c.ShouldBindJSON(&dest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	applyChange(c, "put", "destination", name, http.StatusOK, func(cfg *RouterConfig) error {
+		d := dest
+		d.restoreSecrets(cfg.Destinations[name])
+		cfg.Destinations[name] = &d
+		return nil
+	}, destinationSnapshot(name))
+}
+
+// deleteDestination removes a destination; it fails while a route still uses it
+func deleteDestination(c *gin.Context) {
+	name := c.Param("name")
+	applyChange(c, "delete", "destination", name, http.StatusOK, func(cfg *RouterConfig) error {
+		if _, ok := cfg.Destinations[name]; !ok {
+			return &notFoundError{"destination", name}
+		}
+		delete(cfg.Destinations, name)
+		return nil
+	}, destinationSnapshot(name))
+}
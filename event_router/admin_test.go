@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminConfig has a PagerDuty destination whose routing key a route
+// template also spells out
+const adminConfig = `{
+  "destinations": {
+    "pager": {"type": "pagerduty", "url": "https://events.pagerduty.example/v2/enqueue", "routing_key": "R0UT1NGKEY"}
+  },
+  "routes": [{"name": "critical", "match": {"types": ["critical"]},
+    "destinations": [{"destination": "pager", "template": "{\"routing_key\": \"R0UT1NGKEY\", \"summary\": {{json .Message}}}"}]}]
+}`
+
+// adminServer serves the config admin API behind adminAuth, with the
+// tokens of alice and bob
+func adminServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	t.Setenv("EVENT_ROUTER_ADMIN_TOKEN", "")
+	t.Setenv("EVENT_ROUTER_ADMIN_TOKENS", "alice:tok-alice, bob:tok-bob")
+	routingFixture(t, adminConfig)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	admin := r.Group("/admin", adminAuth())
+	admin.GET("/routes", listRoutes)
+	admin.GET("/routes/:name", getRoute)
+	admin.PUT("/routes/:name", updateRoute)
+	admin.GET("/destinations/:name", getDestination)
+	admin.PUT("/destinations/:name", putDestination)
+	admin.GET("/audit", getAuditTrail)
+	return r
+}
+
+// call sends a request with a bearer token and, unless empty, If-Match
+func call(r *gin.Engine, method, path, token, ifMatch, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	r := adminServer(t)
+	for token, want := range map[string]int{"": 401, "tok-alic": 401, "tok-alice-and-more": 401, "tok-bob": 200} {
+		if w := call(r, "GET", "/admin/routes", token, "", ""); w.Code != want {
+			t.Errorf("token %q: %d, want %d", token, w.Code, want)
+		}
+	}
+	tokens := adminTokens()
+	if actor, ok := matchToken(tokens, "tok-alice"); !ok || actor != "alice" {
+		t.Errorf("tok-alice = %q, %v, want alice", actor, ok)
+	}
+
+	t.Setenv("EVENT_ROUTER_ADMIN_TOKENS", "")
+	disabled := gin.New()
+	disabled.GET("/admin/routes", adminAuth(), listRoutes)
+	if w := call(disabled, "GET", "/admin/routes", "tok-alice", "", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("admin API without tokens = %d, want 503", w.Code)
+	}
+}
+
+// Every change names the version it was based on; each one that applies
+// moves the version on
+func TestAdminChangesNeedTheCurrentVersion(t *testing.T) {
+	r := adminServer(t)
+	route := `{"match": {"types": ["critical", "high"]}, "destinations": ["pager"]}`
+
+	if w := call(r, "PUT", "/admin/routes/critical", "tok-alice", "", route); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("change without If-Match = %d, want 428", w.Code)
+	}
+	w := call(r, "GET", "/admin/routes/critical", "tok-alice", "", "")
+	version := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || version == "" {
+		t.Fatalf("get route = %d, ETag %q", w.Code, version)
+	}
+
+	w = call(r, "PUT", "/admin/routes/critical", "tok-alice", version, route)
+	next, _ := strconv.Atoi(w.Header().Get("ETag"))
+	if current, _ := strconv.Atoi(version); w.Code != http.StatusOK || next != current+1 {
+		t.Errorf("update = %d with ETag %d, want 200 and version %d", w.Code, next, current+1)
+	}
+	if w := call(r, "PUT", "/admin/routes/critical", "tok-bob", version, route); w.Code != http.StatusConflict {
+		t.Errorf("update on a stale version = %d, want 409", w.Code)
+	}
+	if w := call(r, "PUT", "/admin/routes/critical", "tok-bob", `"`+strconv.Itoa(next)+`"`, route); w.Code != http.StatusOK {
+		t.Errorf("update on the quoted current version = %d %s, want 200", w.Code, w.Body)
+	}
+	if got := configs.current().Version; got != next+1 {
+		t.Errorf("config version = %d, want %d", got, next+1)
+	}
+}
+
+// A PUT of a destination creates it the first time and updates it after,
+// and the audit trail records both with the actor and the secrets redacted
+func TestAdminDestinationsAndAuditTrail(t *testing.T) {
+	r := adminServer(t)
+	dest := `{"type": "webhook", "url": "https://hooks.example/T0/s3cret"}`
+
+	version := strconv.Itoa(configs.current().Version)
+	if w := call(r, "PUT", "/admin/destinations/hook", "tok-alice", version, dest); w.Code != http.StatusCreated {
+		t.Errorf("first put = %d %s, want 201", w.Code, w.Body)
+	}
+	version = strconv.Itoa(configs.current().Version)
+	if w := call(r, "PUT", "/admin/destinations/hook", "tok-bob", version, `{"type": "webhook", "url": "https://hooks.example/REDACTED", "headers": {"X-Team": "noc"}}`); w.Code != http.StatusOK {
+		t.Errorf("second put = %d %s, want 200", w.Code, w.Body)
+	}
+	if got := configs.current().Destinations["hook"]; got.URL != "https://hooks.example/T0/s3cret" || got.Headers["X-Team"] != "noc" {
+		t.Errorf("updated destination = %+v, want the stored URL kept", got)
+	}
+
+	w := call(r, "GET", "/admin/audit?kind=destination", "tok-alice", "", "")
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("audit trail leaks the webhook URL:\n%s", w.Body)
+	}
+	var trail struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &trail); err != nil {
+		t.Fatal(err)
+	}
+	if len(trail.Entries) != 2 {
+		t.Fatalf("audit entries = %+v, want 2", trail.Entries)
+	}
+	update, create := trail.Entries[0], trail.Entries[1]
+	if update.Action != "update" || update.Actor != "bob" || update.Before == nil || update.After == nil {
+		t.Errorf("newest entry = %+v, want bob's update with before and after", update)
+	}
+	if create.Action != "create" || create.Actor != "alice" || create.Before != nil || create.Version != update.Version-1 {
+		t.Errorf("oldest entry = %+v, want alice's create without a before", create)
+	}
+}
+
+// Routes are shown without the destination secrets their templates repeat
+func TestAdminRoutesRedacted(t *testing.T) {
+	r := adminServer(t)
+	for _, path := range []string{"/admin/routes", "/admin/routes/critical"} {
+		w := call(r, "GET", path, "tok-alice", "", "")
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "R0UT1NGKEY") || !strings.Contains(w.Body.String(), redacted) {
+			t.Errorf("%s = %d, leaks the routing key or lost the template:\n%s", path, w.Code, w.Body)
+		}
+	}
+	if tmpl := configs.current().Routes[0].Destinations[0].Template; !strings.Contains(tmpl, "R0UT1NGKEY") {
+		t.Errorf("redacting changed the live route: %q", tmpl)
+	}
+}
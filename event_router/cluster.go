@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+)
+
+// forwardedHeader marks a request one replica forwarded to another. A
+// forwarded event is always handled where it lands, so replicas that briefly
+// disagree about membership cannot bounce it back and forth.
+const forwardedHeader = "X-Event-Router-Forwarded-By"
+
+// cluster shards events across router replicas. Every replica hashes an
+// event's device key (see orderingKey) onto a consistent-hash ring of the
+// members, so all events for a device are handled by the same replica and
+// stateful stages such as flap detection see all of them. A replica that
+// receives an event it does not own forwards it to the owner.
+type cluster struct {
+	self string
+
+	mu      sync.RWMutex
+	members []string
+	ring    *hashRing
+
+	forwarded         atomic.Uint64
+	forwardFailed     atomic.Uint64
+	receivedFromPeers atomic.Uint64
+}
+
+// peers is nil when the router runs as a single instance
+var peers *cluster
+
+var peerClient = &http.Client{Timeout: 60 * time.Second}
+
+func newCluster(self string, members []string) *cluster {
+	c := &cluster{self: normalizePeer(self)}
+	c.setMembers(members)
+	return c
+}
+
+func normalizePeer(p string) string {
+	p = strings.TrimRight(strings.TrimSpace(p), "/")
+	if p != "" && !strings.Contains(p, "://") {
+		p = "http://" + p
+	}
+	return p
+}
+
+// setMembers replaces the member list; this instance is always a member.
+// It reports whether membership changed.
+func (c *cluster) setMembers(members []string) bool {
+	set := map[string]bool{c.self: true}
+	for _, m := range members {
+		if m = normalizePeer(m); m != "" {
+			set[m] = true
+		}
+	}
+	next := make([]string, 0, len(set))
+	for m := range set {
+		next = append(next, m)
+	}
+	sort.Strings(next)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if strings.Join(next, ",") == strings.Join(c.members, ",") {
+		return false
+	}
+	c.members, c.ring = next, newHashRing(next)
+	return true
+}
+
+func (c *cluster) snapshot() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.members...)
+}
+
+// owner returns the member responsible for a device key
+func (c *cluster) owner(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.get(key)
+}
+
+// forwardTarget returns the peer an incoming event should be forwarded to,
+// or "" when this instance handles it
+func (c *cluster) forwardTarget(evt Event, forwardedBy string) string {
+	if forwardedBy != "" {
+		c.receivedFromPeers.Add(1)
+		return ""
+	}
+	if owner := c.owner(orderingKey(evt)); owner != c.self {
+		return owner
+	}
+	return ""
+}
+
+// forward sends an event to its owner's /route and returns the owner's reply
+func (c *cluster) forward(owner string, evt Event, async bool) (int, []byte, error) {
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return 0, nil, err
+	}
+	url := owner + "/route"
+	if async {
+		url += "?async=true"
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(forwardedHeader, c.self)
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		c.forwardFailed.Add(1)
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.forwardFailed.Add(1)
+		return 0, nil, err
+	}
+	c.forwarded.Add(1)
+	return resp.StatusCode, body, nil
+}
+
+/* ---------------- MEMBERSHIP ---------------- */
+
+// clusterFromEnv sets up clustering from EVENT_ROUTER_PEERS (a static list)
+// or EVENT_ROUTER_PEERS_DNS (a host:port name resolving to every replica).
+// It returns nil when neither is set.
+func clusterFromEnv() (*cluster, error) {
+	static := config.GetEnv("EVENT_ROUTER_PEERS", "")
+	dns := config.GetEnv("EVENT_ROUTER_PEERS_DNS", "")
+	if static == "" && dns == "" {
+		return nil, nil
+	}
+	self := config.GetEnv("EVENT_ROUTER_SELF", "")
+	if self == "" {
+		return nil, errors.New("EVENT_ROUTER_SELF must be set to this instance's address when peers are configured")
+	}
+
+	if static != "" {
+		return newCluster(self, strings.Split(static, ",")), nil
+	}
+
+	// Members found through DNS are http://<ip>:<port>, so self must be too
+	// or this replica would join the ring twice under different names
+	resolved, err := resolveSelf(self, dns)
+	if err != nil {
+		log.Printf("Failed to resolve EVENT_ROUTER_SELF %s, using it as is: %v", self, err)
+	}
+	c := newCluster(resolved, nil)
+	members, err := resolvePeers(dns)
+	if err != nil {
+		log.Printf("Peer discovery via %s failed, starting alone: %v", dns, err)
+	} else {
+		c.setMembers(members)
+		c.checkSelf(dns, members)
+	}
+	interval := time.Duration(config.GetEnvInt("EVENT_ROUTER_PEERS_REFRESH_SECONDS", 10)) * time.Second
+	go c.watchDNS(dns, interval)
+	return c, nil
+}
+
+// resolvePeers looks up every address behind a host:port name
+func resolvePeers(hostport string) ([]string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, len(addrs))
+	for i, a := range addrs {
+		members[i] = "http://" + net.JoinHostPort(a, port)
+	}
+	return members, nil
+}
+
+// resolveSelf turns EVENT_ROUTER_SELF into the form DNS members take,
+// http://<ip>:<port>, taking the port from the peer name when self has none
+func resolveSelf(self, hostport string) (string, error) {
+	var host, port string
+	if ip := net.ParseIP(strings.TrimSpace(self)); ip != nil {
+		host = ip.String() // a bare IPv6 address does not parse as a URL
+	} else {
+		u, err := url.Parse(normalizePeer(self))
+		if err != nil {
+			return normalizePeer(self), err
+		}
+		host, port = u.Hostname(), u.Port()
+	}
+	var err error
+	if port == "" {
+		if _, port, err = net.SplitHostPort(hostport); err != nil {
+			return normalizePeer(self), err
+		}
+	}
+	if net.ParseIP(host) == nil {
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return normalizePeer(self), err
+		}
+		host = addrs[0]
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+// checkSelf logs an error when the peer name does not resolve to this
+// replica. Its peers then leave it out of their rings, so the devices it
+// owns in its own ring are owned by another replica in everyone else's.
+func (c *cluster) checkSelf(hostport string, members []string) {
+	for _, m := range members {
+		if m == c.self {
+			return
+		}
+	}
+	log.Printf("ERROR: EVENT_ROUTER_SELF %s is not among the addresses %s resolves to (%s); replicas will disagree about which one owns a device",
+		c.self, hostport, strings.Join(members, ", "))
+}
+
+// watchDNS re-resolves the peer name; on a failed lookup the last known
+// members are kept
+func (c *cluster) watchDNS(hostport string, interval time.Duration) {
+	for range time.Tick(interval) {
+		members, err := resolvePeers(hostport)
+		if err != nil {
+			log.Printf("Peer discovery via %s failed, keeping %d members: %v", hostport, len(c.snapshot()), err)
+			continue
+		}
+		if c.setMembers(members) {
+			log.Printf("Cluster membership changed: %s", strings.Join(c.snapshot(), ", "))
+			c.checkSelf(hostport, members)
+		}
+	}
+}
+
+/* ---------------- HANDLERS ---------------- */
+
+// getCluster shows the members and, with ?key= (e.g. host:core-1) or
+// ?source_host=, which member owns a device
+func getCluster(c *gin.Context) {
+	if peers == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	out := gin.H{
+		"enabled":             true,
+		"self":                peers.self,
+		"members":             peers.snapshot(),
+		"forwarded":           peers.forwarded.Load(),
+		"forward_failures":    peers.forwardFailed.Load(),
+		"received_from_peers": peers.receivedFromPeers.Load(),
+	}
+	key := c.Query("key")
+	if h := c.Query("source_host"); h != "" {
+		key = orderingKey(Event{SourceHost: h})
+	}
+	if key != "" {
+		out["key"], out["owner"] = key, peers.owner(key)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// writeMetrics renders the forwarding counters in the Prometheus text format
+func (c *cluster) writeMetrics(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP event_router_cluster_members Replicas in the cluster.\n# TYPE event_router_cluster_members gauge\nevent_router_cluster_members %d\n", len(c.snapshot()))
+	fmt.Fprintf(b, "# HELP event_router_cluster_forwarded_total Events forwarded to the owning replica.\n# TYPE event_router_cluster_forwarded_total counter\nevent_router_cluster_forwarded_total %d\n", c.forwarded.Load())
+	fmt.Fprintf(b, "# HELP event_router_cluster_forward_failures_total Forwards that failed; the event was handled locally.\n# TYPE event_router_cluster_forward_failures_total counter\nevent_router_cluster_forward_failures_total %d\n", c.forwardFailed.Load())
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Keys only move to a new peer or away from a departed one
+func TestRingRebalance(t *testing.T) {
+	const n, keys = 4, 50000
+	members := make([]string, n)
+	for i := range members {
+		members[i] = fmt.Sprintf("http://router-%d:8082", i+1)
+	}
+	ownerships := func(ms []string) []string {
+		ring := newHashRing(ms)
+		out := make([]string, keys)
+		for i := range out {
+			out[i] = ring.get(fmt.Sprintf("host:device-%d", i))
+		}
+		return out
+	}
+	before := ownerships(members)
+	share := make(map[string]int)
+	for _, o := range before {
+		share[o]++
+	}
+	lo, hi := keys, 0
+	for _, m := range members {
+		lo, hi = min(lo, share[m]), max(hi, share[m])
+	}
+	if ideal := keys / n; float64(hi) >= 1.5*float64(ideal) || float64(lo) <= 0.5*float64(ideal) {
+		t.Errorf("keys per peer %d..%d, ideal %d", lo, hi, ideal)
+	}
+
+	joined := fmt.Sprintf("http://router-%d:8082", n+1)
+	after := ownerships(append(append([]string(nil), members...), joined))
+	moved, wrong := 0, 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if after[i] != joined {
+				wrong++
+			}
+		}
+	}
+	if wrong > 0 {
+		t.Errorf("join: %d of %d moved keys went to an existing peer", wrong, moved)
+	}
+	if idealMove := float64(keys) / float64(n+1); float64(moved) >= 1.5*idealMove {
+		t.Errorf("join moved %d keys, ideal %.0f", moved, idealMove)
+	}
+
+	departed := members[0]
+	after = ownerships(members[1:])
+	moved, wrong = 0, 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if before[i] != departed {
+				wrong++
+			}
+		}
+	}
+	if wrong > 0 || moved != share[departed] {
+		t.Errorf("leave moved %d keys, %d owned by the departed peer, %d others", moved, share[departed], wrong)
+	}
+}
+
+// In-process replicas forwarding to each other over HTTP: every device's
+// events end up on its owner, whichever replica they were sent to, and only
+// the devices of a joining or departing replica move
+func TestForwardingRebalance(t *testing.T) {
+	const n, devices = 4, 300
+	replicas := map[string]*testReplica{}
+	urls := func() []string {
+		out := []string{}
+		for u := range replicas {
+			out = append(out, u)
+		}
+		return out
+	}
+	rebuild := func() {
+		for _, r := range replicas {
+			r.cluster.setMembers(urls())
+		}
+	}
+	for i := 0; i < n; i++ {
+		r := startTestReplica()
+		defer r.server.Close()
+		replicas[r.cluster.self] = r
+	}
+	rebuild()
+
+	send := func(round string) map[string]string {
+		t.Helper()
+		handledBy := make(map[string]string)
+		all := urls()
+		for d := 0; d < devices; d++ {
+			host := fmt.Sprintf("device-%d", d)
+			for j := 0; j < 3; j++ {
+				by, err := replicas[all[rand.Intn(len(all))]].post(Event{Type: "info", Message: round, SourceHost: host})
+				if err != nil {
+					t.Fatalf("%s: %v", round, err)
+				}
+				if prev, ok := handledBy[host]; ok && prev != by {
+					handledBy[host] = "split"
+				} else if !ok {
+					handledBy[host] = by
+				}
+			}
+		}
+		misplaced := 0
+		anyReplica := replicas[all[0]].cluster
+		for host, by := range handledBy {
+			if by != anyReplica.owner(orderingKey(Event{SourceHost: host})) {
+				misplaced++
+			}
+		}
+		if misplaced > 0 {
+			t.Errorf("%s: %d of %d devices not handled by their owner only", round, misplaced, len(handledBy))
+		}
+		return handledBy
+	}
+
+	first := send("initial")
+
+	joiner := startTestReplica()
+	defer joiner.server.Close()
+	replicas[joiner.cluster.self] = joiner
+	rebuild()
+	second := send("after join")
+	for host, by := range second {
+		if by != first[host] && by != joiner.cluster.self {
+			t.Errorf("after join: %s moved from %s to %s, not to the new replica", host, first[host], by)
+		}
+	}
+
+	leaver := replicas[urls()[0]]
+	leaver.server.Close()
+	delete(replicas, leaver.cluster.self)
+	rebuild()
+	third := send("after leave")
+	for host, by := range third {
+		if by != second[host] && second[host] != leaver.cluster.self {
+			t.Errorf("after leave: %s moved from %s to %s", host, second[host], by)
+		}
+	}
+}
+
+// testReplica is an in-process stand-in for a router replica: it forwards
+// events it does not own exactly as /route does and reports who handled them
+type testReplica struct {
+	server  *httptest.Server
+	cluster *cluster
+}
+
+func startTestReplica() *testReplica {
+	r := &testReplica{}
+	r.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var evt Event
+		if err := json.NewDecoder(req.Body).Decode(&evt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if owner := r.cluster.forwardTarget(evt, req.Header.Get(forwardedHeader)); owner != "" {
+			code, body, err := r.cluster.forward(owner, evt, false)
+			if err == nil {
+				w.WriteHeader(code)
+				w.Write(body)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"handled_by": r.cluster.self})
+	}))
+	r.cluster = newCluster("http://"+r.server.Listener.Addr().String(), nil)
+	r.server.Start()
+	return r
+}
+
+// post sends an event to the replica and returns which replica handled it
+func (r *testReplica) post(evt Event) (string, error) {
+	payload, _ := json.Marshal(evt)
+	resp, err := http.Post(r.server.URL+"/route", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("replica answered %d", resp.StatusCode)
+	}
+	var out struct {
+		HandledBy string `json:"handled_by"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	return out.HandledBy, err
+}
+
+// In DNS mode self takes the form of the resolved members
+func TestResolveSelf(t *testing.T) {
+	for _, tc := range []struct{ self, want string }{
+		{"10.0.0.5", "http://10.0.0.5:8082"},
+		{"10.0.0.5:9000", "http://10.0.0.5:9000"},
+		{"http://10.0.0.5:8082/", "http://10.0.0.5:8082"},
+		{"fd00::5", "http://[fd00::5]:8082"},
+	} {
+		if got, err := resolveSelf(tc.self, "routers.default.svc:8082"); err != nil || got != tc.want {
+			t.Errorf("resolveSelf(%q) = %q, %v, want %q", tc.self, got, err, tc.want)
+		}
+	}
+	got, err := resolveSelf("localhost", "routers:8082")
+	if err != nil || (got != "http://127.0.0.1:8082" && got != "http://[::1]:8082") {
+		t.Errorf("resolveSelf(localhost) = %q, %v, want the loopback address", got, err)
+	}
+}
+
+func TestCheckSelfLogsMissingSelf(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c := newCluster("http://10.0.0.5:8082", nil)
+	c.checkSelf("routers:8082", []string{"http://10.0.0.5:8082", "http://10.0.0.6:8082"})
+	if buf.Len() != 0 {
+		t.Errorf("logged %q for a resolved self", buf.String())
+	}
+	c.checkSelf("routers:8082", []string{"http://10.0.0.6:8082", "http://10.0.0.7:8082"})
+	if !strings.Contains(buf.String(), "ERROR: EVENT_ROUTER_SELF http://10.0.0.5:8082 is not among") {
+		t.Errorf("logged %q, want an error about self", buf.String())
+	}
+}
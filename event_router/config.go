@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+)
+
+// RouterConfig is the routing configuration loaded from EVENT_ROUTER_CONFIG_PATH.
+//
+// Two formats are accepted. The legacy format maps an event type straight to
+// a URL:
+//
+//	{"critical": "http://api-gateway:8080/api/internal/events"}
+//
+// The full format names destinations and lists routes that select them:
+//
+//	{
+//	  "destinations": {"gateway": {"type": "webhook", "url": "..."}},
+//	  "routes": [{"name": "critical", "match": {"types": ["critical"]}, "destinations": ["gateway"]}]
+//	}
+type RouterConfig struct {
+	// Version increases with every change made through the admin API
+	Version      int                     `json:"version,omitempty"`
+	Destinations map[string]*Destination `json:"destinations"`
+	Routes       []*Route                `json:"routes"`
+	Lookups      []*LookupTable          `json:"lookups,omitempty"`
+	Correlation  []*CorrelationRule      `json:"correlation,omitempty"`
+	Flapping     []*FlapRule             `json:"flapping,omitempty"`
+	Calendars    map[string]*Calendar    `json:"calendars,omitempty"`
+	Schedules    map[string]*Schedule    `json:"schedules,omitempty"`
+}
+
+// Destination types
+const (
+	DestinationWebhook   = "webhook"
+	DestinationSlack     = "slack"
+	DestinationTeams     = "teams"
+	DestinationPagerDuty = "pagerduty"
+	DestinationTemplate  = "template"
+	DestinationEmail     = "email"
+)
+
+// Destination is a named delivery endpoint and the payload format it expects
+type Destination struct {
+	Type        string            `json:"type"`
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+
+	// Template / TemplateFile hold a Go text/template body (type "template",
+	// or to override the built-in rendering of any other type)
+	Template     string `json:"template,omitempty"`
+	TemplateFile string `json:"template_file,omitempty"`
+
+	// PagerDuty settings
+	RoutingKey string `json:"routing_key,omitempty"`
+	DedupKey   string `json:"dedup_key,omitempty"` // text/template, defaults to source_host:category; the event ID when it renders empty
+	// ResolvePattern optionally resolves the incident for messages matching
+	// it; events labelled state=resolved always do
+	ResolvePattern string `json:"resolve_pattern,omitempty"`
+
+	// Email settings (type "email")
+	Email *EmailSettings `json:"email,omitempty"`
+
+	tmpl      *template.Template
+	dedupTmpl *template.Template
+	resolveRe *regexp.Regexp
+}
+
+// Route selects events and sends them to one or more destinations
+type Route struct {
+	Name         string        `json:"name"`
+	Match        RouteMatch    `json:"match"`
+	Destinations []RouteTarget `json:"destinations"`
+	// Transforms rewrite or drop the event for this route's destinations
+	Transforms []*EventTransform `json:"transforms,omitempty"`
+	// Stop ends rule evaluation when this route matches
+	Stop bool `json:"stop,omitempty"`
+}
+
+// RouteMatch lists the conditions an event must meet. Empty lists match
+// anything; values within a list are OR'ed and lists are AND'ed together.
+type RouteMatch struct {
+	Kinds       []string `json:"kinds,omitempty"` // event or incident
+	Types       []string `json:"types,omitempty"`
+	EventTypes  []string `json:"event_types,omitempty"`
+	Categories  []string `json:"categories,omitempty"`
+	SourceHosts []string `json:"source_hosts,omitempty"` // glob patterns
+	// Labels maps a label, e.g. one added by a lookup table, to the glob
+	// patterns its value must match
+	Labels map[string][]string `json:"labels,omitempty"`
+	// During and Outside name a calendar the current time must be within
+	// (or outside of), e.g. business hours
+	During  string `json:"during,omitempty"`
+	Outside string `json:"outside,omitempty"`
+
+	during, outside *Calendar
+}
+
+// RouteTarget references a destination, optionally overriding its payload
+// template for this route. In JSON it is either a destination name or an
+// object: {"destination": "slack-noc", "template": "..."}. Instead of a fixed
+// destination, OnCall names a schedule whose on-call person is notified.
+type RouteTarget struct {
+	Destination  string `json:"destination,omitempty"`
+	OnCall       string `json:"on_call,omitempty"`
+	Template     string `json:"template,omitempty"`
+	TemplateFile string `json:"template_file,omitempty"`
+
+	tmpl *template.Template
+}
+
+func (t RouteTarget) MarshalJSON() ([]byte, error) {
+	if t.Template == "" && t.TemplateFile == "" && t.OnCall == "" {
+		return json.Marshal(t.Destination)
+	}
+	type plain RouteTarget
+	return json.Marshal(plain(t))
+}
+
+func (t *RouteTarget) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = RouteTarget{Destination: name}
+		return nil
+	}
+	type plain RouteTarget
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*t = RouteTarget(p)
+	return nil
+}
+
+// loadConfigFile reads, parses and validates a routing config file
+func loadConfigFile(configPath string) (*RouterConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file %s: %w", configPath, err)
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", configPath, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig parses either config format and compiles its templates
+func parseConfig(data []byte) (*RouterConfig, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+
+	var cfg RouterConfig
+	if _, ok := probe["routes"]; ok {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+	} else {
+		legacy := make(map[string]string)
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("legacy config must map event types to URLs: %w", err)
+		}
+		cfg = legacyConfig(legacy)
+	}
+
+	if err := cfg.compile(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// legacyConfig turns a type->URL map into one webhook route per type
+func legacyConfig(legacy map[string]string) RouterConfig {
+	cfg := RouterConfig{Destinations: make(map[string]*Destination)}
+
+	types := make([]string, 0, len(legacy))
+	for t := range legacy {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	for _, t := range types {
+		cfg.Destinations[t] = &Destination{Type: DestinationWebhook, URL: legacy[t]}
+		cfg.Routes = append(cfg.Routes, &Route{
+			Name:         t,
+			Match:        RouteMatch{Types: []string{t}},
+			Destinations: []RouteTarget{{Destination: t}},
+		})
+	}
+	return cfg
+}
+
+// compile validates references and parses every template so that errors
+// surface at load time rather than on the first matching event
+func (cfg *RouterConfig) compile() error {
+	if cfg.Destinations == nil {
+		cfg.Destinations = make(map[string]*Destination)
+	}
+
+	for name, d := range cfg.Destinations {
+		if d.Type == "" {
+			d.Type = DestinationWebhook
+		}
+		switch d.Type {
+		case DestinationWebhook, DestinationSlack, DestinationTeams, DestinationPagerDuty, DestinationTemplate, DestinationEmail:
+		default:
+			return fmt.Errorf("destination %q: unknown type %q", name, d.Type)
+		}
+		if d.URL == "" {
+			return fmt.Errorf("destination %q: url is required", name)
+		}
+
+		tmpl, err := compileTemplate("destination "+name, d.Template, d.TemplateFile)
+		if err != nil {
+			return err
+		}
+		if d.Type == DestinationTemplate && tmpl == nil {
+			return fmt.Errorf("destination %q: template destinations need template or template_file", name)
+		}
+		d.tmpl = tmpl
+
+		if d.Type == DestinationEmail {
+			if err := d.compileEmail(name); err != nil {
+				return err
+			}
+		}
+		if d.Type == DestinationPagerDuty {
+			if d.RoutingKey == "" {
+				return fmt.Errorf("destination %q: pagerduty destinations need routing_key", name)
+			}
+			dedup := d.DedupKey
+			if dedup == "" {
+				dedup = "{{.SourceHost}}:{{.Category}}"
+			}
+			if d.dedupTmpl, err = template.New(name + "-dedup").Funcs(templateFuncs).Parse(dedup); err != nil {
+				return fmt.Errorf("destination %q: dedup_key: %w", name, err)
+			}
+			if d.ResolvePattern != "" {
+				if d.resolveRe, err = regexp.Compile(d.ResolvePattern); err != nil {
+					return fmt.Errorf("destination %q: resolve_pattern: %w", name, err)
+				}
+			}
+		}
+	}
+
+	for name, cal := range cfg.Calendars {
+		if err := cal.compile(name); err != nil {
+			return err
+		}
+	}
+	for name, sched := range cfg.Schedules {
+		if err := sched.compile(name, cfg.Destinations); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range cfg.Lookups {
+		if err := t.compile(); err != nil {
+			return err
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("duplicate lookup table name %q", t.Name)
+		}
+		seen[t.Name] = true
+	}
+
+	seen = make(map[string]bool)
+	for i, r := range cfg.Routes {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("route-%d", i+1)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("duplicate route name %q", r.Name)
+		}
+		seen[r.Name] = true
+
+		if err := cfg.compileMatch(&r.Match); err != nil {
+			return fmt.Errorf("route %q: %w", r.Name, err)
+		}
+		for j, t := range r.Transforms {
+			if err := t.compile(); err != nil {
+				return fmt.Errorf("route %q: transform %d: %w", r.Name, j+1, err)
+			}
+		}
+		for j := range r.Destinations {
+			t := &r.Destinations[j]
+			label := t.Destination
+			switch {
+			case t.OnCall != "" && t.Destination != "":
+				return fmt.Errorf("route %q: set either destination or on_call, not both", r.Name)
+			case t.OnCall != "":
+				if _, ok := cfg.Schedules[t.OnCall]; !ok {
+					return fmt.Errorf("route %q: unknown schedule %q", r.Name, t.OnCall)
+				}
+				label = "on-call " + t.OnCall
+			default:
+				if _, ok := cfg.Destinations[t.Destination]; !ok {
+					return fmt.Errorf("route %q: unknown destination %q", r.Name, t.Destination)
+				}
+			}
+			tmpl, err := compileTemplate(fmt.Sprintf("route %s -> %s", r.Name, label), t.Template, t.TemplateFile)
+			if err != nil {
+				return err
+			}
+			t.tmpl = tmpl
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, r := range cfg.Correlation {
+		if err := r.compile(); err != nil {
+			return err
+		}
+		if err := cfg.compileMatch(&r.Match); err != nil {
+			return fmt.Errorf("correlation rule %q: %w", r.Name, err)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate correlation rule name %q", r.Name)
+		}
+		names[r.Name] = true
+	}
+	names = make(map[string]bool)
+	for _, r := range cfg.Flapping {
+		if err := r.compile(); err != nil {
+			return err
+		}
+		if err := cfg.compileMatch(&r.Match); err != nil {
+			return fmt.Errorf("flapping rule %q: %w", r.Name, err)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate flapping rule name %q", r.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
+
+// compileMatch validates a match and binds the calendars it names
+func (cfg *RouterConfig) compileMatch(m *RouteMatch) error {
+	if err := validateGlobs(m.SourceHosts); err != nil {
+		return fmt.Errorf("source_hosts: %w", err)
+	}
+	for name, patterns := range m.Labels {
+		if err := validateGlobs(patterns); err != nil {
+			return fmt.Errorf("labels.%s: %w", name, err)
+		}
+	}
+	calendar := func(name string) (*Calendar, error) {
+		if name == "" {
+			return nil, nil
+		}
+		cal, ok := cfg.Calendars[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown calendar %q", name)
+		}
+		return cal, nil
+	}
+	var err error
+	if m.during, err = calendar(m.During); err != nil {
+		return err
+	}
+	m.outside, err = calendar(m.Outside)
+	return err
+}
+
+// templateDir holds the files template_file settings may name
+var templateDir = config.GetEnv("EVENT_ROUTER_TEMPLATE_DIR", "templates")
+
+// readTemplateFile reads a template file named relative to templateDir.
+// Absolute paths and paths with ".." are rejected, so a config written
+// through the admin API cannot read arbitrary files.
+func readTemplateFile(name string) (string, error) {
+	if !filepath.IsLocal(name) || slices.Contains(strings.Split(filepath.ToSlash(name), "/"), "..") {
+		return "", fmt.Errorf("template file %q must be a relative path inside the template directory", name)
+	}
+	data, err := os.ReadFile(filepath.Join(templateDir, name))
+	return string(data), err
+}
+
+func compileTemplate(owner, text, file string) (*template.Template, error) {
+	if text == "" && file == "" {
+		return nil, nil
+	}
+	if text != "" && file != "" {
+		return nil, fmt.Errorf("%s: set either template or template_file, not both", owner)
+	}
+	if file != "" {
+		var err error
+		if text, err = readTemplateFile(file); err != nil {
+			return nil, fmt.Errorf("%s: %w", owner, err)
+		}
+	}
+	tmpl, err := template.New(owner).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", owner, err)
+	}
+	return tmpl, nil
+}
+
+// matches reports whether an event satisfies every condition
+func (m RouteMatch) matches(evt Event) bool {
+	for _, cond := range m.conditions(evt) {
+		if !cond.Matched {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(values []string, v string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, candidate := range values {
+		if candidate == v {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(patterns []string, v string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// target is a destination resolved for a specific event
+type target struct {
+	Route       string
+	Destination string
+	dest        *Destination
+	tmpl        *template.Template // route-level override, may be nil
+	evt         *Event             // the event after the route's transforms, if it has any
+}
+
+// event returns the event as the target's route delivers it
+func (t target) event(evt Event) Event {
+	if t.evt != nil {
+		return *t.evt
+	}
+	return evt
+}
+
+// resolve evaluates the routes in order and returns the destinations the
+// event should be delivered to, each destination at most once
+func (cfg *RouterConfig) resolve(evt Event) []target {
+	return cfg.evaluate(evt).targets
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+)
+
+var (
+	errVersionConflict = errors.New("config version conflict")
+	errPersist         = errors.New("persist config")
+)
+
+// configStore owns the active routing config. Readers take the current
+// snapshot without locking; writers serialize through mu, validate a modified
+// copy, persist it to the config file and then swap it in, so changes apply
+// without a restart.
+type configStore struct {
+	mu     sync.Mutex
+	path   string
+	active atomic.Pointer[RouterConfig]
+	// modTime is the newest modification time of the config file and the
+	// lookup tables it references, as of the last load
+	modTime time.Time
+}
+
+func newConfigStore(path string) (*configStore, error) {
+	s := &configStore{path: path}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s.active.Store(cfg)
+	s.modTime = s.sourcesModTime(cfg)
+	return s, nil
+}
+
+// current returns the active config; it must be treated as read-only
+func (s *configStore) current() *RouterConfig {
+	return s.active.Load()
+}
+
+// update applies fn to a copy of the active config. The change is rejected
+// with errVersionConflict if expectedVersion is stale. On success the new
+// config is written to disk and becomes active; the previous and new
+// configs are returned for auditing.
+func (s *configStore) update(expectedVersion int, fn func(*RouterConfig) error) (before, after *RouterConfig, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before = s.current()
+	if expectedVersion != before.Version {
+		return nil, nil, fmt.Errorf("%w: expected version %d, current is %d", errVersionConflict, expectedVersion, before.Version)
+	}
+
+	next, err := before.clone()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fn(next); err != nil {
+		return nil, nil, err
+	}
+	if err := next.compile(); err != nil {
+		return nil, nil, err
+	}
+	next.Version = before.Version + 1
+
+	if err := s.persist(next); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errPersist, err)
+	}
+	s.active.Store(next)
+	return before, next, nil
+}
+
+// persist writes the config file atomically; callers must hold s.mu
+func (s *configStore) persist(cfg *RouterConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteAtomic(s.path, append(data, '\n')); err != nil {
+		return err
+	}
+	s.modTime = s.sourcesModTime(cfg)
+	return nil
+}
+
+// sourcesModTime returns the newest modification time of the config file and
+// the lookup tables cfg reads
+func (s *configStore) sourcesModTime(cfg *RouterConfig) time.Time {
+	var latest time.Time
+	for _, file := range append([]string{s.path}, cfg.lookupFiles()...) {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// watch reloads the config when the file, or a lookup table it references,
+// is edited outside the admin API. A file that fails to parse is logged and
+// the active config is kept.
+func (s *configStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.reloadIfChanged()
+	}
+}
+
+func (s *configStore) reloadIfChanged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	modTime := s.sourcesModTime(s.current())
+	if !modTime.After(s.modTime) {
+		return
+	}
+	s.modTime = modTime
+
+	cfg, err := loadConfigFile(s.path)
+	if err != nil {
+		log.Printf("Config reload failed, keeping version %d: %v", s.current().Version, err)
+		return
+	}
+	if prev := s.current(); cfg.Version <= prev.Version {
+		cfg.Version = prev.Version + 1
+	}
+	s.active.Store(cfg)
+	if latest := s.sourcesModTime(cfg); latest.After(s.modTime) {
+		s.modTime = latest // the new config may read other lookup tables
+	}
+	log.Printf("Reloaded config from %s (version %d, %d routes)", s.path, cfg.Version, len(cfg.Routes))
+	auditLog.record(auditEntry{Actor: "file", Action: "reload", Kind: "config", Name: s.path, Version: cfg.Version})
+}
+
+// clone deep-copies the exported fields of a config; compile must be run
+// on the result to rebuild templates
+func (cfg *RouterConfig) clone() (*RouterConfig, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var out RouterConfig
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
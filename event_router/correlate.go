@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+)
+
+// Event kinds
+const (
+	KindEvent    = "event"
+	KindIncident = "incident"
+)
+
+// CorrelationRule groups related events into an incident, e.g. all events
+// from the same site within five minutes of each other
+type CorrelationRule struct {
+	Name string `json:"name"`
+	// Match selects the events this rule considers
+	Match RouteMatch `json:"match"`
+	// Key lists the fields that must be equal for events to correlate:
+	// type, source_host, source_ip, category, event_type or label:<name>
+	Key []string `json:"key"`
+	// Window is how long an incident stays open after its latest event
+	Window string `json:"window"`
+	// MaxDuration closes an incident this long after its first event even if
+	// events keep arriving, so a noisy key cannot hold one open forever
+	// (default 12 windows)
+	MaxDuration string `json:"max_duration,omitempty"`
+	// MinEvents is how many correlated events open an incident (default 2)
+	MinEvents int `json:"min_events,omitempty"`
+	// RootPriority ranks candidate root events: regexes tried in order against
+	// "<category> <message>"; ties go to the higher severity, then the earlier event
+	RootPriority []string `json:"root_priority,omitempty"`
+
+	window      time.Duration
+	maxDuration time.Duration
+	rootRes     []*regexp.Regexp
+}
+
+// IncidentInfo is attached to incident events forwarded by the router
+type IncidentInfo struct {
+	ID          string    `json:"id"`
+	Rule        string    `json:"rule"`
+	Key         string    `json:"key"`
+	Status      string    `json:"status"` // opened, updated or resolved
+	RootEventID string    `json:"root_event_id"`
+	EventCount  int       `json:"event_count"`
+	EventIDs    []string  `json:"event_ids"` // the first maxIncidentEventIDs events
+	OpenedAt    time.Time `json:"opened_at"`
+	LastEventAt time.Time `json:"last_event_at"`
+}
+
+func (r *CorrelationRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("correlation rule needs a name")
+	}
+	if len(r.Key) == 0 {
+		return fmt.Errorf("correlation rule %q: key is required", r.Name)
+	}
+	for _, field := range r.Key {
+		if _, ok := eventField(Event{}, field); !ok {
+			return fmt.Errorf("correlation rule %q: unknown key field %q", r.Name, field)
+		}
+	}
+	d, err := time.ParseDuration(r.Window)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("correlation rule %q: window must be a positive duration", r.Name)
+	}
+	r.window = d
+	r.maxDuration = 12 * d
+	if r.MaxDuration != "" {
+		if r.maxDuration, err = time.ParseDuration(r.MaxDuration); err != nil || r.maxDuration < d {
+			return fmt.Errorf("correlation rule %q: max_duration must be a duration of at least the window", r.Name)
+		}
+	}
+	if r.MinEvents == 0 {
+		r.MinEvents = 2
+	}
+	r.rootRes = nil
+	for _, p := range r.RootPriority {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("correlation rule %q: root_priority: %w", r.Name, err)
+		}
+		r.rootRes = append(r.rootRes, re)
+	}
+	return nil
+}
+
+// eventField reads a field by name for correlation keys and lookups
+func eventField(evt Event, field string) (string, bool) {
+	switch field {
+	case "type":
+		return evt.Type, true
+	case "source_host":
+		return evt.SourceHost, true
+	case "source_ip":
+		return evt.SourceIP, true
+	case "category":
+		return evt.Category, true
+	case "event_type":
+		return evt.EventType, true
+	}
+	if name, ok := strings.CutPrefix(field, "label:"); ok && name != "" {
+		return evt.Labels[name], true
+	}
+	return "", false
+}
+
+// key builds the correlation key; ok is false when a key field is empty
+func (r *CorrelationRule) key(evt Event) (string, bool) {
+	parts := make([]string, len(r.Key))
+	for i, field := range r.Key {
+		v, _ := eventField(evt, field)
+		if v == "" {
+			return "", false
+		}
+		parts[i] = field + "=" + v
+	}
+	return strings.Join(parts, ","), true
+}
+
+// rootRank orders root candidates; lower is a better root
+func (r *CorrelationRule) rootRank(evt Event) int {
+	rank := len(r.rootRes)
+	text := evt.Category + " " + evt.Message
+	for i, re := range r.rootRes {
+		if re.MatchString(text) {
+			rank = i
+			break
+		}
+	}
+	return rank*100 + constants.GetSeverityPriority(evt.Type)
+}
+
+/* ---------------- ENGINE ---------------- */
+
+// maxIncidentEventIDs caps the event IDs an incident lists; later events
+// are only counted
+const maxIncidentEventIDs = 100
+
+// correlationGroup collects events sharing a rule and key. Only the events
+// an incident reports are kept, so a group's size does not grow with the
+// number of events in it.
+type correlationGroup struct {
+	rule string
+	key  string
+	// incidentID is assigned when the group starts, so the events that
+	// arrive before MinEvents carry it too
+	incidentID string
+	opened     bool
+	count      int
+	root       Event
+	rootRank   int
+	severity   string // the most severe type seen
+	eventIDs   []string
+	openedAt   time.Time
+	lastAt     time.Time
+}
+
+// expired reports whether the group's incident is over at now
+func (g *correlationGroup) expired(rule *CorrelationRule, now time.Time) bool {
+	return now.Sub(g.lastAt) > rule.window || now.Sub(g.openedAt) > rule.maxDuration
+}
+
+// correlator tracks open groups across events
+type correlator struct {
+	mu     sync.Mutex
+	groups map[string]*correlationGroup
+}
+
+var correlations = &correlator{groups: make(map[string]*correlationGroup)}
+
+// apply runs the correlation stage. The event is tagged with the incident
+// it belongs to: the first open one among the rules it matches, else the
+// first pending one. An incident event is returned when an incident opens,
+// its root changes or it is found expired. With dryRun the engine state is
+// left untouched.
+func (c *correlator) apply(rules []*CorrelationRule, evt Event, now time.Time, dryRun bool) (Event, []pipelineStep, []Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var steps []pipelineStep
+	var emitted []Event
+	pending := false // tagged with a group that has not opened yet
+
+	for _, rule := range rules {
+		if evt.Kind == KindIncident || !rule.Match.matches(evt) {
+			continue
+		}
+		key, ok := rule.key(evt)
+		if !ok {
+			continue
+		}
+
+		groupID := rule.Name + "|" + key
+		g := c.groups[groupID]
+		if g != nil && g.expired(rule, now) {
+			if g.opened {
+				emitted = append(emitted, g.incidentEvent("resolved"))
+			}
+			g = nil
+		}
+		if g == nil {
+			g = &correlationGroup{rule: rule.Name, key: key, openedAt: now, incidentID: fileutil.NewID("inc")}
+			if dryRun {
+				g.incidentID = "inc-(new)"
+			}
+		} else if dryRun {
+			cp := *g
+			cp.eventIDs = append([]string(nil), g.eventIDs...)
+			g = &cp
+		}
+
+		g.count++
+		g.lastAt = now
+		if len(g.eventIDs) < maxIncidentEventIDs {
+			g.eventIDs = append(g.eventIDs, evt.EventID)
+		}
+		if g.severity == "" || constants.GetSeverityPriority(evt.Type) < constants.GetSeverityPriority(g.severity) {
+			g.severity = evt.Type
+		}
+		isRoot := false
+		if rank := rule.rootRank(evt); g.count == 1 || rank < g.rootRank {
+			g.rootRank, isRoot = rank, true
+		}
+
+		status := ""
+		switch {
+		case !g.opened && g.count >= rule.MinEvents:
+			g.opened = true
+			status = "opened"
+		case g.opened && isRoot:
+			status = "updated"
+		}
+
+		// A pending group keeps the event only until another rule's incident
+		// has opened with it
+		switch {
+		case g.opened:
+			evt.IncidentID = g.incidentID
+			role := "symptom"
+			if isRoot {
+				role = "root"
+			}
+			evt.Labels = withLabel(evt.Labels, "incident_role", role)
+		case !pending:
+			evt.IncidentID = g.incidentID
+			evt.Labels = withLabel(evt.Labels, "incident_role", "pending")
+			pending = true
+		}
+		if isRoot {
+			g.root = evt
+		}
+
+		if g.opened {
+			action := "attached"
+			if status != "" {
+				action = status
+				emitted = append(emitted, g.incidentEvent(status))
+			}
+			steps = append(steps, pipelineStep{
+				Stage:  "correlation",
+				Action: action,
+				Rule:   rule.Name,
+				Detail: fmt.Sprintf("incident %s (%s), %d events, root %s", g.incidentID, key, g.count, g.root.EventID),
+			})
+		} else {
+			steps = append(steps, pipelineStep{
+				Stage:  "correlation",
+				Action: "pending",
+				Rule:   rule.Name,
+				Detail: fmt.Sprintf("%d/%d events for %s, incident %s once it opens", g.count, rule.MinEvents, key, g.incidentID),
+			})
+		}
+
+		if !dryRun {
+			c.groups[groupID] = g
+		}
+		// An event joins at most one incident
+		if g.opened {
+			break
+		}
+	}
+	return evt, steps, emitted
+}
+
+// incidentEvent builds the event forwarded for an incident
+func (g *correlationGroup) incidentEvent(status string) Event {
+	root := g.root
+	return Event{
+		EventID:    g.incidentID,
+		Kind:       KindIncident,
+		Type:       g.severity,
+		Message:    fmt.Sprintf("Incident: %s (%d related events)", root.Message, g.count),
+		SourceHost: root.SourceHost,
+		SourceIP:   root.SourceIP,
+		EventType:  root.EventType,
+		Category:   root.Category,
+		Labels:     root.Labels,
+		Incident: &IncidentInfo{
+			ID:          g.incidentID,
+			Rule:        g.rule,
+			Key:         g.key,
+			Status:      status,
+			RootEventID: root.EventID,
+			EventCount:  g.count,
+			EventIDs:    append([]string(nil), g.eventIDs...),
+			OpenedAt:    g.openedAt,
+			LastEventAt: g.lastAt,
+		},
+	}
+}
+
+// sweep forgets groups whose window has passed and returns a resolved
+// incident event for each of them that had opened
+func (c *correlator) sweep(rules []*CorrelationRule, now time.Time) []Event {
+	byName := make(map[string]*CorrelationRule)
+	for _, r := range rules {
+		byName[r.Name] = r
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var resolved []Event
+	for id, g := range c.groups {
+		rule, ok := byName[g.rule]
+		if !ok || g.expired(rule, now) {
+			if g.opened {
+				resolved = append(resolved, g.incidentEvent("resolved"))
+			}
+			delete(c.groups, id)
+		}
+	}
+	return resolved
+}
+
+// openIncidents lists the incidents currently open, newest first
+func (c *correlator) openIncidents() []IncidentInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := []IncidentInfo{}
+	for _, g := range c.groups {
+		if g.opened {
+			out = append(out, *g.incidentEvent("open").Incident)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].OpenedAt.After(out[j].OpenedAt) })
+	return out
+}
+
+// runCorrelationSweeper periodically drops expired correlation groups and
+// routes the incidents they close
+func runCorrelationSweeper(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		for _, e := range correlations.sweep(configs.current().Correlation, now) {
+			log.Printf("Correlation: incident %s resolved after %d events", e.EventID, e.Incident.EventCount)
+			routeEmitted([]Event{e})
+		}
+	}
+}
+
+func listIncidents(c *gin.Context) {
+	incidents := correlations.openIncidents()
+	c.JSON(http.StatusOK, gin.H{"count": len(incidents), "incidents": incidents})
+}
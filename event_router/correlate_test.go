@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func correlationRule(t *testing.T, maxDuration string) *CorrelationRule {
+	t.Helper()
+	r := &CorrelationRule{Name: "site", Key: []string{"source_host"}, Window: "5m", MaxDuration: maxDuration, MinEvents: 3}
+	if err := r.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCorrelationLinksEventsBeforeTheIncidentOpens(t *testing.T) {
+	c := &correlator{groups: make(map[string]*correlationGroup)}
+	rules := []*CorrelationRule{correlationRule(t, "")}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	var routed []Event
+	var incident Event
+	for i := 0; i < 3; i++ {
+		evt := Event{Type: "high", SourceHost: "core-sw-01", Message: fmt.Sprintf("link %d down", i), EventID: fmt.Sprintf("evt-%d", i)}
+		out, _, emitted := c.apply(rules, evt, now.Add(time.Duration(i)*time.Second), false)
+		routed = append(routed, out)
+		if len(emitted) > 0 {
+			incident = emitted[0]
+		}
+	}
+	if incident.Incident == nil || incident.Incident.Status != "opened" {
+		t.Fatalf("no incident opened: %+v", incident)
+	}
+	for i, evt := range routed {
+		if evt.IncidentID != incident.EventID {
+			t.Errorf("event %d carries incident %q, want %q", i, evt.IncidentID, incident.EventID)
+		}
+	}
+	if role := routed[0].Labels["incident_role"]; role != "pending" {
+		t.Errorf("first event role = %q, want pending", role)
+	}
+}
+
+func TestCorrelationGroupStaysBounded(t *testing.T) {
+	c := &correlator{groups: make(map[string]*correlationGroup)}
+	rule := correlationRule(t, "30m")
+	rules := []*CorrelationRule{rule}
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	var first string
+	for i := 0; i < 1500; i++ {
+		at := start.Add(time.Duration(i) * time.Second)
+		evt, _, _ := c.apply(rules, Event{Type: "info", SourceHost: "noisy", Message: "flap", EventID: fmt.Sprintf("evt-%d", i)}, at, false)
+		if i == 0 {
+			first = evt.IncidentID
+		}
+	}
+	g := c.groups["site|source_host=noisy"]
+	if g.count != 1500 || len(g.eventIDs) != maxIncidentEventIDs {
+		t.Errorf("group counts %d events and keeps %d IDs, want 1500 and %d", g.count, len(g.eventIDs), maxIncidentEventIDs)
+	}
+
+	// Still sending after max_duration starts a new incident
+	evt, _, _ := c.apply(rules, Event{Type: "info", SourceHost: "noisy", Message: "flap"}, start.Add(31*time.Minute), false)
+	if evt.IncidentID == first {
+		t.Errorf("incident %s kept open past max_duration", first)
+	}
+}
+
+// An event pending in one rule's group keeps that incident ID when a later
+// rule's group is also pending, and takes the ID of one that opens
+func TestCorrelationTagsTheFirstOpenIncident(t *testing.T) {
+	c := &correlator{groups: make(map[string]*correlationGroup)}
+	byHost := correlationRule(t, "")
+	bySite := &CorrelationRule{Name: "by-site", Key: []string{"label:site"}, Window: "5m", MinEvents: 2}
+	if err := bySite.compile(); err != nil {
+		t.Fatal(err)
+	}
+	rules := []*CorrelationRule{byHost, bySite}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	event := func(host, id string) Event {
+		return Event{Type: "high", SourceHost: host, Message: "link down", EventID: id, Labels: map[string]string{"site": "fra"}}
+	}
+
+	first, _, _ := c.apply(rules, event("sw-1", "evt-1"), now, false)
+	hostGroup := c.groups["site|source_host=sw-1"]
+	if first.IncidentID != hostGroup.incidentID || first.Labels["incident_role"] != "pending" {
+		t.Errorf("pending event tagged %s (%s), want the first rule's pending incident %s",
+			first.IncidentID, first.Labels["incident_role"], hostGroup.incidentID)
+	}
+
+	second, _, emitted := c.apply(rules, event("sw-2", "evt-2"), now.Add(time.Second), false)
+	siteGroup := c.groups["by-site|label:site=fra"]
+	if len(emitted) != 1 || emitted[0].EventID != siteGroup.incidentID {
+		t.Fatalf("site incident not opened: %+v", emitted)
+	}
+	if second.IncidentID != siteGroup.incidentID || second.Labels["incident_role"] == "pending" {
+		t.Errorf("event tagged %s (%s), want the open site incident %s",
+			second.IncidentID, second.Labels["incident_role"], siteGroup.incidentID)
+	}
+}
+
+// Incidents that expire are announced as resolved, whether the sweeper or a
+// later event finds them expired; groups that never opened are dropped quietly
+func TestCorrelationResolvesExpiredIncidents(t *testing.T) {
+	c := &correlator{groups: make(map[string]*correlationGroup)}
+	rules := []*CorrelationRule{correlationRule(t, "")}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	var opened Event
+	for i := 0; i < 3; i++ {
+		_, _, emitted := c.apply(rules, Event{Type: "high", SourceHost: "sw-1", Message: "link down"}, now, false)
+		if len(emitted) > 0 {
+			opened = emitted[0]
+		}
+	}
+	c.apply(rules, Event{Type: "high", SourceHost: "sw-2", Message: "link down"}, now, false)
+
+	if resolved := c.sweep(rules, now.Add(time.Minute)); len(resolved) != 0 || len(c.groups) != 2 {
+		t.Errorf("groups within their window swept: %+v", resolved)
+	}
+	resolved := c.sweep(rules, now.Add(6*time.Minute))
+	if len(resolved) != 1 || resolved[0].EventID != opened.EventID || resolved[0].Incident.Status != "resolved" || resolved[0].Incident.EventCount != 3 {
+		t.Errorf("expired incident not resolved: %+v", resolved)
+	}
+	if len(c.groups) != 0 {
+		t.Errorf("%d expired groups kept", len(c.groups))
+	}
+
+	for i := 0; i < 3; i++ {
+		c.apply(rules, Event{Type: "high", SourceHost: "sw-1", Message: "link down"}, now, false)
+	}
+	reopened := c.groups["site|source_host=sw-1"].incidentID
+	_, _, emitted := c.apply(rules, Event{Type: "high", SourceHost: "sw-1", Message: "link down"}, now.Add(6*time.Minute), false)
+	if len(emitted) != 1 || emitted[0].EventID != reopened || emitted[0].Incident.Status != "resolved" {
+		t.Errorf("incident found expired by a later event not resolved: %+v", emitted)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week). Each field supports
+// "*", single values, ranges "a-b", steps "*/n" or "a-b/n" and lists "a,b".
+// Day-of-week is 0-7 with both 0 and 7 meaning Sunday. As in standard cron,
+// when both day fields are restricted a time matches if either one does.
+type cronSchedule struct {
+	expr                          string
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &cronSchedule{expr: expr}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron %q minute: %w", expr, err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron %q hour: %w", expr, err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron %q day-of-month: %w", expr, err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron %q month: %w", expr, err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron %q day-of-week: %w", expr, err)
+	}
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, stepStr, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad step %q", stepStr)
+			}
+			step = n
+			part = base
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			a, b, _ := strings.Cut(part, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(a)
+			hi, err2 = strconv.Atoi(b)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("bad range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			lo, hi = n, n
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matches reports whether the schedule fires at the minute containing t
+func (s *cronSchedule) matches(t time.Time) bool {
+	return s.minute[t.Minute()] && s.hour[t.Hour()] && s.matchesDay(t)
+}
+
+// matchesDay reports whether the schedule fires at some time on t's day
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if !s.month[int(t.Month())] {
+		return false
+	}
+	domMatch := s.dom[t.Day()]
+	dowMatch := s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dowMatch
+	case s.dowAny:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
+
+// lastStart returns the most recent time in (t-within, t] at which the
+// schedule fired, evaluated in loc. Days and hours the schedule never fires
+// in are skipped whole, so a weekly window costs a few dozen checks rather
+// than one per minute of the week.
+func (s *cronSchedule) lastStart(t time.Time, within time.Duration, loc *time.Location) (time.Time, bool) {
+	t = t.In(loc).Truncate(time.Minute)
+	for probe := t; t.Sub(probe) < within; {
+		y, mo, d := probe.Date()
+		switch {
+		case !s.matchesDay(probe):
+			probe = time.Date(y, mo, d, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !s.hour[probe.Hour()]:
+			probe = time.Date(y, mo, d, probe.Hour(), 0, 0, 0, loc).Add(-time.Minute)
+		case s.minute[probe.Minute()]:
+			return probe, true
+		default:
+			probe = probe.Add(-time.Minute)
+		}
+	}
+	return time.Time{}, false
+}
+
+// activation remembers the latest firing of a schedule found so far, so a
+// rule checked on every event only looks at the minutes since its last check
+type activation struct {
+	mu      sync.Mutex
+	checked time.Time // the minute the last check covered
+	last    time.Time // the latest firing within the window at checked, if any
+}
+
+// lastStart is cronSchedule.lastStart, reusing the previous answer
+func (a *activation) lastStart(s *cronSchedule, t time.Time, within time.Duration, loc *time.Location) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	t = t.In(loc).Truncate(time.Minute)
+	switch {
+	case t.Equal(a.checked):
+	case !a.checked.IsZero() && t.After(a.checked) && t.Sub(a.checked) < within:
+		if last, ok := s.lastStart(t, t.Sub(a.checked), loc); ok {
+			a.last = last
+		}
+		a.checked = t
+	default:
+		a.last, _ = s.lastStart(t, within, loc)
+		a.checked = t
+	}
+	if a.last.IsZero() || t.Sub(a.last) >= within {
+		return time.Time{}, false
+	}
+	return a.last, true
+}
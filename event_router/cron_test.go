@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// lastStartByMinute is the reference: every minute of the window in turn
+func lastStartByMinute(s *cronSchedule, t time.Time, within time.Duration, loc *time.Location) (time.Time, bool) {
+	t = t.In(loc).Truncate(time.Minute)
+	for probe := t; t.Sub(probe) < within; probe = probe.Add(-time.Minute) {
+		if s.matches(probe) {
+			return probe, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func TestLastStartMatchesMinuteScan(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exprs := []string{"0 2 * * 6", "*/15 * * * *", "30 8-17 * * 1-5", "0 0 1 * *", "0 3 13 * 5", "5 4 * 2 *"}
+	windows := []time.Duration{time.Minute, 3 * time.Hour, 36 * time.Hour, 168 * time.Hour}
+	// spans the spring DST change in Berlin
+	start := time.Date(2026, 3, 27, 0, 7, 0, 0, time.UTC)
+
+	for _, expr := range exprs {
+		s, err := parseCron(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, within := range windows {
+			for step := 0; step < 200; step++ {
+				at := start.Add(time.Duration(step) * 53 * time.Minute)
+				want, wantOK := lastStartByMinute(s, at, within, berlin)
+				got, gotOK := s.lastStart(at, within, berlin)
+				if gotOK != wantOK || !got.Equal(want) {
+					t.Fatalf("%q within %s at %s: got %s %v, want %s %v", expr, within, at, got, gotOK, want, wantOK)
+				}
+			}
+		}
+	}
+}
+
+func TestActivationReusesPreviousAnswer(t *testing.T) {
+	s, err := parseCron("0 2 * * 6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &activation{}
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	for m := 0; m < 5*24*60; m += 7 {
+		at := start.Add(time.Duration(m) * time.Minute)
+		want, wantOK := lastStartByMinute(s, at, 3*time.Hour, time.UTC)
+		got, gotOK := a.lastStart(s, at, 3*time.Hour, time.UTC)
+		if gotOK != wantOK || !got.Equal(want) {
+			t.Fatalf("at %s: got %s %v, want %s %v", at, got, gotOK, want, wantOK)
+		}
+	}
+}
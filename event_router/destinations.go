@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// templateFuncs are available to every user-defined payload template
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	"now":   func() string { return time.Now().UTC().Format(time.RFC3339) },
+}
+
+// render produces the request body and content type for delivering an event
+// to a destination. A route-level template takes precedence over the
+// destination's own template, which takes precedence over the built-in format.
+func (t target) render(evt Event) ([]byte, string, error) {
+	d := t.dest
+	if d.Type == DestinationEmail {
+		to, err := t.emailRecipients(evt)
+		if err != nil {
+			return nil, "", err
+		}
+		msg, err := t.renderEmail(evt, to)
+		if err != nil {
+			return nil, "", fmt.Errorf("render email for %s: %w", t.Destination, err)
+		}
+		return msg, "message/rfc822", nil
+	}
+
+	tmpl := t.tmpl
+	if tmpl == nil {
+		tmpl = d.tmpl
+	}
+	if tmpl != nil {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, evt); err != nil {
+			return nil, "", fmt.Errorf("render template for %s: %w", t.Destination, err)
+		}
+		contentType := d.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		return buf.Bytes(), contentType, nil
+	}
+
+	var payload interface{}
+	switch d.Type {
+	case DestinationSlack:
+		payload = slackPayload(evt)
+	case DestinationTeams:
+		payload = teamsPayload(evt)
+	case DestinationPagerDuty:
+		p, err := pagerDutyPayload(d, evt)
+		if err != nil {
+			return nil, "", err
+		}
+		payload = p
+	default:
+		payload = evt
+	}
+
+	body, err := json.Marshal(payload)
+	return body, "application/json", err
+}
+
+/* ---------------- SLACK (Block Kit) ---------------- */
+
+var slackSeverityEmoji = map[string]string{
+	"critical": ":red_circle:",
+	"high":     ":large_orange_circle:",
+	"medium":   ":large_yellow_circle:",
+	"low":      ":large_blue_circle:",
+	"info":     ":white_circle:",
+}
+
+func slackPayload(evt Event) map[string]interface{} {
+	emoji := slackSeverityEmoji[evt.Type]
+	if emoji == "" {
+		emoji = ":grey_question:"
+	}
+	title := fmt.Sprintf("%s %s event on %s", emoji, strings.ToUpper(evt.Type), orDash(evt.SourceHost))
+
+	return map[string]interface{}{
+		"text": fmt.Sprintf("[%s] %s", evt.Type, messageText(evt)),
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "header",
+				"text": map[string]interface{}{"type": "plain_text", "text": title, "emoji": true},
+			},
+			map[string]interface{}{
+				"type": "section",
+				"text": map[string]interface{}{"type": "mrkdwn", "text": messageText(evt)},
+			},
+			map[string]interface{}{
+				"type": "section",
+				"fields": []interface{}{
+					map[string]interface{}{"type": "mrkdwn", "text": "*Severity:*\n" + evt.Type},
+					map[string]interface{}{"type": "mrkdwn", "text": "*Category:*\n" + orDash(evt.Category)},
+					map[string]interface{}{"type": "mrkdwn", "text": "*Host:*\n" + orDash(evt.SourceHost)},
+					map[string]interface{}{"type": "mrkdwn", "text": "*IP:*\n" + orDash(evt.SourceIP)},
+				},
+			},
+			map[string]interface{}{
+				"type": "context",
+				"elements": []interface{}{
+					map[string]interface{}{"type": "mrkdwn", "text": "Source: " + orDash(evt.EventType) + " via event-router"},
+				},
+			},
+		},
+	}
+}
+
+/* ---------------- MICROSOFT TEAMS (Adaptive Card) ---------------- */
+
+var teamsSeverityColor = map[string]string{
+	"critical": "attention",
+	"high":     "warning",
+	"medium":   "warning",
+	"low":      "accent",
+	"info":     "default",
+}
+
+func teamsPayload(evt Event) map[string]interface{} {
+	color := teamsSeverityColor[evt.Type]
+	if color == "" {
+		color = "default"
+	}
+
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []interface{}{
+			map[string]interface{}{
+				"type":   "TextBlock",
+				"text":   fmt.Sprintf("%s event on %s", strings.ToUpper(evt.Type), orDash(evt.SourceHost)),
+				"weight": "Bolder",
+				"size":   "Medium",
+				"color":  color,
+			},
+			map[string]interface{}{
+				"type": "TextBlock",
+				"text": messageText(evt),
+				"wrap": true,
+			},
+			map[string]interface{}{
+				"type": "FactSet",
+				"facts": []interface{}{
+					map[string]string{"title": "Severity", "value": evt.Type},
+					map[string]string{"title": "Category", "value": orDash(evt.Category)},
+					map[string]string{"title": "Host", "value": orDash(evt.SourceHost)},
+					map[string]string{"title": "IP", "value": orDash(evt.SourceIP)},
+					map[string]string{"title": "Source", "value": orDash(evt.EventType)},
+				},
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content":     card,
+			},
+		},
+	}
+}
+
+/* ---------------- PAGERDUTY (Events API v2) ---------------- */
+
+// pagerDutySeverity maps our severities onto the four PagerDuty accepts
+var pagerDutySeverity = map[string]string{
+	"critical": "critical",
+	"high":     "error",
+	"medium":   "warning",
+	"low":      "info",
+	"info":     "info",
+}
+
+// stateLabel marks an event as clearing an earlier one when set to
+// stateResolved, e.g. by the source or a lookup table
+const (
+	stateLabel    = "state"
+	stateResolved = "resolved"
+)
+
+// pagerDutySummaryMax is the longest summary PagerDuty accepts, in bytes
+const pagerDutySummaryMax = 1024
+
+// resolves reports whether an event clears the incident it is deduplicated
+// into. Only an explicit signal counts: wording such as "fan speed up" in a
+// failure message must never close an open incident.
+func (d *Destination) resolves(evt Event) bool {
+	if evt.Labels[stateLabel] == stateResolved {
+		return true
+	}
+	return d.resolveRe != nil && d.resolveRe.MatchString(evt.Message)
+}
+
+func pagerDutyPayload(d *Destination, evt Event) (map[string]interface{}, error) {
+	var key bytes.Buffer
+	if err := d.dedupTmpl.Execute(&key, evt); err != nil {
+		return nil, fmt.Errorf("render pagerduty dedup_key: %w", err)
+	}
+	// A key rendered from empty fields, such as ":", would merge unrelated
+	// events into one incident
+	dedup := key.String()
+	if !strings.ContainsFunc(dedup, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		dedup = evt.EventID
+	}
+
+	msg := map[string]interface{}{
+		"routing_key":  d.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    dedup,
+	}
+	if d.resolves(evt) {
+		// Resolve events only need the routing and dedup keys
+		msg["event_action"] = "resolve"
+		return msg, nil
+	}
+
+	severity := pagerDutySeverity[evt.Type]
+	if severity == "" {
+		severity = "info"
+	}
+	source := evt.SourceHost
+	if source == "" {
+		source = orDash(evt.SourceIP)
+	}
+	summary := truncateUTF8(messageText(evt), pagerDutySummaryMax)
+
+	msg["payload"] = map[string]interface{}{
+		"summary":   summary,
+		"source":    source,
+		"severity":  severity,
+		"component": evt.SourceHost,
+		"group":     evt.Category,
+		"class":     evt.EventType,
+		"custom_details": map[string]string{
+			"source_ip": evt.SourceIP,
+			"type":      evt.Type,
+		},
+	}
+	return msg, nil
+}
+
+// truncateUTF8 shortens s to at most max bytes without splitting a rune
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// noMessage stands in for an empty message, which Slack rejects in a
+// section and PagerDuty in a summary
+const noMessage = "(no message)"
+
+func messageText(evt Event) string {
+	if strings.TrimSpace(evt.Message) == "" {
+		return noMessage
+	}
+	return evt.Message
+}
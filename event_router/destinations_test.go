@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenConfig has one destination of every built-in chat and paging format
+const goldenConfig = `{
+  "destinations": {
+    "slack": {"type": "slack", "url": "https://hooks.slack.example/T000/B000"},
+    "teams": {"type": "teams", "url": "https://teams.example/webhook"},
+    "pagerduty": {"type": "pagerduty", "url": "https://events.pagerduty.example/v2/enqueue", "routing_key": "R0UT1NGKEY"},
+    "pagerduty-pattern": {"type": "pagerduty", "url": "https://events.pagerduty.example/v2/enqueue", "routing_key": "R0UT1NGKEY", "resolve_pattern": "(?i)^link up\\b"}
+  },
+  "routes": [{"name": "all", "destinations": ["slack", "teams", "pagerduty", "pagerduty-pattern"]}]
+}`
+
+var goldenEvent = Event{
+	Type:       "critical",
+	Message:    "Power supply 2 failed on chassis 1, fan speed up to 100%",
+	SourceHost: "core-sw-01",
+	SourceIP:   "10.0.0.1",
+	EventType:  "snmp",
+	Category:   "hardware",
+	EventID:    "evt-0000000000000001",
+}
+
+// goldenTarget returns a compiled destination from goldenConfig
+func goldenTarget(t *testing.T, name string) target {
+	t.Helper()
+	cfg, err := parseConfig([]byte(goldenConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target{Route: "all", Destination: name, dest: cfg.Destinations[name]}
+}
+
+// checkGolden compares a rendered payload with testdata/<name>.golden
+func checkGolden(t *testing.T, name string, body []byte) {
+	t.Helper()
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		t.Fatalf("payload is not JSON: %v\n%s", err, body)
+	}
+	indented.WriteByte('\n')
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, indented.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(indented.Bytes(), want) {
+		t.Errorf("payload differs from %s:\n%s", path, indented.Bytes())
+	}
+}
+
+func TestPayloadGolden(t *testing.T) {
+	resolved := goldenEvent
+	resolved.Type = "info"
+	resolved.Message = "Power supply 2 restored on chassis 1"
+	resolved.Labels = map[string]string{stateLabel: stateResolved}
+
+	linkUp := goldenEvent
+	linkUp.Type = "info"
+	linkUp.Message = "Link up on Gi0/1"
+
+	cases := []struct {
+		golden      string
+		destination string
+		evt         Event
+	}{
+		{"slack", "slack", goldenEvent},
+		{"teams", "teams", goldenEvent},
+		{"pagerduty_trigger", "pagerduty", goldenEvent},
+		{"pagerduty_resolve_label", "pagerduty", resolved},
+		{"pagerduty_resolve_pattern", "pagerduty-pattern", linkUp},
+		{"pagerduty_no_default_pattern", "pagerduty", linkUp},
+	}
+	for _, tc := range cases {
+		t.Run(tc.golden, func(t *testing.T) {
+			body, contentType, err := goldenTarget(t, tc.destination).render(tc.evt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != "application/json" {
+				t.Errorf("content type = %q, want application/json", contentType)
+			}
+			checkGolden(t, tc.golden, body)
+		})
+	}
+}
+
+// A failure whose message mentions "up" or "restored" must still trigger
+func TestPagerDutyIgnoresResolveWords(t *testing.T) {
+	d := goldenTarget(t, "pagerduty").dest
+	for _, msg := range []string{
+		"Power supply 2 failed, fan speed up to 100%",
+		"BGP session to 10.0.0.2 down, previously restored at 09:00",
+		"Interface Gi0/1 cleared counters then went down",
+	} {
+		evt := goldenEvent
+		evt.Message = msg
+		p, err := pagerDutyPayload(d, evt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p["event_action"] != "trigger" {
+			t.Errorf("%q: event_action = %v, want trigger", msg, p["event_action"])
+		}
+	}
+}
+
+func TestPagerDutySummaryKeepsRunesWhole(t *testing.T) {
+	d := goldenTarget(t, "pagerduty").dest
+	evt := goldenEvent
+	evt.Message = strings.Repeat("a", pagerDutySummaryMax-1) + "é and more"
+
+	p, err := pagerDutyPayload(d, evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := p["payload"].(map[string]interface{})["summary"].(string)
+	if !utf8.ValidString(summary) {
+		t.Fatalf("summary is not valid UTF-8: %q", summary[len(summary)-4:])
+	}
+	if len(summary) != pagerDutySummaryMax-1 {
+		t.Errorf("summary is %d bytes, want %d", len(summary), pagerDutySummaryMax-1)
+	}
+}
+
+// An event without a host or category is deduplicated by its own ID rather
+// than into one incident with every other such event
+func TestPagerDutyDedupKeyFallsBackToEventID(t *testing.T) {
+	d := goldenTarget(t, "pagerduty").dest
+	evt := goldenEvent
+	evt.SourceHost, evt.Category = "", ""
+	p, err := pagerDutyPayload(d, evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p["dedup_key"] != goldenEvent.EventID {
+		t.Errorf("dedup_key = %q, want the event ID %q", p["dedup_key"], goldenEvent.EventID)
+	}
+	if p, _ := pagerDutyPayload(d, goldenEvent); p["dedup_key"] != "core-sw-01:hardware" {
+		t.Errorf("dedup_key = %q, want core-sw-01:hardware", p["dedup_key"])
+	}
+}
+
+// An empty message is replaced where Slack, Teams and PagerDuty require text
+func TestEmptyMessageHasPlaceholder(t *testing.T) {
+	evt := goldenEvent
+	evt.Message = ""
+	for _, name := range []string{"slack", "teams", "pagerduty"} {
+		body, _, err := goldenTarget(t, name).render(evt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), noMessage) || strings.Contains(string(body), `"text":""`) {
+			t.Errorf("%s payload has no placeholder for the empty message:\n%s", name, body)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// DeliveryAttempt records a single try at delivering an event
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	DurationMs int64     `json:"duration_ms"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// DeadLetter is an event whose delivery failed after all retries. A failed
+// email digest is one entry whose Event is the digest's first event.
+type DeadLetter struct {
+	ID            string            `json:"id"`
+	Event         Event             `json:"event"`
+	Digest        *DeadDigest       `json:"digest,omitempty"`
+	Route         string            `json:"route"`
+	Destination   string            `json:"destination"`
+	Error         string            `json:"error"`
+	Attempts      []DeliveryAttempt `json:"attempts"`
+	FailedAt      time.Time         `json:"failed_at"`
+	RedriveCount  int               `json:"redrive_count"`
+	LastRedriveAt *time.Time        `json:"last_redrive_at,omitempty"`
+}
+
+// DeadDigest is the content of an email digest that could not be sent
+type DeadDigest struct {
+	Recipient string    `json:"recipient"`
+	Events    []Event   `json:"events"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+}
+
+func (dd *DeadDigest) data(destination string) digestData {
+	return digestData{Destination: destination, Recipient: dd.Recipient, Events: dd.Events, Since: dd.Since, Until: dd.Until}
+}
+
+// deadLetterFilter selects dead letters by route, destination, event type, host and failure time
+type deadLetterFilter struct {
+	Route       string    `json:"route" form:"route"`
+	Destination string    `json:"destination" form:"destination"`
+	Type        string    `json:"type" form:"type"`
+	SourceHost  string    `json:"source_host" form:"source_host"`
+	Since       time.Time `json:"since" form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until       time.Time `json:"until" form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+func (f deadLetterFilter) matches(d *DeadLetter) bool {
+	if f.Route != "" && d.Route != f.Route {
+		return false
+	}
+	if f.Destination != "" && d.Destination != f.Destination {
+		return false
+	}
+	if f.Type != "" && d.Event.Type != f.Type {
+		return false
+	}
+	if f.SourceHost != "" && d.Event.SourceHost != f.SourceHost {
+		return false
+	}
+	if !f.Since.IsZero() && d.FailedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && d.FailedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+var (
+	errDeadLetterNotFound = errors.New("dead letter not found")
+	errDeadLetterBusy     = errors.New("dead letter is being redriven")
+)
+
+// deadLetterQueue is a file-backed store of failed deliveries. Each change
+// is appended to a journal, so a storm of failures costs one line per entry
+// rather than a rewrite of the whole queue.
+type deadLetterQueue struct {
+	mu      sync.Mutex
+	entries map[string]*DeadLetter
+	claimed map[string]bool // entries being redriven
+	journal *fileutil.Journal
+}
+
+func newDeadLetterQueue(path string) (*deadLetterQueue, error) {
+	q := &deadLetterQueue{entries: make(map[string]*DeadLetter), claimed: make(map[string]bool)}
+
+	var err error
+	q.journal, err = fileutil.OpenJournal(path,
+		func(raw json.RawMessage) error {
+			var d DeadLetter
+			if err := json.Unmarshal(raw, &d); err != nil {
+				return err
+			}
+			q.entries[d.ID] = &d
+			return nil
+		},
+		func(id string) { delete(q.entries, id) },
+		func() interface{} { return q.sorted(deadLetterFilter{}) })
+	if err != nil {
+		return nil, err
+	}
+	if len(q.entries) > 0 {
+		log.Printf("Loaded %d dead-letter entries from %s", len(q.entries), path)
+	}
+	return q, nil
+}
+
+// sorted returns matching entries oldest first; callers must hold q.mu
+func (q *deadLetterQueue) sorted(f deadLetterFilter) []*DeadLetter {
+	out := []*DeadLetter{}
+	for _, d := range q.entries {
+		if f.matches(d) {
+			out = append(out, d)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].FailedAt.Before(out[j].FailedAt) })
+	return out
+}
+
+// Add stores a failed delivery
+func (q *deadLetterQueue) Add(event Event, t target, cause error, attempts []DeliveryAttempt) (DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d := &DeadLetter{
+		ID:          fileutil.NewID("dlq"),
+		Event:       event,
+		Route:       t.Route,
+		Destination: t.Destination,
+		Error:       cause.Error(),
+		Attempts:    attempts,
+		FailedAt:    time.Now().UTC(),
+	}
+	if err := q.journal.Put(d); err != nil {
+		return DeadLetter{}, err
+	}
+	q.entries[d.ID] = d
+	return *d, nil
+}
+
+// AddDigest stores a failed digest as a single entry
+func (q *deadLetterQueue) AddDigest(t target, data digestData, cause error, attempts []DeliveryAttempt) (DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d := &DeadLetter{
+		ID:          fileutil.NewID("dlq"),
+		Event:       data.Events[0],
+		Digest:      &DeadDigest{Recipient: data.Recipient, Events: data.Events, Since: data.Since, Until: data.Until},
+		Route:       t.Route,
+		Destination: t.Destination,
+		Error:       cause.Error(),
+		Attempts:    attempts,
+		FailedAt:    time.Now().UTC(),
+	}
+	if err := q.journal.Put(d); err != nil {
+		return DeadLetter{}, err
+	}
+	q.entries[d.ID] = d
+	return *d, nil
+}
+
+// List returns copies of the entries matching the filter
+func (q *deadLetterQueue) List(f deadLetterFilter) []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := []DeadLetter{}
+	for _, d := range q.sorted(f) {
+		out = append(out, *d)
+	}
+	return out
+}
+
+// Get returns a copy of a single entry
+func (q *deadLetterQueue) Get(id string) (DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d, ok := q.entries[id]
+	if !ok {
+		return DeadLetter{}, errDeadLetterNotFound
+	}
+	return *d, nil
+}
+
+// Remove deletes the entries with the given IDs and returns how many existed
+func (q *deadLetterQueue) Remove(ids ...string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := 0
+	for _, id := range ids {
+		if _, ok := q.entries[id]; !ok {
+			continue
+		}
+		if err := q.journal.Delete(id); err != nil {
+			return removed, err
+		}
+		delete(q.entries, id)
+		removed++
+	}
+	return removed, nil
+}
+
+// Claim reserves an entry for a redrive and returns its current copy. An
+// entry is redriven by one caller at a time, so a single redrive and a bulk
+// one cannot both deliver it.
+func (q *deadLetterQueue) Claim(id string) (DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d, ok := q.entries[id]
+	if !ok {
+		return DeadLetter{}, errDeadLetterNotFound
+	}
+	if q.claimed[id] {
+		return DeadLetter{}, errDeadLetterBusy
+	}
+	q.claimed[id] = true
+	return *d, nil
+}
+
+// Release ends a claim
+func (q *deadLetterQueue) Release(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.claimed, id)
+}
+
+// RecordRedriveFailure updates an entry after a failed redrive. The entry
+// only changes once the update is journaled.
+func (q *deadLetterQueue) RecordRedriveFailure(id string, t target, cause error, attempts []DeliveryAttempt) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d, ok := q.entries[id]
+	if !ok {
+		return errDeadLetterNotFound
+	}
+	now := time.Now().UTC()
+	next := *d
+	next.Route = t.Route
+	next.Destination = t.Destination
+	next.Error = cause.Error()
+	next.Attempts = append(d.Attempts[:len(d.Attempts):len(d.Attempts)], attempts...)
+	next.RedriveCount++
+	next.LastRedriveAt = &now
+	if err := q.journal.Put(&next); err != nil {
+		return err
+	}
+	*d = next
+	return nil
+}
+
+// redriveResult describes the outcome of redriving one entry
+type redriveResult struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Destination string `json:"destination,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// redriveTarget re-evaluates the current routing rules for a dead letter.
+// The original destination is reused if the event is still routed there;
+// otherwise the entry follows its original route to wherever it points now.
+func redriveTarget(d DeadLetter) (target, bool) {
+	targets := configs.current().resolve(d.Event)
+	for _, t := range targets {
+		if t.Destination == d.Destination {
+			return t, true
+		}
+	}
+	for _, t := range targets {
+		if t.Route == d.Route {
+			return t, true
+		}
+	}
+	return target{}, false
+}
+
+// redrive re-delivers an entry using the current routing rules rather than
+// the configuration in effect when it failed. The entry is claimed first,
+// and skipped if another redrive holds it or it is already gone.
+func redrive(entry DeadLetter) redriveResult {
+	d, err := dlq.Claim(entry.ID)
+	switch {
+	case errors.Is(err, errDeadLetterBusy):
+		return redriveResult{ID: entry.ID, Status: "busy", Error: err.Error()}
+	case err != nil:
+		return redriveResult{ID: entry.ID, Status: "not_found", Error: err.Error()}
+	}
+	defer dlq.Release(d.ID)
+
+	t, ok := redriveTarget(d)
+	if !ok {
+		return redriveResult{ID: d.ID, Status: "no_route", Error: fmt.Sprintf("event no longer routes to %s via route %s", d.Destination, d.Route)}
+	}
+
+	if d.Digest != nil {
+		return redriveDigest(d, t)
+	}
+
+	response, attempts, err := deliverWithRetry(t, t.event(d.Event))
+	if err != nil {
+		reportStatus(d.Event.EventID, []models.StatusUpdate{{Status: constants.StatusFailed, Destination: t.Destination, Detail: "redrive: " + err.Error()}})
+		if recErr := dlq.RecordRedriveFailure(d.ID, t, err, attempts); recErr != nil {
+			log.Printf("Failed to update dead-letter entry %s: %v", d.ID, recErr)
+		}
+		return redriveResult{ID: d.ID, Status: "failed", Destination: t.Destination, Error: err.Error()}
+	}
+
+	reportStatus(d.Event.EventID, []models.StatusUpdate{{Status: constants.StatusDelivered, Destination: t.Destination, Detail: response}})
+	if _, err := dlq.Remove(d.ID); err != nil {
+		log.Printf("Redrove %s but failed to remove it from the DLQ: %v", d.ID, err)
+	}
+	return redriveResult{ID: d.ID, Status: "delivered", Destination: t.Destination}
+}
+
+// redriveDigest sends a dead-lettered digest again, as one email to its
+// recipient, if its events still go to a digesting email destination
+func redriveDigest(d DeadLetter, t target) redriveResult {
+	if !t.digested(t.event(d.Event)) {
+		return redriveResult{ID: d.ID, Status: "no_route", Error: fmt.Sprintf("%s no longer sends digests for %s events", t.Destination, d.Event.Type)}
+	}
+	data := d.Digest.data(t.Destination)
+
+	attempts, err := sendDigest(t, data)
+	if err != nil {
+		reportDigest(data, models.StatusUpdate{Status: constants.StatusFailed, Destination: t.Destination, Detail: "redrive: " + err.Error()})
+		if recErr := dlq.RecordRedriveFailure(d.ID, t, err, attempts); recErr != nil {
+			log.Printf("Failed to update dead-letter entry %s: %v", d.ID, recErr)
+		}
+		return redriveResult{ID: d.ID, Status: "failed", Destination: t.Destination, Error: err.Error()}
+	}
+
+	reportDigest(data, models.StatusUpdate{Status: constants.StatusDelivered, Destination: t.Destination, Detail: "sent in digest to " + data.Recipient})
+	if _, err := dlq.Remove(d.ID); err != nil {
+		log.Printf("Redrove %s but failed to remove it from the DLQ: %v", d.ID, err)
+	}
+	return redriveResult{ID: d.ID, Status: "delivered", Destination: t.Destination}
+}
+
+/* ---------------- HANDLERS ---------------- */
+
+func listDeadLetters(c *gin.Context) {
+	var f deadLetterFilter
+	if err := c.ShouldBindQuery(&f); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entries := dlq.List(f)
+	c.JSON(http.StatusOK, gin.H{"count": len(entries), "entries": entries})
+}
+
+func getDeadLetter(c *gin.Context) {
+	d, err := dlq.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func redriveDeadLetter(c *gin.Context) {
+	d, err := dlq.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := redrive(d)
+	status := http.StatusOK
+	switch result.Status {
+	case "no_route", "busy":
+		status = http.StatusConflict
+	case "not_found":
+		status = http.StatusNotFound
+	case "failed":
+		status = http.StatusBadGateway
+	}
+	c.JSON(status, result)
+}
+
+// redriveRun is a bulk redrive working through its entries in the background
+type redriveRun struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"` // running or done
+	Requested  int             `json:"requested"`
+	Delivered  int             `json:"delivered"`
+	Failed     int             `json:"failed"`
+	Skipped    int             `json:"skipped"` // being redriven elsewhere, or gone
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Results    []redriveResult `json:"results"`
+}
+
+// maxRedriveRuns is how many finished bulk redrives are kept for inspection
+const maxRedriveRuns = 20
+
+// redriveRuns tracks bulk redrives. Only one runs at a time; entries are
+// claimed one by one as the run reaches them, which keeps a single redrive
+// from delivering them at the same time.
+var redriveRuns = struct {
+	sync.Mutex
+	runs    map[string]*redriveRun
+	order   []string
+	running bool
+}{runs: make(map[string]*redriveRun)}
+
+// startRedrive registers a bulk redrive and works through it in the
+// background; it returns false while another one is still running
+func startRedrive(entries []DeadLetter) (redriveRun, bool) {
+	redriveRuns.Lock()
+	defer redriveRuns.Unlock()
+	if redriveRuns.running {
+		return redriveRun{}, false
+	}
+	run := &redriveRun{
+		ID: fileutil.NewID("redrive"), Status: "running", Requested: len(entries),
+		StartedAt: time.Now().UTC(), Results: []redriveResult{},
+	}
+	redriveRuns.running = true
+	redriveRuns.runs[run.ID] = run
+	redriveRuns.order = append(redriveRuns.order, run.ID)
+	if len(redriveRuns.order) > maxRedriveRuns {
+		delete(redriveRuns.runs, redriveRuns.order[0])
+		redriveRuns.order = redriveRuns.order[1:]
+	}
+
+	go func() {
+		for _, d := range entries {
+			result := redrive(d)
+			redriveRuns.Lock()
+			switch result.Status {
+			case "delivered":
+				run.Delivered++
+			case "busy", "not_found":
+				run.Skipped++
+			default:
+				run.Failed++
+			}
+			run.Results = append(run.Results, result)
+			redriveRuns.Unlock()
+		}
+
+		redriveRuns.Lock()
+		now := time.Now().UTC()
+		run.Status, run.FinishedAt = "done", &now
+		redriveRuns.running = false
+		redriveRuns.Unlock()
+		log.Printf("Bulk redrive %s: %d/%d delivered", run.ID, run.Delivered, run.Requested)
+	}()
+	return run.snapshot(), true
+}
+
+// snapshot copies a run; callers must hold redriveRuns
+func (r *redriveRun) snapshot() redriveRun {
+	out := *r
+	out.Results = append([]redriveResult{}, r.Results...)
+	return out
+}
+
+// redriveDeadLetters starts redriving every entry matching the filter in the
+// JSON body, or an explicit list of IDs. Deliveries retry with backoff, so
+// the redrive runs in the background; poll /admin/dlq/redrives/:id for its
+// progress.
+func redriveDeadLetters(c *gin.Context) {
+	var req struct {
+		deadLetterFilter
+		IDs []string `json:"ids"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var entries []DeadLetter
+	if len(req.IDs) > 0 {
+		for _, id := range req.IDs {
+			if d, err := dlq.Get(id); err == nil {
+				entries = append(entries, d)
+			}
+		}
+	} else {
+		entries = dlq.List(req.deadLetterFilter)
+	}
+
+	run, ok := startRedrive(entries)
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "a bulk redrive is already running"})
+		return
+	}
+	c.Header("Location", "/admin/dlq/redrives/"+run.ID)
+	c.JSON(http.StatusAccepted, run)
+}
+
+// listRedrives returns the recent bulk redrives, newest first
+func listRedrives(c *gin.Context) {
+	redriveRuns.Lock()
+	defer redriveRuns.Unlock()
+	out := []redriveRun{}
+	for i := len(redriveRuns.order) - 1; i >= 0; i-- {
+		out = append(out, redriveRuns.runs[redriveRuns.order[i]].snapshot())
+	}
+	c.JSON(http.StatusOK, gin.H{"count": len(out), "redrives": out})
+}
+
+// getRedrive reports the progress of a bulk redrive
+func getRedrive(c *gin.Context) {
+	redriveRuns.Lock()
+	defer redriveRuns.Unlock()
+	run, ok := redriveRuns.runs[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "redrive not found"})
+		return
+	}
+	c.JSON(http.StatusOK, run.snapshot())
+}
+
+func deleteDeadLetter(c *gin.Context) {
+	removed, err := dlq.Remove(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": errDeadLetterNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted", "id": c.Param("id")})
+}
+
+// purgeDeadLetters removes every entry matching the query filter.
+// Purging the whole queue requires ?all=true to avoid accidents.
+func purgeDeadLetters(c *gin.Context) {
+	var f deadLetterFilter
+	if err := c.ShouldBindQuery(&f); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if f == (deadLetterFilter{}) && c.Query("all") != "true" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refusing to purge without a filter; pass all=true to purge everything"})
+		return
+	}
+
+	var ids []string
+	for _, d := range dlq.List(f) {
+		ids = append(ids, d.ID)
+	}
+	removed, err := dlq.Remove(ids...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Purged %d dead-letter entries", removed)
+	c.JSON(http.StatusOK, gin.H{"status": "purged", "removed": removed})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dlqTest routes critical events to a webhook answering with status and
+// info events to an archive webhook, and fills the DLQ with failures for both
+func dlqTest(t *testing.T, status *int) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(*status)
+	}))
+	t.Cleanup(srv.Close)
+	routingFixture(t, fmt.Sprintf(`{
+  "destinations": {
+    "pager": {"type": "webhook", "url": %q},
+    "archive": {"type": "webhook", "url": %q}
+  },
+  "routes": [
+    {"name": "critical", "match": {"types": ["critical"]}, "destinations": ["pager"]},
+    {"name": "info", "match": {"types": ["info"]}, "destinations": ["archive"]}
+  ]
+}`, srv.URL, srv.URL))
+	maxRetries, retryBackoff = 0, time.Millisecond
+
+	for i, evt := range []Event{
+		{EventID: "evt-1", Type: "critical", SourceHost: "core-1", Message: "link down"},
+		{EventID: "evt-2", Type: "critical", SourceHost: "core-2", Message: "link down"},
+		{EventID: "evt-3", Type: "info", SourceHost: "core-1", Message: "port flap"},
+	} {
+		tg := configs.current().resolve(evt)[0]
+		if _, err := dlq.Add(evt, tg, errors.New("503"), nil); err != nil {
+			t.Fatal(err)
+		}
+		// Distinct failure times for the time filters
+		time.Sleep(time.Duration(i+1) * time.Millisecond)
+	}
+}
+
+// adminRequest sends a request to a handler registered on its own engine
+func adminRequest(method, pattern, target, body string, h gin.HandlerFunc) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Handle(method, pattern, h)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestDeadLetterFilter(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	dlqTest(t, &status)
+	all := dlq.List(deadLetterFilter{})
+	if len(all) != 3 || all[0].Event.EventID != "evt-1" {
+		t.Fatalf("entries = %+v, want 3 oldest first", all)
+	}
+
+	for _, tc := range []struct {
+		filter deadLetterFilter
+		want   string
+	}{
+		{deadLetterFilter{Route: "critical"}, "evt-1,evt-2"},
+		{deadLetterFilter{Destination: "archive"}, "evt-3"},
+		{deadLetterFilter{Type: "critical", SourceHost: "core-2"}, "evt-2"},
+		{deadLetterFilter{Since: all[1].FailedAt}, "evt-2,evt-3"},
+		{deadLetterFilter{Until: all[1].FailedAt}, "evt-1,evt-2"},
+		{deadLetterFilter{Route: "nope"}, ""},
+	} {
+		var ids []string
+		for _, d := range dlq.List(tc.filter) {
+			ids = append(ids, d.Event.EventID)
+		}
+		if got := strings.Join(ids, ","); got != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestDeadLetterPurge(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	dlqTest(t, &status)
+
+	if w := adminRequest("DELETE", "/admin/dlq", "/admin/dlq", "", purgeDeadLetters); w.Code != http.StatusBadRequest {
+		t.Errorf("purge without a filter = %d, want 400", w.Code)
+	}
+	w := adminRequest("DELETE", "/admin/dlq", "/admin/dlq?source_host=core-1", "", purgeDeadLetters)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"removed":2`) {
+		t.Errorf("purge by host = %d %s, want 2 removed", w.Code, w.Body)
+	}
+	if left := dlq.List(deadLetterFilter{}); len(left) != 1 || left[0].Event.EventID != "evt-2" {
+		t.Errorf("entries left = %+v, want evt-2", left)
+	}
+	if w := adminRequest("DELETE", "/admin/dlq", "/admin/dlq?all=true", "", purgeDeadLetters); w.Code != http.StatusOK || len(dlq.List(deadLetterFilter{})) != 0 {
+		t.Errorf("purge all = %d %s, want an empty queue", w.Code, w.Body)
+	}
+}
+
+// A failed redrive is recorded on the entry; one that succeeds removes it
+func TestDeadLetterRedrive(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	dlqTest(t, &status)
+	d := dlq.List(deadLetterFilter{Route: "critical"})[0]
+
+	w := adminRequest("POST", "/admin/dlq/:id/redrive", "/admin/dlq/"+d.ID+"/redrive", "", redriveDeadLetter)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("failing redrive = %d %s, want 502", w.Code, w.Body)
+	}
+	if got, _ := dlq.Get(d.ID); got.RedriveCount != 1 || got.LastRedriveAt == nil || len(got.Attempts) != 1 {
+		t.Errorf("failed redrive not recorded: %+v", got)
+	}
+
+	status = http.StatusOK
+	if w := adminRequest("POST", "/admin/dlq/:id/redrive", "/admin/dlq/"+d.ID+"/redrive", "", redriveDeadLetter); w.Code != http.StatusOK {
+		t.Errorf("redrive = %d %s, want 200", w.Code, w.Body)
+	}
+	if _, err := dlq.Get(d.ID); err == nil {
+		t.Error("redriven entry kept in the DLQ")
+	}
+	if w := adminRequest("POST", "/admin/dlq/:id/redrive", "/admin/dlq/"+d.ID+"/redrive", "", redriveDeadLetter); w.Code != http.StatusNotFound {
+		t.Errorf("redrive of a removed entry = %d, want 404", w.Code)
+	}
+}
+
+// An entry claimed by one redrive is skipped by any other, so a single and
+// a bulk redrive never both deliver it
+func TestDeadLetterRedriveClaims(t *testing.T) {
+	status := http.StatusOK
+	dlqTest(t, &status)
+	entries := dlq.List(deadLetterFilter{})
+
+	claimed, err := dlq.Claim(entries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := redrive(claimed); r.Status != "busy" {
+		t.Errorf("redrive of a claimed entry = %+v, want busy", r)
+	}
+	if w := adminRequest("POST", "/admin/dlq/:id/redrive", "/admin/dlq/"+claimed.ID+"/redrive", "", redriveDeadLetter); w.Code != http.StatusConflict {
+		t.Errorf("redrive of a claimed entry = %d, want 409", w.Code)
+	}
+
+	run, ok := startRedrive(entries)
+	if !ok {
+		t.Fatal("bulk redrive not started")
+	}
+	var done redriveRun
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		redriveRuns.Lock()
+		done = redriveRuns.runs[run.ID].snapshot()
+		redriveRuns.Unlock()
+		if done.Status == "done" {
+			break
+		}
+	}
+	if done.Status != "done" || done.Delivered != 2 || done.Skipped != 1 || done.Failed != 0 {
+		t.Errorf("bulk redrive = %+v, want 2 delivered and the claimed entry skipped", done)
+	}
+	if _, err := dlq.Get(claimed.ID); err != nil {
+		t.Error("claimed entry removed by the bulk redrive")
+	}
+	dlq.Release(claimed.ID)
+	if r := redrive(claimed); r.Status != "delivered" {
+		t.Errorf("redrive after release = %+v", r)
+	}
+}
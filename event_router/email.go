@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// EmailSettings configure an email destination. The destination URL names
+// the SMTP server: smtp://host:port (STARTTLS, port 587 by default) or
+// smtps://host:port (implicit TLS, port 465 by default). The destination's
+// template, or a route's, replaces the plain-text body.
+type EmailSettings struct {
+	From string `json:"from"`
+	// To lists recipients; each entry is a text/template, so an address can
+	// come from the event, e.g. "{{.Labels.owner_email}}". Empty results and
+	// duplicates are skipped.
+	To       []string `json:"to"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	// PasswordEnv names an environment variable holding the password
+	PasswordEnv string `json:"password_env,omitempty"`
+	// StartTLS is required (default), optional or off; smtps:// always uses TLS
+	StartTLS string `json:"starttls,omitempty"`
+
+	Subject          string `json:"subject,omitempty"`
+	HTMLTemplate     string `json:"html_template,omitempty"`
+	HTMLTemplateFile string `json:"html_template_file,omitempty"`
+
+	Digest *EmailDigest `json:"digest,omitempty"`
+
+	to      []*template.Template
+	subject *template.Template
+	html    *htmltemplate.Template
+}
+
+// EmailDigest batches events of the listed severities into one email per
+// recipient every Interval, instead of one email per event
+type EmailDigest struct {
+	Interval  string   `json:"interval,omitempty"`   // default 15m
+	Types     []string `json:"types,omitempty"`      // default low and info
+	MaxEvents int      `json:"max_events,omitempty"` // send early at this many, default 100
+
+	Subject          string `json:"subject,omitempty"`
+	Template         string `json:"template,omitempty"`
+	TemplateFile     string `json:"template_file,omitempty"`
+	HTMLTemplate     string `json:"html_template,omitempty"`
+	HTMLTemplateFile string `json:"html_template_file,omitempty"`
+
+	interval time.Duration
+	subject  *template.Template
+	text     *template.Template
+	html     *htmltemplate.Template
+}
+
+// StartTLS modes
+const (
+	StartTLSRequired = "required"
+	StartTLSOptional = "optional"
+	StartTLSOff      = "off"
+)
+
+const (
+	defaultEmailSubject = `[{{upper .Type}}] {{with .SourceHost}}{{.}}: {{end}}{{.Message}}`
+	defaultEmailText    = `Severity: {{.Type}}
+{{with .SourceHost}}Host: {{.}}
+{{end}}{{with .SourceIP}}IP: {{.}}
+{{end}}{{with .Category}}Category: {{.}}
+{{end}}{{with .EventID}}Event ID: {{.}}
+{{end}}
+{{.Message}}
+{{range $k, $v := .Labels}}
+{{$k}}: {{$v}}{{end}}
+`
+	defaultEmailHTML = `<html><body>
+<h3>[{{upper .Type}}] {{with .SourceHost}}{{.}}: {{end}}{{.Message}}</h3>
+<table>
+<tr><td>Severity</td><td>{{.Type}}</td></tr>
+{{with .SourceHost}}<tr><td>Host</td><td>{{.}}</td></tr>{{end}}
+{{with .SourceIP}}<tr><td>IP</td><td>{{.}}</td></tr>{{end}}
+{{with .Category}}<tr><td>Category</td><td>{{.}}</td></tr>{{end}}
+{{with .EventID}}<tr><td>Event ID</td><td>{{.}}</td></tr>{{end}}
+{{range $k, $v := .Labels}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>{{end}}
+</table>
+</body></html>
+`
+	defaultDigestSubject = `{{len .Events}} events from {{.Since.Format "2006-01-02 15:04"}} to {{.Until.Format "15:04 MST"}}`
+	defaultDigestText    = `{{len .Events}} events between {{.Since.Format "2006-01-02 15:04"}} and {{.Until.Format "2006-01-02 15:04 MST"}}:
+{{range .Events}}
+[{{upper .Type}}] {{with .SourceHost}}{{.}}: {{end}}{{.Message}}{{end}}
+`
+	defaultDigestHTML = `<html><body>
+<h3>{{len .Events}} events between {{.Since.Format "2006-01-02 15:04"}} and {{.Until.Format "2006-01-02 15:04 MST"}}</h3>
+<table>
+<tr><th>Severity</th><th>Host</th><th>Message</th></tr>
+{{range .Events}}<tr><td>{{.Type}}</td><td>{{.SourceHost}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+</body></html>
+`
+)
+
+// compileEmail validates an email destination and parses its templates
+func (d *Destination) compileEmail(name string) error {
+	e := d.Email
+	if e == nil {
+		return fmt.Errorf("destination %q: email destinations need email settings", name)
+	}
+	u, err := url.Parse(d.URL)
+	if err != nil || (u.Scheme != "smtp" && u.Scheme != "smtps") || u.Hostname() == "" {
+		return fmt.Errorf("destination %q: url must be smtp://host:port or smtps://host:port", name)
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		return fmt.Errorf("destination %q: from: %w", name, err)
+	}
+	if len(e.To) == 0 {
+		return fmt.Errorf("destination %q: email destinations need at least one recipient in to", name)
+	}
+	switch e.StartTLS {
+	case "":
+		e.StartTLS = StartTLSRequired
+	case StartTLSRequired, StartTLSOptional, StartTLSOff:
+	default:
+		return fmt.Errorf("destination %q: starttls must be required, optional or off", name)
+	}
+
+	e.to = make([]*template.Template, len(e.To))
+	for i, to := range e.To {
+		// A missing label yields no recipient rather than "<no value>"
+		if e.to[i], err = template.New(name + "-to").Funcs(templateFuncs).Option("missingkey=zero").Parse(to); err != nil {
+			return fmt.Errorf("destination %q: to: %w", name, err)
+		}
+	}
+	if e.subject, err = parseTextTemplate(name+"-subject", e.Subject, "", defaultEmailSubject); err != nil {
+		return fmt.Errorf("destination %q: subject: %w", name, err)
+	}
+	if e.html, err = parseHTMLTemplate(name+"-html", e.HTMLTemplate, e.HTMLTemplateFile, defaultEmailHTML); err != nil {
+		return fmt.Errorf("destination %q: html_template: %w", name, err)
+	}
+
+	if dg := e.Digest; dg != nil {
+		dg.interval = 15 * time.Minute
+		if dg.Interval != "" {
+			if dg.interval, err = time.ParseDuration(dg.Interval); err != nil || dg.interval <= 0 {
+				return fmt.Errorf("destination %q: digest interval must be a positive duration", name)
+			}
+		}
+		if len(dg.Types) == 0 {
+			dg.Types = []string{"low", "info"}
+		}
+		if dg.MaxEvents <= 0 {
+			dg.MaxEvents = 100
+		}
+		if dg.subject, err = parseTextTemplate(name+"-digest-subject", dg.Subject, "", defaultDigestSubject); err != nil {
+			return fmt.Errorf("destination %q: digest subject: %w", name, err)
+		}
+		if dg.text, err = parseTextTemplate(name+"-digest", dg.Template, dg.TemplateFile, defaultDigestText); err != nil {
+			return fmt.Errorf("destination %q: digest template: %w", name, err)
+		}
+		if dg.html, err = parseHTMLTemplate(name+"-digest-html", dg.HTMLTemplate, dg.HTMLTemplateFile, defaultDigestHTML); err != nil {
+			return fmt.Errorf("destination %q: digest html_template: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func parseTextTemplate(name, text, file, fallback string) (*template.Template, error) {
+	src, err := templateSource(text, file, fallback)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(name).Funcs(templateFuncs).Parse(src)
+}
+
+// parseHTMLTemplate uses html/template so event fields are escaped
+func parseHTMLTemplate(name, text, file, fallback string) (*htmltemplate.Template, error) {
+	src, err := templateSource(text, file, fallback)
+	if err != nil {
+		return nil, err
+	}
+	return htmltemplate.New(name).Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(src)
+}
+
+func templateSource(text, file, fallback string) (string, error) {
+	switch {
+	case text != "" && file != "":
+		return "", fmt.Errorf("set either the template or its file, not both")
+	case file != "":
+		return readTemplateFile(file)
+	case text != "":
+		return text, nil
+	}
+	return fallback, nil
+}
+
+/* ---------------- RENDERING ---------------- */
+
+// emailRecipients renders the recipient list for an event
+func (t target) emailRecipients(evt Event) ([]string, error) {
+	seen := make(map[string]bool)
+	var out []string
+	for _, tmpl := range t.dest.Email.to {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, evt); err != nil {
+			return nil, fmt.Errorf("render recipients for %s: %w", t.Destination, err)
+		}
+		for _, addr := range strings.Split(buf.String(), ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" || seen[addr] {
+				continue
+			}
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return nil, fmt.Errorf("recipient %q for %s: %w", addr, t.Destination, err)
+			}
+			seen[addr] = true
+			out = append(out, addr)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no recipients for %s", t.Destination)
+	}
+	return out, nil
+}
+
+// renderEmail builds the message for a single event
+func (t target) renderEmail(evt Event, to []string) ([]byte, error) {
+	e := t.dest.Email
+	text := t.tmpl
+	if text == nil {
+		text = t.dest.tmpl
+	}
+	if text == nil {
+		text = defaultEmailTextTemplate
+	}
+	return buildEmail(e, to, e.subject, text, e.html, evt)
+}
+
+var defaultEmailTextTemplate = template.Must(template.New("email-text").Funcs(templateFuncs).Parse(defaultEmailText))
+
+// buildEmail renders the subject and bodies and assembles a
+// multipart/alternative message. The message depends on nothing but its
+// input, so explain can compare renderings; the MIME boundary is derived
+// from the content, and Date and Message-ID are added by smtpSend.
+func buildEmail(e *EmailSettings, to []string, subject, text *template.Template, html *htmltemplate.Template, data interface{}) ([]byte, error) {
+	var subj, plain, rich bytes.Buffer
+	if err := subject.Execute(&subj, data); err != nil {
+		return nil, fmt.Errorf("subject: %w", err)
+	}
+	if err := text.Execute(&plain, data); err != nil {
+		return nil, fmt.Errorf("text body: %w", err)
+	}
+	if err := html.Execute(&rich, data); err != nil {
+		return nil, fmt.Errorf("html body: %w", err)
+	}
+
+	var msg bytes.Buffer
+	body := multipart.NewWriter(&msg)
+	sum := sha256.Sum256(append(plain.Bytes(), rich.Bytes()...))
+	if err := body.SetBoundary("alt-" + hex.EncodeToString(sum[:16])); err != nil {
+		return nil, err
+	}
+	headers := []string{
+		"From: " + e.From,
+		"To: " + strings.Join(to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subj.String()), " ")),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + body.Boundary(),
+	}
+	var out bytes.Buffer
+	out.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", plain.Bytes()},
+		{"text/html; charset=utf-8", rich.Bytes()},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		qp.Write(part.content)
+		qp.Close()
+	}
+	body.Close()
+	out.Write(msg.Bytes())
+	return out.Bytes(), nil
+}
+
+// stampEmail adds the headers that differ every time a message is sent
+func stampEmail(from string, msg []byte) []byte {
+	headers := "Date: " + time.Now().Format(time.RFC1123Z) + "\r\nMessage-ID: " + messageID(from) + "\r\n"
+	return append([]byte(headers), msg...)
+}
+
+func messageID(from string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	domain := "event-router"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			domain = addr.Address[i+1:]
+		}
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+/* ---------------- SENDING ---------------- */
+
+// smtpTLSConfig is used for STARTTLS and smtps connections; nil means the
+// system defaults for the server name
+var smtpTLSConfig *tls.Config
+
+const smtpTimeout = 30 * time.Second
+
+// sendEmail delivers an event to an email destination, or adds it to the
+// recipients' digests when its severity is batched
+func sendEmail(t target, evt Event) (string, error) {
+	to, err := t.emailRecipients(evt)
+	if err != nil {
+		return "", &renderError{err}
+	}
+	if t.digested(evt) {
+		for _, rcpt := range to {
+			if err := digests.add(t, rcpt, evt); err != nil {
+				return "", err
+			}
+		}
+		return "queued for digest to " + strings.Join(to, ", "), nil
+	}
+
+	msg, err := t.renderEmail(evt, to)
+	if err != nil {
+		return "", &renderError{fmt.Errorf("render email for %s: %w", t.Destination, err)}
+	}
+	if err := smtpSend(t.dest, to, msg); err != nil {
+		return "", err
+	}
+	return "sent to " + strings.Join(to, ", "), nil
+}
+
+// digested reports whether an event goes into the recipients' digests
+// rather than being sent on its own
+func (t target) digested(evt Event) bool {
+	if t.dest == nil || t.dest.Type != DestinationEmail {
+		return false
+	}
+	dg := t.dest.Email.Digest
+	return dg != nil && matchAny(dg.Types, evt.Type)
+}
+
+// smtpSend delivers a message over SMTP, upgrading the connection with
+// STARTTLS and authenticating as configured
+func smtpSend(d *Destination, to []string, msg []byte) error {
+	e := d.Email
+	u, _ := url.Parse(d.URL)
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "587"
+		if u.Scheme == "smtps" {
+			port = "465"
+		}
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if smtpTLSConfig != nil {
+		tlsConfig = smtpTLSConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	addr := net.JoinHostPort(host, port)
+	var conn net.Conn
+	var err error
+	if u.Scheme == "smtps" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, smtpTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if u.Scheme == "smtp" && e.StartTLS != StartTLSOff {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("starttls: %w", err)
+			}
+		} else if e.StartTLS == StartTLSRequired {
+			return fmt.Errorf("%s does not offer STARTTLS", addr)
+		}
+	}
+	if e.Username != "" {
+		password := e.Password
+		if e.PasswordEnv != "" {
+			password = os.Getenv(e.PasswordEnv)
+		}
+		if err := c.Auth(smtp.PlainAuth("", e.Username, password, host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	from, _ := mail.ParseAddress(e.From)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		addr, _ := mail.ParseAddress(rcpt)
+		if err := c.Rcpt(addr.Address); err != nil {
+			return fmt.Errorf("recipient %s: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(stampEmail(e.From, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// permanentSMTPError reports whether the server rejected the message for
+// good (5xx), so retrying is pointless
+func permanentSMTPError(err error) bool {
+	for err != nil {
+		if te, ok := err.(*textproto.Error); ok {
+			return te.Code >= 500
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
+
+/* ---------------- DIGESTS ---------------- */
+
+// digestBatch collects events for one recipient of one destination. It
+// keeps the destination's name rather than its settings, so the digest is
+// sent with the config in effect when it goes out.
+type digestBatch struct {
+	ID          string    `json:"id"`
+	Route       string    `json:"route"`
+	Destination string    `json:"destination"`
+	Recipient   string    `json:"recipient"`
+	Events      []Event   `json:"events"`
+	Since       time.Time `json:"since"`
+
+	sendAt time.Time
+	timer  *time.Timer
+}
+
+// digestData is what digest templates see
+type digestData struct {
+	Destination string
+	Recipient   string
+	Events      []Event
+	Since       time.Time
+	Until       time.Time
+}
+
+// digestQueue holds pending digests. Every batch is journaled as events
+// join it and forgotten once it is sent or dead-lettered, so digests
+// pending when the router stops are sent after it starts again.
+type digestQueue struct {
+	mu      sync.Mutex
+	open    map[string]*digestBatch // taking events, by destination and recipient
+	stored  map[string]*digestBatch // every batch not yet sent, by ID
+	journal *fileutil.Journal
+}
+
+var digests *digestQueue
+
+func newDigestQueue(path string) (*digestQueue, error) {
+	q := &digestQueue{open: make(map[string]*digestBatch), stored: make(map[string]*digestBatch)}
+
+	var err error
+	q.journal, err = fileutil.OpenJournal(path,
+		func(raw json.RawMessage) error {
+			var b digestBatch
+			if err := json.Unmarshal(raw, &b); err != nil {
+				return err
+			}
+			q.stored[b.ID] = &b
+			return nil
+		},
+		func(id string) { delete(q.stored, id) },
+		func() interface{} { return q.sorted() })
+	if err != nil {
+		return nil, err
+	}
+	if len(q.stored) > 0 {
+		log.Printf("Loaded %d pending digests from %s", len(q.stored), path)
+	}
+	return q, nil
+}
+
+// sorted returns every stored batch, oldest first; callers must hold q.mu
+func (q *digestQueue) sorted() []*digestBatch {
+	out := make([]*digestBatch, 0, len(q.stored))
+	for _, b := range q.stored {
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Since.Before(out[j].Since) })
+	return out
+}
+
+// resume schedules the batches loaded from the journal for when their
+// interval ends, or at once when it already has
+func (q *digestQueue) resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, b := range q.sorted() {
+		key := b.Destination + "\x00" + b.Recipient
+		t, err := digestTarget(b)
+		if _, taken := q.open[key]; err != nil || taken {
+			go q.send(b)
+			continue
+		}
+		q.schedule(key, b, time.Until(b.Since.Add(t.dest.Email.Digest.interval)))
+	}
+}
+
+// schedule opens a batch for more events and sends it after wait; callers
+// must hold q.mu
+func (q *digestQueue) schedule(key string, b *digestBatch, wait time.Duration) {
+	b.sendAt = time.Now().Add(wait)
+	b.timer = time.AfterFunc(wait, func() { q.flush(key, b) })
+	q.open[key] = b
+	q.stored[b.ID] = b
+}
+
+// add puts an event in the recipient's digest. The batch is journaled
+// before the event is reported as queued.
+func (q *digestQueue) add(t target, recipient string, evt Event) error {
+	key := t.Destination + "\x00" + recipient
+	dg := t.dest.Email.Digest
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b, ok := q.open[key]
+	if !ok {
+		b = &digestBatch{ID: fileutil.NewID("dig"), Route: t.Route, Destination: t.Destination, Recipient: recipient, Since: time.Now()}
+	}
+	next := *b
+	next.Events = append(b.Events[:len(b.Events):len(b.Events)], evt)
+	if err := q.journal.Put(&next); err != nil {
+		return fmt.Errorf("journal digest: %w", err)
+	}
+	b.Events = next.Events
+	if !ok {
+		q.schedule(key, b, dg.interval)
+	}
+	if len(b.Events) >= dg.MaxEvents {
+		b.timer.Stop()
+		delete(q.open, key)
+		go q.send(b)
+	}
+	return nil
+}
+
+// flush sends a batch whose interval has elapsed
+func (q *digestQueue) flush(key string, b *digestBatch) {
+	q.mu.Lock()
+	if q.open[key] != b {
+		q.mu.Unlock()
+		return // already sent because it filled up
+	}
+	delete(q.open, key)
+	q.mu.Unlock()
+	q.send(b)
+}
+
+// digestTarget finds a batch's destination in the current config
+func digestTarget(b *digestBatch) (target, error) {
+	t := target{Route: b.Route, Destination: b.Destination}
+	dest := configs.current().Destinations[b.Destination]
+	if dest == nil || dest.Email == nil || dest.Email.Digest == nil {
+		return t, fmt.Errorf("%s no longer sends digests", b.Destination)
+	}
+	t.dest = dest
+	return t, nil
+}
+
+// send delivers a digest, retrying like any other delivery, and reports
+// each event in it as delivered. If it still fails, the digest is
+// dead-lettered as one entry so a redrive sends it once. A digest that
+// could be neither sent nor dead-lettered stays in the journal, to be sent
+// when the router next starts.
+func (q *digestQueue) send(b *digestBatch) {
+	data := digestData{Destination: b.Destination, Recipient: b.Recipient, Events: b.Events, Since: b.Since, Until: time.Now()}
+
+	t, err := digestTarget(b)
+	var attempts []DeliveryAttempt
+	if err == nil {
+		attempts, err = sendDigest(t, data)
+	}
+	if err == nil {
+		log.Printf("Sent digest of %d events to %s via %s", len(b.Events), b.Recipient, t.Destination)
+		reportDigest(data, models.StatusUpdate{Status: constants.StatusDelivered, Destination: t.Destination, Detail: "sent in digest to " + b.Recipient})
+		q.forget(b)
+		return
+	}
+
+	log.Printf("Digest of %d events to %s via %s failed: %v", len(b.Events), b.Recipient, t.Destination, err)
+	update := models.StatusUpdate{Status: constants.StatusFailed, Destination: t.Destination, Detail: fmt.Sprintf("digest to %s: %v", b.Recipient, err)}
+	entry, dlqErr := dlq.AddDigest(t, data, err, attempts)
+	if dlqErr != nil {
+		log.Printf("Failed to persist dead-letter entry: %v", dlqErr)
+	} else {
+		update.Detail += fmt.Sprintf(" (dead-lettered as %s)", entry.ID)
+		q.forget(b)
+	}
+	reportDigest(data, update)
+}
+
+// forget removes a batch that was sent or dead-lettered from the journal
+func (q *digestQueue) forget(b *digestBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.stored, b.ID)
+	if err := q.journal.Delete(b.ID); err != nil {
+		log.Printf("Failed to remove sent digest %s from the journal: %v", b.ID, err)
+	}
+}
+
+// sendDigest renders a digest for its one recipient and sends it, retrying
+// like any other delivery
+func sendDigest(t target, data digestData) ([]DeliveryAttempt, error) {
+	dg := t.dest.Email.Digest
+	msg, err := buildEmail(t.dest.Email, []string{data.Recipient}, dg.subject, dg.text, dg.html, data)
+	if err != nil {
+		return nil, &renderError{fmt.Errorf("render digest for %s: %w", t.Destination, err)}
+	}
+	var attempts []DeliveryAttempt
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		start := time.Now()
+		err = smtpSend(t.dest, []string{data.Recipient}, msg)
+		attempt := DeliveryAttempt{At: start, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		attempts = append(attempts, attempt)
+		if err == nil || i >= maxRetries || permanentSMTPError(err) {
+			return attempts, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// reportDigest reports the same update for every event in a digest
+func reportDigest(data digestData, u models.StatusUpdate) {
+	for _, evt := range data.Events {
+		reportStatus(evt.EventID, []models.StatusUpdate{u})
+	}
+}
+
+// listDigests shows the digests waiting to be sent
+func listDigests(c *gin.Context) {
+	out := digests.pending()
+	c.JSON(http.StatusOK, gin.H{"count": len(out), "digests": out})
+}
+
+func (q *digestQueue) pending() []gin.H {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := []gin.H{}
+	for _, b := range q.open {
+		out = append(out, gin.H{
+			"destination": b.Destination,
+			"recipient":   b.Recipient,
+			"events":      len(b.Events),
+			"since":       b.Since,
+			"send_at":     b.sendAt,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["since"].(time.Time).Before(out[j]["since"].(time.Time)) })
+	return out
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+)
+
+// emailTest starts an SMTP stand-in server and a router config with one
+// email destination, sending info events in digests of at most 3
+func emailTest(t *testing.T) (*smtpStandIn, target) {
+	t.Helper()
+	srv, err := newSMTPStandIn(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.close)
+	smtpTLSConfig = &tls.Config{RootCAs: srv.roots}
+	t.Cleanup(func() { smtpTLSConfig = nil })
+
+	routingFixture(t, fmt.Sprintf(`{
+  "destinations": {
+    "mail": {"type": "email", "url": "smtp://%s", "email": {
+      "from": "Event Router <router@example.com>",
+      "to": ["noc@example.com", "{{.Labels.owner_email}}"],
+      "username": "router", "password": "secret",
+      "digest": {"interval": "300ms", "types": ["info"], "max_events": 3}
+    }}
+  },
+  "routes": [{"name": "all", "match": {}, "destinations": ["mail"]}]
+}`, srv.addr()))
+	maxRetries, retryBackoff = 1, 10*time.Millisecond
+	return srv, configs.current().resolve(Event{Type: "critical"})[0]
+}
+
+// A critical event is sent right away, over TLS, to every recipient
+func TestEmailDelivery(t *testing.T) {
+	srv, mail := emailTest(t)
+
+	_, _, err := deliverWithRetry(mail, Event{Type: "critical", SourceHost: "core-1", Message: "link <b>down</b>",
+		Labels: map[string]string{"owner_email": "net-team@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.take()
+	if len(msgs) != 1 {
+		t.Fatalf("messages sent = %d, want 1", len(msgs))
+	}
+	m := msgs[0]
+	if !m.tls || !m.auth {
+		t.Errorf("tls = %v, auth = %v, want both", m.tls, m.auth)
+	}
+	if got := strings.Join(m.to, ","); got != "noc@example.com,net-team@example.com" {
+		t.Errorf("recipients = %s", got)
+	}
+	if m.subject != "[CRITICAL] core-1: link <b>down</b>" {
+		t.Errorf("subject = %q", m.subject)
+	}
+	if !strings.Contains(m.parts["text/plain"], "link <b>down</b>") {
+		t.Errorf("plain-text part = %q", m.parts["text/plain"])
+	}
+	if !strings.Contains(m.parts["text/html"], "link &lt;b&gt;down&lt;/b&gt;") {
+		t.Errorf("HTML part does not escape event fields: %q", m.parts["text/html"])
+	}
+	if m.date == "" || m.id == "" {
+		t.Errorf("Date = %q, Message-ID = %q, want both set when sending", m.date, m.id)
+	}
+}
+
+// Rendering an email twice gives the same bytes, so explain can compare a
+// candidate config with the live one
+func TestEmailRenderingIsStable(t *testing.T) {
+	_, mail := emailTest(t)
+	evt := Event{Type: "critical", SourceHost: "core-1", Message: "link down", EventID: "evt-1"}
+
+	a, b := configs.current().explain(evt), configs.current().explain(evt)
+	if a.Destinations[0].PayloadText == "" || a.Destinations[0].PayloadText != b.Destinations[0].PayloadText {
+		t.Errorf("renderings differ:\n%s\n---\n%s", a.Destinations[0].PayloadText, b.Destinations[0].PayloadText)
+	}
+	if changes := diffExplanations(a, b); len(changes) != 0 {
+		t.Errorf("diff of a config with itself = %v, want none", changes)
+	}
+	if msg, _ := mail.renderEmail(evt, []string{"noc@example.com"}); strings.Contains(string(msg), "Message-ID") {
+		t.Error("rendered email has a Message-ID, want it added when sending")
+	}
+}
+
+// Info events are batched per recipient and reported as queued. Four events
+// for one owner fill a digest (max 3) early; the rest go out when the
+// interval ends.
+func TestEmailDigests(t *testing.T) {
+	srv, mail := emailTest(t)
+
+	for i := 1; i <= 4; i++ {
+		r := deliver(mail, Event{Type: "info", SourceHost: "edge-1", Message: fmt.Sprintf("port flap %d", i),
+			Labels: map[string]string{"owner_email": "edge-team@example.com"}})
+		if r.Status != constants.StatusQueued {
+			t.Errorf("info event %d: %+v, want queued", i, r)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := perRecipient(srv.take()); len(got) != 2 || got["noc@example.com"] != 3 || got["edge-team@example.com"] != 3 {
+		t.Errorf("digests sent early = %v, want 3 events each", got)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if got := perRecipient(srv.take()); len(got) != 2 || got["noc@example.com"] != 1 || got["edge-team@example.com"] != 1 {
+		t.Errorf("digests sent after the interval = %v, want 1 event each", got)
+	}
+}
+
+// Digests pending when the router stops are sent after it starts again
+func TestPendingDigestsSurviveRestart(t *testing.T) {
+	srv, mail := emailTest(t)
+	path := filepath.Join(t.TempDir(), "digests.json")
+	var err error
+	if digests, err = newDigestQueue(path); err != nil {
+		t.Fatal(err)
+	}
+
+	deliver(mail, Event{Type: "info", SourceHost: "edge-1", Message: "port flap", EventID: "evt-1"})
+	// Stop the router before the interval ends
+	digests.mu.Lock()
+	for _, b := range digests.open {
+		b.timer.Stop()
+	}
+	digests.mu.Unlock()
+	digests.journal.Close()
+
+	if digests, err = newDigestQueue(path); err != nil {
+		t.Fatal(err)
+	}
+	if pending := digests.pending(); len(pending) != 0 {
+		t.Errorf("digests open before resuming: %v", pending)
+	}
+	digests.resume()
+	if pending := digests.pending(); len(pending) != 1 || pending[0]["events"] != 1 {
+		t.Errorf("pending digests after restart = %v, want one with 1 event", pending)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if got := perRecipient(srv.take()); len(got) != 1 || got["noc@example.com"] != 1 {
+		t.Errorf("digests sent after restart = %v, want the noc one", got)
+	}
+	digests.mu.Lock()
+	defer digests.mu.Unlock()
+	if len(digests.stored) != 0 {
+		t.Errorf("%d sent digests still journaled", len(digests.stored))
+	}
+}
+
+// A digest is rendered with the destination's settings when it is sent,
+// not those in effect when its first event arrived
+func TestDigestUsesConfigAtSendTime(t *testing.T) {
+	srv, mail := emailTest(t)
+
+	deliver(mail, Event{Type: "info", SourceHost: "edge-1", Message: "port flap"})
+	_, _, err := configs.update(configs.current().Version, func(cfg *RouterConfig) error {
+		cfg.Destinations["mail"].Email.Digest.Subject = "{{len .Events}} events (reloaded)"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	msgs := srv.take()
+	if len(msgs) != 1 || msgs[0].subject != "1 events (reloaded)" {
+		t.Errorf("digests sent = %+v, want one with the reloaded subject", msgs)
+	}
+}
+
+// A digest that cannot be sent is dead-lettered once, for its one
+// recipient, and a redrive sends it as one email
+func TestFailedDigestDeadLettersOnce(t *testing.T) {
+	srv, mail := emailTest(t)
+	srv.reject("edge-team@example.com", true)
+
+	for i := 1; i <= 3; i++ {
+		deliver(mail, Event{Type: "info", SourceHost: "edge-1", Message: fmt.Sprintf("port flap %d", i), EventID: fmt.Sprintf("evt-%d", i),
+			Labels: map[string]string{"owner_email": "edge-team@example.com"}})
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := perRecipient(srv.take()); got["noc@example.com"] != 3 {
+		t.Errorf("digests sent = %v, want the noc one", got)
+	}
+	entries := dlq.List(deadLetterFilter{})
+	if len(entries) != 1 || entries[0].Digest == nil {
+		t.Fatalf("dead letters = %+v, want one digest entry", entries)
+	}
+	d := entries[0]
+	if d.Digest.Recipient != "edge-team@example.com" || len(d.Digest.Events) != 3 || len(d.Attempts) != 1 {
+		t.Errorf("dead digest = %+v with %d attempts, want 3 events for edge-team, not retried", d.Digest, len(d.Attempts))
+	}
+
+	srv.reject("edge-team@example.com", false)
+	if r := redrive(d); r.Status != "delivered" {
+		t.Fatalf("redrive = %+v", r)
+	}
+	if got := perRecipient(srv.take()); len(got) != 1 || got["edge-team@example.com"] != 3 {
+		t.Errorf("redriven digests = %v, want one with 3 events", got)
+	}
+	if n := len(dlq.List(deadLetterFilter{})); n != 0 {
+		t.Errorf("dead letters after redrive = %d, want 0", n)
+	}
+}
+
+// A recipient rejected with 5xx fails at once, without retries
+func TestEmailPermanentRejection(t *testing.T) {
+	srv, mail := emailTest(t)
+	srv.reject("gone@example.com", true)
+
+	_, attempts, err := deliverWithRetry(mail, Event{Type: "critical", Message: "x", Labels: map[string]string{"owner_email": "gone@example.com"}})
+	if err == nil {
+		t.Fatal("rejected recipient delivered")
+	}
+	if len(attempts) != 1 {
+		t.Errorf("attempts = %d, want 1", len(attempts))
+	}
+}
+
+// STARTTLS is required by default
+func TestEmailRequiresStartTLS(t *testing.T) {
+	_, mail := emailTest(t)
+	plain, err := newSMTPStandIn(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.close()
+
+	d := *mail.dest
+	d.URL = "smtp://" + plain.addr()
+	_, err = sendEmail(target{Destination: "mail", dest: &d}, Event{Type: "critical", Message: "x"})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("send = %v, want a STARTTLS error", err)
+	}
+	if n := len(plain.take()); n != 0 {
+		t.Errorf("%d messages sent in the clear", n)
+	}
+}
+
+// perRecipient counts digest events by recipient, read from the subject
+func perRecipient(msgs []receivedEmail) map[string]int {
+	out := make(map[string]int)
+	for _, m := range msgs {
+		var n int
+		fmt.Sscanf(m.subject, "%d events", &n)
+		for _, rcpt := range m.to {
+			out[rcpt] += n
+		}
+	}
+	return out
+}
+
+/* ---------------- SMTP STAND-IN ---------------- */
+
+// smtpStandIn is a minimal SMTP server that accepts AUTH PLAIN for
+// router/secret and records every message
+type smtpStandIn struct {
+	ln       net.Listener
+	tls      *tls.Config
+	roots    *x509.CertPool
+	startTLS bool
+
+	mu       sync.Mutex
+	rejected map[string]bool
+	messages []receivedEmail
+}
+
+type receivedEmail struct {
+	from, subject string
+	date, id      string // Date and Message-ID headers
+	to            []string
+	tls, auth     bool
+	parts         map[string]string // content type -> decoded body
+}
+
+func newSMTPStandIn(startTLS bool) (*smtpStandIn, error) {
+	cert, roots, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &smtpStandIn{ln: ln, tls: &tls.Config{Certificates: []tls.Certificate{cert}}, roots: roots,
+		startTLS: startTLS, rejected: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *smtpStandIn) addr() string { return s.ln.Addr().String() }
+func (s *smtpStandIn) close()       { s.ln.Close() }
+
+func (s *smtpStandIn) reject(rcpt string, rejected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected[rcpt] = rejected
+}
+
+// take returns and clears the messages received so far
+func (s *smtpStandIn) take() []receivedEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.messages
+	s.messages = nil
+	return out
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	var msg receivedEmail
+	secure := false
+	tp.PrintfLine("220 stand-in ESMTP")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			ext := []string{"stand-in"}
+			if s.startTLS && !secure {
+				ext = append(ext, "STARTTLS")
+			}
+			ext = append(ext, "AUTH PLAIN", "8BITMIME")
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, e)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			mech, resp, _ := strings.Cut(arg, " ")
+			creds, _ := base64.StdEncoding.DecodeString(resp)
+			if strings.ToUpper(mech) == "PLAIN" && string(creds) == "\x00router\x00secret" {
+				msg.auth = true
+				tp.PrintfLine("235 authenticated")
+			} else {
+				tp.PrintfLine("535 bad credentials")
+			}
+		case "MAIL":
+			msg = receivedEmail{auth: msg.auth, from: smtpPath(arg)}
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			rcpt := smtpPath(arg)
+			s.mu.Lock()
+			rejected := s.rejected[rcpt]
+			s.mu.Unlock()
+			if rejected {
+				tp.PrintfLine("550 no such user")
+				continue
+			}
+			msg.to = append(msg.to, rcpt)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.tls = secure
+			msg.subject, msg.date, msg.id, msg.parts = parseReceived(string(data))
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// smtpPath extracts the address from "FROM:<a@b>" or "TO:<a@b>"
+func smtpPath(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	path, _, _ = strings.Cut(path, " ")
+	return strings.Trim(path, "<>")
+}
+
+// parseReceived decodes the headers and the parts of a multipart message
+func parseReceived(data string) (subject, date, id string, parts map[string]string) {
+	parts = make(map[string]string)
+	m, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(data)))
+	if err != nil {
+		return "", "", "", parts
+	}
+	subject, _ = new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	_, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := io.ReadAll(p)
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[mediaType] = string(body)
+	}
+	return subject, m.Header.Get("Date"), m.Header.Get("Message-ID"), parts
+}
+
+func selfSignedCert() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smtp stand-in"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots, nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+)
+
+// conditionResult records how one match condition evaluated
+type conditionResult struct {
+	Field   string   `json:"field"`
+	Allowed []string `json:"allowed"`
+	Actual  string   `json:"actual"`
+	Matched bool     `json:"matched"`
+}
+
+// pipelineStep records what a pre-routing stage did to an event
+type pipelineStep struct {
+	Stage  string `json:"stage"`
+	Action string `json:"action"`
+	Rule   string `json:"rule,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ruleEvaluation records how one route evaluated against an event
+type ruleEvaluation struct {
+	Route        string            `json:"route"`
+	Evaluated    bool              `json:"evaluated"`
+	Matched      bool              `json:"matched"`
+	Conditions   []conditionResult `json:"conditions"`
+	Destinations []string          `json:"destinations,omitempty"`
+	OnCall       []OnCall          `json:"on_call,omitempty"`
+	// EventTransforms are the route's transform steps and the event they produced
+	EventTransforms []transformResult `json:"event_transforms,omitempty"`
+	Event           *Event            `json:"event,omitempty"`
+	Dropped         bool              `json:"dropped,omitempty"`
+	Stop            bool              `json:"stop,omitempty"`
+}
+
+// transformStep describes how the payload for a destination would be built
+type transformStep struct {
+	Destination string `json:"destination"`
+	Kind        string `json:"kind"`   // builtin, destination_template or route_template
+	Format      string `json:"format"` // destination type
+}
+
+// explainedTarget is a final destination with the payload it would receive
+type explainedTarget struct {
+	Route       string          `json:"route"`
+	Destination string          `json:"destination"`
+	Type        string          `json:"type"`
+	URL         string          `json:"url"`
+	ContentType string          `json:"content_type,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	PayloadText string          `json:"payload_text,omitempty"` // non-JSON payloads
+	Error       string          `json:"error,omitempty"`
+}
+
+// Explanation is the full trace of how the router would handle an event
+type Explanation struct {
+	Event        Event             `json:"event"`
+	Pipeline     []pipelineStep    `json:"pipeline"`
+	Dropped      bool              `json:"dropped"`
+	Emitted      []Event           `json:"emitted,omitempty"`
+	Rules        []ruleEvaluation  `json:"rules"`
+	Transforms   []transformStep   `json:"transforms"`
+	Destinations []explainedTarget `json:"destinations"`
+
+	targets []target
+}
+
+// evaluate runs every route against the event and records the outcome.
+// resolve uses the same evaluation to pick delivery targets.
+func (cfg *RouterConfig) evaluate(evt Event) *Explanation {
+	return cfg.evaluateAt(evt, time.Now())
+}
+
+// evaluateAt evaluates calendar conditions and on-call schedules at now
+func (cfg *RouterConfig) evaluateAt(evt Event, now time.Time) *Explanation {
+	ex := &Explanation{
+		Event:        evt,
+		Pipeline:     []pipelineStep{},
+		Rules:        []ruleEvaluation{},
+		Transforms:   []transformStep{},
+		Destinations: []explainedTarget{},
+	}
+	seen := make(map[string]bool)
+	stopped := false
+
+	for _, r := range cfg.Routes {
+		eval := ruleEvaluation{Route: r.Name, Stop: r.Stop}
+		if stopped {
+			ex.Rules = append(ex.Rules, eval)
+			continue
+		}
+		eval.Evaluated = true
+		eval.Conditions = r.Match.conditionsAt(evt, now)
+		eval.Matched = true
+		for _, cond := range eval.Conditions {
+			eval.Matched = eval.Matched && cond.Matched
+		}
+
+		if eval.Matched && len(r.Transforms) > 0 {
+			routeEvt, results, dropped := r.transform(evt)
+			eval.EventTransforms, eval.Event, eval.Dropped = results, &routeEvt, dropped
+		}
+		if eval.Matched && !eval.Dropped {
+			for _, t := range r.Destinations {
+				name := t.Destination
+				if t.OnCall != "" {
+					oc := cfg.Schedules[t.OnCall].onCall(t.OnCall, now)
+					eval.OnCall = append(eval.OnCall, oc)
+					if name = oc.Destination; name == "" {
+						continue
+					}
+				}
+				eval.Destinations = append(eval.Destinations, name)
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				ex.targets = append(ex.targets, target{
+					Route:       r.Name,
+					Destination: name,
+					dest:        cfg.Destinations[name],
+					tmpl:        t.tmpl,
+					evt:         eval.Event,
+				})
+			}
+		}
+		stopped = eval.Matched && r.Stop
+		ex.Rules = append(ex.Rules, eval)
+	}
+	return ex
+}
+
+// droppedBy lists the matching routes whose transforms dropped the event
+func (ex *Explanation) droppedBy() []string {
+	var routes []string
+	for _, r := range ex.Rules {
+		if r.Dropped {
+			routes = append(routes, r.Route)
+		}
+	}
+	return routes
+}
+
+// dropFailed reports whether a route dropped the event because its drop
+// step failed, rather than because the step matched
+func (ex *Explanation) dropFailed() bool {
+	for _, r := range ex.Rules {
+		if n := len(r.EventTransforms); r.Dropped && n > 0 && r.EventTransforms[n-1].Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// explain evaluates the event and renders the payload each destination
+// would receive. Nothing is delivered.
+func (cfg *RouterConfig) explain(evt Event) *Explanation {
+	return cfg.explainAt(evt, time.Now())
+}
+
+// explainAt explains the event with calendars and schedules evaluated at now
+func (cfg *RouterConfig) explainAt(evt Event, now time.Time) *Explanation {
+	ex := cfg.evaluateAt(evt, now)
+	for _, t := range ex.targets {
+		kind := "builtin"
+		if t.tmpl != nil {
+			kind = "route_template"
+		} else if t.dest.tmpl != nil {
+			kind = "destination_template"
+		}
+		ex.Transforms = append(ex.Transforms, transformStep{Destination: t.Destination, Kind: kind, Format: t.dest.Type})
+
+		et := explainedTarget{Route: t.Route, Destination: t.Destination, Type: t.dest.Type, URL: t.dest.URL}
+		body, contentType, err := t.render(t.event(evt))
+		if err != nil {
+			et.Error = err.Error()
+		} else {
+			et.ContentType = contentType
+			if json.Valid(body) {
+				et.Payload = body
+			} else {
+				et.PayloadText = string(body)
+			}
+		}
+		ex.Destinations = append(ex.Destinations, et)
+	}
+	return ex
+}
+
+// conditions lists every non-empty condition of the match with its result
+func (m RouteMatch) conditions(evt Event) []conditionResult {
+	return m.conditionsAt(evt, time.Now())
+}
+
+// conditionsAt evaluates calendar conditions at now
+func (m RouteMatch) conditionsAt(evt Event, now time.Time) []conditionResult {
+	out := []conditionResult{}
+	add := func(field string, allowed []string, actual string, match func([]string, string) bool) {
+		if len(allowed) > 0 {
+			out = append(out, conditionResult{Field: field, Allowed: allowed, Actual: actual, Matched: match(allowed, actual)})
+		}
+	}
+	kind := evt.Kind
+	if kind == "" {
+		kind = KindEvent
+	}
+	add("kind", m.Kinds, kind, matchAny)
+	add("type", m.Types, evt.Type, matchAny)
+	add("event_type", m.EventTypes, evt.EventType, matchAny)
+	add("category", m.Categories, evt.Category, matchAny)
+	add("source_host", m.SourceHosts, evt.SourceHost, matchGlob)
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add("label:"+name, m.Labels[name], evt.Labels[name], matchGlob)
+	}
+	calendar := func(field, name string, cal *Calendar, want bool) {
+		if cal != nil {
+			actual := now.In(cal.loc).Format("Mon 2006-01-02 15:04 MST")
+			out = append(out, conditionResult{Field: field, Allowed: []string{name}, Actual: actual, Matched: cal.contains(now) == want})
+		}
+	}
+	calendar("during", m.During, m.during, true)
+	calendar("outside", m.Outside, m.outside, false)
+	return out
+}
+
+/* ---------------- HTTP ---------------- */
+
+// explainRoute handles POST /route/explain. The pre-routing pipeline runs as
+// a dry run, so stateful stages are not affected. Destination URLs and
+// credentials are redacted from the result.
+func explainRoute(c *gin.Context) {
+	var evt Event
+	if err := c.ShouldBindJSON(&evt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if evt.EventID == "" {
+		evt.EventID = fileutil.NewID("evt")
+	}
+	ex := livePipeline().explain(configs.current(), evt, time.Now(), true)
+	ex.redact()
+	c.JSON(http.StatusOK, ex)
+}
+
+// explain runs the event through the pre-routing stages and, unless they
+// drop it, explains how cfg routes it. Nothing is delivered.
+func (p pipelineState) explain(cfg *RouterConfig, evt Event, now time.Time, dryRun bool) *Explanation {
+	result := p.preprocess(cfg, evt, now, dryRun)
+	var ex *Explanation
+	if result.Dropped != "" {
+		ex = &Explanation{Event: result.Event, Rules: []ruleEvaluation{}, Transforms: []transformStep{}, Destinations: []explainedTarget{}}
+	} else {
+		ex = cfg.explainAt(result.Event, now)
+	}
+	ex.Pipeline = result.Steps
+	ex.Dropped = result.Dropped != ""
+	ex.Emitted = result.Emitted
+	return ex
+}
+
+/* ---------------- CLI ---------------- */
+
+// runExplainCLI runs sample events through a candidate config and reports
+// where the outcome differs from the live config:
+//
+//	event_router explain -config candidate.json -events samples.json [-live config.json] [-suppressions suppressions.json] [-now 2024-05-01T09:00:00Z] [-json]
+//
+// Each config runs the events in order through the same stages as the
+// router: enrichment, suppression, flap detection and correlation, then the
+// routes. The flap and correlation state each config builds is its own and
+// starts empty, so a burst of samples can flap or open an incident. Every
+// event is handled at the same instant, -now, so results do not depend on
+// when the command runs. It exits 1 when any event is routed differently,
+// so it can gate CI.
+func runExplainCLI(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	candidatePath := fs.String("config", "", "candidate config file (required)")
+	livePath := fs.String("live", config.GetEnv("EVENT_ROUTER_CONFIG_PATH", "config.json"), "live config file to compare against")
+	eventsPath := fs.String("events", "", "file of sample events: a JSON array or one JSON object per line (required)")
+	suppressionsPath := fs.String("suppressions", config.GetEnv("EVENT_ROUTER_SUPPRESSIONS_PATH", "suppressions.json"), "suppression rules file both configs run with")
+	nowFlag := fs.String("now", "", "RFC 3339 time to handle every event at (default: the time the command starts)")
+	asJSON := fs.Bool("json", false, "print the full explanations as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *candidatePath == "" || *eventsPath == "" {
+		fs.Usage()
+		return 2
+	}
+	now := time.Now()
+	if *nowFlag != "" {
+		t, err := time.Parse(time.RFC3339, *nowFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "now:", err)
+			return 2
+		}
+		now = t
+	}
+
+	candidate, err := loadConfigFile(*candidatePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "candidate:", err)
+		return 2
+	}
+	live, err := loadConfigFile(*livePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "live:", err)
+		return 2
+	}
+	events, err := readSampleEvents(*eventsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "events:", err)
+		return 2
+	}
+	rules, err := loadSuppressions(*suppressionsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "suppressions:", err)
+		return 2
+	}
+	supp := &suppressionStore{path: *suppressionsPath, rules: rules}
+	supp.rebuild(now)
+	livePipe, candidatePipe := samplePipeline(supp), samplePipeline(supp)
+
+	type comparison struct {
+		Event     Event        `json:"event"`
+		Live      *Explanation `json:"live"`
+		Candidate *Explanation `json:"candidate"`
+		Changes   []string     `json:"changes"`
+	}
+	var results []comparison
+	changed := 0
+	for i, evt := range events {
+		if evt.EventID == "" {
+			evt.EventID = fmt.Sprintf("sample-%d", i+1)
+		}
+		cmp := comparison{
+			Event:     evt,
+			Live:      livePipe.explain(live, evt, now, false),
+			Candidate: candidatePipe.explain(candidate, evt, now, false),
+		}
+		cmp.Changes = diffExplanations(cmp.Live, cmp.Candidate)
+		if len(cmp.Changes) > 0 {
+			changed++
+		}
+		results = append(results, cmp)
+	}
+
+	if *asJSON {
+		// CI logs are not the place for webhook URLs and routing keys
+		for _, cmp := range results {
+			cmp.Live.redact()
+			cmp.Candidate.redact()
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		for i, cmp := range results {
+			marker := "="
+			if len(cmp.Changes) > 0 {
+				marker = "~"
+			}
+			fmt.Printf("%s event %d: [%s] %s: %s\n", marker, i+1, cmp.Event.Type, orDash(cmp.Event.SourceHost), cmp.Event.Message)
+			fmt.Printf("    live:      %s\n", summarize(cmp.Live))
+			fmt.Printf("    candidate: %s\n", summarize(cmp.Candidate))
+			for _, change := range cmp.Changes {
+				fmt.Printf("    %s\n", change)
+			}
+		}
+		fmt.Printf("\n%d of %d events routed differently\n", changed, len(results))
+	}
+
+	if changed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// samplePipeline is a pipeline with empty flap and correlation state for
+// running sample events
+func samplePipeline(supp *suppressionStore) pipelineState {
+	return pipelineState{
+		suppressions: supp,
+		flaps:        &flapDetector{states: make(map[string]*FlapState)},
+		correlations: &correlator{groups: make(map[string]*correlationGroup)},
+	}
+}
+
+// readSampleEvents accepts a JSON array of events or JSON lines
+func readSampleEvents(path string) ([]Event, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var events []Event
+		err := json.Unmarshal(trimmed, &events)
+		return events, err
+	}
+
+	var events []Event
+	dec := json.NewDecoder(bufio.NewReader(bytes.NewReader(trimmed)))
+	for {
+		var evt Event
+		if err := dec.Decode(&evt); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("event %d: %w", len(events)+1, err)
+		}
+		events = append(events, evt)
+	}
+	return events, nil
+}
+
+func summarize(ex *Explanation) string {
+	if ex.Dropped {
+		return "dropped: " + droppedStage(ex)
+	}
+	var dests []string
+	for _, d := range ex.Destinations {
+		dests = append(dests, d.Destination)
+	}
+	return fmt.Sprintf("routes=%v destinations=%v", matchedRoutes(ex), dests)
+}
+
+func matchedRoutes(ex *Explanation) []string {
+	var matched []string
+	for _, r := range ex.Rules {
+		if r.Matched {
+			matched = append(matched, r.Route)
+		}
+	}
+	return matched
+}
+
+// droppedStage names the pre-routing stage that dropped the event
+func droppedStage(ex *Explanation) string {
+	if n := len(ex.Pipeline); n > 0 {
+		return ex.Pipeline[n-1].Stage
+	}
+	return "-"
+}
+
+// diffExplanations lists the differences between two outcomes for the same event
+func diffExplanations(live, candidate *Explanation) []string {
+	var changes []string
+
+	if live.Dropped != candidate.Dropped {
+		outcome := func(ex *Explanation) string {
+			if ex.Dropped {
+				return "dropped by " + droppedStage(ex)
+			}
+			return "routed"
+		}
+		changes = append(changes, fmt.Sprintf("~ %s -> %s", outcome(live), outcome(candidate)))
+	}
+
+	if lr, cr := matchedRoutes(live), matchedRoutes(candidate); strings.Join(lr, ",") != strings.Join(cr, ",") {
+		changes = append(changes, fmt.Sprintf("~ matched routes: %v -> %v", lr, cr))
+	}
+
+	liveDest := make(map[string]explainedTarget)
+	for _, d := range live.Destinations {
+		liveDest[d.Destination] = d
+	}
+	candDest := make(map[string]explainedTarget)
+	for _, d := range candidate.Destinations {
+		candDest[d.Destination] = d
+	}
+
+	names := make(map[string]bool)
+	for n := range liveDest {
+		names[n] = true
+	}
+	for n := range candDest {
+		names[n] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	for _, n := range sorted {
+		l, inLive := liveDest[n]
+		c, inCand := candDest[n]
+		switch {
+		case inLive && !inCand:
+			changes = append(changes, fmt.Sprintf("- %s (was via route %s)", n, l.Route))
+		case !inLive && inCand:
+			changes = append(changes, fmt.Sprintf("+ %s (via route %s)", n, c.Route))
+		default:
+			if l.URL != c.URL {
+				changes = append(changes, fmt.Sprintf("~ %s url: %s -> %s", n, redactURL(l.URL), redactURL(c.URL)))
+			}
+			if l.Type != c.Type {
+				changes = append(changes, fmt.Sprintf("~ %s type: %s -> %s", n, l.Type, c.Type))
+			}
+			if !bytes.Equal(l.Payload, c.Payload) || l.PayloadText != c.PayloadText || l.Error != c.Error {
+				changes = append(changes, fmt.Sprintf("~ %s payload changed", n))
+			}
+		}
+	}
+	return changes
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const explainConfig = `{
+  "destinations": {
+    "noc": {"type": "webhook", "url": "https://noc.example/hook"},
+    "oncall": {"type": "webhook", "url": "https://oncall.example/hook"}
+  },
+  "calendars": {"office": {"timezone": "UTC", "start": "09:00", "end": "17:00"}},
+  "routes": [
+    {"name": "office-hours", "match": {"during": "office"}, "destinations": ["noc"], "stop": true},
+    {"name": "after-hours", "destinations": ["oncall"]}
+  ]%s
+}`
+
+// explainFiles writes the configs, samples and suppressions the explain
+// command reads and returns their paths
+func explainFiles(t *testing.T, live, candidate, events, suppressions string) (livePath, candidatePath, eventsPath, suppressionsPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return write("live.json", live), write("candidate.json", candidate), write("events.jsonl", events), write("suppressions.json", suppressions)
+}
+
+type explainComparison struct {
+	Live      Explanation `json:"live"`
+	Candidate Explanation `json:"candidate"`
+	Changes   []string    `json:"changes"`
+}
+
+// runExplain runs the explain command with -json and decodes what it printed
+func runExplain(t *testing.T, args ...string) (int, []explainComparison) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	code := runExplainCLI(append(args, "-json"))
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	var results []explainComparison
+	if code != 2 {
+		if err := json.Unmarshal(out, &results); err != nil {
+			t.Fatalf("explain output: %v\n%s", err, out)
+		}
+	}
+	return code, results
+}
+
+// Samples go through suppression, flap detection and correlation before the
+// routes, as they would in the router
+func TestExplainCLIRunsThePipeline(t *testing.T) {
+	live := strings.Replace(explainConfig, "%s", "", 1)
+	candidate := strings.Replace(explainConfig, "%s", `,
+  "flapping": [{"name": "ports", "high": 3}],
+  "correlation": [{"name": "site", "key": ["source_host"], "window": "5m", "min_events": 2}]`, 1)
+	events := `{"type": "high", "source_host": "lab-1", "message": "Interface Gi0/1 down"}
+{"type": "high", "source_host": "core-1", "message": "Interface Gi0/1 changed state to down"}
+{"type": "high", "source_host": "core-1", "message": "Interface Gi0/1 changed state to up"}
+{"type": "high", "source_host": "core-1", "message": "Interface Gi0/1 changed state to down"}
+{"type": "high", "source_host": "core-1", "message": "Interface Gi0/1 changed state to up"}`
+	suppressions := `[{"id": "sup-lab", "name": "lab", "action": "drop", "created_at": "2026-01-01T00:00:00Z",
+  "scope": {"devices": ["lab-*"]}, "window": {"start": "2026-01-01T00:00:00Z", "end": "2027-01-01T00:00:00Z"}}]`
+	livePath, candidatePath, eventsPath, suppressionsPath := explainFiles(t, live, candidate, events, suppressions)
+	before := len(flaps.states)
+
+	code, results := runExplain(t, "-live", livePath, "-config", candidatePath, "-events", eventsPath,
+		"-suppressions", suppressionsPath, "-now", "2026-10-19T10:00:00Z")
+	if code != 1 || len(results) != 5 {
+		t.Fatalf("explain = %d with %d results, want 1 and 5", code, len(results))
+	}
+
+	for _, ex := range []Explanation{results[0].Live, results[0].Candidate} {
+		if !ex.Dropped || droppedStage(&ex) != "suppression" || len(ex.Destinations) != 0 {
+			t.Errorf("suppressed sample = %+v, want dropped by suppression", ex)
+		}
+	}
+	if len(results[0].Changes) != 0 {
+		t.Errorf("suppressed sample changes = %v, want none", results[0].Changes)
+	}
+
+	// The candidate correlates the samples on core-1 and absorbs the third
+	// state change, which takes the flap score to 3
+	if got := results[2].Candidate; got.Event.IncidentID == "" || got.Event.Labels["incident_role"] == "pending" {
+		t.Errorf("second sample on core-1 = %+v, want it in an open incident", got.Event)
+	}
+	third := results[4]
+	if third.Live.Dropped || !third.Candidate.Dropped || droppedStage(&third.Candidate) != "flapping" {
+		t.Errorf("third state change: live dropped %v, candidate %+v; want only the candidate to absorb it", third.Live.Dropped, third.Candidate)
+	}
+	if want := "~ routed -> dropped by flapping"; len(third.Changes) == 0 || third.Changes[0] != want {
+		t.Errorf("changes = %v, want %q first", third.Changes, want)
+	}
+	if len(third.Candidate.Emitted) != 1 || third.Candidate.Emitted[0].Labels["flapping"] != "started" {
+		t.Errorf("emitted = %+v, want the flapping event", third.Candidate.Emitted)
+	}
+
+	// The samples never reach the router's own state
+	if len(flaps.states) != before {
+		t.Errorf("explain changed the router's flap state")
+	}
+}
+
+// -now decides calendars, so a run gives the same answer whenever it runs
+func TestExplainCLIFreezesNow(t *testing.T) {
+	cfg := strings.Replace(explainConfig, "%s", "", 1)
+	livePath, candidatePath, eventsPath, suppressionsPath := explainFiles(t, cfg, cfg, `[{"type": "critical", "source_host": "core-1", "message": "down"}]`, "")
+
+	for now, want := range map[string]string{"2026-10-19T10:00:00Z": "noc", "2026-10-19T22:00:00Z": "oncall", "2026-10-18T10:00:00Z": "oncall"} {
+		code, results := runExplain(t, "-live", livePath, "-config", candidatePath, "-events", eventsPath, "-suppressions", suppressionsPath, "-now", now)
+		if code != 0 || len(results) != 1 {
+			t.Fatalf("explain at %s = %d with %d results, want 0 and 1", now, code, len(results))
+		}
+		if dests := results[0].Live.Destinations; len(dests) != 1 || dests[0].Destination != want {
+			t.Errorf("at %s routed to %+v, want %s", now, dests, want)
+		}
+	}
+	if code, _ := runExplain(t, "-config", candidatePath, "-events", eventsPath, "-now", "yesterday"); code != 2 {
+		t.Errorf("explain with a bad -now = %d, want 2", code)
+	}
+}
+
+// The endpoint runs the live pipeline as a dry run and leaves its state alone
+func TestExplainRouteIsADryRun(t *testing.T) {
+	routingFixture(t, strings.Replace(explainConfig, "%s", `,
+  "flapping": [{"name": "ports", "high": 3}]`, 1))
+	prev := flaps
+	flaps = &flapDetector{states: make(map[string]*FlapState)}
+	t.Cleanup(func() { flaps = prev })
+
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	for _, msg := range []string{"Interface Gi0/1 changed state to down", "Interface Gi0/1 changed state to up"} {
+		ex := livePipeline().explain(configs.current(), Event{EventID: "evt-1", Type: "high", SourceHost: "core-1", Message: msg}, now, true)
+		if ex.Dropped || len(ex.Destinations) != 1 || ex.Destinations[0].Destination != "noc" {
+			t.Errorf("%q explained as %+v, want routed to noc", msg, ex)
+		}
+	}
+	if len(flaps.states) != 0 {
+		t.Errorf("dry run tracked %d entities", len(flaps.states))
+	}
+}
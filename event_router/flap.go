@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+)
+
+const (
+	defaultDownPattern = `(?i)\b(down|lost|fail(ed|ure)?|unreachable)\b`
+	defaultUpPattern   = `(?i)\b(up|restored|recovered|established|reachable)\b`
+)
+
+// FlapRule detects entities (an interface, a BGP session) that keep changing
+// state. Every down/up transition adds 1 to the entity's flap score, which
+// decays by half every HalfLife. Like Nagios flap detection the thresholds
+// have hysteresis: an entity starts flapping when its score reaches High and
+// stops once it decays to Low. While an entity flaps its raw events are
+// replaced by a single "flapping" event and a "stable" event when it settles.
+type FlapRule struct {
+	Name  string     `json:"name"`
+	Match RouteMatch `json:"match"`
+	// Entity lists the fields identifying the entity (default source_host);
+	// EntityPattern optionally adds part of the message, e.g. the interface name
+	Entity        []string `json:"entity,omitempty"`
+	EntityPattern string   `json:"entity_pattern,omitempty"`
+	// DownPattern and UpPattern classify messages; events matching neither
+	// (or both) are not state changes and pass through
+	DownPattern string  `json:"down_pattern,omitempty"`
+	UpPattern   string  `json:"up_pattern,omitempty"`
+	HalfLife    string  `json:"half_life,omitempty"` // default 5m
+	High        float64 `json:"high,omitempty"`      // default 5
+	Low         float64 `json:"low,omitempty"`       // default 2
+
+	halfLife time.Duration
+	entityRe *regexp.Regexp
+	downRe   *regexp.Regexp
+	upRe     *regexp.Regexp
+}
+
+func (r *FlapRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("flapping rule needs a name")
+	}
+	if len(r.Entity) == 0 {
+		r.Entity = []string{"source_host"}
+	}
+	for _, field := range r.Entity {
+		if _, ok := eventField(Event{}, field); !ok {
+			return fmt.Errorf("flapping rule %q: unknown entity field %q", r.Name, field)
+		}
+	}
+
+	r.halfLife = 5 * time.Minute
+	if r.HalfLife != "" {
+		d, err := time.ParseDuration(r.HalfLife)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("flapping rule %q: half_life must be a positive duration", r.Name)
+		}
+		r.halfLife = d
+	}
+	if r.High == 0 {
+		r.High = 5
+	}
+	if r.Low == 0 {
+		r.Low = 2
+	}
+	if r.Low <= 0 || r.Low >= r.High {
+		return fmt.Errorf("flapping rule %q: need 0 < low < high", r.Name)
+	}
+
+	var err error
+	compile := func(field, pattern, def string) *regexp.Regexp {
+		if pattern == "" {
+			pattern = def
+		}
+		re, e := regexp.Compile(pattern)
+		if e != nil && err == nil {
+			err = fmt.Errorf("flapping rule %q: %s: %w", r.Name, field, e)
+		}
+		return re
+	}
+	r.downRe = compile("down_pattern", r.DownPattern, defaultDownPattern)
+	r.upRe = compile("up_pattern", r.UpPattern, defaultUpPattern)
+	r.entityRe = nil
+	if r.EntityPattern != "" {
+		r.entityRe = compile("entity_pattern", r.EntityPattern, "")
+	}
+	return err
+}
+
+// entity identifies what the event is about; ok is false when it cannot be told
+func (r *FlapRule) entity(evt Event) (string, bool) {
+	parts := make([]string, 0, len(r.Entity)+1)
+	for _, field := range r.Entity {
+		v, _ := eventField(evt, field)
+		if v == "" {
+			return "", false
+		}
+		parts = append(parts, v)
+	}
+	if r.entityRe != nil {
+		m := r.entityRe.FindStringSubmatch(evt.Message)
+		if m == nil {
+			return "", false
+		}
+		parts = append(parts, m[len(m)-1])
+	}
+	return strings.Join(parts, "/"), true
+}
+
+// state classifies the event as "down", "up" or "" when it is neither
+func (r *FlapRule) state(evt Event) string {
+	down, up := r.downRe.MatchString(evt.Message), r.upRe.MatchString(evt.Message)
+	switch {
+	case down && !up:
+		return "down"
+	case up && !down:
+		return "up"
+	}
+	return ""
+}
+
+/* ---------------- DETECTOR ---------------- */
+
+// FlapState is the tracked state of one entity
+type FlapState struct {
+	Rule        string    `json:"rule"`
+	Entity      string    `json:"entity"`
+	State       string    `json:"state"`
+	Score       float64   `json:"score"`
+	Transitions int       `json:"transitions"`
+	LastChange  time.Time `json:"last_change"`
+	Flapping    bool      `json:"flapping"`
+	Since       time.Time `json:"since,omitempty"`
+	Suppressed  int       `json:"suppressed"` // raw events swallowed while flapping
+
+	last Event
+}
+
+// scoreAt is the decayed flap score at now
+func (s *FlapState) scoreAt(now time.Time, halfLife time.Duration) float64 {
+	elapsed := now.Sub(s.LastChange)
+	if elapsed <= 0 {
+		return s.Score
+	}
+	return s.Score * math.Pow(0.5, float64(elapsed)/float64(halfLife))
+}
+
+type flapDetector struct {
+	mu     sync.Mutex
+	states map[string]*FlapState
+}
+
+var flaps = &flapDetector{states: make(map[string]*FlapState)}
+
+// apply runs the flap detection stage. dropped means the event was absorbed
+// into a flapping entity; emitted holds flapping/stable notifications.
+// With dryRun the detector state is left untouched.
+func (d *flapDetector) apply(rules []*FlapRule, evt Event, now time.Time, dryRun bool) (Event, []pipelineStep, bool, []Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var steps []pipelineStep
+	var emitted []Event
+
+	for _, rule := range rules {
+		if evt.Kind == KindIncident || !rule.Match.matches(evt) {
+			continue
+		}
+		entity, ok := rule.entity(evt)
+		if !ok {
+			continue
+		}
+		newState := rule.state(evt)
+		if newState == "" {
+			continue
+		}
+
+		id := rule.Name + "|" + entity
+		s := d.states[id]
+		if s == nil {
+			s = &FlapState{Rule: rule.Name, Entity: entity}
+		} else if dryRun {
+			cp := *s
+			s = &cp
+		}
+		if !dryRun {
+			d.states[id] = s
+		}
+
+		// A quiet period may have let the entity settle since its last event
+		if s.Flapping && s.scoreAt(now, rule.halfLife) <= rule.Low {
+			emitted = append(emitted, s.stable(rule, now))
+			steps = append(steps, pipelineStep{Stage: "flapping", Action: "stable", Rule: rule.Name, Detail: entity + " stopped flapping"})
+		}
+
+		if s.State != "" && s.State != newState {
+			s.Score = s.scoreAt(now, rule.halfLife) + 1
+			s.Transitions++
+			s.LastChange = now
+		} else if s.State == "" {
+			s.LastChange = now
+		}
+		s.State = newState
+		s.last = evt
+
+		switch {
+		case s.Flapping:
+			s.Suppressed++
+			steps = append(steps, pipelineStep{
+				Stage:  "flapping",
+				Action: "absorbed",
+				Rule:   rule.Name,
+				Detail: fmt.Sprintf("%s is flapping (score %.1f), %d events absorbed", entity, s.Score, s.Suppressed),
+			})
+			return evt, steps, true, emitted
+		case s.Score >= rule.High:
+			s.Flapping, s.Since, s.Suppressed = true, now, 1
+			emitted = append(emitted, s.flappingEvent(rule))
+			steps = append(steps, pipelineStep{
+				Stage:  "flapping",
+				Action: "started",
+				Rule:   rule.Name,
+				Detail: fmt.Sprintf("%s started flapping (score %.1f >= %.1f)", entity, s.Score, rule.High),
+			})
+			return evt, steps, true, emitted
+		}
+		steps = append(steps, pipelineStep{
+			Stage:  "flapping",
+			Action: "tracked",
+			Rule:   rule.Name,
+			Detail: fmt.Sprintf("%s %s (score %.1f)", entity, newState, s.Score),
+		})
+		// An event is tracked by at most one rule
+		return evt, steps, false, emitted
+	}
+	return evt, steps, false, emitted
+}
+
+// flappingEvent replaces the raw events of an entity that started flapping
+func (s *FlapState) flappingEvent(rule *FlapRule) Event {
+	evt := s.last
+	evt.EventID = fileutil.NewID("evt")
+	evt.Message = fmt.Sprintf("Flapping: %s changed state %d times (score %.1f); further state changes are suppressed until it stabilizes", s.Entity, s.Transitions, s.Score)
+	evt.Labels = withLabel(evt.Labels, "flapping", "started")
+	evt.Labels["flap_rule"] = rule.Name
+	return evt
+}
+
+// stable ends the flapping period and returns the event announcing it
+func (s *FlapState) stable(rule *FlapRule, now time.Time) Event {
+	evt := s.last
+	evt.EventID = fileutil.NewID("evt")
+	evt.Message = fmt.Sprintf("Stopped flapping: %s is %s after %s (%d events suppressed)", s.Entity, s.State, now.Sub(s.Since).Round(time.Second), s.Suppressed)
+	if s.State == "up" {
+		evt.Type = "info"
+	}
+	evt.Labels = withLabel(evt.Labels, "flapping", "stopped")
+	evt.Labels["flap_rule"] = rule.Name
+	s.Flapping = false
+	s.Suppressed = 0
+	return evt
+}
+
+// sweep ends flapping periods that have decayed below the low threshold and
+// forgets entities that have been quiet long enough
+func (d *flapDetector) sweep(rules []*FlapRule, now time.Time) []Event {
+	byName := make(map[string]*FlapRule)
+	for _, r := range rules {
+		byName[r.Name] = r
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var emitted []Event
+	for id, s := range d.states {
+		rule, ok := byName[s.Rule]
+		if !ok {
+			delete(d.states, id)
+			continue
+		}
+		score := s.scoreAt(now, rule.halfLife)
+		if s.Flapping && score <= rule.Low {
+			emitted = append(emitted, s.stable(rule, now))
+		}
+		if !s.Flapping && score < 0.1 {
+			delete(d.states, id)
+		}
+	}
+	return emitted
+}
+
+// list returns tracked entities, flapping ones first
+func (d *flapDetector) list(rules []*FlapRule, now time.Time, onlyFlapping bool) []FlapState {
+	halfLives := make(map[string]time.Duration)
+	for _, r := range rules {
+		halfLives[r.Name] = r.halfLife
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := []FlapState{}
+	for _, s := range d.states {
+		if onlyFlapping && !s.Flapping {
+			continue
+		}
+		cp := *s
+		if hl, ok := halfLives[s.Rule]; ok {
+			cp.Score = math.Round(s.scoreAt(now, hl)*100) / 100
+		}
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Flapping != out[j].Flapping {
+			return out[i].Flapping
+		}
+		return out[i].Score > out[j].Score
+	})
+	return out
+}
+
+// runFlapSweeper announces entities that stabilized without further events
+func runFlapSweeper(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		for _, e := range flaps.sweep(configs.current().Flapping, now) {
+			log.Printf("Flapping: %s", e.Message)
+			routeEmitted([]Event{e})
+		}
+	}
+}
+
+func listFlapping(c *gin.Context) {
+	states := flaps.list(configs.current().Flapping, time.Now(), c.Query("flapping") == "true")
+	c.JSON(http.StatusOK, gin.H{"count": len(states), "entities": states})
+}
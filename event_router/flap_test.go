@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func flapRule(t *testing.T) *FlapRule {
+	t.Helper()
+	r := &FlapRule{Name: "ports", EntityPattern: `Interface (\S+)`, HalfLife: "1m", High: 3, Low: 1.5}
+	if err := r.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// port is a state change of one interface of core-sw-01
+func port(iface, state string) Event {
+	return Event{Type: "high", SourceHost: "core-sw-01", Message: "Interface " + iface + " changed state to " + state, Labels: map[string]string{"site": "dc1"}}
+}
+
+func TestFlapScoreHalvesEveryHalfLife(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	s := &FlapState{Score: 4, LastChange: start}
+	for _, c := range []struct {
+		after time.Duration
+		want  float64
+	}{{0, 4}, {-time.Minute, 4}, {time.Minute, 2}, {90 * time.Second, math.Sqrt(2)}, {3 * time.Minute, 0.5}} {
+		if got := s.scoreAt(start.Add(c.after), time.Minute); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("score after %s = %v, want %v", c.after, got, c.want)
+		}
+	}
+
+	// A state change adds 1 to the decayed score; repeats add nothing
+	d := &flapDetector{states: make(map[string]*FlapState)}
+	rules := []*FlapRule{flapRule(t)}
+	for i, c := range []struct {
+		state string
+		after time.Duration
+		want  float64
+	}{{"down", 0, 0}, {"up", 0, 1}, {"up", 10 * time.Second, 1}, {"down", time.Minute, 1.5}, {"up", 2 * time.Minute, 1.75}} {
+		d.apply(rules, port("Gi0/1", c.state), start.Add(c.after), false)
+		if got := d.states["ports|core-sw-01/Gi0/1"].Score; math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("event %d: score = %v, want %v", i+1, got, c.want)
+		}
+	}
+}
+
+// An entity starts flapping when its score reaches high and stops only once
+// it has decayed to low, not as soon as it drops below high
+func TestFlapHysteresis(t *testing.T) {
+	d := &flapDetector{states: make(map[string]*FlapState)}
+	rules := []*FlapRule{flapRule(t)}
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	var dropped bool
+	var emitted []Event
+	for i, state := range []string{"down", "up", "down", "up"} {
+		_, _, dropped, emitted = d.apply(rules, port("Gi0/1", state), start, false)
+		if i < 3 && (dropped || len(emitted) > 0) {
+			t.Fatalf("event %d dropped at a score below high", i+1)
+		}
+	}
+	if !dropped || len(emitted) != 1 {
+		t.Fatalf("score 3 gave dropped=%v emitted=%+v, want the flapping event instead", dropped, emitted)
+	}
+	started := emitted[0]
+	if started.Labels["flapping"] != "started" || started.Labels["flap_rule"] != "ports" || started.Labels["site"] != "dc1" {
+		t.Errorf("started labels = %v", started.Labels)
+	}
+	if !strings.Contains(started.Message, "core-sw-01/Gi0/1 changed state 3 times") || started.EventID == "" {
+		t.Errorf("started event = %+v", started)
+	}
+
+	// Having decayed to about 1.7, below high but above low, the score
+	// still marks the entity as flapping
+	_, steps, dropped, emitted := d.apply(rules, port("Gi0/1", "down"), start.Add(50*time.Second), false)
+	if !dropped || len(emitted) != 0 || steps[0].Action != "absorbed" {
+		t.Errorf("change below high while flapping: dropped=%v emitted=%d %+v, want it absorbed", dropped, len(emitted), steps)
+	}
+	if s := d.states["ports|core-sw-01/Gi0/1"]; s.Suppressed != 2 || !s.Flapping {
+		t.Errorf("state = %+v, want 2 events absorbed", s)
+	}
+
+	// Other interfaces of the device are tracked on their own
+	if _, _, dropped, _ := d.apply(rules, port("Gi0/2", "down"), start.Add(time.Minute), false); dropped {
+		t.Error("another interface was absorbed")
+	}
+
+	// Decayed below low, the next change ends the flapping period and is routed
+	evt, _, dropped, emitted := d.apply(rules, port("Gi0/1", "up"), start.Add(4*time.Minute), false)
+	if dropped || len(emitted) != 1 || evt.Labels["flapping"] != "" {
+		t.Fatalf("change after settling: dropped=%v emitted=%+v", dropped, emitted)
+	}
+	stopped := emitted[0]
+	if stopped.Labels["flapping"] != "stopped" || stopped.Labels["flap_rule"] != "ports" || stopped.Type != "high" {
+		t.Errorf("stopped event = %+v, want flapping=stopped with the last state's severity", stopped)
+	}
+	if !strings.Contains(stopped.Message, "is down after 4m0s (2 events suppressed)") {
+		t.Errorf("stopped message = %q", stopped.Message)
+	}
+}
+
+// The sweep ends flapping periods of entities that went quiet, reporting an
+// entity that settled up as info, and forgets entities whose score is gone
+func TestFlapSweep(t *testing.T) {
+	d := &flapDetector{states: make(map[string]*FlapState)}
+	rules := []*FlapRule{flapRule(t)}
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for i, state := range []string{"up", "down", "up", "down", "up"} {
+		d.apply(rules, port("Gi0/1", state), start.Add(time.Duration(i)*time.Second), false)
+	}
+	d.apply(rules, port("Gi0/3", "down"), start, false)
+
+	if emitted := d.sweep(rules, start.Add(time.Minute)); len(emitted) != 0 {
+		t.Errorf("sweep above low emitted %+v", emitted)
+	}
+	emitted := d.sweep(rules, start.Add(2*time.Minute))
+	if len(emitted) != 1 || emitted[0].Labels["flapping"] != "stopped" || emitted[0].Type != "info" {
+		t.Fatalf("sweep = %+v, want one info event for the interface that settled up", emitted)
+	}
+	if listed := d.list(rules, start.Add(2*time.Minute), true); len(listed) != 0 {
+		t.Errorf("still flapping: %+v", listed)
+	}
+
+	// Gi0/3 never changed state, so it has no score and is forgotten
+	if _, ok := d.states["ports|core-sw-01/Gi0/3"]; ok {
+		t.Error("entity without a score still tracked")
+	}
+	d.sweep(rules, start.Add(time.Hour))
+	if len(d.states) != 0 {
+		t.Errorf("states after an hour = %v, want none", d.states)
+	}
+	// Entities of rules removed from the config go too
+	d.apply(rules, port("Gi0/1", "down"), start, false)
+	d.sweep(nil, start)
+	if len(d.states) != 0 {
+		t.Error("entity of a removed rule still tracked")
+	}
+}
+
+// Events that are not state changes, have no entity or are incidents pass
+// through untouched, and a dry run leaves the state alone
+func TestFlapIgnoresOtherEvents(t *testing.T) {
+	d := &flapDetector{states: make(map[string]*FlapState)}
+	rules := []*FlapRule{flapRule(t)}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	for _, evt := range []Event{
+		{SourceHost: "core-sw-01", Message: "Interface Gi0/1 CRC errors rising"},
+		{SourceHost: "core-sw-01", Message: "BGP neighbor 10.0.0.1 down"},
+		{SourceHost: "core-sw-01", Message: "Interface Gi0/1 down", Kind: KindIncident},
+	} {
+		if _, steps, dropped, emitted := d.apply(rules, evt, now, false); dropped || len(steps)+len(emitted) > 0 {
+			t.Errorf("%q: steps %+v, want it passed through", evt.Message, steps)
+		}
+	}
+	if _, steps, _, _ := d.apply(rules, port("Gi0/1", "down"), now, true); len(steps) != 1 || steps[0].Action != "tracked" {
+		t.Errorf("dry run steps = %+v, want it tracked", steps)
+	}
+	if len(d.states) != 0 {
+		t.Errorf("states = %v, want none", d.states)
+	}
+}
@@ -1,8 +1,9 @@
 module github.com/ibm-live-project-interns/ingestor/event_router
 
-go 1.23
+go 1.23.0
 
 require (
+	github.com/expr-lang/expr v1.17.8
 	github.com/gin-gonic/gin v1.11.0
 	github.com/ibm-live-project-interns/ingestor/shared v0.0.0-00010101000000-000000000000
 )
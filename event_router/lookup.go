@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Lookup match modes
+const (
+	LookupExact = "exact"
+	LookupCIDR  = "cidr"
+	LookupGlob  = "glob"
+)
+
+// LookupTable enriches events with columns from a CSV or JSON file, e.g. the
+// owner_team, site and business_service of a device. The row whose key
+// matches the event field adds its other columns to the event's labels,
+// which routes can then match on. Labels already set on the event win.
+//
+// A CSV file has a header row. A JSON file is an array of objects with
+// string values.
+type LookupTable struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Field is the event field looked up: source_ip, source_host, category,
+	// type, event_type or label:<name>
+	Field string `json:"field"`
+	// Match is exact, cidr or glob; it defaults to cidr for source_ip, glob
+	// for source_host and exact otherwise
+	Match string `json:"match,omitempty"`
+	// KeyColumn names the column holding the key, default "key"
+	KeyColumn string `json:"key_column,omitempty"`
+
+	exact    map[string]map[string]string
+	prefixes []lookupPrefix // longest first
+	globs    []lookupGlob   // in file order
+}
+
+type lookupPrefix struct {
+	prefix netip.Prefix
+	values map[string]string
+}
+
+type lookupGlob struct {
+	pattern string
+	values  map[string]string
+}
+
+func (t *LookupTable) compile() error {
+	if t.Name == "" {
+		return fmt.Errorf("lookup table needs a name")
+	}
+	if t.File == "" {
+		return fmt.Errorf("lookup table %q: file is required", t.Name)
+	}
+	if _, ok := eventField(Event{}, t.Field); !ok {
+		return fmt.Errorf("lookup table %q: unknown field %q", t.Name, t.Field)
+	}
+	if t.Match == "" {
+		switch t.Field {
+		case "source_ip":
+			t.Match = LookupCIDR
+		case "source_host":
+			t.Match = LookupGlob
+		default:
+			t.Match = LookupExact
+		}
+	}
+	if t.KeyColumn == "" {
+		t.KeyColumn = "key"
+	}
+
+	rows, err := readLookupRows(t.File)
+	if err != nil {
+		return fmt.Errorf("lookup table %q: %w", t.Name, err)
+	}
+	t.exact, t.prefixes, t.globs = nil, nil, nil
+	for i, row := range rows {
+		key := strings.TrimSpace(row[t.KeyColumn])
+		if key == "" {
+			return fmt.Errorf("lookup table %q: row %d has no %q column", t.Name, i+1, t.KeyColumn)
+		}
+		values := make(map[string]string)
+		for col, v := range row {
+			if col != t.KeyColumn && v != "" {
+				values[col] = v
+			}
+		}
+
+		switch t.Match {
+		case LookupExact:
+			if t.exact == nil {
+				t.exact = make(map[string]map[string]string)
+			}
+			t.exact[key] = values
+		case LookupCIDR:
+			p, err := parsePrefix(key)
+			if err != nil {
+				return fmt.Errorf("lookup table %q: row %d: %w", t.Name, i+1, err)
+			}
+			t.prefixes = append(t.prefixes, lookupPrefix{p, values})
+		case LookupGlob:
+			if _, err := path.Match(key, ""); err != nil {
+				return fmt.Errorf("lookup table %q: row %d: bad pattern %q", t.Name, i+1, key)
+			}
+			t.globs = append(t.globs, lookupGlob{key, values})
+		default:
+			return fmt.Errorf("lookup table %q: unknown match %q, want exact, cidr or glob", t.Name, t.Match)
+		}
+	}
+	sort.SliceStable(t.prefixes, func(i, j int) bool { return t.prefixes[i].prefix.Bits() > t.prefixes[j].prefix.Bits() })
+	return nil
+}
+
+// parsePrefix accepts a CIDR or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// readLookupRows reads a CSV or JSON table, chosen by file extension
+func readLookupRows(file string) ([]map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		var rows []map[string]string
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, fmt.Errorf("%s: want an array of objects with string values: %w", file, err)
+		}
+		return rows, nil
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, rec := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, col := range header {
+			row[strings.TrimSpace(col)] = strings.TrimSpace(rec[i])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// lookup returns the values of the row matching the event, if any
+func (t *LookupTable) lookup(evt Event) (string, map[string]string) {
+	v, _ := eventField(evt, t.Field)
+	if v == "" {
+		return "", nil
+	}
+	switch t.Match {
+	case LookupExact:
+		if values, ok := t.exact[v]; ok {
+			return v, values
+		}
+	case LookupCIDR:
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return "", nil
+		}
+		for _, p := range t.prefixes {
+			if p.prefix.Contains(addr) {
+				return p.prefix.String(), p.values
+			}
+		}
+	case LookupGlob:
+		for _, g := range t.globs {
+			if ok, _ := path.Match(g.pattern, v); ok {
+				return g.pattern, g.values
+			}
+		}
+	}
+	return "", nil
+}
+
+// enrich applies every lookup table in order, so a later table can key on a
+// label added by an earlier one
+func (cfg *RouterConfig) enrich(evt Event) (Event, []pipelineStep) {
+	steps := []pipelineStep{}
+	for _, t := range cfg.Lookups {
+		key, values := t.lookup(evt)
+		if values == nil {
+			continue
+		}
+		labels := make(map[string]string, len(evt.Labels)+len(values))
+		for k, v := range evt.Labels {
+			labels[k] = v
+		}
+		added := []string{}
+		for k, v := range values {
+			if _, exists := labels[k]; !exists {
+				labels[k] = v
+				added = append(added, k+"="+v)
+			}
+		}
+		evt.Labels = labels
+		sort.Strings(added)
+		detail := "labels already set"
+		if len(added) > 0 {
+			detail = strings.Join(added, ", ")
+		}
+		steps = append(steps, pipelineStep{Stage: "enrichment", Action: "matched", Rule: t.Name,
+			Detail: fmt.Sprintf("%s %s: %s", t.Field, key, detail)})
+	}
+	return evt, steps
+}
+
+// lookupFiles lists the files the config's lookup tables are read from
+func (cfg *RouterConfig) lookupFiles() []string {
+	files := make([]string, len(cfg.Lookups))
+	for i, t := range cfg.Lookups {
+		files[i] = t.File
+	}
+	return files
+}
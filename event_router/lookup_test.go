@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lookupTable writes content to a file named name and compiles a table on it
+func lookupTable(t *testing.T, name, content string, table LookupTable) (*LookupTable, error) {
+	t.Helper()
+	table.File = filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(table.File, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if table.Name == "" {
+		table.Name = "inventory"
+	}
+	return &table, table.compile()
+}
+
+func TestLookupCIDRLongestPrefixWins(t *testing.T) {
+	table, err := lookupTable(t, "networks.csv", `key, site, owner_team
+10.0.0.0/8, corp, it
+10.1.2.3, dc1, neteng-core
+10.1.2.0/16, dc1, neteng
+2001:db8::/32, dc2, neteng-v6
+`, LookupTable{Field: "source_ip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Match != LookupCIDR {
+		t.Errorf("match = %q, want cidr by default for source_ip", table.Match)
+	}
+	for ip, want := range map[string]string{
+		"10.1.2.3":     "10.1.2.3/32 dc1 neteng-core",
+		"10.1.9.9":     "10.1.0.0/16 dc1 neteng",
+		"10.200.0.1":   "10.0.0.0/8 corp it",
+		"2001:db8::10": "2001:db8::/32 dc2 neteng-v6",
+		"192.168.0.1":  " ",
+		"core-sw-01":   " ",
+		"":             " ",
+	} {
+		key, values := table.lookup(Event{SourceIP: ip})
+		got := strings.TrimSpace(fmt.Sprintf("%s %s %s", key, values["site"], values["owner_team"]))
+		if got != strings.TrimSpace(want) {
+			t.Errorf("%q matched %q, want %q", ip, got, strings.TrimSpace(want))
+		}
+	}
+}
+
+func TestLookupGlobFirstMatchWins(t *testing.T) {
+	table, err := lookupTable(t, "devices.json", `[
+  {"key": "core-sw-0?", "tier": "core", "site": "dc1"},
+  {"key": "core-*", "tier": "core"},
+  {"key": "*", "tier": "access", "site": ""}
+]`, LookupTable{Field: "source_host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"core-sw-01": "core-sw-0? core dc1",
+		"core-sw-10": "core-* core",
+		"acc-sw-01":  "* access",
+	} {
+		key, values := table.lookup(Event{SourceHost: host})
+		got := strings.TrimSpace(key + " " + values["tier"] + " " + values["site"])
+		if got != want {
+			t.Errorf("%s matched %q, want %q", host, got, want)
+		}
+		if _, ok := values["site"]; host == "acc-sw-01" && ok {
+			t.Error("an empty column was kept as a label")
+		}
+	}
+}
+
+func TestLookupExactCategory(t *testing.T) {
+	table, err := lookupTable(t, "categories.csv", "category,business_service\nnetwork,Connectivity\n\"power, cooling\",Facilities\n",
+		LookupTable{Field: "category", KeyColumn: "category"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Match != LookupExact {
+		t.Errorf("match = %q, want exact by default for category", table.Match)
+	}
+	for category, want := range map[string]string{"network": "Connectivity", "power, cooling": "Facilities", "Network": "", "net*": ""} {
+		if _, values := table.lookup(Event{Category: category}); values["business_service"] != want {
+			t.Errorf("%q = %v, want %q", category, values, want)
+		}
+	}
+}
+
+func TestLookupRejectsBadTables(t *testing.T) {
+	for name, c := range map[string]struct {
+		file, content string
+		table         LookupTable
+	}{
+		"ragged csv row":     {"t.csv", "key,site\n10.0.0.1,dc1,extra\n", LookupTable{Field: "source_ip"}},
+		"row without a key":  {"t.csv", "key,site\n,dc1\n", LookupTable{Field: "source_ip"}},
+		"missing key column": {"t.csv", "ip,site\n10.0.0.1,dc1\n", LookupTable{Field: "source_ip"}},
+		"bad cidr":           {"t.csv", "key,site\n10.0.0.0/33,dc1\n", LookupTable{Field: "source_ip"}},
+		"bad glob":           {"t.csv", "key,site\ncore-[,dc1\n", LookupTable{Field: "source_host"}},
+		"unknown match":      {"t.csv", "key,site\na,b\n", LookupTable{Field: "source_host", Match: "regex"}},
+		"unknown field":      {"t.csv", "key,site\na,b\n", LookupTable{Field: "vendor"}},
+		"json number":        {"t.json", `[{"key": "10.0.0.1", "rack": 4}]`, LookupTable{Field: "source_ip"}},
+		"json object":        {"t.json", `{"10.0.0.1": {"site": "dc1"}}`, LookupTable{Field: "source_ip"}},
+	} {
+		if _, err := lookupTable(t, c.file, c.content, c.table); err == nil {
+			t.Errorf("%s: compiled, want an error", name)
+		}
+	}
+	if err := (&LookupTable{Name: "gone", File: filepath.Join(t.TempDir(), "gone.csv"), Field: "source_ip"}).compile(); err == nil {
+		t.Error("missing file: compiled, want an error")
+	}
+	if table, err := lookupTable(t, "empty.csv", "", LookupTable{Field: "source_ip"}); err != nil {
+		t.Errorf("empty table: %v", err)
+	} else if _, values := table.lookup(Event{SourceIP: "10.0.0.1"}); values != nil {
+		t.Errorf("empty table matched %v", values)
+	}
+}
+
+// Tables run in order, so a later one can key on a label an earlier one
+// added, and labels already on the event are kept
+func TestEnrichChainsTables(t *testing.T) {
+	sites, err := lookupTable(t, "sites.csv", "key,site,owner_team\n10.1.0.0/16,dc1,neteng\n", LookupTable{Name: "sites", Field: "source_ip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := lookupTable(t, "services.csv", "key,business_service\ndc1,payments\n", LookupTable{Name: "services", Field: "label:site"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &RouterConfig{Lookups: []*LookupTable{sites, services}}
+
+	original := map[string]string{"owner_team": "sre"}
+	evt, steps := cfg.enrich(Event{SourceIP: "10.1.4.4", Labels: original})
+	want := map[string]string{"site": "dc1", "owner_team": "sre", "business_service": "payments"}
+	if fmt.Sprint(evt.Labels) != fmt.Sprint(want) {
+		t.Errorf("labels = %v, want %v", evt.Labels, want)
+	}
+	if len(original) != 1 {
+		t.Errorf("enrich changed the event's label map: %v", original)
+	}
+	if len(steps) != 2 || steps[0].Detail != "source_ip 10.1.0.0/16: site=dc1" || steps[1].Detail != "label:site dc1: business_service=payments" {
+		t.Errorf("steps = %+v", steps)
+	}
+
+	_, steps = cfg.enrich(Event{SourceIP: "10.1.4.4", Labels: map[string]string{"site": "dc1", "owner_team": "sre", "business_service": "payments"}})
+	if len(steps) != 2 || steps[0].Detail != "source_ip 10.1.0.0/16: labels already set" {
+		t.Errorf("steps with labels set = %+v", steps)
+	}
+	if evt, steps := cfg.enrich(Event{SourceIP: "172.16.0.1"}); len(steps) != 0 || evt.Labels != nil {
+		t.Errorf("unmatched event got %v %+v", evt.Labels, steps)
+	}
+}
+
+// Editing a lookup table reloads the config that reads it
+func TestLookupTableEditsReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sites.csv")
+	if err := os.WriteFile(file, []byte("key,site\n10.1.0.0/16,dc1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	routingFixture(t, `{
+  "destinations": {"noc": {"type": "webhook", "url": "https://noc.example"}},
+  "lookups": [{"name": "sites", "file": "`+file+`", "field": "source_ip"}],
+  "routes": [{"name": "dc2", "match": {"labels": {"site": ["dc2"]}}, "destinations": ["noc"]}]
+}`)
+	evt := Event{Type: "high", SourceIP: "10.1.4.4"}
+	if targets := configs.current().resolve(mustEnrich(evt)); len(targets) != 0 {
+		t.Fatalf("routed before the edit: %+v", targets)
+	}
+
+	if err := os.WriteFile(file, []byte("key,site\n10.1.0.0/16,dc2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(file, later, later)
+	version := configs.current().Version
+	configs.reloadIfChanged()
+	if configs.current().Version != version+1 {
+		t.Errorf("version = %d, want %d after the table changed", configs.current().Version, version+1)
+	}
+	if targets := configs.current().resolve(mustEnrich(evt)); len(targets) != 1 {
+		t.Errorf("not routed with the edited table")
+	}
+}
+
+func mustEnrich(evt Event) Event {
+	evt, _ = configs.current().enrich(evt)
+	return evt
+}
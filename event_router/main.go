@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
 )
 
 type Event struct {
@@ -20,24 +24,64 @@ type Event struct {
 	SourceIP   string `json:"source_ip,omitempty"`
 	EventType  string `json:"event_type,omitempty"`
 	Category   string `json:"category,omitempty"`
+
+	// EventID identifies the event; the router assigns one when it is missing
+	EventID string `json:"event_id,omitempty"`
+	// Kind is "event" (the default) or "incident" for correlated groups
+	Kind string `json:"kind,omitempty"`
+	// IncidentID links an event to the incident it was correlated into
+	IncidentID string        `json:"incident_id,omitempty"`
+	Incident   *IncidentInfo `json:"incident,omitempty"`
+
+	// Labels carry metadata added along the pipeline, e.g. suppressed=<rule id>
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
-func loadConfig() map[string]string {
+// configs holds the active routing configuration
+var configs *configStore
+
+// dlq holds deliveries that failed after all retries
+var dlq *deadLetterQueue
+
+// suppressions holds maintenance windows and other suppression rules
+var suppressions *suppressionStore
+
+var (
+	maxRetries   = config.GetEnvInt("EVENT_ROUTER_MAX_RETRIES", 3)
+	retryBackoff = time.Duration(config.GetEnvInt("EVENT_ROUTER_RETRY_BACKOFF_MS", 500)) * time.Millisecond
+	httpClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+func loadConfig() *configStore {
 	configPath := config.GetEnv("EVENT_ROUTER_CONFIG_PATH", "config.json")
-	data, err := os.ReadFile(configPath)
+	store, err := newConfigStore(configPath)
 	if err != nil {
-		log.Fatalf("Error reading config file %s: %v", configPath, err)
+		log.Fatalf("Error loading config: %v", err)
 	}
-
-	config := make(map[string]string)
-	json.Unmarshal(data, &config)
-	return config
+	cfg := store.current()
+	log.Printf("Loaded %d routes and %d destinations from %s", len(cfg.Routes), len(cfg.Destinations), configPath)
+	return store
 }
 
-func forwardEvent(url string, event Event) (string, error) {
-	body, _ := json.Marshal(event)
+func forwardEvent(t target, event Event) (string, error) {
+	if t.dest.Type == DestinationEmail {
+		return sendEmail(t, event)
+	}
+	body, contentType, err := t.render(event)
+	if err != nil {
+		return "", &renderError{err}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.dest.URL, bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range t.dest.Headers {
+		req.Header.Set(k, v)
+	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -45,48 +89,396 @@ func forwardEvent(url string, event Event) (string, error) {
 
 	respBody, _ := io.ReadAll(resp.Body)
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return string(respBody), &deliveryError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
 	return string(respBody), nil
 }
 
+// deliveryError is returned when the destination answers with a non-2xx status
+type deliveryError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *deliveryError) Error() string {
+	return fmt.Sprintf("destination returned %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// renderError is returned when an event cannot be turned into a payload
+type renderError struct{ err error }
+
+func (e *renderError) Error() string { return e.err.Error() }
+
+// retryable reports whether a failed delivery is worth another attempt.
+// Client errors (4xx other than 408/429) and render failures will not succeed on retry.
+func retryable(err error) bool {
+	if _, ok := err.(*renderError); ok {
+		return false
+	}
+	if de, ok := err.(*deliveryError); ok {
+		return de.StatusCode >= 500 || de.StatusCode == http.StatusRequestTimeout || de.StatusCode == http.StatusTooManyRequests
+	}
+	return !permanentSMTPError(err)
+}
+
+// deliverOnce makes a single delivery attempt and records it
+func deliverOnce(t target, event Event) (string, DeliveryAttempt, error) {
+	start := time.Now()
+	response, err := forwardEvent(t, event)
+
+	attempt := DeliveryAttempt{At: start, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		attempt.Error = err.Error()
+		if de, ok := err.(*deliveryError); ok {
+			attempt.StatusCode = de.StatusCode
+		}
+	}
+	return response, attempt, err
+}
+
+// deliverWithRetry forwards an event, retrying with exponential backoff.
+// It returns the downstream reply and the history of every attempt made.
+// It blocks for the whole backoff, so routing uses the retry queue instead.
+func deliverWithRetry(t target, event Event) (string, []DeliveryAttempt, error) {
+	var attempts []DeliveryAttempt
+	backoff := retryBackoff
+
+	for i := 0; ; i++ {
+		response, attempt, err := deliverOnce(t, event)
+		attempts = append(attempts, attempt)
+
+		if err == nil {
+			return response, attempts, nil
+		}
+		if i >= maxRetries || !retryable(err) {
+			return response, attempts, err
+		}
+
+		log.Printf("Delivery to %s failed (attempt %d/%d): %v", t.Destination, i+1, maxRetries+1, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// pipelineResult is the outcome of the stages run before routing
+type pipelineResult struct {
+	Event   Event
+	Steps   []pipelineStep
+	Dropped string  // why the event must not be routed: suppressed or flapping
+	Emitted []Event // events generated along the way, e.g. incidents
+}
+
+// pipelineState holds the state of the stateful pre-routing stages
+type pipelineState struct {
+	suppressions *suppressionStore
+	flaps        *flapDetector
+	correlations *correlator
+}
+
+// livePipeline is the state the router routes with
+func livePipeline() pipelineState {
+	return pipelineState{suppressions: suppressions, flaps: flaps, correlations: correlations}
+}
+
+// preprocess runs the stages that act on an event before routing with the
+// live config and state
+func preprocess(evt Event, now time.Time, dryRun bool) pipelineResult {
+	return livePipeline().preprocess(configs.current(), evt, now, dryRun)
+}
+
+// preprocess runs the stages that act on an event before routing and
+// reports what each did. With dryRun, stateful stages leave their state as is.
+func (p pipelineState) preprocess(cfg *RouterConfig, evt Event, now time.Time, dryRun bool) pipelineResult {
+	res := pipelineResult{Steps: []pipelineStep{}}
+
+	evt, steps := cfg.enrich(evt)
+	res.Steps = append(res.Steps, steps...)
+
+	evt, step, dropped := p.suppressions.apply(evt, now)
+	if step != nil {
+		res.Steps = append(res.Steps, *step)
+	}
+	if dropped {
+		res.Event, res.Dropped = evt, "suppressed"
+		return res
+	}
+
+	evt, steps, dropped, emitted := p.flaps.apply(cfg.Flapping, evt, now, dryRun)
+	res.Steps = append(res.Steps, steps...)
+	res.Emitted = append(res.Emitted, emitted...)
+	if dropped {
+		res.Event, res.Dropped = evt, "flapping"
+		return res
+	}
+
+	evt, steps, emitted = p.correlations.apply(cfg.Correlation, evt, now, dryRun)
+	res.Steps = append(res.Steps, steps...)
+	res.Event, res.Emitted = evt, append(res.Emitted, emitted...)
+	return res
+}
+
+// deliveryResult is the outcome of delivering an event to one destination
+type deliveryResult struct {
+	Route           string `json:"route"`
+	Destination     string `json:"destination"`
+	Status          string `json:"status"`
+	DownstreamReply string `json:"downstream_reply,omitempty"`
+	Attempts        int    `json:"attempts"`
+	Error           string `json:"error,omitempty"`
+	DLQID           string `json:"dlq_id,omitempty"`
+}
+
+// deliverAll fans an event out to its destinations concurrently. Each
+// destination gets one attempt here; a delivery that fails with a retryable
+// error, or whose destination keeps failing, is handed to the retry queue
+// and reported as retrying. Other failures are dead-lettered.
+func deliverAll(targets []target, evt Event) []deliveryResult {
+	results := make([]deliveryResult, len(targets))
+	var wg sync.WaitGroup
+
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			results[i] = deliver(t, evt)
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// deliveredStatus is "queued" for an event a destination holds back for a
+// digest, which is reported delivered once the digest is sent
+func deliveredStatus(t target, evt Event) string {
+	if t.digested(t.event(evt)) {
+		return constants.StatusQueued
+	}
+	return "delivered"
+}
+
+func deliver(t target, evt Event) deliveryResult {
+	r := deliveryResult{Route: t.Route, Destination: t.Destination, Status: "retrying"}
+	if breakers.open(t.Destination) {
+		if retries.add(&retryJob{t: t, evt: evt}) {
+			return r
+		}
+		return deadLetter(t, evt, fmt.Errorf("destination %s is failing and the retry queue is full", t.Destination), nil)
+	}
+
+	response, attempt, err := deliverOnce(t, t.event(evt))
+	breakers.record(t.Destination, err)
+	r.Attempts = 1
+	if err == nil {
+		r.Status, r.DownstreamReply = deliveredStatus(t, evt), response
+		return r
+	}
+	attempts := []DeliveryAttempt{attempt}
+	if maxRetries > 0 && retryable(err) {
+		log.Printf("Delivery to %s failed (attempt 1/%d), retrying in the background: %v", t.Destination, maxRetries+1, err)
+		if retries.add(&retryJob{t: t, evt: evt, attempts: attempts}) {
+			r.Error = err.Error()
+			return r
+		}
+	}
+	return deadLetter(t, evt, err, attempts)
+}
+
+// routeEvent runs an event through the pipeline and delivers it
+func routeEvent(evt Event) routeOutcome {
+	result := preprocess(evt, time.Now(), false)
+	emitted := routeEmitted(result.Emitted)
+	if result.Dropped != "" {
+		reportStatus(evt.EventID, []models.StatusUpdate{{Status: constants.StatusSuppressed, Detail: result.Dropped}})
+		return routeOutcome{200, gin.H{"status": result.Dropped, "event_id": evt.EventID, "pipeline": result.Steps, "emitted": emitted}}
+	}
+	evt = result.Event
+
+	ex := configs.current().evaluate(evt)
+	targets := ex.targets
+	if dropped := ex.droppedBy(); len(targets) == 0 && len(dropped) > 0 {
+		update := models.StatusUpdate{Status: constants.StatusSuppressed, Detail: "dropped by transforms of route " + strings.Join(dropped, ", ")}
+		if ex.dropFailed() {
+			update.Status, update.Detail = constants.StatusFailed, "a drop transform of route "+strings.Join(dropped, ", ")+" failed, so the event was dropped"
+		}
+		reportStatus(evt.EventID, []models.StatusUpdate{update})
+		return routeOutcome{200, gin.H{"status": "dropped", "event_id": evt.EventID, "dropped_by": dropped, "pipeline": result.Steps, "emitted": emitted}}
+	}
+	if len(targets) == 0 {
+		reportStatus(evt.EventID, []models.StatusUpdate{{Status: constants.StatusFailed, Detail: "no route for event type " + evt.Type}})
+		return routeOutcome{400, gin.H{
+			"error":    fmt.Sprintf("No route configured for event type: %s", evt.Type),
+			"event_id": evt.EventID,
+			"emitted":  emitted,
+		}}
+	}
+
+	results := deliverAll(targets, evt)
+	reportStatus(evt.EventID, routedUpdates(results))
+	status, code := "forwarded", 200
+	forwardedTo := []string{}
+	retrying := 0
+	for _, r := range results {
+		switch r.Status {
+		case "delivered", constants.StatusQueued:
+			forwardedTo = append(forwardedTo, r.Destination)
+		case "retrying":
+			retrying++
+		}
+	}
+	switch failed := len(results) - len(forwardedTo) - retrying; {
+	case failed == 0 && retrying > 0:
+		status, code = "retrying", 202
+	case failed == len(results):
+		status, code = "dead_lettered", 500
+	case failed > 0:
+		status, code = "partial", 207
+	}
+
+	return routeOutcome{code, gin.H{
+		"status":       status,
+		"event_id":     evt.EventID,
+		"incident_id":  evt.IncidentID,
+		"forwarded_to": forwardedTo,
+		"deliveries":   results,
+		"pipeline":     result.Steps,
+		"emitted":      emitted,
+	}}
+}
+
+// emittedResult reports how an event generated by the pipeline was delivered
+type emittedResult struct {
+	EventID    string           `json:"event_id"`
+	Kind       string           `json:"kind"`
+	Status     string           `json:"status,omitempty"`
+	Deliveries []deliveryResult `json:"deliveries"`
+}
+
+// routeEmitted routes events generated by the pipeline like any other event
+func routeEmitted(events []Event) []emittedResult {
+	out := []emittedResult{}
+	for _, e := range events {
+		r := emittedResult{EventID: e.EventID, Kind: e.Kind, Deliveries: []deliveryResult{}}
+		if e.Incident != nil {
+			r.Status = e.Incident.Status
+		}
+		if targets := configs.current().resolve(e); len(targets) > 0 {
+			r.Deliveries = deliverAll(targets, e)
+		} else {
+			log.Printf("No route for generated %s %s", e.Kind, e.EventID)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		os.Exit(runExplainCLI(os.Args[2:]))
+	}
+
 	port := config.GetEnv("EVENT_ROUTER_PORT", "8082")
 
 	router := gin.Default()
-	config := loadConfig()
+	configs = loadConfig()
+	reloadInterval := time.Duration(config.GetEnvInt("EVENT_ROUTER_CONFIG_RELOAD_SECONDS", 5)) * time.Second
+	go configs.watch(reloadInterval)
+
+	var err error
+	dlq, err = newDeadLetterQueue(config.GetEnv("EVENT_ROUTER_DLQ_PATH", "dlq.json"))
+	if err != nil {
+		log.Fatalf("Error loading dead-letter queue: %v", err)
+	}
+	digests, err = newDigestQueue(config.GetEnv("EVENT_ROUTER_DIGESTS_PATH", "digests.json"))
+	if err != nil {
+		log.Fatalf("Error loading pending digests: %v", err)
+	}
+	digests.resume()
+	suppressions, err = newSuppressionStore(config.GetEnv("EVENT_ROUTER_SUPPRESSIONS_PATH", "suppressions.json"))
+	if err != nil {
+		log.Fatalf("Error loading suppression rules: %v", err)
+	}
+	go suppressions.watch(reloadInterval)
+	go runCorrelationSweeper(30 * time.Second)
+	go runFlapSweeper(30 * time.Second)
+
+	weights, err := laneSettings("EVENT_ROUTER_LANE_WEIGHTS", defaultLaneWeights)
+	if err != nil {
+		log.Fatalf("Error reading lane settings: %v", err)
+	}
+	capacities, err := laneSettings("EVENT_ROUTER_LANE_CAPACITY", defaultLaneCapacities)
+	if err != nil {
+		log.Fatalf("Error reading lane settings: %v", err)
+	}
+	workers := config.GetEnvInt("EVENT_ROUTER_WORKERS", 16)
+	lanes = newLaneScheduler(weights, capacities, workers)
+	lanes.run(func(job *routeJob) routeOutcome { return routeEvent(job.evt) })
+	log.Printf("Routing with %d partitioned workers", workers)
+
+	if peers, err = clusterFromEnv(); err != nil {
+		log.Fatalf("Error setting up cluster: %v", err)
+	}
+	if peers != nil {
+		log.Printf("Clustered as %s with members %s", peers.self, strings.Join(peers.snapshot(), ", "))
+	}
 
 	// Health check endpoint
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "healthy", "service": "event-router"})
 	})
 
-	router.POST("/route", func(c *gin.Context) {
-		var evt Event
+	router.POST("/route", enqueueRoute)
+	router.GET("/metrics", getMetrics)
+	router.GET("/cluster", getCluster)
 
-		if err := c.ShouldBindJSON(&evt); err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
+	// Dry run: show how an event would be routed without delivering it.
+	// It reveals the routing config, so it takes an admin token.
+	requireAdmin := adminAuth()
+	router.POST("/route/explain", requireAdmin, explainRoute)
 
-		destURL, ok := config[evt.Type]
-		if !ok {
-			c.JSON(400, gin.H{
-				"error": fmt.Sprintf("No route configured for event type: %s", evt.Type),
-			})
-			return
-		}
+	// Who is on call now (or ?at=<RFC3339>)
+	router.GET("/oncall", getOnCall)
+	router.GET("/oncall/:schedule", getOnCall)
 
-		response, err := forwardEvent(destURL, evt)
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
+	// Admin API
+	admin := router.Group("/admin")
+	admin.Use(requireAdmin)
+	configWrite := singleReplica("config")
+	suppressionWrite := singleReplica("suppressions")
+	{
+		admin.GET("/config", getConfig)
+		admin.GET("/routes", listRoutes)
+		admin.GET("/routes/:name", getRoute)
+		admin.POST("/routes", configWrite, createRoute)
+		admin.PUT("/routes/:name", configWrite, updateRoute)
+		admin.DELETE("/routes/:name", configWrite, deleteRoute)
+		admin.GET("/destinations", listDestinations)
+		admin.GET("/destinations/:name", getDestination)
+		admin.PUT("/destinations/:name", configWrite, putDestination)
+		admin.DELETE("/destinations/:name", configWrite, deleteDestination)
+		admin.PUT("/schedules/:schedule", configWrite, putSchedule)
+		admin.DELETE("/schedules/:schedule", configWrite, deleteSchedule)
+		admin.POST("/schedules/:schedule/overrides", configWrite, addOverride)
+		admin.GET("/audit", getAuditTrail)
+		admin.GET("/suppressions", listSuppressions)
+		admin.GET("/suppressions/:id", getSuppression)
+		admin.POST("/suppressions", suppressionWrite, createSuppression)
+		admin.POST("/suppressions/:id/expire", suppressionWrite, expireSuppression)
 
-		c.JSON(200, gin.H{
-			"status":           "forwarded",
-			"forwarded_to":     destURL,
-			"downstream_reply": response,
-		})
-	})
+		admin.GET("/incidents", listIncidents)
+		admin.GET("/flapping", listFlapping)
+		admin.GET("/digests", listDigests)
+
+		admin.GET("/dlq", listDeadLetters)
+		admin.GET("/dlq/:id", getDeadLetter)
+		admin.POST("/dlq/redrive", redriveDeadLetters)
+		admin.GET("/dlq/redrives", listRedrives)
+		admin.GET("/dlq/redrives/:id", getRedrive)
+		admin.POST("/dlq/:id/redrive", redriveDeadLetter)
+		admin.DELETE("/dlq", purgeDeadLetters)
+		admin.DELETE("/dlq/:id", deleteDeadLetter)
+	}
 
 	log.Printf("🌐 Event Router running on :%s\n", port)
 	router.Run(":" + port)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// latencyBuckets are the histogram upper bounds in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram is a cumulative latency histogram in the Prometheus sense.
+// It is not safe for concurrent use; callers hold the owner's lock.
+type histogram struct {
+	counts []uint64 // per bucket, plus +Inf at the end
+	sum    float64
+	total  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.total++
+}
+
+// write emits the histogram in the Prometheus text format
+func (h *histogram) write(b *strings.Builder, name, labels string) {
+	var cum uint64
+	for i, le := range latencyBuckets {
+		cum += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, cum)
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.total)
+	fmt.Fprintf(b, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.total)
+}
+
+// writeMetrics renders the lane metrics in the Prometheus text format
+func (s *laneScheduler) writeMetrics(b *strings.Builder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	series := func(name, kind, help string, value func(*lane) uint64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, l := range s.lanes {
+			fmt.Fprintf(b, "%s{lane=%q} %d\n", name, l.name, value(l))
+		}
+	}
+	series("event_router_lane_depth", "gauge", "Events waiting in the lane.", func(l *lane) uint64 { return uint64(l.depth) })
+	series("event_router_lane_capacity", "gauge", "Maximum events the lane holds.", func(l *lane) uint64 { return uint64(l.capacity) })
+	series("event_router_lane_weight", "gauge", "Scheduling weight of the lane.", func(l *lane) uint64 { return uint64(l.weight) })
+	series("event_router_lane_enqueued_total", "counter", "Events accepted into the lane.", func(l *lane) uint64 { return l.enqueued })
+	series("event_router_lane_dequeued_total", "counter", "Events taken from the lane by a worker.", func(l *lane) uint64 { return l.dequeued })
+	series("event_router_lane_rejected_total", "counter", "Events rejected because the lane was full.", func(l *lane) uint64 { return l.rejected })
+
+	histograms := []struct {
+		name, help string
+		get        func(*lane) *histogram
+	}{
+		{"event_router_lane_wait_seconds", "Time events spent queued before a worker took them.", func(l *lane) *histogram { return l.wait }},
+		{"event_router_lane_latency_seconds", "Time from enqueue until routing finished.", func(l *lane) *histogram { return l.latency }},
+	}
+	for _, h := range histograms {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		for _, l := range s.lanes {
+			h.get(l).write(b, h.name, fmt.Sprintf("lane=%q", l.name))
+		}
+	}
+}
+
+func getMetrics(c *gin.Context) {
+	var b strings.Builder
+	lanes.writeMetrics(&b)
+	retries.writeMetrics(&b)
+	breakers.writeMetrics(&b)
+	if peers != nil {
+		peers.writeMetrics(&b)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// weeklyWindow is a time-of-day range on selected weekdays. When end is not
+// after start the window runs past midnight into the next day.
+type weeklyWindow struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+}
+
+func parseWeeklyWindow(days []string, start, end string) (weeklyWindow, error) {
+	var w weeklyWindow
+	for _, d := range days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q, want mon..sun", d)
+		}
+		w.days[wd] = true
+	}
+	var err error
+	if w.start, err = parseClock(start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("time %q: want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether local time t falls in the window
+func (w weeklyWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.end > w.start {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// endAfter returns when the window containing local time t closes
+func (w weeklyWindow) endAfter(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	end := midnight.Add(time.Duration(w.end) * time.Minute)
+	if w.end <= w.start && t.Hour()*60+t.Minute() >= w.start {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(name)
+}
+
+/* ---------------- CALENDARS ---------------- */
+
+// Calendar describes working hours, e.g. business hours. Routes match on it
+// with "during" or "outside".
+type Calendar struct {
+	Timezone string   `json:"timezone,omitempty"`
+	Days     []string `json:"days,omitempty"` // default mon-fri
+	Start    string   `json:"start"`          // HH:MM
+	End      string   `json:"end"`
+	Holidays []string `json:"holidays,omitempty"` // YYYY-MM-DD, outside hours all day
+
+	loc      *time.Location
+	window   weeklyWindow
+	holidays map[string]bool
+}
+
+func (c *Calendar) compile(name string) error {
+	loc, err := loadLocation(c.Timezone)
+	if err != nil {
+		return fmt.Errorf("calendar %q: %w", name, err)
+	}
+	days := c.Days
+	if len(days) == 0 {
+		days = []string{"mon", "tue", "wed", "thu", "fri"}
+	}
+	w, err := parseWeeklyWindow(days, c.Start, c.End)
+	if err != nil {
+		return fmt.Errorf("calendar %q: %w", name, err)
+	}
+	c.loc, c.window = loc, w
+	c.holidays = make(map[string]bool)
+	for _, h := range c.Holidays {
+		if _, err := time.Parse("2006-01-02", h); err != nil {
+			return fmt.Errorf("calendar %q: holiday %q: want YYYY-MM-DD", name, h)
+		}
+		c.holidays[h] = true
+	}
+	return nil
+}
+
+// contains reports whether t is within the calendar's hours
+func (c *Calendar) contains(t time.Time) bool {
+	local := t.In(c.loc)
+	return !c.holidays[local.Format("2006-01-02")] && c.window.contains(local)
+}
+
+/* ---------------- SCHEDULES ---------------- */
+
+// Schedule says who on a team is on call. The first of these that applies
+// wins: an override, a weekly shift, the rotation, then the fallback.
+type Schedule struct {
+	Timezone string `json:"timezone,omitempty"`
+	// Members maps each person to the destination that reaches them
+	Members   map[string]string `json:"members"`
+	Shifts    []Shift           `json:"shifts,omitempty"`
+	Rotation  *Rotation         `json:"rotation,omitempty"`
+	Overrides []Override        `json:"overrides,omitempty"`
+	// Fallback is the destination used when nobody is on call
+	Fallback string `json:"fallback,omitempty"`
+
+	loc *time.Location
+}
+
+// Shift puts a person on call at the same hours every week
+type Shift struct {
+	Person string   `json:"person"`
+	Days   []string `json:"days"`
+	Start  string   `json:"start"` // HH:MM; an end before the start runs past midnight
+	End    string   `json:"end"`
+
+	window weeklyWindow
+}
+
+// Rotation hands on-call duty to the next person every Length, starting at Start
+type Rotation struct {
+	People []string  `json:"people"`
+	Start  time.Time `json:"start"`
+	Length string    `json:"length,omitempty"` // default one week
+
+	length time.Duration
+}
+
+// Override temporarily puts someone else on call, e.g. to cover a shift
+type Override struct {
+	Person    string    `json:"person"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// OnCall is who is on call for a schedule at a given time
+type OnCall struct {
+	Schedule    string     `json:"schedule"`
+	Person      string     `json:"person,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	Source      string     `json:"source"` // override, shift, rotation, fallback or none
+	Until       *time.Time `json:"until,omitempty"`
+}
+
+func (s *Schedule) compile(name string, destinations map[string]*Destination) error {
+	loc, err := loadLocation(s.Timezone)
+	if err != nil {
+		return fmt.Errorf("schedule %q: %w", name, err)
+	}
+	s.loc = loc
+
+	for person, dest := range s.Members {
+		if _, ok := destinations[dest]; !ok {
+			return fmt.Errorf("schedule %q: member %q: unknown destination %q", name, person, dest)
+		}
+	}
+	if s.Fallback != "" {
+		if _, ok := destinations[s.Fallback]; !ok {
+			return fmt.Errorf("schedule %q: unknown fallback destination %q", name, s.Fallback)
+		}
+	}
+	member := func(person string) error {
+		if _, ok := s.Members[person]; !ok {
+			return fmt.Errorf("schedule %q: %q is not a member", name, person)
+		}
+		return nil
+	}
+
+	for i := range s.Shifts {
+		sh := &s.Shifts[i]
+		if err := member(sh.Person); err != nil {
+			return err
+		}
+		if sh.window, err = parseWeeklyWindow(sh.Days, sh.Start, sh.End); err != nil {
+			return fmt.Errorf("schedule %q: shift %d: %w", name, i+1, err)
+		}
+	}
+	if r := s.Rotation; r != nil {
+		if len(r.People) == 0 {
+			return fmt.Errorf("schedule %q: rotation needs people", name)
+		}
+		for _, p := range r.People {
+			if err := member(p); err != nil {
+				return err
+			}
+		}
+		r.length = 7 * 24 * time.Hour
+		if r.Length != "" {
+			if r.length, err = time.ParseDuration(r.Length); err != nil || r.length <= 0 {
+				return fmt.Errorf("schedule %q: rotation length must be a positive duration", name)
+			}
+		}
+	}
+	for _, o := range s.Overrides {
+		if err := member(o.Person); err != nil {
+			return err
+		}
+		if !o.End.After(o.Start) {
+			return fmt.Errorf("schedule %q: override for %q ends before it starts", name, o.Person)
+		}
+	}
+	return nil
+}
+
+// onCall resolves who is on call at now
+func (s *Schedule) onCall(name string, now time.Time) OnCall {
+	oc := OnCall{Schedule: name, Source: "none"}
+	set := func(person, source string, until time.Time) OnCall {
+		oc.Person, oc.Destination, oc.Source = person, s.Members[person], source
+		if !until.IsZero() {
+			oc.Until = &until
+		}
+		return oc
+	}
+
+	for _, o := range s.Overrides {
+		if !now.Before(o.Start) && now.Before(o.End) {
+			return set(o.Person, "override", o.End)
+		}
+	}
+	local := now.In(s.loc)
+	for _, sh := range s.Shifts {
+		if sh.window.contains(local) {
+			return set(sh.Person, "shift", sh.window.endAfter(local))
+		}
+	}
+	if r := s.Rotation; r != nil && !now.Before(r.Start) {
+		n := int(now.Sub(r.Start) / r.length)
+		return set(r.People[n%len(r.People)], "rotation", r.Start.Add(time.Duration(n+1)*r.length))
+	}
+	if s.Fallback != "" {
+		oc.Destination, oc.Source = s.Fallback, "fallback"
+	}
+	return oc
+}
+
+/* ---------------- HANDLERS ---------------- */
+
+// getOnCall shows who is on call for every schedule, now or at ?at=<RFC3339>
+func getOnCall(c *gin.Context) {
+	at := time.Now()
+	if v := c.Query("at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at must be an RFC3339 time"})
+			return
+		}
+		at = t
+	}
+
+	cfg := configs.current()
+	out := []OnCall{}
+	for name, s := range cfg.Schedules {
+		if filter := c.Param("schedule"); filter != "" && filter != name {
+			continue
+		}
+		out = append(out, s.onCall(name, at))
+	}
+	if c.Param("schedule") != "" && len(out) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+		return
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Schedule < out[j].Schedule })
+	c.JSON(http.StatusOK, gin.H{"at": at, "on_call": out})
+}
+
+func scheduleSnapshot(name string) func(*RouterConfig) interface{} {
+	return func(cfg *RouterConfig) interface{} {
+		if s, ok := cfg.Schedules[name]; ok {
+			return s
+		}
+		return nil
+	}
+}
+
+func putSchedule(c *gin.Context) {
+	name := c.Param("schedule")
+	var s Schedule
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	applyChange(c, "put", "schedule", name, http.StatusOK, func(cfg *RouterConfig) error {
+		if cfg.Schedules == nil {
+			cfg.Schedules = make(map[string]*Schedule)
+		}
+		cp := s
+		cfg.Schedules[name] = &cp
+		return nil
+	}, scheduleSnapshot(name))
+}
+
+// deleteSchedule removes a schedule; it fails while a route still targets it
+func deleteSchedule(c *gin.Context) {
+	name := c.Param("schedule")
+	applyChange(c, "delete", "schedule", name, http.StatusOK, func(cfg *RouterConfig) error {
+		if _, ok := cfg.Schedules[name]; !ok {
+			return &notFoundError{"schedule", name}
+		}
+		delete(cfg.Schedules, name)
+		return nil
+	}, scheduleSnapshot(name))
+}
+
+// addOverride puts someone on call for a period; overrides that have ended
+// are pruned at the same time
+func addOverride(c *gin.Context) {
+	name := c.Param("schedule")
+	var o Override
+	if err := c.ShouldBindJSON(&o); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	o.CreatedBy = c.GetString("actor")
+
+	now := time.Now()
+	applyChange(c, "override", "schedule", name, http.StatusCreated, func(cfg *RouterConfig) error {
+		s, ok := cfg.Schedules[name]
+		if !ok {
+			return &notFoundError{"schedule", name}
+		}
+		kept := []Override{}
+		for _, existing := range s.Overrides {
+			if existing.End.After(now) {
+				kept = append(kept, existing)
+			}
+		}
+		s.Overrides = append(kept, o)
+		return nil
+	}, scheduleSnapshot(name))
+}
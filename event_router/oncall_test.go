@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var oncallDestinations = map[string]*Destination{
+	"alice-pager": {Type: "webhook"}, "bob-pager": {Type: "webhook"}, "carol-pager": {Type: "webhook"}, "noc": {Type: "webhook"},
+}
+
+// teamSchedule rotates alice and bob weekly from Monday 5 October 2026,
+// with carol covering weekend nights in London
+func teamSchedule(t *testing.T) *Schedule {
+	t.Helper()
+	s := &Schedule{
+		Timezone: "Europe/London",
+		Members:  map[string]string{"alice": "alice-pager", "bob": "bob-pager", "carol": "carol-pager"},
+		Shifts:   []Shift{{Person: "carol", Days: []string{"sat", "sun"}, Start: "20:00", End: "08:00"}},
+		Rotation: &Rotation{People: []string{"alice", "bob"}, Start: time.Date(2026, 10, 5, 9, 0, 0, 0, time.UTC)},
+		Fallback: "noc",
+	}
+	if err := s.compile("network", oncallDestinations); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func utc(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestScheduleResolution(t *testing.T) {
+	s := teamSchedule(t)
+	for _, c := range []struct {
+		at, person, source, dest, until string
+	}{
+		// Before the rotation starts only the fallback is left
+		{"2026-10-01T12:00:00Z", "", "fallback", "noc", ""},
+		{"2026-10-05T09:00:00Z", "alice", "rotation", "alice-pager", "2026-10-12T09:00:00Z"},
+		{"2026-10-13T03:00:00Z", "bob", "rotation", "bob-pager", "2026-10-19T09:00:00Z"},
+		{"2026-10-19T10:00:00Z", "alice", "rotation", "alice-pager", "2026-10-26T09:00:00Z"},
+		// Shifts are in the schedule's time zone (BST, UTC+1) and run past
+		// midnight into the next day
+		{"2026-10-17T19:00:00Z", "carol", "shift", "carol-pager", "2026-10-18T07:00:00Z"},
+		{"2026-10-18T06:59:00Z", "carol", "shift", "carol-pager", "2026-10-18T07:00:00Z"},
+		{"2026-10-18T07:00:00Z", "bob", "rotation", "bob-pager", "2026-10-19T09:00:00Z"},
+		{"2026-10-17T18:59:00Z", "bob", "rotation", "bob-pager", "2026-10-19T09:00:00Z"},
+		// Sunday night runs into Monday morning
+		{"2026-10-19T06:00:00Z", "carol", "shift", "carol-pager", "2026-10-19T07:00:00Z"},
+	} {
+		oc := s.onCall("network", utc(c.at))
+		until := ""
+		if oc.Until != nil {
+			until = oc.Until.UTC().Format(time.RFC3339)
+		}
+		if oc.Person != c.person || oc.Source != c.source || oc.Destination != c.dest || until != c.until {
+			t.Errorf("at %s: %s via %s to %s until %q, want %s via %s to %s until %q",
+				c.at, oc.Person, oc.Source, oc.Destination, until, c.person, c.source, c.dest, c.until)
+		}
+	}
+
+	empty := &Schedule{Members: map[string]string{}}
+	if err := empty.compile("empty", oncallDestinations); err != nil {
+		t.Fatal(err)
+	}
+	if oc := empty.onCall("empty", utc("2026-10-19T10:00:00Z")); oc.Source != "none" || oc.Destination != "" {
+		t.Errorf("empty schedule = %+v, want nobody", oc)
+	}
+}
+
+// Overrides win over shifts and the rotation for their period, the first
+// listed winning where they overlap
+func TestScheduleOverrides(t *testing.T) {
+	s := teamSchedule(t)
+	s.Overrides = []Override{
+		{Person: "bob", Start: utc("2026-10-19T09:00:00Z"), End: utc("2026-10-19T17:00:00Z"), Reason: "alice at the dentist"},
+		{Person: "carol", Start: utc("2026-10-19T12:00:00Z"), End: utc("2026-10-20T00:00:00Z")},
+		{Person: "alice", Start: utc("2026-10-24T00:00:00Z"), End: utc("2026-10-26T00:00:00Z"), Reason: "carol away"},
+	}
+	if err := s.compile("network", oncallDestinations); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ at, person, source, until string }{
+		{"2026-10-19T08:59:00Z", "bob", "rotation", "2026-10-19T09:00:00Z"},
+		{"2026-10-19T09:00:00Z", "bob", "override", "2026-10-19T17:00:00Z"},
+		{"2026-10-19T12:00:00Z", "bob", "override", "2026-10-19T17:00:00Z"},
+		{"2026-10-19T17:00:00Z", "carol", "override", "2026-10-20T00:00:00Z"},
+		{"2026-10-20T00:00:00Z", "alice", "rotation", "2026-10-26T09:00:00Z"},
+		{"2026-10-24T22:00:00Z", "alice", "override", "2026-10-26T00:00:00Z"},
+	} {
+		oc := s.onCall("network", utc(c.at))
+		if oc.Person != c.person || oc.Source != c.source || oc.Until == nil || !oc.Until.Equal(utc(c.until)) {
+			t.Errorf("at %s: %s via %s until %v, want %s via %s until %s", c.at, oc.Person, oc.Source, oc.Until, c.person, c.source, c.until)
+		}
+	}
+}
+
+func TestScheduleRejectsInvalid(t *testing.T) {
+	start := utc("2026-10-19T09:00:00Z")
+	for name, s := range map[string]*Schedule{
+		"unknown destination": {Members: map[string]string{"alice": "nowhere"}},
+		"unknown fallback":    {Members: map[string]string{}, Fallback: "nowhere"},
+		"shift for a stranger": {Members: map[string]string{"alice": "alice-pager"},
+			Shifts: []Shift{{Person: "dave", Days: []string{"mon"}, Start: "09:00", End: "17:00"}}},
+		"shift on a bad day": {Members: map[string]string{"alice": "alice-pager"},
+			Shifts: []Shift{{Person: "alice", Days: []string{"someday"}, Start: "09:00", End: "17:00"}}},
+		"empty rotation": {Members: map[string]string{}, Rotation: &Rotation{Start: start}},
+		"bad rotation length": {Members: map[string]string{"alice": "alice-pager"},
+			Rotation: &Rotation{People: []string{"alice"}, Start: start, Length: "-1h"}},
+		"backwards override": {Members: map[string]string{"alice": "alice-pager"},
+			Overrides: []Override{{Person: "alice", Start: start, End: start}}},
+		"unknown time zone": {Timezone: "Mars/Olympus", Members: map[string]string{}},
+	} {
+		if err := s.compile("network", oncallDestinations); err == nil {
+			t.Errorf("%s: compiled, want an error", name)
+		}
+	}
+}
+
+func TestCalendarHoursAndHolidays(t *testing.T) {
+	c := &Calendar{Timezone: "America/New_York", Start: "09:00", End: "17:30", Holidays: []string{"2026-11-26"}}
+	if err := c.compile("office"); err != nil {
+		t.Fatal(err)
+	}
+	for at, want := range map[string]bool{
+		"2026-10-19T13:00:00Z": true,  // Monday 09:00 EDT
+		"2026-10-19T12:59:00Z": false, // Monday 08:59 EDT
+		"2026-10-19T21:30:00Z": false, // Monday 17:30 EDT
+		"2026-10-17T15:00:00Z": false, // Saturday
+		"2026-11-26T15:00:00Z": false, // Thanksgiving
+		"2026-11-27T15:00:00Z": true,
+	} {
+		if got := c.contains(utc(at)); got != want {
+			t.Errorf("%s in office hours = %v, want %v", at, got, want)
+		}
+	}
+	if err := (&Calendar{Start: "9am", End: "17:00"}).compile("bad"); err == nil {
+		t.Error("calendar with a bad start compiled")
+	}
+}
+
+// Overrides added through the admin API record who added them and prune
+// the ones that have ended; routes reach whoever is on call
+func TestAddOverride(t *testing.T) {
+	routingFixture(t, `{
+  "destinations": {"alice-pager": {"type": "webhook", "url": "https://a.example"}, "bob-pager": {"type": "webhook", "url": "https://b.example"}},
+  "schedules": {"network": {"members": {"alice": "alice-pager", "bob": "bob-pager"},
+    "rotation": {"people": ["alice"], "start": "2026-01-05T00:00:00Z"},
+    "overrides": [{"person": "bob", "start": "2026-01-01T00:00:00Z", "end": "2026-01-02T00:00:00Z"}]}},
+  "routes": [{"name": "network", "destinations": [{"on_call": "network"}]}]
+}`)
+	t.Setenv("EVENT_ROUTER_ADMIN_TOKEN", "")
+	t.Setenv("EVENT_ROUTER_ADMIN_TOKENS", "alice:tok-alice")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/oncall/:schedule", getOnCall)
+	r.POST("/admin/schedules/:schedule/overrides", adminAuth(), addOverride)
+	r.PUT("/admin/schedules/:schedule", adminAuth(), putSchedule)
+
+	start, end := time.Now().Add(-time.Minute).UTC(), time.Now().Add(time.Hour).UTC()
+	body := `{"person": "bob", "start": "` + start.Format(time.RFC3339) + `", "end": "` + end.Format(time.RFC3339) + `", "reason": "swap"}`
+	version := strconv.Itoa(configs.current().Version)
+	if w := call(r, "POST", "/admin/schedules/network/overrides", "tok-alice", version, body); w.Code != http.StatusCreated {
+		t.Fatalf("add override = %d %s", w.Code, w.Body)
+	}
+	overrides := configs.current().Schedules["network"].Overrides
+	if len(overrides) != 1 || overrides[0].Person != "bob" || overrides[0].CreatedBy != "alice" {
+		t.Errorf("overrides = %+v, want bob's, added by alice, with the ended one pruned", overrides)
+	}
+	if targets := configs.current().resolve(Event{Type: "critical"}); len(targets) != 1 || targets[0].Destination != "bob-pager" {
+		t.Errorf("route targets = %+v, want bob-pager", targets)
+	}
+
+	w := call(r, "GET", "/oncall/network?at="+end.Format(time.RFC3339), "", "", "")
+	var resp struct {
+		OnCall []OnCall `json:"on_call"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.OnCall) != 1 || resp.OnCall[0].Person != "alice" {
+		t.Errorf("on call when the override ends = %s, want alice", w.Body)
+	}
+	if w := call(r, "GET", "/oncall/network?at=tomorrow", "", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bad at = %d, want 400", w.Code)
+	}
+	if w := call(r, "GET", "/oncall/support", "", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown schedule = %d, want 404", w.Code)
+	}
+	if w := call(r, "POST", "/admin/schedules/support/overrides", "tok-alice", strconv.Itoa(configs.current().Version), body); w.Code != http.StatusNotFound {
+		t.Errorf("override for an unknown schedule = %d, want 404", w.Code)
+	}
+	stranger := strings.Replace(body, `"bob"`, `"dave"`, 1)
+	if w := call(r, "POST", "/admin/schedules/network/overrides", "tok-alice", strconv.Itoa(configs.current().Version), stranger); w.Code != http.StatusBadRequest {
+		t.Errorf("override for a non-member = %d, want 400", w.Code)
+	}
+
+	// A schedule is created, then updated
+	schedule := `{"members": {"alice": "alice-pager"}, "fallback": "bob-pager"}`
+	for _, want := range []int{http.StatusCreated, http.StatusOK} {
+		if w := call(r, "PUT", "/admin/schedules/support", "tok-alice", strconv.Itoa(configs.current().Version), schedule); w.Code != want {
+			t.Errorf("put schedule = %d %s, want %d", w.Code, w.Body, want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+)
+
+// Default lane settings, indexed like constants.AllSeverities. Each lane
+// has its own capacity, so an info flood can never take the room reserved
+// for critical and high events.
+var (
+	defaultLaneWeights    = []int{16, 8, 4, 2, 1}
+	defaultLaneCapacities = []int{1000, 1000, 500, 500, 500}
+)
+
+// routeJob is an event waiting in a lane
+type routeJob struct {
+	evt        Event
+	key        string // ordering key, see orderingKey
+	seq        uint64
+	enqueuedAt time.Time
+	done       chan routeOutcome // nil when the caller does not wait
+}
+
+// routeOutcome is the response for a routed event
+type routeOutcome struct {
+	code int
+	body gin.H
+}
+
+// lane holds the settings and metrics for one severity
+type lane struct {
+	name     string
+	weight   int
+	capacity int
+	depth    int
+
+	enqueued, dequeued, rejected uint64
+	wait, latency                *histogram
+}
+
+// partition is served by a single worker, which keeps the events of each
+// device in order. It queues jobs per lane and picks among lanes with
+// smooth weighted round-robin, so critical events for one device still get
+// ahead of an info backlog from other devices in the same partition.
+type partition struct {
+	name    string
+	queues  [][]*routeJob       // per lane, in arrival order
+	current []int               // weighted round-robin state per lane
+	pending map[string][]uint64 // per ordering key, sequence numbers not yet taken
+	cond    *sync.Cond
+}
+
+// laneScheduler spreads events over partitions by device using consistent
+// hashing. Partitions run in parallel; within a partition an event is only
+// taken once every earlier event for the same device has been, so priority
+// applies across devices while order is preserved per device.
+type laneScheduler struct {
+	mu         sync.Mutex
+	lanes      []*lane
+	partitions map[string]*partition
+	ring       *hashRing
+	seq        uint64
+}
+
+var errLaneFull = errors.New("lane full")
+
+func newLaneScheduler(weights, capacities []int, partitions int) *laneScheduler {
+	s := &laneScheduler{partitions: make(map[string]*partition)}
+	for i, name := range constants.AllSeverities {
+		s.lanes = append(s.lanes, &lane{
+			name:     name,
+			weight:   weights[i],
+			capacity: capacities[i],
+			wait:     newHistogram(),
+			latency:  newHistogram(),
+		})
+	}
+	names := make([]string, partitions)
+	for i := range names {
+		names[i] = fmt.Sprintf("p%d", i)
+		s.partitions[names[i]] = &partition{
+			name:    names[i],
+			queues:  make([][]*routeJob, len(s.lanes)),
+			current: make([]int, len(s.lanes)),
+			pending: make(map[string][]uint64),
+			cond:    sync.NewCond(&s.mu),
+		}
+	}
+	s.ring = newHashRing(names)
+	return s
+}
+
+// orderingKey identifies the device an event is about. Events without a
+// source have no ordering requirement and are spread by their ID.
+func orderingKey(evt Event) string {
+	switch {
+	case evt.SourceHost != "":
+		return "host:" + evt.SourceHost
+	case evt.SourceIP != "":
+		return "ip:" + evt.SourceIP
+	}
+	return "id:" + evt.EventID
+}
+
+// laneIndex maps a severity to its lane; unknown severities share the info lane
+func (s *laneScheduler) laneIndex(severity string) int {
+	i := constants.GetSeverityPriority(severity) - 1
+	if i < 0 || i >= len(s.lanes) {
+		i = len(s.lanes) - 1
+	}
+	return i
+}
+
+// enqueue adds a job to its lane in the partition owning its device,
+// failing with errLaneFull at the lane's capacity
+func (s *laneScheduler) enqueue(job *routeJob) (*lane, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	li := s.laneIndex(job.evt.Type)
+	l := s.lanes[li]
+	if l.depth >= l.capacity {
+		l.rejected++
+		return l, errLaneFull
+	}
+	s.seq++
+	job.seq = s.seq
+	job.key = orderingKey(job.evt)
+	job.enqueuedAt = time.Now()
+
+	p := s.partitions[s.ring.get(job.key)]
+	p.queues[li] = append(p.queues[li], job)
+	p.pending[job.key] = append(p.pending[job.key], job.seq)
+	l.depth++
+	l.enqueued++
+	p.cond.Signal()
+	return l, nil
+}
+
+// next blocks until the partition has a job that may run now
+func (s *laneScheduler) next(p *partition) (*routeJob, *lane) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		// Lanes whose queue holds a job that is first in line for its device
+		total := 0
+		best, bestPos := -1, -1
+		for li, q := range p.queues {
+			pos := -1
+			for i, job := range q {
+				if p.pending[job.key][0] == job.seq {
+					pos = i
+					break
+				}
+			}
+			if pos < 0 {
+				continue
+			}
+			p.current[li] += s.lanes[li].weight
+			total += s.lanes[li].weight
+			if best < 0 || p.current[li] > p.current[best] {
+				best, bestPos = li, pos
+			}
+		}
+		if best >= 0 {
+			p.current[best] -= total
+			q := p.queues[best]
+			job := q[bestPos]
+			p.queues[best] = append(q[:bestPos:bestPos], q[bestPos+1:]...)
+			if rest := p.pending[job.key][1:]; len(rest) > 0 {
+				p.pending[job.key] = rest
+			} else {
+				delete(p.pending, job.key)
+			}
+
+			l := s.lanes[best]
+			l.depth--
+			l.dequeued++
+			l.wait.observe(time.Since(job.enqueuedAt))
+			return job, l
+		}
+		p.cond.Wait()
+	}
+}
+
+// run starts one worker per partition
+func (s *laneScheduler) run(process func(*routeJob) routeOutcome) {
+	for _, p := range s.partitions {
+		go func(p *partition) {
+			for {
+				job, l := s.next(p)
+				outcome := process(job)
+				s.observeLatency(l, time.Since(job.enqueuedAt))
+				if job.done != nil {
+					job.done <- outcome
+				}
+			}
+		}(p)
+	}
+}
+
+func (s *laneScheduler) observeLatency(l *lane, d time.Duration) {
+	s.mu.Lock()
+	l.latency.observe(d)
+	s.mu.Unlock()
+}
+
+// laneSettings reads per-lane values such as "critical=16,high=8" from an
+// environment variable, falling back to defaults for lanes not listed
+func laneSettings(key string, defaults []int) ([]int, error) {
+	out := append([]int(nil), defaults...)
+	raw := config.GetEnv(key, "")
+	if raw == "" {
+		return out, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n <= 0 || !constants.IsValidSeverity(name) {
+			return nil, fmt.Errorf("%s: invalid entry %q, want <severity>=<positive int>", key, pair)
+		}
+		out[constants.GetSeverityPriority(name)-1] = n
+	}
+	return out, nil
+}
+
+/* ---------------- HANDLER ---------------- */
+
+// lanes queues incoming events by severity
+var lanes *laneScheduler
+
+// enqueueRoute accepts an event into its lane. By default it waits for the
+// event to be routed and returns the routing result; with ?async=true it
+// returns 202 as soon as the event is queued.
+func enqueueRoute(c *gin.Context) {
+	var evt Event
+	if err := c.ShouldBindJSON(&evt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if evt.EventID == "" {
+		evt.EventID = fileutil.NewID("evt")
+	}
+
+	async := c.Query("async") == "true"
+	if peers != nil {
+		if owner := peers.forwardTarget(evt, c.GetHeader(forwardedHeader)); owner != "" {
+			code, body, err := peers.forward(owner, evt, async)
+			if err == nil {
+				c.Data(code, "application/json; charset=utf-8", body)
+				return
+			}
+			// Better out of order than lost: handle it here
+			log.Printf("Forwarding %s to %s failed, routing it locally: %v", evt.EventID, owner, err)
+		}
+	}
+
+	job := &routeJob{evt: evt}
+	if !async {
+		job.done = make(chan routeOutcome, 1)
+	}
+	l, err := lanes.enqueue(job)
+	if err != nil {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":    fmt.Sprintf("%s lane is full (%d queued)", l.name, l.capacity),
+			"event_id": evt.EventID,
+		})
+		return
+	}
+	if async {
+		c.JSON(http.StatusAccepted, gin.H{"status": "queued", "event_id": evt.EventID, "lane": l.name})
+		return
+	}
+
+	select {
+	case out := <-job.done:
+		c.JSON(out.code, out.body)
+	case <-c.Request.Context().Done():
+		// The caller went away; the event is still routed
+	}
+}
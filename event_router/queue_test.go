@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+)
+
+type loadResult struct {
+	sent, rejected, outOfOrder int
+	latencies                  []time.Duration
+}
+
+func (r *loadResult) percentile(q float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	return r.latencies[int(q*float64(len(r.latencies)-1))]
+}
+
+type loadRun struct {
+	mu         sync.Mutex
+	bySeverity map[string]*loadResult
+	lastSeq    map[string]int // per device, highest sequence number processed
+}
+
+// load describes the traffic of a run: info events from many edge devices
+// and a steady trickle of critical ones from a few core devices
+type load struct {
+	duration               time.Duration
+	infoRate, criticalRate int
+	devices, workers       int
+	fifo                   bool // every event goes to the same lane
+}
+
+// runLoad generates the load against a fresh scheduler whose workers call
+// process, and waits for the queued events to drain. Every event carries a
+// per-device sequence number so reordering can be detected.
+func runLoad(l load, process func(*routeJob) routeOutcome) *loadRun {
+	run := &loadRun{
+		bySeverity: map[string]*loadResult{
+			constants.SeverityCritical: {},
+			constants.SeverityInfo:     {},
+		},
+		lastSeq: make(map[string]int),
+	}
+
+	capacities := defaultLaneCapacities
+	if l.fifo {
+		// One lane holding what all lanes would
+		capacities = append([]int(nil), defaultLaneCapacities...)
+		for _, n := range defaultLaneCapacities[:len(capacities)-1] {
+			capacities[len(capacities)-1] += n
+		}
+	}
+	s := newLaneScheduler(defaultLaneWeights, capacities, l.workers)
+	s.run(func(job *routeJob) routeOutcome {
+		out := process(job)
+		latency := time.Since(job.enqueuedAt)
+		seq, _ := strconv.Atoi(job.evt.Labels["seq"])
+
+		run.mu.Lock()
+		defer run.mu.Unlock()
+		r := run.bySeverity[job.evt.Labels["severity"]]
+		r.latencies = append(r.latencies, latency)
+		if seq <= run.lastSeq[job.evt.SourceHost] {
+			r.outOfOrder++
+		}
+		run.lastSeq[job.evt.SourceHost] = seq
+		return out
+	})
+
+	send := func(severity, hostPrefix string, hosts, perSecond int, stop <-chan struct{}, wg *sync.WaitGroup) {
+		defer wg.Done()
+		const tick = 10 * time.Millisecond
+		batch := float64(perSecond) * tick.Seconds()
+		owed := 0.0
+		seqs := make([]int, hosts)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for n := 0; ; {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for owed += batch; owed >= 1; owed-- {
+				h := n % hosts
+				n++
+				seqs[h]++
+				evt := Event{
+					Type:       severity,
+					Message:    "load test",
+					SourceHost: fmt.Sprintf("%s-%d", hostPrefix, h),
+					EventID:    fmt.Sprintf("evt-%s-%d-%d", hostPrefix, h, seqs[h]),
+					Labels:     map[string]string{"severity": severity, "seq": strconv.Itoa(seqs[h])},
+				}
+				if l.fifo {
+					evt.Type = constants.SeverityInfo
+				}
+				_, err := s.enqueue(&routeJob{evt: evt})
+				run.mu.Lock()
+				run.bySeverity[severity].sent++
+				if err != nil {
+					run.bySeverity[severity].rejected++
+				}
+				run.mu.Unlock()
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go send(constants.SeverityInfo, "edge", l.devices, l.infoRate, stop, &wg)
+	go send(constants.SeverityCritical, "core", 10, l.criticalRate, stop, &wg)
+	time.Sleep(l.duration)
+	close(stop)
+	wg.Wait()
+
+	// Let queued events drain so their latency is counted
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		run.mu.Lock()
+		pending := 0
+		for _, r := range run.bySeverity {
+			pending += r.sent - r.rejected - len(r.latencies)
+		}
+		run.mu.Unlock()
+		if pending <= 0 {
+			break
+		}
+	}
+	return run
+}
+
+func (run *loadRun) check(t *testing.T, mode string) *loadResult {
+	t.Helper()
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	for _, sev := range []string{constants.SeverityCritical, constants.SeverityInfo} {
+		r := run.bySeverity[sev]
+		t.Logf("%s %s: sent %d, routed %d, rejected %d, p50 %s, p99 %s, max %s", mode, sev, r.sent, len(r.latencies), r.rejected,
+			r.percentile(0.50), r.percentile(0.99), r.percentile(1))
+		if r.outOfOrder > 0 {
+			t.Errorf("%s: %d %s events were processed out of order", mode, r.outOfOrder, sev)
+		}
+	}
+	return run.bySeverity[constants.SeverityCritical]
+}
+
+// An info flood beyond what the workers can deliver must not delay critical
+// events, which a single FIFO lane does
+func TestLanesKeepCriticalLatencyLow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	l := load{duration: time.Second, infoRate: 4000, criticalRate: 20, devices: 200, workers: 4}
+	delivery := func(*routeJob) routeOutcome {
+		time.Sleep(2 * time.Millisecond)
+		return routeOutcome{}
+	}
+
+	l.fifo = true
+	fifo := runLoad(l, delivery).check(t, "fifo")
+	l.fifo = false
+	lanes := runLoad(l, delivery).check(t, "lanes")
+
+	if p99 := lanes.percentile(0.99); p99 > 100*time.Millisecond {
+		t.Errorf("critical p99 with lanes = %s, want under 100ms", p99)
+	}
+	if lanes.percentile(0.99) >= fifo.percentile(0.99) {
+		t.Errorf("critical p99 with lanes (%s) is no better than fifo (%s)", lanes.percentile(0.99), fifo.percentile(0.99))
+	}
+}
+
+// routingFixture points the router globals at a config and temporary
+// state, restoring the retry settings afterwards
+func routingFixture(t *testing.T, cfg string) {
+	t.Helper()
+	dir := t.TempDir()
+	auditLog = &auditTrail{path: filepath.Join(dir, "audit.jsonl")}
+
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if configs, err = newConfigStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if dlq, err = newDeadLetterQueue(filepath.Join(dir, "dlq.json")); err != nil {
+		t.Fatal(err)
+	}
+	if suppressions, err = newSuppressionStore(filepath.Join(dir, "suppressions.json")); err != nil {
+		t.Fatal(err)
+	}
+	if digests, err = newDigestQueue(filepath.Join(dir, "digests.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	prevRetries, prevBackoff := maxRetries, retryBackoff
+	breakers = &breakerRegistry{failures: make(map[string]int)}
+	t.Cleanup(func() { maxRetries, retryBackoff = prevRetries, prevBackoff })
+}
+
+// A destination that answers slowly with errors must not hold up the
+// partition workers: critical events sharing those workers with events for
+// the failing destination are routed without waiting for retries, and the
+// failed deliveries end up in the DLQ
+func TestFailingDestinationKeepsCriticalLatencyLow(t *testing.T) {
+	const slow = 150 * time.Millisecond
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(slow)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	routingFixture(t, fmt.Sprintf(`{
+  "destinations": {
+    "pager": {"type": "webhook", "url": %q},
+    "archive": {"type": "webhook", "url": %q}
+  },
+  "routes": [
+    {"name": "critical", "match": {"types": ["critical"]}, "destinations": ["pager"]},
+    {"name": "info", "match": {"types": ["info"]}, "destinations": ["archive"]}
+  ]
+}`, healthy.URL, failing.URL))
+	// Retried inline, every info event would hold its worker for about 1s
+	maxRetries, retryBackoff = 3, 20*time.Millisecond
+
+	var mu sync.Mutex
+	statuses := make(map[string]int)
+	l := load{duration: 2 * time.Second, infoRate: 50, criticalRate: 20, devices: 20, workers: 2}
+	critical := runLoad(l, func(job *routeJob) routeOutcome {
+		out := routeEvent(job.evt)
+		mu.Lock()
+		statuses[fmt.Sprintf("%s %v", job.evt.Type, out.body["status"])]++
+		mu.Unlock()
+		return out
+	}).check(t, "failing destination")
+
+	// A critical event waits for at most one inline attempt at the failing
+	// destination, and only until its breaker opens
+	if max := critical.percentile(1); max > 2*slow {
+		t.Errorf("critical max latency = %s, want under %s", max, 2*slow)
+	}
+	if statuses["critical forwarded"] != len(critical.latencies) {
+		t.Errorf("statuses = %v, want every critical event forwarded", statuses)
+	}
+	if statuses["info retrying"] == 0 {
+		t.Errorf("statuses = %v, want info events retrying", statuses)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		retries.mu.Lock()
+		pending := retries.pending
+		retries.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+	}
+	if got, want := len(dlq.List(deadLetterFilter{})), statuses["info retrying"]+statuses["info dead_lettered"]; got != want {
+		t.Errorf("dead letters = %d, want %d", got, want)
+	}
+	if !breakers.open("archive") {
+		t.Error("breaker for the failing destination is closed")
+	}
+}
+
+// A delivery that fails once and then succeeds is completed by the retry
+// queue and closes the destination's breaker
+func TestRetryQueueRecovers(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer flaky.Close()
+
+	routingFixture(t, fmt.Sprintf(`{
+  "destinations": {"flaky": {"type": "webhook", "url": %q}},
+  "routes": [{"name": "all", "destinations": ["flaky"]}]
+}`, flaky.URL))
+	maxRetries, retryBackoff = 3, 10*time.Millisecond
+
+	out := routeEvent(Event{Type: "critical", Message: "link down", SourceHost: "core-1", EventID: "evt-1"})
+	if out.code != http.StatusAccepted || out.body["status"] != "retrying" {
+		t.Fatalf("routeEvent = %d %v, want 202 retrying", out.code, out.body["status"])
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := calls
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(dlq.List(deadLetterFilter{})); n != 0 {
+		t.Errorf("dead letters = %d, want 0", n)
+	}
+	if breakers.open("flaky") {
+		t.Error("breaker is open after a successful retry")
+	}
+}
+
+// A device sending info and critical events interleaved gets them routed in
+// the order sent, even though critical events of other devices overtake the
+// info backlog. This is what partition.pending enforces.
+func TestInterleavedSeveritiesKeepDeviceOrder(t *testing.T) {
+	s := newLaneScheduler(defaultLaneWeights, defaultLaneCapacities, 1)
+	enqueue := func(host, severity string, seq int) {
+		t.Helper()
+		evt := Event{Type: severity, SourceHost: host, Labels: map[string]string{"seq": strconv.Itoa(seq)}}
+		if _, err := s.enqueue(&routeJob{evt: evt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 100; i++ {
+		enqueue(fmt.Sprintf("edge-%d", i), constants.SeverityInfo, 1)
+	}
+	for seq := 1; seq <= 20; seq++ {
+		severity := constants.SeverityInfo
+		if seq%2 == 0 {
+			severity = constants.SeverityCritical
+		}
+		enqueue("core-1", severity, seq)
+	}
+	enqueue("core-2", constants.SeverityCritical, 1)
+
+	total := 121
+	order := make(chan Event, total)
+	s.run(func(job *routeJob) routeOutcome {
+		order <- job.evt
+		return routeOutcome{}
+	})
+
+	var device []string
+	core2At := -1
+	for i := 0; i < total; i++ {
+		select {
+		case evt := <-order:
+			switch evt.SourceHost {
+			case "core-1":
+				device = append(device, evt.Labels["seq"]+"/"+evt.Type)
+				if seq, _ := strconv.Atoi(evt.Labels["seq"]); seq != len(device) {
+					t.Fatalf("core-1 events routed as %v, want them in the order sent", device)
+				}
+			case "core-2":
+				core2At = i
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d events routed", i, total)
+		}
+	}
+	if len(device) != 20 {
+		t.Errorf("core-1 events routed = %d, want 20", len(device))
+	}
+	if core2At < 0 || core2At > 10 {
+		t.Errorf("critical event of another device routed at position %d, want it ahead of the info backlog", core2At)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+)
+
+// redacted replaces secret values in anything the router shows or logs
+const redacted = "REDACTED"
+
+// redactURL keeps the scheme and host of a destination URL and hides the
+// rest: Slack and Teams webhooks carry their credentials in the path, other
+// endpoints in the query or user info
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	out := u.Scheme + "://" + u.Host
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		out += "/" + redacted
+	}
+	return out
+}
+
+// secrets lists the credential values of a destination, for scrubbing them
+// from rendered payloads
+func (d *Destination) secrets() []string {
+	out := []string{d.URL}
+	for _, v := range d.Headers {
+		out = append(out, v)
+	}
+	if d.RoutingKey != "" {
+		out = append(out, d.RoutingKey)
+	}
+	if d.Email != nil && d.Email.Password != "" {
+		out = append(out, d.Email.Password)
+	}
+	return out
+}
+
+// redacted returns a copy of the destination that is safe to return from
+// the API or write to the audit log
+func (d *Destination) redacted() *Destination {
+	if d == nil {
+		return nil
+	}
+	c := *d
+	c.URL = redactURL(d.URL)
+	if len(d.Headers) > 0 {
+		c.Headers = make(map[string]string, len(d.Headers))
+		for k := range d.Headers {
+			c.Headers[k] = redacted
+		}
+	}
+	if c.RoutingKey != "" {
+		c.RoutingKey = redacted
+	}
+	if d.Email != nil && d.Email.Password != "" {
+		email := *d.Email
+		email.Password = redacted
+		c.Email = &email
+	}
+	return &c
+}
+
+// redactSecrets replaces every occurrence of the secrets in a payload
+func redactSecrets(body []byte, secrets []string) []byte {
+	for _, s := range secrets {
+		if s != "" {
+			body = bytes.ReplaceAll(body, []byte(s), []byte(redacted))
+		}
+	}
+	return body
+}
+
+// redact hides destination URLs and credentials from an explanation, e.g.
+// the routing key in a PagerDuty payload
+func (ex *Explanation) redact() {
+	for i, t := range ex.targets {
+		d := &ex.Destinations[i]
+		secrets := t.dest.secrets()
+		d.URL = redactURL(d.URL)
+		if d.Payload != nil {
+			d.Payload = redactSecrets(d.Payload, secrets)
+		}
+		d.PayloadText = string(redactSecrets([]byte(d.PayloadText), secrets))
+		if d.Error != "" {
+			d.Error = string(redactSecrets([]byte(d.Error), secrets))
+		}
+	}
+}
+
+// redacted returns a copy of the config with every destination and route
+// redacted
+func (cfg *RouterConfig) redacted() *RouterConfig {
+	c := *cfg
+	c.Destinations = redactedDestinations(cfg.Destinations)
+	c.Routes = make([]*Route, len(cfg.Routes))
+	for i, r := range cfg.Routes {
+		c.Routes[i] = r.redacted(cfg.Destinations)
+	}
+	return &c
+}
+
+// redacted returns a copy of the route, for showing only, with every
+// destination secret that its templates or transforms spell out replaced,
+// e.g. a webhook token pasted into a route template
+func (r *Route) redacted(dests map[string]*Destination) *Route {
+	// Not HTML-escaped, so secrets holding & or < are found as written
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(r); err != nil {
+		return &Route{Name: r.Name}
+	}
+	var secrets []string
+	for _, d := range dests {
+		secrets = append(secrets, d.secrets()...)
+	}
+	var c Route
+	if err := json.Unmarshal(redactSecrets(buf.Bytes(), secrets), &c); err != nil {
+		return &Route{Name: r.Name}
+	}
+	return &c
+}
+
+func redactedDestinations(dests map[string]*Destination) map[string]*Destination {
+	out := make(map[string]*Destination, len(dests))
+	for name, d := range dests {
+		out[name] = d.redacted()
+	}
+	return out
+}
+
+// restoreSecrets keeps the current value of every secret the client sent
+// back redacted, so a destination read from the API can be edited and
+// written back without re-entering its credentials
+func (d *Destination) restoreSecrets(prev *Destination) {
+	if prev == nil {
+		return
+	}
+	if d.URL == redactURL(prev.URL) && d.URL != prev.URL {
+		d.URL = prev.URL
+	}
+	for k, v := range d.Headers {
+		if v == redacted {
+			d.Headers[k] = prev.Headers[k]
+		}
+	}
+	if d.RoutingKey == redacted {
+		d.RoutingKey = prev.RoutingKey
+	}
+	if d.Email != nil && d.Email.Password == redacted && prev.Email != nil {
+		d.Email.Password = prev.Email.Password
+	}
+}
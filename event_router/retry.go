@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// retryJob is a delivery waiting for its next attempt. evt is the event as
+// routed, before the target's transforms, which is what the DLQ keeps.
+type retryJob struct {
+	t        target
+	evt      Event
+	attempts []DeliveryAttempt
+	backoff  time.Duration
+}
+
+// retryQueue re-attempts failed deliveries in the background with
+// exponential backoff, so a destination that is down never holds up the
+// partition worker serving the next event. A delivery still failing after
+// maxRetries retries is dead-lettered.
+type retryQueue struct {
+	mu       sync.Mutex
+	capacity int
+	pending  int
+
+	retried, recovered, deadLettered, overflowed uint64
+}
+
+var retries = &retryQueue{capacity: config.GetEnvInt("EVENT_ROUTER_RETRY_QUEUE_CAPACITY", 10000)}
+
+// add schedules the next attempt of a failed delivery. It returns false
+// when the queue is full, and the caller dead-letters the delivery instead.
+func (q *retryQueue) add(job *retryJob) bool {
+	q.mu.Lock()
+	if q.pending >= q.capacity {
+		q.overflowed++
+		q.mu.Unlock()
+		return false
+	}
+	q.pending++
+	q.mu.Unlock()
+
+	if job.backoff == 0 {
+		job.backoff = retryBackoff
+	}
+	time.AfterFunc(job.backoff, func() { q.attempt(job) })
+	return true
+}
+
+func (q *retryQueue) attempt(job *retryJob) {
+	response, attempt, err := deliverOnce(job.t, job.t.event(job.evt))
+	job.attempts = append(job.attempts, attempt)
+	breakers.record(job.t.Destination, err)
+
+	q.mu.Lock()
+	q.retried++
+	q.mu.Unlock()
+
+	if err != nil && len(job.attempts) <= maxRetries && retryable(err) {
+		log.Printf("Delivery to %s failed (attempt %d/%d): %v", job.t.Destination, len(job.attempts), maxRetries+1, err)
+		job.backoff *= 2
+		time.AfterFunc(job.backoff, func() { q.attempt(job) })
+		return
+	}
+
+	q.mu.Lock()
+	q.pending--
+	if err == nil {
+		q.recovered++
+	} else {
+		q.deadLettered++
+	}
+	q.mu.Unlock()
+
+	if err == nil {
+		reportStatus(job.evt.EventID, []models.StatusUpdate{{Status: deliveredStatus(job.t, job.evt), Destination: job.t.Destination, Detail: response}})
+		return
+	}
+	r := deadLetter(job.t, job.evt, err, job.attempts)
+	reportStatus(job.evt.EventID, []models.StatusUpdate{deliveryUpdate(r)})
+}
+
+// deadLetter stores a delivery that failed for good and describes it
+func deadLetter(t target, evt Event, err error, attempts []DeliveryAttempt) deliveryResult {
+	r := deliveryResult{Route: t.Route, Destination: t.Destination, Status: "failed", Attempts: len(attempts), Error: err.Error()}
+	entry, dlqErr := dlq.Add(evt, t, err, attempts)
+	if dlqErr != nil {
+		log.Printf("Failed to persist dead-letter entry: %v", dlqErr)
+		return r
+	}
+	r.Status, r.DLQID = "dead_lettered", entry.ID
+	log.Printf("Event dead-lettered as %s after %d attempts: %v", entry.ID, len(attempts), err)
+	return r
+}
+
+func (q *retryQueue) writeMetrics(b *strings.Builder) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fmt.Fprintf(b, "# HELP event_router_retry_pending Deliveries waiting for a retry.\n# TYPE event_router_retry_pending gauge\nevent_router_retry_pending %d\n", q.pending)
+	fmt.Fprintf(b, "# HELP event_router_retry_attempts_total Retry attempts made in the background.\n# TYPE event_router_retry_attempts_total counter\nevent_router_retry_attempts_total %d\n", q.retried)
+	fmt.Fprintf(b, "# HELP event_router_retry_recovered_total Deliveries that succeeded on a retry.\n# TYPE event_router_retry_recovered_total counter\nevent_router_retry_recovered_total %d\n", q.recovered)
+	fmt.Fprintf(b, "# HELP event_router_retry_dead_lettered_total Deliveries dead-lettered after their retries.\n# TYPE event_router_retry_dead_lettered_total counter\nevent_router_retry_dead_lettered_total %d\n", q.deadLettered)
+	fmt.Fprintf(b, "# HELP event_router_retry_overflow_total Deliveries dead-lettered at once because the retry queue was full.\n# TYPE event_router_retry_overflow_total counter\nevent_router_retry_overflow_total %d\n", q.overflowed)
+}
+
+/* ---------------- CIRCUIT BREAKER ---------------- */
+
+// breakerRegistry counts consecutive failures per destination. Once a
+// destination has failed breakerThreshold times in a row, deliveries to it
+// skip the attempt on the worker and go straight to the retry queue, whose
+// attempts close the breaker again as soon as one succeeds. A slow or
+// unreachable destination therefore costs the worker a few timeouts, not
+// one per event.
+type breakerRegistry struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+var (
+	breakers         = &breakerRegistry{failures: make(map[string]int)}
+	breakerThreshold = config.GetEnvInt("EVENT_ROUTER_BREAKER_FAILURES", 3)
+)
+
+func (b *breakerRegistry) record(destination string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.failures, destination)
+		return
+	}
+	b.failures[destination]++
+	if b.failures[destination] == breakerThreshold {
+		log.Printf("Destination %s failed %d times in a row; retrying its deliveries in the background until it recovers", destination, breakerThreshold)
+	}
+}
+
+// open reports whether deliveries to the destination skip the inline attempt
+func (b *breakerRegistry) open(destination string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerThreshold > 0 && b.failures[destination] >= breakerThreshold
+}
+
+func (b *breakerRegistry) writeMetrics(sb *strings.Builder) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP event_router_destination_breaker_open Whether deliveries to the destination bypass the workers.\n# TYPE event_router_destination_breaker_open gauge\n")
+	for dest, n := range b.failures {
+		open := 0
+		if n >= breakerThreshold {
+			open = 1
+		}
+		fmt.Fprintf(sb, "event_router_destination_breaker_open{destination=%q} %d\n", dest, open)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// hashRing maps keys onto members with consistent hashing: every member owns
+// several points on the ring, and a key belongs to the first point at or
+// after its hash. Adding or removing a member only moves the keys next to
+// that member's points.
+type hashRing struct {
+	points  []uint32
+	owners  map[uint32]string
+	members []string
+}
+
+const ringReplicas = 64
+
+func newHashRing(members []string) *hashRing {
+	r := &hashRing{owners: make(map[uint32]string), members: members}
+	for _, m := range members {
+		for i := 0; i < ringReplicas; i++ {
+			h := hashKey(fmt.Sprintf("%s#%d", m, i))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = m
+			r.points = append(r.points, h)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// get returns the member owning key
+func (r *hashRing) get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hashKey is FNV-1a with a final mix, since plain FNV clusters similar
+// short keys such as "p1#2" and "p1#3"
+func hashKey(s string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb33fe63a94f3
+	x ^= x >> 33
+	return uint32(x)
+}
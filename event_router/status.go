@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// statusURL is where delivery status is reported, normally Ingestor Core,
+// authenticating with statusToken. Reporting is off when it is empty.
+var (
+	statusURL    = strings.TrimRight(config.GetEnv("EVENT_ROUTER_STATUS_URL", ""), "/")
+	statusToken  = config.GetEnv("EVENT_ROUTER_STATUS_TOKEN", "")
+	statusClient = &http.Client{Timeout: 2 * time.Second}
+)
+
+// reportStatus posts status updates for an event in the background. It is
+// best effort: a lost update never affects routing.
+func reportStatus(eventID string, updates []models.StatusUpdate) {
+	if statusURL == "" || eventID == "" || len(updates) == 0 {
+		return
+	}
+	for i := range updates {
+		updates[i].EventID, updates[i].Hop = eventID, "event_router"
+		if updates[i].At.IsZero() {
+			updates[i].At = time.Now()
+		}
+	}
+
+	go func() {
+		payload, err := json.Marshal(updates)
+		if err != nil {
+			return
+		}
+		req, err := http.NewRequest(http.MethodPost, statusURL+"/events/"+url.PathEscape(eventID)+"/status", bytes.NewReader(payload))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if statusToken != "" {
+			req.Header.Set("Authorization", "Bearer "+statusToken)
+		}
+		resp, err := statusClient.Do(req)
+		if err != nil {
+			log.Printf("Failed to report status of %s: %v", eventID, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Failed to report status of %s: status endpoint returned %d", eventID, resp.StatusCode)
+		}
+	}()
+}
+
+// routedUpdates describes the routing decision and each delivery's outcome
+func routedUpdates(results []deliveryResult) []models.StatusUpdate {
+	dests := make([]string, len(results))
+	for i, r := range results {
+		dests[i] = r.Destination
+	}
+	updates := []models.StatusUpdate{{Status: constants.StatusRouted, Detail: "to " + strings.Join(dests, ", ")}}
+	for _, r := range results {
+		if r.Status != "retrying" { // reported once the retry queue is done with it
+			updates = append(updates, deliveryUpdate(r))
+		}
+	}
+	return updates
+}
+
+func deliveryUpdate(r deliveryResult) models.StatusUpdate {
+	u := models.StatusUpdate{Status: constants.StatusDelivered, Destination: r.Destination, Detail: r.DownstreamReply}
+	switch r.Status {
+	case "delivered":
+	case constants.StatusQueued:
+		u.Status = constants.StatusQueued
+	default:
+		u.Status, u.Detail = constants.StatusFailed, r.Error
+		if r.DLQID != "" {
+			u.Detail = fmt.Sprintf("%s (dead-lettered as %s)", r.Error, r.DLQID)
+		}
+	}
+	return u
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
+)
+
+// Suppression actions
+const (
+	SuppressDrop      = "drop"
+	SuppressDowngrade = "downgrade"
+	SuppressTag       = "tag"
+)
+
+// SuppressionRule silences events in scope while its window is open, e.g.
+// during planned maintenance on a core switch
+type SuppressionRule struct {
+	ID     string           `json:"id"`
+	Name   string           `json:"name"`
+	Reason string           `json:"reason,omitempty"`
+	Scope  SuppressionScope `json:"scope"`
+
+	// Action is drop, downgrade or tag. Downgraded events are lowered to
+	// DowngradeTo, or one severity level when it is empty. Downgraded and
+	// tagged events carry the label suppressed=<rule id>.
+	Action      string `json:"action"`
+	DowngradeTo string `json:"downgrade_to,omitempty"`
+
+	Window SuppressionWindow `json:"window"`
+
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	schedule   *cronSchedule
+	activation *activation
+	location   *time.Location
+	duration   time.Duration
+	nets       []*net.IPNet
+}
+
+// SuppressionScope selects events. Empty fields match anything; values within
+// a field are OR'ed and fields are AND'ed together.
+type SuppressionScope struct {
+	Devices    []string          `json:"devices,omitempty"` // source_host glob patterns
+	CIDRs      []string          `json:"cidrs,omitempty"`
+	Categories []string          `json:"categories,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// SuppressionWindow is either one-off (Start/End) or recurring: it opens
+// whenever Cron fires and stays open for Duration, evaluated in Timezone.
+type SuppressionWindow struct {
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Cron     string     `json:"cron,omitempty"`
+	Duration string     `json:"duration,omitempty"`
+	Timezone string     `json:"timezone,omitempty"`
+}
+
+// compile validates the rule and prepares its schedule and networks
+func (r *SuppressionRule) compile() error {
+	switch r.Action {
+	case SuppressDrop, SuppressTag:
+	case SuppressDowngrade:
+		if r.DowngradeTo != "" && !constants.IsValidSeverity(r.DowngradeTo) {
+			return fmt.Errorf("downgrade_to %q is not a valid severity", r.DowngradeTo)
+		}
+	default:
+		return fmt.Errorf("action must be %s, %s or %s", SuppressDrop, SuppressDowngrade, SuppressTag)
+	}
+
+	s := r.Scope
+	if len(s.Devices) == 0 && len(s.CIDRs) == 0 && len(s.Categories) == 0 && len(s.Labels) == 0 {
+		return errors.New("scope must name at least one device, cidr, category or label")
+	}
+	if err := validateGlobs(s.Devices); err != nil {
+		return fmt.Errorf("devices: %w", err)
+	}
+	r.nets = nil
+	for _, cidr := range s.CIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("cidrs: %w", err)
+		}
+		r.nets = append(r.nets, n)
+	}
+
+	w := r.Window
+	r.location = time.UTC
+	if w.Timezone != "" {
+		loc, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return fmt.Errorf("timezone: %w", err)
+		}
+		r.location = loc
+	}
+
+	switch {
+	case w.Cron != "":
+		if w.Start != nil || w.End != nil {
+			return errors.New("window takes either cron/duration or start/end, not both")
+		}
+		schedule, err := parseCron(w.Cron)
+		if err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(w.Duration)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("recurring windows need a positive duration such as \"2h\"")
+		}
+		r.schedule, r.duration = schedule, d
+		r.activation = &activation{}
+	case w.Start != nil && w.End != nil:
+		if !w.End.After(*w.Start) {
+			return errors.New("window end must be after start")
+		}
+	default:
+		return errors.New("window needs start and end, or cron and duration")
+	}
+	return nil
+}
+
+// endTime returns when the rule stops applying for good: when it was
+// expired, or the end of a one-off window. Recurring rules never end.
+func (r *SuppressionRule) endTime() (time.Time, bool) {
+	end, ok := time.Time{}, false
+	if r.schedule == nil && r.Window.End != nil {
+		end, ok = *r.Window.End, true
+	}
+	if r.ExpiresAt != nil && (!ok || r.ExpiresAt.Before(end)) {
+		end, ok = *r.ExpiresAt, true
+	}
+	return end, ok
+}
+
+// ended reports whether the rule can no longer apply at t or later
+func (r *SuppressionRule) ended(t time.Time) bool {
+	end, ok := r.endTime()
+	return ok && !t.Before(end)
+}
+
+// active reports whether the rule's window is open at t
+func (r *SuppressionRule) active(t time.Time) bool {
+	if r.ExpiresAt != nil && !t.Before(*r.ExpiresAt) {
+		return false
+	}
+	if r.schedule != nil {
+		_, ok := r.activation.lastStart(r.schedule, t, r.duration, r.location)
+		return ok
+	}
+	return !t.Before(*r.Window.Start) && t.Before(*r.Window.End)
+}
+
+// inScope reports whether the event falls under the rule's scope
+func (r *SuppressionRule) inScope(evt Event) bool {
+	s := r.Scope
+	if !matchGlob(s.Devices, evt.SourceHost) || !matchAny(s.Categories, evt.Category) {
+		return false
+	}
+	if len(r.nets) > 0 {
+		ip := net.ParseIP(evt.SourceIP)
+		found := false
+		for _, n := range r.nets {
+			if ip != nil && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range s.Labels {
+		if evt.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// downgrade returns the severity a downgraded event should carry
+func (r *SuppressionRule) downgrade(severity string) string {
+	if r.DowngradeTo != "" {
+		return r.DowngradeTo
+	}
+	for i, s := range constants.AllSeverities {
+		if s == severity && i+1 < len(constants.AllSeverities) {
+			return constants.AllSeverities[i+1]
+		}
+	}
+	return constants.SeverityInfo
+}
+
+func validateGlobs(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", p)
+		}
+	}
+	return nil
+}
+
+/* ---------------- STORE ---------------- */
+
+// suppressionStore is a file-backed set of suppression rules. The rules
+// that can still open are kept sorted, oldest first, in live, which is
+// rebuilt on every change rather than on every event.
+type suppressionStore struct {
+	mu    sync.RWMutex
+	path  string
+	rules map[string]*SuppressionRule
+	live  []*SuppressionRule
+	// modTime is the file's modification time as of the last load or write
+	modTime time.Time
+}
+
+// suppressionRetention is how long an ended rule stays listed before it is
+// removed from the store
+var suppressionRetention = time.Duration(config.GetEnvInt("EVENT_ROUTER_SUPPRESSIONS_RETENTION_HOURS", 168)) * time.Hour
+
+func newSuppressionStore(path string) (*suppressionStore, error) {
+	s := &suppressionStore{path: path}
+	rules, err := loadSuppressions(path)
+	if err != nil {
+		return nil, err
+	}
+	s.rules = rules
+	s.modTime = fileModTime(path)
+	s.rebuild(time.Now())
+	if len(rules) > 0 {
+		log.Printf("Loaded %d suppression rules from %s", len(rules), path)
+	}
+	return s, nil
+}
+
+// loadSuppressions reads and compiles the rules in a suppressions file
+func loadSuppressions(path string) (map[string]*SuppressionRule, error) {
+	rules := make(map[string]*SuppressionRule)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored []*SuppressionRule
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	for _, r := range stored {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("suppression %s: %w", r.ID, err)
+		}
+		rules[r.ID] = r
+	}
+	return rules, nil
+}
+
+func fileModTime(path string) time.Time {
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+// persist writes all rules; callers must hold s.mu
+func (s *suppressionStore) persist() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.modTime = fileModTime(s.path)
+	return nil
+}
+
+// sorted returns rules oldest first; callers must hold s.mu
+func (s *suppressionStore) sorted() []*SuppressionRule {
+	out := make([]*SuppressionRule, 0, len(s.rules))
+	for _, r := range s.rules {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// rebuild recomputes the rules that can still open; callers must hold s.mu
+func (s *suppressionStore) rebuild(now time.Time) {
+	s.live = s.live[:0]
+	for _, r := range s.sorted() {
+		if !r.ended(now) {
+			s.live = append(s.live, r)
+		}
+	}
+}
+
+func (s *suppressionStore) Add(r *SuppressionRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules[r.ID] = r
+	if err := s.persist(); err != nil {
+		delete(s.rules, r.ID)
+		return err
+	}
+	s.rebuild(time.Now())
+	return nil
+}
+
+func (s *suppressionStore) List() []SuppressionRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := []SuppressionRule{}
+	for _, r := range s.sorted() {
+		out = append(out, *r)
+	}
+	return out
+}
+
+func (s *suppressionStore) Get(id string) (SuppressionRule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.rules[id]
+	if !ok {
+		return SuppressionRule{}, false
+	}
+	return *r, true
+}
+
+// Expire closes a rule's window at the given time
+func (s *suppressionStore) Expire(id string, at time.Time) (SuppressionRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rules[id]
+	if !ok {
+		return SuppressionRule{}, &notFoundError{"suppression", id}
+	}
+	prev := r.ExpiresAt
+	r.ExpiresAt = &at
+	if err := s.persist(); err != nil {
+		r.ExpiresAt = prev
+		return SuppressionRule{}, err
+	}
+	s.rebuild(time.Now())
+	return *r, nil
+}
+
+// match returns the first active rule (oldest first) covering the event
+func (s *suppressionStore) match(evt Event, now time.Time) *SuppressionRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.live {
+		if r.active(now) && r.inScope(evt) {
+			return r
+		}
+	}
+	return nil
+}
+
+// watch reloads the file when it is edited outside the admin API, and drops
+// rules that ended: from matching at once, from the store after
+// suppressionRetention
+func (s *suppressionStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.reloadIfChanged()
+		s.prune(time.Now())
+	}
+}
+
+func (s *suppressionStore) reloadIfChanged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	modTime := fileModTime(s.path)
+	if modTime.Equal(s.modTime) {
+		return
+	}
+	s.modTime = modTime
+
+	rules, err := loadSuppressions(s.path)
+	if err != nil {
+		log.Printf("Suppressions reload failed, keeping %d rules: %v", len(s.rules), err)
+		return
+	}
+	s.rules = rules
+	s.rebuild(time.Now())
+	log.Printf("Reloaded %d suppression rules from %s", len(rules), s.path)
+	auditLog.record(auditEntry{Actor: "file", Action: "reload", Kind: "suppression", Name: s.path})
+}
+
+func (s *suppressionStore) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed []string
+	for id, r := range s.rules {
+		if end, ok := r.endTime(); ok && now.Sub(end) >= suppressionRetention {
+			delete(s.rules, id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) > 0 {
+		if err := s.persist(); err != nil {
+			log.Printf("Failed to write %s after pruning suppressions: %v", s.path, err)
+		}
+		log.Printf("Removed %d suppression rules that ended over %s ago", len(removed), suppressionRetention)
+	}
+	s.rebuild(now)
+}
+
+// apply runs the suppression stage. It returns the (possibly modified) event,
+// the pipeline step describing what happened, and whether the event was dropped.
+func (s *suppressionStore) apply(evt Event, now time.Time) (Event, *pipelineStep, bool) {
+	r := s.match(evt, now)
+	if r == nil {
+		return evt, nil, false
+	}
+
+	step := &pipelineStep{Stage: "suppression", Action: r.Action, Rule: r.ID}
+	switch r.Action {
+	case SuppressDrop:
+		step.Detail = fmt.Sprintf("dropped by %q", r.Name)
+		return evt, step, true
+	case SuppressDowngrade:
+		to := r.downgrade(evt.Type)
+		step.Detail = fmt.Sprintf("severity %s -> %s by %q", evt.Type, to, r.Name)
+		evt.Type = to
+	default:
+		step.Detail = fmt.Sprintf("tagged by %q", r.Name)
+	}
+	evt.Labels = withLabel(evt.Labels, "suppressed", r.ID)
+	return evt, step, false
+}
+
+// withLabel returns a copy of labels with key set, leaving the original untouched
+func withLabel(labels map[string]string, key, value string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+/* ---------------- HANDLERS ---------------- */
+
+func createSuppression(c *gin.Context) {
+	var r SuppressionRule
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := r.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r.ID = fileutil.NewID("sup")
+	r.CreatedBy = c.GetString("actor")
+	r.CreatedAt = time.Now().UTC()
+	if r.Name == "" {
+		r.Name = r.ID
+	}
+
+	if err := suppressions.Add(&r); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditLog.record(auditEntry{Actor: r.CreatedBy, Action: "create", Kind: "suppression", Name: r.ID, After: r})
+	log.Printf("Suppression %s (%s, %s) created by %s", r.ID, r.Name, r.Action, r.CreatedBy)
+	c.JSON(http.StatusCreated, r)
+}
+
+// listSuppressions lists all rules; ?active=true limits it to open windows
+func listSuppressions(c *gin.Context) {
+	now := time.Now()
+	onlyActive := c.Query("active") == "true"
+
+	type view struct {
+		SuppressionRule
+		Active bool `json:"active"`
+	}
+	rules := []view{}
+	for _, r := range suppressions.List() {
+		active := r.active(now)
+		if onlyActive && !active {
+			continue
+		}
+		rules = append(rules, view{r, active})
+	}
+	c.JSON(http.StatusOK, gin.H{"count": len(rules), "suppressions": rules})
+}
+
+func getSuppression(c *gin.Context) {
+	r, ok := suppressions.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": (&notFoundError{"suppression", c.Param("id")}).Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"suppression": r, "active": r.active(time.Now())})
+}
+
+// expireSuppression ends a rule now; the rule is kept for history
+func expireSuppression(c *gin.Context) {
+	id := c.Param("id")
+	before, _ := suppressions.Get(id)
+	r, err := suppressions.Expire(id, time.Now().UTC())
+	if err != nil {
+		var nf *notFoundError
+		if errors.As(err, &nf) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditLog.record(auditEntry{Actor: c.GetString("actor"), Action: "expire", Kind: "suppression", Name: id, Before: before, After: r})
+	log.Printf("Suppression %s expired by %s", id, c.GetString("actor"))
+	c.JSON(http.StatusOK, r)
+}
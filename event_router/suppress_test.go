@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSuppressionStoreReloadsAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	auditLog = &auditTrail{path: filepath.Join(dir, "audit.jsonl")}
+	path := filepath.Join(dir, "suppressions.json")
+	store, err := newSuppressionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	start, end := now.Add(-time.Hour), now.Add(time.Hour)
+	rule := &SuppressionRule{
+		ID: "sup-1", Name: "patching", Action: SuppressDrop, CreatedAt: now,
+		Scope:  SuppressionScope{Devices: []string{"core-*"}},
+		Window: SuppressionWindow{Start: &start, End: &end},
+	}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(rule); err != nil {
+		t.Fatal(err)
+	}
+	evt := Event{Type: "critical", SourceHost: "core-sw-01"}
+	if store.match(evt, now) == nil {
+		t.Fatal("active rule did not match")
+	}
+
+	// An edit to the file is picked up without a restart
+	edited := `[{"id": "sup-2", "name": "lab", "action": "tag", "created_at": "2026-01-01T00:00:00Z",
+	  "scope": {"devices": ["lab-*"]}, "window": {"cron": "* * * * *", "duration": "1m"}}]`
+	if err := os.WriteFile(path, []byte(edited), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, now.Add(time.Second), now.Add(time.Second))
+	store.reloadIfChanged()
+	if store.match(evt, now) != nil {
+		t.Error("rule removed from the file still matches")
+	}
+	if r := store.match(Event{SourceHost: "lab-1"}, now); r == nil || r.ID != "sup-2" {
+		t.Errorf("reloaded rule does not match: %v", r)
+	}
+
+	// Ended rules leave the matching set at once and the store after the retention
+	expired := now.Add(-suppressionRetention - time.Minute)
+	if _, err := store.Expire("sup-2", expired); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.live) != 0 {
+		t.Errorf("expired rule still checked on every event")
+	}
+	store.prune(now)
+	if len(store.List()) != 0 {
+		t.Errorf("rule that ended over the retention ago was kept")
+	}
+}
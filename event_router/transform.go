@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	"github.com/expr-lang/expr/vm"
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+)
+
+// EventTransform rewrites an event for the destinations of one route. Its
+// expressions are written in expr (https://expr-lang.org) and see the event
+// fields type, message, source_host, source_ip, event_type, category, kind,
+// event_id, incident_id and labels, plus the route name:
+//
+//	{"when": "labels.site == 'lab' && type == 'high'", "set": {"type": "'medium'"}}
+//
+// When is a boolean condition (empty means always). Set assigns event fields
+// and Labels assigns labels, an empty result removing the label; all of a
+// step's expressions see the event as it was before the step. Drop stops
+// delivery to the route's destinations.
+//
+// Expressions cannot loop: predicates (all, any, map, filter, ...), ranges
+// and repeat are rejected when the config loads, and the VM's memory budget
+// bounds the arrays and maps an evaluation builds. Builtins can still build
+// strings that grow with the event, e.g. join(split(message, ""), message)
+// is quadratic in the message, so each evaluation also runs under
+// transformTimeout.
+type EventTransform struct {
+	When   string            `json:"when,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Drop   bool              `json:"drop,omitempty"`
+
+	when   *vm.Program
+	set    map[string]*vm.Program
+	labels map[string]*vm.Program
+}
+
+// transformResult records what one transform step did
+type transformResult struct {
+	Step    int               `json:"step"`
+	Applied bool              `json:"applied"`
+	Set     map[string]string `json:"set,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Dropped bool              `json:"dropped,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// settableFields are the event fields a transform may assign
+var settableFields = map[string]func(*Event, string){
+	"type":        func(e *Event, v string) { e.Type = v },
+	"message":     func(e *Event, v string) { e.Message = v },
+	"source_host": func(e *Event, v string) { e.SourceHost = v },
+	"source_ip":   func(e *Event, v string) { e.SourceIP = v },
+	"event_type":  func(e *Event, v string) { e.EventType = v },
+	"category":    func(e *Event, v string) { e.Category = v },
+}
+
+const (
+	// transformMaxNodes bounds the size of each expression
+	transformMaxNodes = 500
+	// transformMemoryBudget bounds what one evaluation may allocate, counted
+	// in the VM's units (roughly elements of arrays and maps built)
+	transformMemoryBudget = 10000
+)
+
+// transformTimeout bounds how long one expression may run
+var transformTimeout = time.Duration(config.GetEnvInt("EVENT_ROUTER_TRANSFORM_TIMEOUT_MS", 50)) * time.Millisecond
+
+var errTransformTimeout = errors.New("expression timed out")
+
+// compileExpr checks that an expression is bounded and compiles it
+func compileExpr(src string, opts ...expr.Option) (*vm.Program, error) {
+	tree, err := parser.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	bounded := &boundedCheck{}
+	ast.Walk(&tree.Node, bounded)
+	if bounded.err != nil {
+		return nil, bounded.err
+	}
+	opts = append(opts, expr.MaxNodes(transformMaxNodes), expr.DisableBuiltin("repeat"))
+	return expr.Compile(src, opts...)
+}
+
+// boundedCheck rejects the constructs that let an expression loop
+type boundedCheck struct{ err error }
+
+func (b *boundedCheck) Visit(node *ast.Node) {
+	if b.err != nil {
+		return
+	}
+	switch n := (*node).(type) {
+	case *ast.PredicateNode:
+		b.err = fmt.Errorf("predicates are not allowed in transforms")
+	case *ast.BinaryNode:
+		if n.Operator == ".." {
+			b.err = fmt.Errorf("ranges are not allowed in transforms")
+		}
+	}
+}
+
+// transformEnv exposes an event to expressions
+func transformEnv(evt Event, route string) map[string]interface{} {
+	labels := make(map[string]string, len(evt.Labels))
+	for k, v := range evt.Labels {
+		labels[k] = v
+	}
+	kind := evt.Kind
+	if kind == "" {
+		kind = KindEvent
+	}
+	return map[string]interface{}{
+		"type":        evt.Type,
+		"message":     evt.Message,
+		"source_host": evt.SourceHost,
+		"source_ip":   evt.SourceIP,
+		"event_type":  evt.EventType,
+		"category":    evt.Category,
+		"kind":        kind,
+		"event_id":    evt.EventID,
+		"incident_id": evt.IncidentID,
+		"labels":      labels,
+		"route":       route,
+	}
+}
+
+// compile type-checks every expression against the event environment
+func (t *EventTransform) compile() error {
+	env := transformEnv(Event{}, "")
+	var err error
+	if t.When != "" {
+		if t.when, err = compileExpr(t.When, expr.Env(env), expr.AsBool()); err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+	}
+	t.set = make(map[string]*vm.Program, len(t.Set))
+	for field, src := range t.Set {
+		if _, ok := settableFields[field]; !ok {
+			return fmt.Errorf("set: unknown field %q, want one of %s", field, strings.Join(transformFields(), ", "))
+		}
+		if t.set[field], err = compileExpr(src, expr.Env(env), expr.AsKind(reflect.String)); err != nil {
+			return fmt.Errorf("set.%s: %w", field, err)
+		}
+		if c, ok := t.set[field].Node().(*ast.StringNode); ok && field == "type" {
+			if err := checkSeverity(c.Value); err != nil {
+				return fmt.Errorf("set.type: %w", err)
+			}
+		}
+	}
+	t.labels = make(map[string]*vm.Program, len(t.Labels))
+	for name, src := range t.Labels {
+		if t.labels[name], err = compileExpr(src, expr.Env(env), expr.AsKind(reflect.String)); err != nil {
+			return fmt.Errorf("labels.%s: %w", name, err)
+		}
+	}
+	if t.when == nil && len(t.set) == 0 && len(t.labels) == 0 && !t.Drop {
+		return fmt.Errorf("transform does nothing")
+	}
+	return nil
+}
+
+// checkSeverity rejects event types the router has no lane or route for
+func checkSeverity(v string) error {
+	if !constants.IsValidSeverity(v) {
+		return fmt.Errorf("%q is not a severity, want one of %s", v, strings.Join(constants.AllSeverities, ", "))
+	}
+	return nil
+}
+
+// runExpr runs a program within transformMemoryBudget and transformTimeout.
+// The VM cannot be interrupted, so a run past the deadline is abandoned and
+// finishes on its own; the limits checked at compile time keep it finite.
+func runExpr(p *vm.Program, env map[string]interface{}) (interface{}, error) {
+	type result struct {
+		out interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		machine := vm.VM{MemoryBudget: transformMemoryBudget}
+		out, err := machine.Run(p, env)
+		done <- result{out, err}
+	}()
+
+	timer := time.NewTimer(transformTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%w after %s", errTransformTimeout, transformTimeout)
+	}
+}
+
+// apply runs one step. A step that fails leaves the event unchanged.
+func (t *EventTransform) apply(evt Event, route string) (Event, transformResult, error) {
+	var res transformResult
+	env := transformEnv(evt, route)
+	if t.when != nil {
+		ok, err := runExpr(t.when, env)
+		if err != nil {
+			return evt, res, fmt.Errorf("when: %w", err)
+		}
+		if !ok.(bool) {
+			return evt, res, nil
+		}
+	}
+	res.Applied = true
+
+	fields := make(map[string]string, len(t.set))
+	for field, p := range t.set {
+		out, err := runExpr(p, env)
+		if err != nil {
+			return evt, res, fmt.Errorf("set.%s: %w", field, err)
+		}
+		if field == "type" {
+			if err := checkSeverity(out.(string)); err != nil {
+				return evt, res, fmt.Errorf("set.type: %w", err)
+			}
+		}
+		fields[field] = out.(string)
+	}
+	labels := make(map[string]string, len(t.labels))
+	for name, p := range t.labels {
+		out, err := runExpr(p, env)
+		if err != nil {
+			return evt, res, fmt.Errorf("labels.%s: %w", name, err)
+		}
+		labels[name] = out.(string)
+	}
+
+	for field, v := range fields {
+		settableFields[field](&evt, v)
+	}
+	if len(labels) > 0 {
+		merged := make(map[string]string, len(evt.Labels)+len(labels))
+		for k, v := range evt.Labels {
+			merged[k] = v
+		}
+		for k, v := range labels {
+			if v == "" {
+				delete(merged, k)
+			} else {
+				merged[k] = v
+			}
+		}
+		evt.Labels = merged
+	}
+	if len(fields) > 0 {
+		res.Set = fields
+	}
+	if len(labels) > 0 {
+		res.Labels = labels
+	}
+	res.Dropped = t.Drop
+	return evt, res, nil
+}
+
+// transform runs a route's steps in order. A failing step is skipped so an
+// event is never lost to a broken expression, except a step that would drop
+// the event: it fails closed and drops it, since whatever it was meant to
+// keep from the route's destinations may be what made it fail. dropped
+// reports whether a step dropped the event.
+func (r *Route) transform(evt Event) (Event, []transformResult, bool) {
+	results := []transformResult{}
+	for i, t := range r.Transforms {
+		next, res, err := t.apply(evt, r.Name)
+		res.Step = i + 1
+		if err != nil {
+			res.Error = err.Error()
+			if t.Drop {
+				res.Dropped = true
+				log.Printf("Route %s transform %d failed for event %s, dropping the event: %v", r.Name, i+1, evt.EventID, err)
+			} else {
+				log.Printf("Route %s transform %d failed for event %s, skipping it: %v", r.Name, i+1, evt.EventID, err)
+			}
+		}
+		results = append(results, res)
+		evt = next
+		if res.Dropped {
+			return evt, results, true
+		}
+	}
+	return evt, results, false
+}
+
+// transformFields lists the fields a transform may set, for error messages
+func transformFields() []string {
+	out := make([]string, 0, len(settableFields))
+	for f := range settableFields {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransformRejectsUnboundedExpressions(t *testing.T) {
+	for _, src := range []string{
+		`any(1..100000000, # < 0) ? 'a' : 'b'`,
+		`join(map(1..1000, string(#)), ',')`,
+		`string(len(1..100000000))`,
+		`repeat(message, 100000000)`,
+	} {
+		tr := &EventTransform{Labels: map[string]string{"x": src}}
+		if err := tr.compile(); err == nil {
+			t.Errorf("%s compiled, want it rejected", src)
+		}
+	}
+
+	tr := &EventTransform{Labels: map[string]string{"x": `join(keys(labels), ',') + upper(message)`}}
+	if err := tr.compile(); err != nil {
+		t.Errorf("bounded expression rejected: %v", err)
+	}
+}
+
+func TestTransformRejectsOutsideTheSandbox(t *testing.T) {
+	for name, tr := range map[string]*EventTransform{
+		"unknown variable":   {Labels: map[string]string{"x": `password`}},
+		"unknown function":   {Labels: map[string]string{"x": `exec('rm -rf /')`}},
+		"disabled builtin":   {Labels: map[string]string{"x": `repeat('a', 3)`}},
+		"non-string label":   {Labels: map[string]string{"x": `len(message)`}},
+		"non-boolean when":   {When: `message`, Drop: true},
+		"unknown field":      {Set: map[string]string{"event_id": `'evt-1'`}},
+		"too many nodes":     {Labels: map[string]string{"x": "message" + strings.Repeat(" + message", transformMaxNodes)}},
+		"predicate in a set": {Set: map[string]string{"message": `join(filter(split(message, ' '), # != ''), ' ')`}},
+	} {
+		if err := tr.compile(); err == nil {
+			t.Errorf("%s: compiled, want it rejected", name)
+		}
+	}
+}
+
+// Arrays built from the event count against the memory budget
+func TestTransformMemoryBudget(t *testing.T) {
+	r := &Route{Name: "lab", Transforms: []*EventTransform{{Labels: map[string]string{"chars": `string(len(concat(split(message, ''), split(message, ''))))`}}}}
+	if err := r.Transforms[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+	evt, results, _ := r.transform(Event{Message: "short"})
+	if evt.Labels["chars"] != "10" {
+		t.Errorf("chars = %q, want 10: %+v", evt.Labels["chars"], results)
+	}
+	evt, results, _ = r.transform(Event{Message: strings.Repeat("a", transformMemoryBudget)})
+	if _, ok := evt.Labels["chars"]; ok || !strings.Contains(results[0].Error, "memory budget") {
+		t.Errorf("large message gave %v %+v, want the step skipped over its memory budget", evt.Labels, results)
+	}
+}
+
+// Strings that grow with the event are not counted by the memory budget, so
+// the time an expression takes is bounded by transformTimeout
+func TestTransformRunsUnderADeadline(t *testing.T) {
+	prev := transformTimeout
+	transformTimeout = time.Millisecond
+	t.Cleanup(func() { transformTimeout = prev })
+
+	// Quadratic in the message: about 20ms for 4000 characters
+	const slow = `len(join(split(message, ''), message)) > 0`
+	long := Event{Type: "info", Message: strings.Repeat("a", 4000)}
+
+	r := &Route{Name: "lab", Transforms: []*EventTransform{
+		{When: slow, Set: map[string]string{"type": `'critical'`}},
+		{Labels: map[string]string{"checked": `'yes'`}},
+	}}
+	for _, tr := range r.Transforms {
+		if err := tr.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evt, results, dropped := r.transform(long)
+	if evt.Type != "info" || dropped || !strings.Contains(results[0].Error, errTransformTimeout.Error()) {
+		t.Errorf("slow step gave %q dropped=%v %+v, want it skipped as timed out", evt.Type, dropped, results)
+	}
+	if evt.Labels["checked"] != "yes" {
+		t.Errorf("the step after a timed out one did not run: %+v", results)
+	}
+
+	// A drop step that times out fails closed
+	drop := &Route{Name: "lab", Transforms: []*EventTransform{{When: slow, Drop: true}}}
+	if err := drop.Transforms[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, results, dropped := drop.transform(long); !dropped || results[0].Error == "" {
+		t.Errorf("timed out drop gave dropped=%v %+v, want the event dropped", dropped, results)
+	}
+	if _, _, dropped := drop.transform(Event{Type: "info"}); dropped {
+		t.Error("fast drop condition on an empty message dropped the event")
+	}
+}
+
+func TestTransformSetTypeMustBeSeverity(t *testing.T) {
+	tr := &EventTransform{Set: map[string]string{"type": `'urgent'`}}
+	if err := tr.compile(); err == nil || !strings.Contains(err.Error(), "not a severity") {
+		t.Errorf("compile = %v, want a severity error", err)
+	}
+
+	// Computed types are checked when they run; the step is skipped
+	r := &Route{Name: "lab", Transforms: []*EventTransform{{Set: map[string]string{"type": `labels.level`}}}}
+	if err := r.Transforms[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+	evt, results, dropped := r.transform(Event{Type: "high", Labels: map[string]string{"level": "urgent"}})
+	if evt.Type != "high" || dropped || results[0].Error == "" {
+		t.Errorf("transform = %q dropped=%v %+v, want the step skipped", evt.Type, dropped, results)
+	}
+	evt, _, _ = r.transform(Event{Type: "high", Labels: map[string]string{"level": "low"}})
+	if evt.Type != "low" {
+		t.Errorf("type = %q, want low", evt.Type)
+	}
+}
+
+func TestFailingDropFailsClosed(t *testing.T) {
+	// int() of a non-numeric label fails at run time
+	r := &Route{Name: "lab", Transforms: []*EventTransform{{When: `int(labels.rack) > 10`, Drop: true}}}
+	if err := r.Transforms[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, dropped := r.transform(Event{Type: "info", Labels: map[string]string{"rack": "4"}}); dropped {
+		t.Error("event dropped although the condition is false")
+	}
+	_, results, dropped := r.transform(Event{Type: "info", Labels: map[string]string{"rack": "east"}})
+	if !dropped || results[0].Error == "" {
+		t.Errorf("transform = dropped=%v %+v, want the failing drop to drop the event", dropped, results)
+	}
+
+	ex := &Explanation{Rules: []ruleEvaluation{{Route: "lab", Dropped: true, EventTransforms: results}}}
+	if !ex.dropFailed() {
+		t.Error("dropFailed = false, want true")
+	}
+}
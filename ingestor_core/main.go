@@ -7,12 +7,30 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/fileutil"
 	"github.com/ibm-live-project-interns/ingestor/shared/models"
 )
 
+// statuses tracks the delivery status of recent events
+var statuses = newStatusStore(config.GetEnvInt("INGESTOR_STATUS_RETENTION", 10000))
+
+// routerError is returned when the Event Router answers with a non-2xx status
+type routerError struct {
+	StatusCode int
+	Body       string
+	RetryAfter string
+}
+
+func (e *routerError) Error() string {
+	return fmt.Sprintf("event router returned %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
 // forwardToRouter takes an Event, converts it to a RoutedEvent, and forwards to Event Router
 func forwardToRouter(event models.Event, eventRouterURL string) (string, error) {
 	// Use the shared model's ToRoutedEvent method
@@ -36,6 +54,9 @@ func forwardToRouter(event models.Event, eventRouterURL string) (string, error)
 	if err != nil {
 		return "", fmt.Errorf("failed to read router response: %w", err)
 	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return string(bodyBytes), &routerError{StatusCode: resp.StatusCode, Body: string(bodyBytes), RetryAfter: resp.Header.Get("Retry-After")}
+	}
 
 	return string(bodyBytes), nil
 }
@@ -69,18 +90,45 @@ func main() {
 			return
 		}
 
+		if event.EventID == "" {
+			event.EventID = fileutil.NewID("evt")
+		}
+		event.ReceivedAt = time.Now()
+		statuses.record(models.StatusUpdate{EventID: event.EventID, Hop: "ingestor_core", Status: constants.StatusReceived, At: event.ReceivedAt})
+
 		routerResp, err := forwardToRouter(event, eventRouterURL)
+		if re, ok := err.(*routerError); ok {
+			log.Println("Event Router rejected event:", err)
+			statuses.record(models.StatusUpdate{EventID: event.EventID, Hop: "ingestor_core", Status: constants.StatusFailed, Detail: err.Error()})
+			code := http.StatusBadGateway
+			if re.StatusCode == http.StatusServiceUnavailable {
+				// The router's lane is full; the source should retry later
+				code = http.StatusServiceUnavailable
+				c.Header("Retry-After", re.RetryAfter)
+			}
+			c.JSON(code, gin.H{
+				"status":          "router_rejected",
+				"event_id":        event.EventID,
+				"error":           err.Error(),
+				"router_status":   re.StatusCode,
+				"router_response": routerResp,
+			})
+			return
+		}
 		if err != nil {
 			log.Println("Error forwarding to Event Router:", err)
+			statuses.record(models.StatusUpdate{EventID: event.EventID, Hop: "ingestor_core", Status: constants.StatusFailed, Detail: err.Error()})
 			c.JSON(http.StatusBadGateway, gin.H{
-				"status": "router_unreachable",
-				"error":  err.Error(),
+				"status":   "router_unreachable",
+				"event_id": event.EventID,
+				"error":    err.Error(),
 			})
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"status":          "received",
+			"event_id":        event.EventID,
 			"event_type":      event.EventType,
 			"severity":        event.Severity,
 			"forwarded_to":    "event_router",
@@ -88,6 +136,10 @@ func main() {
 		})
 	})
 
+	// Delivery status, reported by downstream hops
+	router.GET("/events/:id/status", getEventStatus)
+	router.POST("/events/:id/status", statusAuth(), postEventStatus)
+
 	// LEGACY: Keep /ingest/metadata for backwards compatibility (deprecated)
 	router.POST("/ingest/metadata", func(c *gin.Context) {
 		log.Println("Warning: /ingest/metadata is deprecated, use /ingest/event instead")
@@ -130,6 +182,14 @@ func main() {
 		defer resp.Body.Close()
 
 		bodyBytes, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"status":          "router_rejected",
+				"router_status":   resp.StatusCode,
+				"router_response": string(bodyBytes),
+			})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"status":          "received",
 			"forwarded_to":    "event_router",
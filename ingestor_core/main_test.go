@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+func TestForwardToRouterRejectsErrorStatus(t *testing.T) {
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"critical lane is full"}`))
+	}))
+	defer router.Close()
+
+	evt := models.Event{EventID: "evt-1", EventType: "snmp", Severity: "critical", SourceHost: "core-1", Message: "link down"}
+	body, err := forwardToRouter(evt, router.URL)
+	re, ok := err.(*routerError)
+	if !ok {
+		t.Fatalf("forwardToRouter error = %v, want a routerError", err)
+	}
+	if re.StatusCode != http.StatusServiceUnavailable || re.RetryAfter != "1" || !strings.Contains(body, "lane is full") {
+		t.Errorf("routerError = %+v, body %q", re, body)
+	}
+}
+
+func TestStatusUpdatesRequireToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/events/:id/status", statusAuth(), postEventStatus)
+
+	post := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/events/evt-1/status", strings.NewReader(`[{"status":"delivered","destination":"slack"}]`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	statusToken = ""
+	if code := post("anything"); code != http.StatusServiceUnavailable {
+		t.Errorf("without a configured token: %d, want 503", code)
+	}
+	statusToken = "s3cret"
+	defer func() { statusToken = "" }()
+	if code := post(""); code != http.StatusUnauthorized {
+		t.Errorf("without a token: %d, want 401", code)
+	}
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("with a wrong token: %d, want 401", code)
+	}
+	if code := post("s3cret"); code != http.StatusAccepted {
+		t.Errorf("with the token: %d, want 202", code)
+	}
+	if s, ok := statuses.get("evt-1"); !ok || s.Status != "delivered" {
+		t.Errorf("status = %+v, want delivered", s)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ibm-live-project-interns/ingestor/shared/config"
+	"github.com/ibm-live-project-interns/ingestor/shared/constants"
+	"github.com/ibm-live-project-interns/ingestor/shared/models"
+)
+
+// EventStatus is the delivery status of one event across all hops
+type EventStatus struct {
+	EventID      string                       `json:"event_id"`
+	Status       string                       `json:"status"` // received, routed, delivered, partial, failed or suppressed
+	ReceivedAt   time.Time                    `json:"received_at,omitempty"`
+	UpdatedAt    time.Time                    `json:"updated_at"`
+	Destinations map[string]DestinationStatus `json:"destinations"`
+	History      []models.StatusUpdate        `json:"history"`
+}
+
+// DestinationStatus is the latest status reported for one destination
+type DestinationStatus struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// statusStore keeps the status of recent events in memory, forgetting the
+// oldest once it holds limit events
+type statusStore struct {
+	mu     sync.Mutex
+	events map[string]*EventStatus
+	order  []string
+	limit  int
+}
+
+func newStatusStore(limit int) *statusStore {
+	return &statusStore{events: make(map[string]*EventStatus), limit: limit}
+}
+
+// record applies a status update
+func (s *statusStore) record(u models.StatusUpdate) {
+	if u.At.IsZero() {
+		u.At = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.events[u.EventID]
+	if !ok {
+		e = &EventStatus{EventID: u.EventID, Destinations: make(map[string]DestinationStatus)}
+		s.events[u.EventID] = e
+		s.order = append(s.order, u.EventID)
+		if len(s.order) > s.limit {
+			delete(s.events, s.order[0])
+			s.order = s.order[1:]
+		}
+	}
+
+	if u.Status == constants.StatusReceived && e.ReceivedAt.IsZero() {
+		e.ReceivedAt = u.At
+	}
+	if u.Destination != "" {
+		// Updates may arrive out of order; keep the latest per destination
+		if prev, ok := e.Destinations[u.Destination]; !ok || !u.At.Before(prev.At) {
+			e.Destinations[u.Destination] = DestinationStatus{Status: u.Status, At: u.At, Detail: u.Detail}
+		}
+	}
+	e.History = append(e.History, u)
+	sort.SliceStable(e.History, func(i, j int) bool { return e.History[i].At.Before(e.History[j].At) })
+	if u.At.After(e.UpdatedAt) {
+		e.UpdatedAt = u.At
+	}
+	e.Status = overallStatus(e)
+}
+
+// overallStatus summarizes an event: once destinations are known it reflects
+// their outcome, otherwise the latest hop-level status
+func overallStatus(e *EventStatus) string {
+	if len(e.Destinations) > 0 {
+		delivered, failed := 0, 0
+		for _, d := range e.Destinations {
+			switch d.Status {
+			case constants.StatusDelivered:
+				delivered++
+			case constants.StatusFailed:
+				failed++
+			}
+		}
+		switch {
+		case delivered == len(e.Destinations):
+			return constants.StatusDelivered
+		case failed == len(e.Destinations):
+			return constants.StatusFailed
+		case delivered+failed == len(e.Destinations):
+			return "partial"
+		}
+		return constants.StatusRouted
+	}
+	for i := len(e.History) - 1; i >= 0; i-- {
+		if e.History[i].Destination == "" {
+			return e.History[i].Status
+		}
+	}
+	return constants.StatusReceived
+}
+
+// get returns a copy of an event's status
+func (s *statusStore) get(id string) (EventStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.events[id]
+	if !ok {
+		return EventStatus{}, false
+	}
+	out := *e
+	out.History = append([]models.StatusUpdate(nil), e.History...)
+	out.Destinations = make(map[string]DestinationStatus, len(e.Destinations))
+	for k, v := range e.Destinations {
+		out.Destinations[k] = v
+	}
+	return out, true
+}
+
+// statusToken authenticates the hops that post status updates. Posting
+// status is disabled when it is not set.
+var statusToken = config.GetEnv("INGESTOR_STATUS_TOKEN", "")
+
+// statusAuth requires "Authorization: Bearer <INGESTOR_STATUS_TOKEN>"
+func statusAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if statusToken == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "status updates disabled: INGESTOR_STATUS_TOKEN not set"})
+			return
+		}
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(statusToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing status token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+/* ---------------- HANDLERS ---------------- */
+
+func getEventStatus(c *gin.Context) {
+	status, ok := statuses.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "event not found"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// postEventStatus receives status callbacks from downstream hops
+func postEventStatus(c *gin.Context) {
+	var updates []models.StatusUpdate
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id := c.Param("id")
+	for _, u := range updates {
+		if u.Status == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status is required"})
+			return
+		}
+		u.EventID = id
+		statuses.record(u)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"event_id": id, "recorded": len(updates)})
+}
@@ -37,6 +37,19 @@ func GetEnvInt(key string, fallback int) int {
 	return value
 }
 
+// GetEnvFloat returns a float environment variable or a fallback value
+func GetEnvFloat(key string, fallback float64) float64 {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
 // GetEnvBool returns a boolean environment variable or a fallback value
 func GetEnvBool(key string, fallback bool) bool {
 	valueStr := os.Getenv(key)
@@ -0,0 +1,12 @@
+package constants
+
+// Delivery status constants, reported by each hop as an event moves through
+// the pipeline
+const (
+	StatusReceived   = "received"
+	StatusRouted     = "routed"
+	StatusDelivered  = "delivered"
+	StatusQueued     = "queued" // accepted by a destination that batches, e.g. an email digest
+	StatusFailed     = "failed"
+	StatusSuppressed = "suppressed"
+)
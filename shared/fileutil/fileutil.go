@@ -0,0 +1,38 @@
+package fileutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// WriteAtomic replaces path with data by writing a temp file in the same
+// directory and renaming it over the original
+func WriteAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// NewID returns a random identifier such as "evt-1f2e3d4c5b6a7988". It
+// panics if the system random source fails, since every caller relies on the
+// IDs being unique
+func NewID(prefix string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic("fileutil: reading random bytes: " + err.Error())
+	}
+	return prefix + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,20 @@
+package fileutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewIDIsPrefixedAndUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := NewID("evt")
+		if !strings.HasPrefix(id, "evt-") || len(id) != len("evt-")+16 {
+			t.Fatalf("unexpected id %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id %q", id)
+		}
+		seen[id] = true
+	}
+}
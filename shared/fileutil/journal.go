@@ -0,0 +1,154 @@
+package fileutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultCompactAfter is how many changes a journal logs before folding them
+// into its snapshot
+const DefaultCompactAfter = 1000
+
+// Journal persists a set of JSON records as a snapshot file holding an array
+// of every record plus a log, <path>.log, of the changes made since. Saving a
+// record appends one line to the log instead of rewriting every record; the
+// log is folded back into the snapshot every CompactAfter changes.
+//
+// A Journal is not safe for concurrent use: callers serialise access, usually
+// under the lock that guards the records themselves.
+type Journal struct {
+	// CompactAfter is how many logged changes trigger a compaction
+	CompactAfter int
+
+	path     string
+	log      *os.File
+	logged   int
+	snapshot func() interface{}
+}
+
+// journalChange is one line of the log: a record to insert or replace, or
+// the ID of a record to delete
+type journalChange struct {
+	Put    json.RawMessage `json:"put,omitempty"`
+	Delete string          `json:"delete,omitempty"`
+}
+
+// OpenJournal loads the snapshot at path and replays its log, calling put
+// for every stored or saved record and remove for every deleted ID, in the
+// order they were written. snapshot must return every current record and is
+// called whenever the log is compacted.
+func OpenJournal(path string, put func(json.RawMessage) error, remove func(id string), snapshot func() interface{}) (*Journal, error) {
+	j := &Journal{CompactAfter: DefaultCompactAfter, path: path, snapshot: snapshot}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		var records []json.RawMessage
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for _, r := range records {
+			if err := put(r); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", path, err)
+			}
+		}
+	}
+
+	j.log, err = os.OpenFile(path+".log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(j.log)
+	var offset int64
+	for line := 1; ; line++ {
+		raw, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(raw) > 0 {
+				// A last line without a newline was cut short by a crash
+				// mid-write; the change it held was never acknowledged
+				if err := j.log.Truncate(offset); err != nil {
+					j.log.Close()
+					return nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			j.log.Close()
+			return nil, err
+		}
+		var change journalChange
+		if err := json.Unmarshal(raw, &change); err != nil {
+			j.log.Close()
+			return nil, fmt.Errorf("parse %s.log line %d: %w", path, line, err)
+		}
+		if change.Delete != "" {
+			remove(change.Delete)
+		} else if err := put(change.Put); err != nil {
+			j.log.Close()
+			return nil, fmt.Errorf("parse %s.log line %d: %w", path, line, err)
+		}
+		offset += int64(len(raw))
+		j.logged++
+	}
+	return j, nil
+}
+
+// Put logs a record that was added or changed
+func (j *Journal) Put(record interface{}) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return j.append(journalChange{Put: raw})
+}
+
+// Delete logs the removal of a record
+func (j *Journal) Delete(id string) error {
+	return j.append(journalChange{Delete: id})
+}
+
+func (j *Journal) append(change journalChange) error {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if _, err := j.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.logged++
+	if j.logged >= j.CompactAfter {
+		return j.Compact()
+	}
+	return nil
+}
+
+// Compact writes every current record to the snapshot and empties the log.
+// Replaying a log over a snapshot that already holds its changes is
+// harmless, so a crash between the two steps loses nothing.
+func (j *Journal) Compact() error {
+	data, err := json.MarshalIndent(j.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := WriteAtomic(j.path, data); err != nil {
+		return err
+	}
+	if err := j.log.Truncate(0); err != nil {
+		return err
+	}
+	j.logged = 0
+	return nil
+}
+
+// Close closes the log
+func (j *Journal) Close() error {
+	return j.log.Close()
+}
@@ -0,0 +1,134 @@
+package fileutil
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type record struct {
+	ID    string `json:"id"`
+	Value int    `json:"value"`
+}
+
+// store is a minimal journaled map, the way callers use a Journal
+type store struct {
+	records map[string]record
+	journal *Journal
+}
+
+func openStore(t *testing.T, path string) *store {
+	t.Helper()
+	s := &store{records: make(map[string]record)}
+	var err error
+	s.journal, err = OpenJournal(path,
+		func(raw json.RawMessage) error {
+			var r record
+			if err := json.Unmarshal(raw, &r); err != nil {
+				return err
+			}
+			s.records[r.ID] = r
+			return nil
+		},
+		func(id string) { delete(s.records, id) },
+		func() interface{} {
+			out := make([]record, 0, len(s.records))
+			for _, r := range s.records {
+				out = append(out, r)
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+			return out
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.journal.Close() })
+	return s
+}
+
+func (s *store) put(t *testing.T, r record) {
+	t.Helper()
+	s.records[r.ID] = r
+	if err := s.journal.Put(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *store) delete(t *testing.T, id string) {
+	t.Helper()
+	delete(s.records, id)
+	if err := s.journal.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalReplaysChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := openStore(t, path)
+	s.put(t, record{"a", 1})
+	s.put(t, record{"b", 2})
+	s.put(t, record{"a", 3})
+	s.delete(t, "b")
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("snapshot written before compaction: %v", err)
+	}
+	reopened := openStore(t, path)
+	want := map[string]record{"a": {"a", 3}}
+	if !reflect.DeepEqual(reopened.records, want) {
+		t.Fatalf("records = %v, want %v", reopened.records, want)
+	}
+}
+
+func TestJournalCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := openStore(t, path)
+	s.journal.CompactAfter = 3
+	s.put(t, record{"a", 1})
+	s.put(t, record{"b", 2})
+	s.put(t, record{"c", 3})
+	s.delete(t, "c")
+
+	var snapshot []record
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot) != 3 {
+		t.Fatalf("snapshot holds %d records, want 3", len(snapshot))
+	}
+
+	reopened := openStore(t, path)
+	want := map[string]record{"a": {"a", 1}, "b": {"b", 2}}
+	if !reflect.DeepEqual(reopened.records, want) {
+		t.Fatalf("records = %v, want %v", reopened.records, want)
+	}
+}
+
+func TestJournalIgnoresTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := openStore(t, path)
+	s.put(t, record{"a", 1})
+	s.journal.Close()
+
+	f, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"put":{"id":"b","va`)
+	f.Close()
+
+	reopened := openStore(t, path)
+	reopened.put(t, record{"c", 3})
+	again := openStore(t, path)
+	want := map[string]record{"a": {"a", 1}, "c": {"c", 3}}
+	if !reflect.DeepEqual(again.records, want) {
+		t.Fatalf("records = %v, want %v", again.records, want)
+	}
+}
@@ -0,0 +1,68 @@
+package models
+
+import "time"
+
+// AnalysisSchemaVersion identifies the Analysis contract. Field names follow
+// the API gateway's AIAnalysis so the gateway can decode it as is; bump the
+// version on any incompatible change.
+const AnalysisSchemaVersion = "analysis/v2"
+
+// Analysis is the Agents API's assessment of an event
+type Analysis struct {
+	SchemaVersion      string   `json:"schemaVersion"`
+	Severity           string   `json:"severity"`
+	Summary            string   `json:"summary"`
+	RootCauses         []string `json:"rootCauses"`
+	BusinessImpact     string   `json:"businessImpact"`
+	RecommendedActions []string `json:"recommendedActions"`
+
+	// Confidence is between 0 and 1, calibrated by the Agents API rather
+	// than taken from the model as is
+	Confidence float64 `json:"confidence"`
+
+	// Citations are the runbook sections the analysis is based on
+	Citations []Citation `json:"citations,omitempty"`
+
+	// SimilarIncidents are the most similar past incidents, out of
+	// SimilarCount found
+	SimilarIncidents []SimilarIncident `json:"similarIncidents,omitempty"`
+	SimilarCount     int               `json:"similarCount"`
+
+	// IncidentID is the ID the event is kept under among past incidents,
+	// to report its resolution with
+	IncidentID string `json:"incidentId,omitempty"`
+
+	// Cached is set when the analysis was made for an earlier, identical
+	// event
+	Cached bool `json:"cached,omitempty"`
+
+	// Source is the provider that produced the analysis (e.g. watsonx or
+	// rules); FallbackReason says why the configured provider was not used
+	Source         string `json:"source"`
+	Model          string `json:"model,omitempty"`
+	Rule           string `json:"rule,omitempty"`
+	FallbackReason string `json:"fallbackReason,omitempty"`
+
+	// PromptVersion is the prompt template the model was given, e.g.
+	// default.v2; rule answers have none
+	PromptVersion string `json:"promptVersion,omitempty"`
+}
+
+// Citation points at a section of a runbook
+type Citation struct {
+	ID      string `json:"id"`
+	Runbook string `json:"runbook"`
+	Section string `json:"section"`
+}
+
+// SimilarIncident is a past incident resembling the analyzed event, with
+// how it was resolved if known
+type SimilarIncident struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Message    string    `json:"message"`
+	Host       string    `json:"sourceHost,omitempty"`
+	Severity   string    `json:"severity"`
+	Resolution string    `json:"resolution,omitempty"`
+	Similarity float64   `json:"similarity"`
+}
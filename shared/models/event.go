@@ -9,6 +9,10 @@ import (
 
 // Event represents a normalized network event from datasource or external systems
 type Event struct {
+	// EventID identifies the event across every hop; Ingestor Core assigns
+	// one when the source does not
+	EventID string `json:"event_id,omitempty"`
+
 	// Core normalized fields (from datasource / normalizer)
 	EventType      string    `json:"event_type" binding:"required,oneof=syslog snmp metadata"`
 	SourceHost     string    `json:"source_host" binding:"required"`
@@ -56,6 +60,7 @@ func (e *Event) Validate() error {
 
 // RoutedEvent is the format expected by Event Router
 type RoutedEvent struct {
+	EventID    string `json:"event_id,omitempty"`
 	Type       string `json:"type"`
 	Message    string `json:"message"`
 	SourceHost string `json:"source_host,omitempty"`
@@ -67,6 +72,7 @@ type RoutedEvent struct {
 // ToRoutedEvent converts a normalized Event to a RoutedEvent
 func (e *Event) ToRoutedEvent() RoutedEvent {
 	return RoutedEvent{
+		EventID:    e.EventID,
 		Type:       e.Severity, // routing is done by severity
 		Message:    e.Message,
 		SourceHost: e.SourceHost,
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// StatusUpdate reports the progress of an event at one hop, optionally for a
+// single destination. Hops post these to Ingestor Core, which keeps the
+// delivery status of each event.
+type StatusUpdate struct {
+	EventID     string    `json:"event_id"`
+	Hop         string    `json:"hop"` // e.g. ingestor_core, event_router
+	Status      string    `json:"status"`
+	Destination string    `json:"destination,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+	At          time.Time `json:"at"`
+}